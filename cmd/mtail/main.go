@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -35,6 +36,9 @@ func (f *seqStringFlag) Set(value string) error {
 }
 
 var logs seqStringFlag
+var tags seqStringFlag
+var tcpListenAddresses seqStringFlag
+var eventLogChannels seqStringFlag
 
 var (
 	port               = flag.String("port", "3903", "HTTP port to listen on.")
@@ -42,6 +46,7 @@ var (
 	unixSocket         = flag.String("unix_socket", "", "UNIX Socket to listen on")
 	progs              = flag.String("progs", "", "Name of the directory containing mtail programs")
 	ignoreRegexPattern = flag.String("ignore_filename_regex_pattern", "", "")
+	journal            = flag.Bool("journald", false, "Read log lines from the systemd journal, by running journalctl.")
 
 	version = flag.Bool("version", false, "Print mtail version information.")
 
@@ -53,15 +58,32 @@ var (
 	dumpBytecode = flag.Bool("dump_bytecode", false, "Dump bytecode of programs (to INFO log).")
 
 	// VM Runtime behaviour flags
-	syslogUseCurrentYear = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
-	overrideTimezone     = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
-	emitProgLabel        = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
-	emitMetricTimestamp  = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
+	syslogUseCurrentYear   = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
+	overrideTimezone       = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
+	emitProgLabel          = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
+	geoipDatabase          = flag.String("geoip_database", "", "Path to a CSV file of networks and their country codes, used by the geocountry() builtin.")
+	lookupTables           = flag.String("lookup_tables", "", "Path to a CSV file of table names, keys and values, used by the lookup() builtin.")
+	histogramQuantiles     = flag.String("histogram_quantiles", "", "Comma separated list of quantiles, such as 0.5,0.99, to estimate from histogram buckets and export as a series with a _quantile suffix.")
+	metricNameReplace      = flag.String("metric_name_replace", "", "If set to old=new, replace every occurrence of old with new in the names of exported metrics, such as __=: to export http__requests as http:requests.")
+	jsonTimestampFormat    = flag.String("json_timestamp_format", "unix", "Encoding of metric timestamps in the JSON export: unix for nanoseconds since the epoch, or rfc3339nano.")
+	bucketOverflowCounters = flag.Bool("histogram_bucket_overflow_counters", false, "Export a counter for each histogram, named after it with a _bucket_overflow_total suffix, of the observations above its largest bucket boundary.")
+	sortLabels             = flag.Bool("sort_labels", false, "Render the labels of exported metrics in alphabetical order, instead of the order their keys were declared in.")
+	openMetrics            = flag.Bool("openmetrics", false, "Serve the OpenMetrics format from /metrics to collectors that ask for it, which includes the exemplars recorded for histogram buckets.")
+	programPrefix          = flag.Bool("program_prefix", false, "Prefix the name of each exported metric with the base name of the program file that defines it, like web_requests_total for requests_total in web.mtail.")
+	jsonDeltaExport        = flag.Bool("json_delta_export", false, "Export only the metrics changed since the last export to JSON consumers that name themselves with the `consumer' query parameter.")
+	staleMarkers           = flag.Bool("prometheus_stale_markers", false, "Export a Prometheus staleness marker for each series removed by metric expiry, so that it ends immediately instead of after the collector's lookback period.  Markers are only exported in the protobuf exposition format; scrapers that use a text format never see them.")
+	emitMetricTimestamp    = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
 
 	// Ops flags
 	pollInterval                = flag.Duration("poll_interval", 250*time.Millisecond, "Set the interval to poll all log files for data; must be positive, or zero to disable polling.  With polling mode, only the files found at mtail startup will be polled.")
 	expiredMetricGcTickInterval = flag.Duration("expired_metrics_gc_interval", time.Hour, "interval between expired metric garbage collection runs")
 	staleLogGcTickInterval      = flag.Duration("stale_log_gc_interval", time.Hour, "interval between stale log garbage collection runs")
+	lineRateLimit               = flag.Float64("line_rate_limit", 0, "Maximum lines per second processed from each log; excess lines are dropped.  Zero disables the limit.")
+	lineRateLimitBurst          = flag.Int("line_rate_limit_burst", 1000, "Number of lines from each log that may be processed in a burst over the line_rate_limit.")
+	maxLineLength               = flag.Int("max_line_length", 0, "Maximum length in bytes of the lines read from logs; longer lines are truncated.  Zero disables the limit.")
+	lineQueueLength             = flag.Int("line_queue_length", 1000, "Number of lines buffered for each program, so that a slow program doesn't hold up the others until its queue is full.  Must be positive.")
+	ruleTiming                  = flag.Bool("rule_timing", false, "Record the time programs spend matching regular expressions, by named rule, in the mtail_vm_rule_match_duration_seconds histogram.")
+	lineDeadline                = flag.Duration("line_deadline", 0, "Maximum time a program may spend processing one line; lines that take longer are abandoned and counted in prog_line_timeouts_total.  Zero disables the deadline.")
 	metricPushInterval          = flag.Duration("metric_push_interval", time.Minute, "interval between metric pushes to passive collectors")
 
 	// Debugging flags
@@ -79,6 +101,9 @@ var (
 
 func init() {
 	flag.Var(&logs, "logs", "List of log files to monitor, separated by commas.  This flag may be specified multiple times.")
+	flag.Var(&eventLogChannels, "eventlog_channel", "Channel of the Windows Event Log to read new events from, such as Application or System.  This flag may be specified multiple times, or the channels separated by commas.  Only available on Windows.")
+	flag.Var(&tcpListenAddresses, "tcp_listen_address", "Address on which to accept TCP connections sending newline delimited log lines, such as localhost:3904.  This flag may be specified multiple times, or the addresses separated by commas.")
+	flag.Var(&tags, "build_tags", "List of build tags selecting the `# +build' sections of programs to compile, separated by commas.  This flag may be specified multiple times.")
 }
 
 var (
@@ -130,8 +155,8 @@ func main() {
 		glog.Exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
 	}
 	if !(*dumpBytecode || *dumpAst || *dumpAstTypes || *compileOnly) {
-		if len(logs) == 0 {
-			glog.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
+		if len(logs) == 0 && len(tcpListenAddresses) == 0 && len(eventLogChannels) == 0 && !*journal {
+			glog.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs, the flag -tcp_listen_address to receive logs over TCP, the flag -journald to read the systemd journal, or the flag -eventlog_channel to read the Windows Event Log.")
 		}
 	}
 
@@ -157,11 +182,30 @@ func main() {
 	opts := []mtail.Option{
 		mtail.ProgramPath(*progs),
 		mtail.LogPathPatterns(logs...),
+		mtail.TCPListenAddresses(tcpListenAddresses...),
+		mtail.EventLogChannels(eventLogChannels...),
 		mtail.IgnoreRegexPattern(*ignoreRegexPattern),
 		mtail.SetBuildInfo(buildInfo),
 		mtail.OverrideLocation(loc),
 		mtail.MetricPushInterval(*metricPushInterval),
+		mtail.BuildTags(tags...),
+		mtail.JSONTimestampFormat(*jsonTimestampFormat),
+		mtail.GeoIPDatabase(*geoipDatabase),
+		mtail.LookupTables(*lookupTables),
 	}
+	if *lineRateLimit > 0 {
+		opts = append(opts, mtail.LineRateLimit(*lineRateLimit, *lineRateLimitBurst))
+	}
+	if *ruleTiming {
+		opts = append(opts, mtail.RuleTiming)
+	}
+	if *lineDeadline > 0 {
+		opts = append(opts, mtail.LineDeadline(*lineDeadline))
+	}
+	if *maxLineLength > 0 {
+		opts = append(opts, mtail.MaxLineLength(*maxLineLength))
+	}
+	opts = append(opts, mtail.LineQueueLength(*lineQueueLength))
 	if *staleLogGcTickInterval > 0 {
 		staleLogGcWaker := waker.NewTimed(ctx, *staleLogGcTickInterval)
 		opts = append(opts, mtail.StaleLogGcWaker(staleLogGcWaker))
@@ -176,11 +220,14 @@ func main() {
 		opts = append(opts, mtail.BindUnixSocket(*unixSocket))
 	}
 	if *oneShot {
-		opts = append(opts, mtail.OneShot)
+		opts = append(opts, mtail.OneShot, mtail.FlushOutput(os.Stdout))
 	}
 	if *compileOnly {
 		opts = append(opts, mtail.CompileOnly)
 	}
+	if *journal {
+		opts = append(opts, mtail.Journal)
+	}
 	if *dumpAst {
 		opts = append(opts, mtail.DumpAst)
 	}
@@ -196,9 +243,45 @@ func main() {
 	if !*emitProgLabel {
 		opts = append(opts, mtail.OmitProgLabel)
 	}
+	if *histogramQuantiles != "" {
+		var quantiles []float64
+		for _, s := range strings.Split(*histogramQuantiles, ",") {
+			q, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				glog.Exitf("Couldn't parse histogram quantile %q: %s", s, err)
+			}
+			quantiles = append(quantiles, q)
+		}
+		opts = append(opts, mtail.HistogramQuantiles(quantiles...))
+	}
+	if *metricNameReplace != "" {
+		i := strings.Index(*metricNameReplace, "=")
+		if i < 0 {
+			glog.Exitf("Couldn't parse metric name replacement %q: expected old=new", *metricNameReplace)
+		}
+		opts = append(opts, mtail.MetricNameReplace((*metricNameReplace)[:i], (*metricNameReplace)[i+1:]))
+	}
+	if *bucketOverflowCounters {
+		opts = append(opts, mtail.BucketOverflowCounters)
+	}
+	if *programPrefix {
+		opts = append(opts, mtail.ProgramPrefix)
+	}
+	if *sortLabels {
+		opts = append(opts, mtail.SortLabels)
+	}
+	if *openMetrics {
+		opts = append(opts, mtail.OpenMetrics)
+	}
 	if *emitMetricTimestamp {
 		opts = append(opts, mtail.EmitMetricTimestamp)
 	}
+	if *staleMarkers {
+		opts = append(opts, mtail.PrometheusStaleMarkers)
+	}
+	if *jsonDeltaExport {
+		opts = append(opts, mtail.JSONDeltaExport)
+	}
 	if *jaegerEndpoint != "" {
 		opts = append(opts, mtail.JaegerReporter(*jaegerEndpoint))
 	}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+/*
+Command mtest runs an mtail program over the input lines of a fixture file,
+and checks the resulting metrics against the values the fixture expects.
+
+In the fixture, lines beginning with `> ' are input to the program, blank lines
+and lines beginning with `#' are ignored, and every other line is an expected
+metric value, checked after the input lines above it:
+
+	> GET /index.html 200
+	requests_total{code=200} 1
+	> GET /index.html 200
+	requests_total{code=200} 2
+
+mtest exits with status 1 if any value does not match.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/vm"
+)
+
+var (
+	prog    = flag.String("prog", "", "Name of the mtail program to test.")
+	fixture = flag.String("fixture", "", "Name of the fixture of input lines and expected metric values.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *prog == "" {
+		glog.Exitf("No -prog given")
+	}
+	if *fixture == "" {
+		glog.Exitf("No -fixture given")
+	}
+
+	p, err := os.Open(*prog)
+	if err != nil {
+		glog.Exit(err)
+	}
+	defer p.Close()
+	f, err := os.Open(*fixture)
+	if err != nil {
+		glog.Exit(err)
+	}
+	defer f.Close()
+	mismatches, err := vm.RunFixture(*prog, p, f)
+	if err != nil {
+		glog.Exit(err)
+	}
+	for _, m := range mismatches {
+		fmt.Printf("%s:%s\n", *fixture, m)
+	}
+	if len(mismatches) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
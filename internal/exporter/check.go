@@ -0,0 +1,111 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+var (
+	exportCheckTotal = expvar.NewInt("exporter_check_total")
+)
+
+// Nagios plugin return codes.
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatusNames = map[int]string{
+	checkOK:       "OK",
+	checkWarning:  "WARNING",
+	checkCritical: "CRITICAL",
+	checkUnknown:  "UNKNOWN",
+}
+
+// CheckStatusHeader is the HTTP response header carrying the Nagios plugin
+// return code of a check.
+const CheckStatusHeader = "X-Nagios-Status"
+
+// HandleCheck evaluates a Nagios-style threshold check against a metric via
+// HTTP.  The request names the metric and the warning and critical
+// thresholds, as in `/check?metric=foo&warn=10&crit=20`.  The values of all
+// the metric's label sets are summed, and the status is WARNING or CRITICAL
+// if the sum exceeds the respective threshold.  The response body is the
+// plugin output line with perfdata, and the return code is sent in the
+// X-Nagios-Status header.  The HTTP status is 200 for OK and WARNING, 503 for
+// CRITICAL, and 404 or 400 when the metric is missing or not numeric, so that
+// plain HTTP checks also fail.
+func (e *Exporter) HandleCheck(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("metric")
+	if name == "" {
+		http.Error(w, "missing metric parameter", http.StatusBadRequest)
+		return
+	}
+	warn, err := strconv.ParseFloat(r.FormValue("warn"), 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid warn threshold: %s", err), http.StatusBadRequest)
+		return
+	}
+	crit, err := strconv.ParseFloat(r.FormValue("crit"), 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid crit threshold: %s", err), http.StatusBadRequest)
+		return
+	}
+	exportCheckTotal.Add(1)
+
+	var sum float64
+	found := false
+	err = e.store.RLockedRange(func(m *metrics.Metric) error {
+		if m.Name != name {
+			return nil
+		}
+		if m.Type == metrics.String {
+			return fmt.Errorf("metric %s is not numeric", name)
+		}
+		found = true
+		for _, lv := range m.LabelValues {
+			if v, ok := datum.NumericValue(lv.Value); ok {
+				sum += v
+			}
+		}
+		return nil
+	})
+
+	status := checkOK
+	code := http.StatusOK
+	var output string
+	switch {
+	case err != nil:
+		status = checkUnknown
+		code = http.StatusBadRequest
+		output = err.Error()
+	case !found:
+		status = checkUnknown
+		code = http.StatusNotFound
+		output = fmt.Sprintf("metric %s not found", name)
+	default:
+		if sum > crit {
+			status = checkCritical
+			code = http.StatusServiceUnavailable
+		} else if sum > warn {
+			status = checkWarning
+		}
+		v := strconv.FormatFloat(sum, 'g', -1, 64)
+		output = fmt.Sprintf("%s = %s | %s=%s;%s;%s", name, v, name, v,
+			strconv.FormatFloat(warn, 'g', -1, 64), strconv.FormatFloat(crit, 'g', -1, 64))
+	}
+	w.Header().Set("content-type", "text/plain")
+	w.Header().Set(CheckStatusHeader, strconv.Itoa(status))
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s - %s\n", checkStatusNames[status], output)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+var handleCheckTests = []struct {
+	name     string
+	query    string
+	code     int
+	status   string
+	expected string
+}{
+	{"ok",
+		"/check?metric=foo&warn=10&crit=20",
+		200,
+		"0",
+		"OK - foo = 7 | foo=7;10;20\n",
+	},
+	{"warning",
+		"/check?metric=foo&warn=5&crit=20",
+		200,
+		"1",
+		"WARNING - foo = 7 | foo=7;5;20\n",
+	},
+	{"critical",
+		"/check?metric=foo&warn=2&crit=5.5",
+		503,
+		"2",
+		"CRITICAL - foo = 7 | foo=7;2;5.5\n",
+	},
+	{"unknown",
+		"/check?metric=bar&warn=10&crit=20",
+		404,
+		"3",
+		"UNKNOWN - metric bar not found\n",
+	},
+}
+
+func TestHandleCheck(t *testing.T) {
+	for _, tc := range handleCheckTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			ms := metrics.NewStore()
+			testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Counter,
+				Keys:    []string{"a"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"1"}, Value: datum.MakeInt(3, time.Unix(0, 0))},
+					{Labels: []string{"2"}, Value: datum.MakeInt(4, time.Unix(0, 0))},
+				},
+			}))
+			e, err := New(ctx, &wg, ms, Hostname("gunstar"))
+			testutil.FatalIfErr(t, err)
+			response := httptest.NewRecorder()
+			e.HandleCheck(response, httptest.NewRequest("GET", tc.query, nil))
+			if response.Code != tc.code {
+				t.Errorf("response code not %d: %d", tc.code, response.Code)
+			}
+			testutil.ExpectNoDiff(t, tc.status, response.Header().Get(CheckStatusHeader))
+			testutil.ExpectNoDiff(t, tc.expected, response.Body.String())
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandleCheckBadThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, metrics.NewStore(), Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	response := httptest.NewRecorder()
+	e.HandleCheck(response, httptest.NewRequest("GET", "/check?metric=foo&warn=x&crit=20", nil))
+	if response.Code != 400 {
+		t.Errorf("response code not 400: %d", response.Code)
+	}
+	cancel()
+	wg.Wait()
+}
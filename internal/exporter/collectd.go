@@ -30,13 +30,13 @@ var (
 
 // metricToCollectd encodes the metric data in the collectd text protocol format.  The
 // metric lock is held before entering this function.
-func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet, interval time.Duration) string {
+func metricToCollectd(hostname, name string, m *metrics.Metric, l *metrics.LabelSet, interval time.Duration) string {
 	return fmt.Sprintf(collectdFormat,
 		hostname,
 		*collectdPrefix,
 		m.Program,
 		kindToCollectdType(m.Kind),
-		formatLabels(m.Name, l.Labels, "-", "-", "_"),
+		formatLabels(name, l.Labels, "-", "-", "_"),
 		int64(interval.Seconds()),
 		l.Datum.TimeString(),
 		l.Datum.ValueString())
@@ -6,13 +6,17 @@
 package exporter
 
 import (
+	"bytes"
 	"context"
 	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -30,14 +34,26 @@ var (
 // Exporter manages the export of metrics to passive and active collectors.
 type Exporter struct {
 	ctx           context.Context
-	wg            sync.WaitGroup
+	wg            *sync.WaitGroup // Waited on by the caller of New for the final push to complete.
 	store         *metrics.Store
 	pushInterval  time.Duration
 	hostname      string
 	omitProgLabel bool
 	emitTimestamp bool
+	quantiles     []float64           // Quantiles estimated from histograms for export.
+	jsonTime      JSONTimestampFormat // Encoding of timestamps in the JSON export.
+	nameOld       string              // If not empty, replaced in exported metric names by nameNew.
+	nameNew       string
+	sortLabels    bool // If set, all labels are rendered in alphabetical order.
+	staleMarkers  bool // If set, series removed by expiry are exported once as stale.
+	deltaExport   bool // If set, JSON consumers that name themselves get only the metrics changed since their last export.
 	pushTargets   []pushOptions
+	pushgateway   *pushgatewayTarget // If not nil, metrics are also pushed to this Pushgateway.
 	initDone      chan struct{}
+
+	deltaMu      sync.Mutex                // protects lastVersions and deltaExports
+	lastVersions map[string]*deltaConsumer // The last export to each named consumer.
+	deltaExports uint64                    // Count of delta exports, to order the consumers by their last export.
 }
 
 // Option configures a new Exporter.
@@ -67,6 +83,100 @@ func EmitTimestamp() Option {
 	}
 }
 
+// staleSeriesRetention is how long the series removed by expiry are kept to
+// be marked as stale, if they are not collected sooner.
+const staleSeriesRetention = 10 * time.Minute
+
+// StaleMarkers instructs the exporter to export the series of counters and
+// gauges removed by expiry once more to Prometheus, with the staleness marker
+// value, so that they end immediately instead of when Prometheus times them
+// out.  The markers are only served in the protobuf format by the handler
+// from PrometheusHandler: the text formats can only write a marker as a plain
+// NaN, which Prometheus would record as a value, so scrapers that negotiate a
+// text format never see them.
+func StaleMarkers() Option {
+	return func(e *Exporter) error {
+		e.staleMarkers = true
+		e.store.TrackRemoved(staleSeriesRetention)
+		return nil
+	}
+}
+
+// DeltaExport instructs the exporter to send a consumer of the JSON export
+// that names itself with the `consumer' query parameter only the metrics that
+// changed since the last export to that consumer.  The first export to each
+// consumer has all the metrics.  Metrics and label values that are removed
+// are not reported to consumers; they just stop appearing.
+func DeltaExport() Option {
+	return func(e *Exporter) error {
+		e.deltaExport = true
+		return nil
+	}
+}
+
+// HistogramQuantiles instructs the exporter to export estimates of the given
+// quantiles of each histogram, as a series named with a `_quantile' suffix.
+func HistogramQuantiles(quantiles ...float64) Option {
+	return func(e *Exporter) error {
+		for _, q := range quantiles {
+			if q < 0 || q > 1 {
+				return errors.Errorf("quantile %v not between 0 and 1", q)
+			}
+		}
+		e.quantiles = quantiles
+		return nil
+	}
+}
+
+// JSONTimestamps sets the encoding of datum timestamps in the JSON export.
+func JSONTimestamps(f JSONTimestampFormat) Option {
+	return func(e *Exporter) error {
+		e.jsonTime = f
+		return nil
+	}
+}
+
+// SortLabels instructs the exporter to render the labels of each metric in
+// alphabetical order, including the prog and instance labels of the varz
+// export, so that the output is the same regardless of the order the keys
+// were declared in.
+func SortLabels() Option {
+	return func(e *Exporter) error {
+		e.sortLabels = true
+		return nil
+	}
+}
+
+// validNameReplacement matches the strings that can replace part of a metric
+// name and keep it valid in every export format.
+var validNameReplacement = regexp.MustCompile(`^[a-zA-Z0-9_:]*$`)
+
+// MetricNameReplace instructs the exporter to replace every occurrence of old
+// in metric names with new, when exporting to Prometheus, varz, and the push
+// collectors.  The replacement may only contain letters, digits, underscores,
+// and colons.
+func MetricNameReplace(old, new string) Option {
+	return func(e *Exporter) error {
+		if old == "" {
+			return errors.New("metric name replacement needs a string to replace")
+		}
+		if !validNameReplacement.MatchString(new) {
+			return errors.Errorf("invalid metric name replacement %q", new)
+		}
+		e.nameOld = old
+		e.nameNew = new
+		return nil
+	}
+}
+
+// exportName returns the name of a metric as exported.
+func (e *Exporter) exportName(name string) string {
+	if e.nameOld == "" {
+		return name
+	}
+	return strings.Replace(name, e.nameOld, e.nameNew, -1)
+}
+
 func PushInterval(opt time.Duration) Option {
 	return func(e *Exporter) error {
 		e.pushInterval = opt
@@ -80,9 +190,11 @@ func New(ctx context.Context, wg *sync.WaitGroup, store *metrics.Store, options
 		return nil, errors.New("exporter needs a Store")
 	}
 	e := &Exporter{
-		ctx:      ctx,
-		store:    store,
-		initDone: make(chan struct{}),
+		ctx:          ctx,
+		wg:           wg,
+		store:        store,
+		initDone:     make(chan struct{}),
+		lastVersions: make(map[string]*deltaConsumer),
 	}
 	defer close(e.initDone)
 	if err := e.SetOption(options...); err != nil {
@@ -109,17 +221,18 @@ func New(ctx context.Context, wg *sync.WaitGroup, store *metrics.Store, options
 		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
 		e.RegisterPushExport(o)
 	}
+	if *influxdbWriteURL != "" {
+		o := pushOptions{"http", *influxdbWriteURL, metricToInfluxDB, influxdbExportTotal, influxdbExportSuccess}
+		e.RegisterPushExport(o)
+	}
+	if *pushgatewayURL != "" {
+		instance := *pushgatewayInstance
+		if instance == "" {
+			instance = e.hostname
+		}
+		e.pushgateway = &pushgatewayTarget{*pushgatewayURL, *pushgatewayJob, instance, *pushgatewayDeleteOnShutdown}
+	}
 	e.StartMetricPush()
-
-	// This routine manages shutdown of the Exporter.  TODO(jaq): This doesn't
-	// happen before mtail returns because of how context cancellation is set
-	// up..  How can we tie this shutdown in before mtail exits?  Should
-	// exporter be merged with httpserver?
-	go func() {
-		<-e.initDone
-		<-e.ctx.Done()
-		e.wg.Wait()
-	}()
 	return e, nil
 }
 
@@ -137,6 +250,7 @@ func (e *Exporter) SetOption(options ...Option) error {
 // string for exporting to the correct output format for each export target.
 // ksep and sep mark what to use for key/val separator, and between label separators respoectively.
 // If not empty, rep is used to replace cases of ksep and sep in the original strings.
+// Labels are formatted in order of their keys, so the output is stable.
 func formatLabels(name string, m map[string]string, ksep, sep, rep string) string {
 	r := name
 	if len(m) > 0 {
@@ -146,6 +260,7 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 			v1 := strings.Replace(strings.Replace(v, ksep, rep, -1), sep, rep, -1)
 			s = append(s, fmt.Sprintf("%s%s%s", k1, ksep, v1))
 		}
+		sort.Strings(s)
 		return r + sep + strings.Join(s, sep)
 	}
 	return r
@@ -153,7 +268,7 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 
 // Format a LabelSet into a string to be written to one of the timeseries
 // sockets.
-type formatter func(string, *metrics.Metric, *metrics.LabelSet, time.Duration) string
+type formatter func(string, string, *metrics.Metric, *metrics.LabelSet, time.Duration) string
 
 func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
 	return e.store.Range(func(m *metrics.Metric) error {
@@ -167,7 +282,7 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 		lc := make(chan *metrics.LabelSet)
 		go m.EmitLabelSets(lc)
 		for l := range lc {
-			line := f(e.hostname, m, l, e.pushInterval)
+			line := f(e.hostname, e.exportName(m.Name), m, l, e.pushInterval)
 			n, err := fmt.Fprint(c, line)
 			glog.V(2).Infof("Sent %d bytes\n", n)
 			if err == nil {
@@ -185,6 +300,12 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 func (e *Exporter) PushMetrics() {
 	for _, target := range e.pushTargets {
 		glog.V(2).Infof("pushing to %s", target.addr)
+		if target.net == "http" {
+			if err := e.postMetrics(target); err != nil {
+				glog.Infof("pusher write error: %s", err)
+			}
+			continue
+		}
 		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
 		if err != nil {
 			glog.Infof("pusher dial error: %s", err)
@@ -204,11 +325,67 @@ func (e *Exporter) PushMetrics() {
 			glog.Infof("connection close failed: %s", err)
 		}
 	}
+	if e.pushgateway != nil {
+		glog.V(2).Infof("pushing to %s", e.pushgateway.url)
+		if err := e.pushToGateway(e.pushgateway); err != nil {
+			glog.Infof("pusher write error: %s", err)
+		}
+	}
+}
+
+// httpPushRetries is the number of times a failed push over HTTP is retried
+// before it is abandoned.
+const httpPushRetries = 3
+
+// httpPushRetryDelay is the delay before the first retry of a failed push
+// over HTTP, which doubles on each further retry.
+var httpPushRetryDelay = 500 * time.Millisecond
+
+// postMetrics sends the metrics in the body of a POST request to the URL of
+// the push target, retrying failed requests with exponential backoff.
+// Requests rejected with a client error are not retried, as the same body
+// would be rejected again.
+func (e *Exporter) postMetrics(target pushOptions) error {
+	var b bytes.Buffer
+	if err := e.writeSocketMetrics(&b, target.f, target.total, target.success); err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: *writeDeadline}
+	delay := httpPushRetryDelay
+	var err error
+	for attempt := 0; attempt <= httpPushRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+			case <-e.ctx.Done():
+				// Don't delay the final push on shutdown.
+			}
+			delay *= 2
+		}
+		var resp *http.Response
+		resp, err = client.Post(target.addr, "text/plain; charset=utf-8", bytes.NewReader(b.Bytes()))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode < 500:
+			return errors.Errorf("push to %s rejected: %s", target.addr, resp.Status)
+		}
+		err = errors.Errorf("push to %s failed: %s", target.addr, resp.Status)
+	}
+	return err
 }
 
 // StartMetricPush pushes metrics to the configured services each interval.
+// When the context is cancelled, the metrics are pushed one last time so
+// that updates since the last interval aren't lost, and the WaitGroup passed
+// to New is not done until that push completes.  A Pushgateway set to delete
+// on shutdown has its metrics deleted after the final push instead.
 func (e *Exporter) StartMetricPush() {
-	if len(e.pushTargets) <= 0 {
+	if len(e.pushTargets) <= 0 && e.pushgateway == nil {
 		return
 	}
 	if e.pushInterval <= 0 {
@@ -224,6 +401,13 @@ func (e *Exporter) StartMetricPush() {
 		for {
 			select {
 			case <-e.ctx.Done():
+				glog.Info("Pushing final metrics before shutdown.")
+				e.PushMetrics()
+				if e.pushgateway != nil && e.pushgateway.deleteOnShutdown {
+					if err := e.deleteFromGateway(e.pushgateway); err != nil {
+						glog.Infof("pusher delete error: %s", err)
+					}
+				}
 				return
 			case <-ticker.C:
 				e.PushMetrics()
@@ -4,10 +4,18 @@
 package exporter
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"expvar"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,6 +23,7 @@ import (
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const prefix = "prefix"
@@ -54,7 +63,7 @@ func FakeSocketWrite(f formatter, m *metrics.Metric) []string {
 	d := 60 * time.Second
 	go m.EmitLabelSets(lc)
 	for l := range lc {
-		ret = append(ret, f("gunstar", m, l, d))
+		ret = append(ret, f("gunstar", m.Name, m, l, d))
 	}
 	sort.Strings(ret)
 	return ret
@@ -184,3 +193,231 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 }
+
+func TestMetricNameReplace(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("http__requests", "test", metrics.Counter, metrics.Int)
+	m.SetSource("location.mtail:37")
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), MetricNameReplace("__", ":"))
+	testutil.FatalIfErr(t, err)
+
+	expected := `# HELP http:requests defined at location.mtail:37
+# TYPE http:requests counter
+http:requests 3
+`
+	if err := promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	response := httptest.NewRecorder()
+	e.HandleVarz(response, &http.Request{})
+	testutil.ExpectNoDiff(t, "http:requests{instance=gunstar} 3\n", response.Body.String())
+
+	*graphitePrefix = ""
+	var b bytes.Buffer
+	testutil.FatalIfErr(t, e.writeSocketMetrics(&b, metricToGraphite, expvar.NewInt("test_export_total"), expvar.NewInt("test_export_success")))
+	testutil.ExpectNoDiff(t, "test.http:requests 3 1343124840\n", b.String())
+}
+
+func TestSortLabels(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "zone", "method", "code")
+	d, err := m.GetDatum("eu", "GET", "200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), SortLabels())
+	testutil.FatalIfErr(t, err)
+
+	response := httptest.NewRecorder()
+	e.HandleVarz(response, &http.Request{})
+	testutil.ExpectNoDiff(t, "requests{code=200,instance=gunstar,method=GET,prog=test,zone=eu} 3\n", response.Body.String())
+
+	*graphitePrefix = ""
+	var b bytes.Buffer
+	testutil.FatalIfErr(t, e.writeSocketMetrics(&b, metricToGraphite, expvar.NewInt("test_sorted_export_total"), expvar.NewInt("test_sorted_export_success")))
+	testutil.ExpectNoDiff(t, "test.requests.code.200.method.GET.zone.eu 3 1343124840\n", b.String())
+}
+
+func TestMetricNameReplaceInvalid(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	ms := metrics.NewStore()
+	if _, err := New(ctx, &wg, ms, MetricNameReplace("", "_")); err == nil {
+		t.Error("expected error for empty string to replace")
+	}
+	if _, err := New(ctx, &wg, ms, MetricNameReplace("_", "-")); err == nil {
+		t.Error("expected error for invalid replacement")
+	}
+}
+
+func TestFinalPushOnShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer c.Close()
+		b, err := ioutil.ReadAll(c)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		received <- string(b)
+	}()
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int)
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, ms.Add(m))
+	// The interval is long enough that only the final push can happen.
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), PushInterval(time.Hour))
+	testutil.FatalIfErr(t, err)
+	*graphitePrefix = ""
+	e.RegisterPushExport(pushOptions{"tcp", l.Addr().String(), metricToGraphite, expvar.NewInt("test_final_export_total"), expvar.NewInt("test_final_export_success")})
+	e.StartMetricPush()
+
+	cancel()
+	wg.Wait()
+	select {
+	case got := <-received:
+		testutil.ExpectNoDiff(t, "test.requests 3 1343124840\n", got)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no metrics pushed on shutdown")
+	}
+}
+
+func TestMetricToInfluxDB(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+
+	scalarMetric := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := scalarMetric.GetDatum()
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(metricToInfluxDB, scalarMetric)
+	expected := []string{"foo,prog=prog value=37i 1343124840000000000\n"}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	dimensionedMetric := metrics.NewMetric("bar baz", "prog", metrics.Gauge, metrics.Float, "zone", "host")
+	d, _ = dimensionedMetric.GetDatum("eu", "quux,com")
+	datum.SetFloat(d, 3.5, ts)
+	d, _ = dimensionedMetric.GetDatum("us", "")
+	datum.SetFloat(d, 1, ts)
+	r = FakeSocketWrite(metricToInfluxDB, dimensionedMetric)
+	expected = []string{
+		"bar\\ baz,prog=prog,host=quux\\,com,zone=eu value=3.5 1343124840000000000\n",
+		"bar\\ baz,prog=prog,zone=us value=1 1343124840000000000\n"}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	histogramMetric := metrics.NewMetric("latency", "prog", metrics.Histogram, metrics.Buckets)
+	histogramMetric.Buckets = []datum.Range{{Min: 0, Max: 1}, {Min: 1, Max: math.Inf(+1)}}
+	d, _ = histogramMetric.GetDatum()
+	datum.SetFloat(d, 0.5, ts)
+	datum.SetFloat(d, 2, ts)
+	r = FakeSocketWrite(metricToInfluxDB, histogramMetric)
+	expected = []string{"latency,prog=prog count=2i,sum=2.5 1343124840000000000\n"}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	textMetric := metrics.NewMetric("last_error", "prog", metrics.Text, metrics.String)
+	d, _ = textMetric.GetDatum()
+	datum.SetString(d, `say "hi" \o/`, ts)
+	r = FakeSocketWrite(metricToInfluxDB, textMetric)
+	expected = []string{`last_error,prog=prog value="say \"hi\" \\o/" 1343124840000000000` + "\n"}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	// NaN and infinite values can't be written, so are skipped.
+	nanMetric := metrics.NewMetric("ratio", "prog", metrics.Gauge, metrics.Float, "kind")
+	d, _ = nanMetric.GetDatum("nan")
+	datum.SetFloat(d, math.NaN(), ts)
+	d, _ = nanMetric.GetDatum("inf")
+	datum.SetFloat(d, math.Inf(-1), ts)
+	d, _ = nanMetric.GetDatum("ok")
+	datum.SetFloat(d, 0.5, ts)
+	r = FakeSocketWrite(metricToInfluxDB, nanMetric)
+	expected = []string{"", "", "ratio,prog=prog,kind=ok value=0.5 1343124840000000000\n"}
+	testutil.ExpectNoDiff(t, expected, r)
+}
+
+func TestPushInfluxDB(t *testing.T) {
+	defer func(d time.Duration) { httpPushRetryDelay = d }(httpPushRetryDelay)
+	httpPushRetryDelay = time.Millisecond
+
+	var requests int
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// The first write fails, and is retried.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.FatalIfErr(t, err)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "code")
+	d, err := m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+
+	target := pushOptions{"http", srv.URL + "/write?db=mtail", metricToInfluxDB, expvar.NewInt("test_influxdb_export_total"), expvar.NewInt("test_influxdb_export_success")}
+	testutil.FatalIfErr(t, e.postMetrics(target))
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+	testutil.ExpectNoDiff(t, "requests,prog=test,code=200 value=3i 1343124840000000000\n", body)
+
+	// Client errors are not retried.
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	requests = 0
+	if err := e.postMetrics(target); err == nil {
+		t.Error("expected error for rejected write")
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
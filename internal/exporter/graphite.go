@@ -24,11 +24,11 @@ var (
 
 // metricToGraphite encodes a metric in the graphite text protocol format.  The
 // metric lock is held before entering this function.
-func metricToGraphite(hostname string, m *metrics.Metric, l *metrics.LabelSet, _ time.Duration) string {
+func metricToGraphite(hostname, name string, m *metrics.Metric, l *metrics.LabelSet, _ time.Duration) string {
 	return fmt.Sprintf("%s%s.%s %v %v\n",
 		*graphitePrefix,
 		m.Program,
-		formatLabels(m.Name, l.Labels, ".", ".", "_"),
+		formatLabels(name, l.Labels, ".", ".", "_"),
 		l.Datum.ValueString(),
 		l.Datum.TimeString())
 }
@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+var (
+	influxdbWriteURL = flag.String("influxdb_write_url", "",
+		"URL of the InfluxDB HTTP write API to push metrics to, such as http://localhost:8086/write?db=mtail.")
+
+	influxdbExportTotal   = expvar.NewInt("influxdb_export_total")
+	influxdbExportSuccess = expvar.NewInt("influxdb_export_success")
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// metricToInfluxDB encodes a metric in the InfluxDB line protocol.  The
+// program name and labels are tags, sorted by key, and the value is the
+// `value' field, or the `count' and `sum' fields of a histogram.  String
+// values are quoted.  As the line protocol has no representation of NaN or
+// infinite values, a label set with one is skipped by returning the empty
+// string.  The metric lock is held before entering this function.
+func metricToInfluxDB(_, name string, m *metrics.Metric, l *metrics.LabelSet, _ time.Duration) string {
+	tags := make([]string, 0, len(l.Labels)+1)
+	tags = append(tags, "prog="+influxTagEscaper.Replace(m.Program))
+	for k, v := range l.Labels {
+		if v == "" {
+			// InfluxDB does not accept tags with empty values.
+			continue
+		}
+		tags = append(tags, influxTagEscaper.Replace(k)+"="+influxTagEscaper.Replace(v))
+	}
+	sort.Strings(tags[1:])
+	var fields string
+	switch d := l.Datum.(type) {
+	case *datum.Int:
+		fields = fmt.Sprintf("value=%di", d.Get())
+	case *datum.Float:
+		if !isFinite(d.Get()) {
+			return ""
+		}
+		fields = "value=" + d.ValueString()
+	case *datum.String:
+		fields = `value="` + influxStringEscaper.Replace(d.Get()) + `"`
+	case *datum.Buckets:
+		if !isFinite(d.GetSum()) {
+			return ""
+		}
+		fields = fmt.Sprintf("count=%di,sum=%v", d.GetCount(), d.GetSum())
+	default:
+		fields = "value=" + l.Datum.ValueString()
+	}
+	return fmt.Sprintf("%s,%s %s %d\n",
+		influxMeasurementEscaper.Replace(name),
+		strings.Join(tags, ","),
+		fields,
+		l.Datum.TimeUTC().UnixNano())
+}
+
+// isFinite returns true if f is neither NaN nor infinite.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
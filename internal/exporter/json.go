@@ -9,15 +9,32 @@ import (
 	"net/http"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 )
 
 var (
 	exportJSONErrors = expvar.NewInt("exporter_json_errors")
 )
 
+// JSONTimestampFormat selects the encoding of datum timestamps in the JSON export.
+type JSONTimestampFormat int
+
+const (
+	// JSONTimestampUnixNano encodes timestamps as nanoseconds since the Unix epoch.
+	JSONTimestampUnixNano JSONTimestampFormat = iota
+	// JSONTimestampRFC3339Nano encodes timestamps as RFC3339 strings with nanoseconds.
+	JSONTimestampRFC3339Nano
+)
+
 // HandleJSON exports the metrics in JSON format via HTTP.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	ms := e.jsonMetrics(r.FormValue("consumer"))
+	var v interface{} = ms
+	if e.jsonTime == JSONTimestampRFC3339Nano {
+		v = rfc3339Metrics(ms)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
@@ -30,3 +47,105 @@ func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// rfc3339Metric wraps a Metric to encode the timestamps of its datums in
+// RFC3339 format.
+type rfc3339Metric struct {
+	*metrics.Metric
+	LabelValues []rfc3339LabelValue `json:",omitempty"`
+}
+
+type rfc3339LabelValue struct {
+	*metrics.LabelValue
+	Value rfc3339Datum
+}
+
+type rfc3339Datum struct {
+	datum.Datum
+}
+
+func (d rfc3339Datum) MarshalJSON() ([]byte, error) {
+	return datum.MarshalJSONRFC3339Nano(d.Datum)
+}
+
+// MarshalJSON holds the Metric's read lock while it is encoded.
+func (m rfc3339Metric) MarshalJSON() ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	type noMethods rfc3339Metric
+	for _, lv := range m.Metric.LabelValues {
+		m.LabelValues = append(m.LabelValues, rfc3339LabelValue{lv, rfc3339Datum{lv.Value}})
+	}
+	return json.Marshal(noMethods(m))
+}
+
+func rfc3339Metrics(ms []*metrics.Metric) []rfc3339Metric {
+	r := make([]rfc3339Metric, 0, len(ms))
+	for _, m := range ms {
+		r = append(r, rfc3339Metric{Metric: m})
+	}
+	return r
+}
+
+// maxDeltaConsumers is the number of named consumers whose last export is
+// remembered for delta export.  When another consumer names itself, the one
+// that has gone longest without an export is forgotten, and its next export
+// has all the metrics again.
+const maxDeltaConsumers = 1024
+
+// deltaConsumer records the last delta export to a named consumer.
+type deltaConsumer struct {
+	version uint64 // The datum version at the last export.
+	export  uint64 // The Exporter's count of delta exports at the last export.
+}
+
+// jsonMetrics returns the metrics to export to the named consumer.  With
+// delta export, that is only those changed since the last export to the
+// consumer, otherwise it is all of them.
+func (e *Exporter) jsonMetrics(consumer string) []*metrics.Metric {
+	ms := make([]*metrics.Metric, 0)
+	if !e.deltaExport || consumer == "" {
+		e.store.Range(func(m *metrics.Metric) error {
+			ms = append(ms, m)
+			return nil
+		})
+		return ms
+	}
+	e.deltaMu.Lock()
+	defer e.deltaMu.Unlock()
+	// Datums changed while the store is read have a greater version than
+	// this, so they are exported again next time rather than missed.
+	current := datum.CurrentVersion()
+	c, ok := e.lastVersions[consumer]
+	if !ok {
+		if len(e.lastVersions) >= maxDeltaConsumers {
+			e.forgetIdlestConsumer()
+		}
+		c = &deltaConsumer{}
+		e.lastVersions[consumer] = c
+	}
+	e.store.Range(func(m *metrics.Metric) error {
+		if m.Version() > c.version {
+			ms = append(ms, m)
+		}
+		return nil
+	})
+	e.deltaExports++
+	c.version = current
+	c.export = e.deltaExports
+	return ms
+}
+
+// forgetIdlestConsumer removes the named consumer with the oldest last
+// export.  deltaMu must be held.
+func (e *Exporter) forgetIdlestConsumer() {
+	var idlest string
+	var oldest uint64
+	for name, c := range e.lastVersions {
+		if idlest == "" || c.export < oldest {
+			idlest, oldest = name, c.export
+		}
+	}
+	glog.V(1).Infof("Forgetting delta export consumer %q", idlest)
+	delete(e.lastVersions, idlest)
+}
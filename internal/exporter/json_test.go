@@ -5,10 +5,14 @@ package exporter
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -159,3 +163,112 @@ func TestHandleJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleJSONTimestamps(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		format   JSONTimestampFormat
+		expected string
+	}{
+		{"unixnano", JSONTimestampUnixNano, `"Time": 1234567890000000123`},
+		{"rfc3339nano", JSONTimestampRFC3339Nano, `"Time": "2009-02-13T23:31:30.000000123Z"`},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			ms := metrics.NewStore()
+			testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Keys:        []string{"a"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"1"}, Value: datum.MakeInt(1, time.Unix(1234567890, 123))}},
+			}))
+			e, err := New(ctx, &wg, ms, Hostname("gunstar"), JSONTimestamps(tc.format))
+			testutil.FatalIfErr(t, err)
+			response := httptest.NewRecorder()
+			e.HandleJSON(response, &http.Request{})
+			if response.Code != 200 {
+				t.Errorf("response code not 200: %d", response.Code)
+			}
+			b, err := ioutil.ReadAll(response.Body)
+			testutil.FatalIfErr(t, err)
+			if !strings.Contains(string(b), tc.expected) {
+				t.Errorf("expected timestamp %s in response:\n%s", tc.expected, b)
+			}
+			var got []struct {
+				Name        string
+				LabelValues []struct {
+					Labels []string
+					Value  struct{ Value int64 }
+				}
+			}
+			testutil.FatalIfErr(t, json.Unmarshal(b, &got))
+			if len(got) != 1 || got[0].Name != "foo" || len(got[0].LabelValues) != 1 || got[0].LabelValues[0].Value.Value != 1 {
+				t.Errorf("unexpected response:\n%s", b)
+			}
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandleJSONDelta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	ms := metrics.NewStore()
+	foo := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int)
+	bar := metrics.NewMetric("bar", "test", metrics.Counter, metrics.Int)
+	for _, m := range []*metrics.Metric{foo, bar} {
+		d, err := m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		datum.IncIntBy(d, 1, time.Now())
+		testutil.FatalIfErr(t, ms.Add(m))
+	}
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), DeltaExport())
+	testutil.FatalIfErr(t, err)
+	names := func(consumer string) []string {
+		t.Helper()
+		response := httptest.NewRecorder()
+		e.HandleJSON(response, httptest.NewRequest("GET", "/json?consumer="+consumer, nil))
+		if response.Code != 200 {
+			t.Errorf("response code not 200: %d", response.Code)
+		}
+		var got []struct{ Name string }
+		testutil.FatalIfErr(t, json.NewDecoder(response.Body).Decode(&got))
+		r := []string{}
+		for _, m := range got {
+			r = append(r, m.Name)
+		}
+		sort.Strings(r)
+		return r
+	}
+
+	// The first export to a consumer has all the metrics.
+	testutil.ExpectNoDiff(t, []string{"bar", "foo"}, names("a"))
+
+	d, err := foo.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.IncIntBy(d, 1, time.Now())
+
+	// The second has only the changed metric, and another consumer still
+	// gets all of them.
+	testutil.ExpectNoDiff(t, []string{"foo"}, names("a"))
+	testutil.ExpectNoDiff(t, []string{"bar", "foo"}, names("b"))
+	testutil.ExpectNoDiff(t, []string{}, names("a"))
+
+	// Only the most recent consumers are remembered; the idlest one is
+	// forgotten, and gets all the metrics again.
+	for i := 0; i < maxDeltaConsumers-1; i++ {
+		names(fmt.Sprintf("c%d", i))
+	}
+	testutil.ExpectNoDiff(t, []string{}, names("a"))
+	if len(e.lastVersions) != maxDeltaConsumers {
+		t.Errorf("consumers: got %d, want %d", len(e.lastVersions), maxDeltaConsumers)
+	}
+	testutil.ExpectNoDiff(t, []string{"bar", "foo"}, names("b"))
+	testutil.ExpectNoDiff(t, []string{}, names("a"))
+	cancel()
+	wg.Wait()
+}
@@ -6,13 +6,23 @@ package exporter
 import (
 	"expvar"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 var (
@@ -23,6 +33,18 @@ func noHyphens(s string) string {
 	return strings.Replace(s, "-", "_", -1)
 }
 
+// promName returns the name of the metric as exported to Prometheus.  If the
+// exported name would not be a valid Prometheus metric name, the original
+// name is used instead.
+func (e *Exporter) promName(name string) string {
+	n := noHyphens(e.exportName(name))
+	if !model.IsValidMetricName(model.LabelValue(n)) {
+		glog.Warningf("Exported name %q of metric %q is not a valid Prometheus metric name, using the original name", n, name)
+		return noHyphens(name)
+	}
+	return n
+}
+
 // Describe implements the prometheus.Collector interface.
 func (e *Exporter) Describe(c chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(e, c)
@@ -30,16 +52,19 @@ func (e *Exporter) Describe(c chan<- *prometheus.Desc) {
 
 // Collect implements the prometheus.Collector interface.
 func (e *Exporter) Collect(c chan<- prometheus.Metric) {
+	e.collect(c, e.emitTimestamp)
+}
+
+// collect sends the metrics in the store to the channel, with the timestamp
+// of each datum if emitTimestamp is set.
+func (e *Exporter) collect(c chan<- prometheus.Metric, emitTimestamp bool) {
 	lastMetric := ""
 	lastSource := ""
+	lastHelp := ""
+	lastName := ""
 
 	e.store.Range(func(m *metrics.Metric) error {
 		m.RLock()
-		// We don't have a way of converting text metrics to prometheus format.
-		if m.Kind == metrics.Text {
-			m.RUnlock()
-			return nil
-		}
 		metricExportTotal.Add(1)
 
 		lsc := make(chan *metrics.LabelSet)
@@ -48,6 +73,8 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			if lastMetric != m.Name {
 				lastSource = m.Source
 				lastMetric = m.Name
+				lastHelp = promHelp(m, lastSource)
+				lastName = e.promName(m.Name)
 			}
 			var keys []string
 			var vals []string
@@ -61,42 +88,267 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			}
 			var pM prometheus.Metric
 			var err error
-			if m.Kind == metrics.Histogram {
+			if m.Kind == metrics.Text {
+				// Prometheus has no string values, so text is exported as
+				// a label of a series whose value is always 1.
+				pM, err = prometheus.NewConstMetric(
+					prometheus.NewDesc(lastName,
+						lastHelp, append(keys, "text"), nil),
+					prometheus.GaugeValue,
+					1,
+					append(vals, strings.ToValidUTF8(datum.GetString(ls.Datum), "\uFFFD"))...)
+			} else if m.Kind == metrics.Histogram {
 				pM, err = prometheus.NewConstHistogram(
-					prometheus.NewDesc(noHyphens(m.Name),
-						fmt.Sprintf("defined at %s", lastSource), keys, nil),
+					prometheus.NewDesc(lastName,
+						lastHelp, keys, nil),
 					datum.GetBucketsCount(ls.Datum),
 					datum.GetBucketsSum(ls.Datum),
 					datum.GetBucketsCumByMax(ls.Datum),
 					vals...)
+				if exemplars := datum.GetBucketsExemplarsByMax(ls.Datum); err == nil && len(exemplars) > 0 {
+					pM = &exemplarHistogram{pM, exemplars}
+				}
 			} else {
 				pM, err = prometheus.NewConstMetric(
-					prometheus.NewDesc(noHyphens(m.Name),
-						fmt.Sprintf("defined at %s", lastSource), keys, nil),
+					prometheus.NewDesc(lastName,
+						lastHelp, keys, nil),
 					promTypeForKind(m.Kind),
 					promValueForDatum(ls.Datum),
 					vals...)
 			}
 			if err != nil {
+				// Skip this label set, but keep draining the channel so
+				// that EmitLabelSets finishes.
 				glog.Warning(err)
-				return nil
+				continue
 			}
 			// By default no timestamp is emitted to Prometheus. Setting a
 			// timestamp is not recommended. It can lead to unexpected results
 			// if the timestamp is not updated or moved fowarded enough to avoid
 			// triggering Promtheus staleness handling.
 			// Read more in docs/faq.md
-			if e.emitTimestamp {
+			if emitTimestamp {
 				c <- prometheus.NewMetricWithTimestamp(ls.Datum.TimeUTC(), pM)
 			} else {
 				c <- pM
 			}
+			if m.Kind == metrics.Histogram {
+				e.collectQuantiles(c, m, lastName, lastSource, ls.Datum, keys, vals, emitTimestamp)
+			}
 		}
 		m.RUnlock()
 		return nil
 	})
 }
 
+// PrometheusHandler returns the handler of the /metrics endpoint, which serves
+// the metrics gathered from g, including those of the exporter, with opts.
+// If stale markers are enabled, they are added to the metrics served in the
+// protobuf format.  They are left out of the text formats, which can only
+// write them as a plain NaN, so the series would not end; they are kept until
+// a protobuf scrape collects them instead.
+func (e *Exporter) PrometheusHandler(g prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	h := promhttp.HandlerFor(g, opts)
+	if !e.staleMarkers {
+		return h
+	}
+	stale := prometheus.NewRegistry()
+	stale.MustRegister(staleMarkerCollector{e})
+	withStale := promhttp.HandlerFor(prometheus.Gatherers{g, stale}, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := expfmt.Negotiate(r.Header)
+		if opts.EnableOpenMetrics {
+			f = expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		}
+		if f == expfmt.FmtProtoDelim {
+			withStale.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// staleMarkerCollector collects the staleness markers of the series removed
+// from the store of the exporter.  It has no fixed descriptions, so it is an
+// unchecked collector.
+type staleMarkerCollector struct {
+	e *Exporter
+}
+
+// Describe implements the prometheus.Collector interface.
+func (s staleMarkerCollector) Describe(c chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface.
+func (s staleMarkerCollector) Collect(c chan<- prometheus.Metric) {
+	s.e.collectStaleMarkers(c)
+}
+
+// timestampCollector collects the metrics of an exporter with or without
+// their timestamps, regardless of the exporter's own setting.
+type timestampCollector struct {
+	e             *Exporter
+	emitTimestamp bool
+}
+
+// Describe implements the prometheus.Collector interface.
+func (t timestampCollector) Describe(c chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(t, c)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (t timestampCollector) Collect(c chan<- prometheus.Metric) {
+	t.e.collect(c, t.emitTimestamp)
+}
+
+// writePrometheus writes the metrics in the store to w in the Prometheus
+// exposition format f, as they are exported to Prometheus by Collect, with
+// the timestamp of each datum if emitTimestamp is set.
+func (e *Exporter) writePrometheus(w io.Writer, f expfmt.Format, emitTimestamp bool) error {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(timestampCollector{e, emitTimestamp}); err != nil {
+		return err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, f)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrometheusString returns the metrics in the store in the Prometheus text
+// exposition format, as they are exported to Prometheus.  It is a function of
+// this package rather than a method of metrics.Store, because the conversion
+// to Prometheus lives here and the metrics package can't import it without a
+// cycle.
+func PrometheusString(s *metrics.Store) (string, error) {
+	var b strings.Builder
+	if err := (&Exporter{store: s}).writePrometheus(&b, expfmt.FmtText, false); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// WriteProtobuf writes the metrics in the store to w as length-delimited
+// Prometheus client_model MetricFamily messages, the Prometheus protobuf
+// exposition format, with the timestamp of each datum.  Like
+// PrometheusString, it is not a method of metrics.Store to avoid an import
+// cycle.
+func WriteProtobuf(s *metrics.Store, w io.Writer) error {
+	return (&Exporter{store: s}).writePrometheus(w, expfmt.FmtProtoDelim, true)
+}
+
+// staleNaN is the NaN value with which Prometheus marks the end of a series.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// collectStaleMarkers sends a staleness marker for each series removed from
+// the store by expiry since the last collection.  Series that have been
+// created again since then, and those of histograms and text metrics, which
+// are not exported as single values, are skipped.
+func (e *Exporter) collectStaleMarkers(c chan<- prometheus.Metric) {
+	for _, r := range e.store.TakeRemoved() {
+		m := r.Metric
+		if m.Kind == metrics.Histogram || m.Kind == metrics.Text {
+			continue
+		}
+		m.RLock()
+		recreated := m.FindLabelValueOrNil(r.Labels) != nil
+		help := promHelp(m, m.Source)
+		m.RUnlock()
+		if recreated {
+			continue
+		}
+		var keys []string
+		var vals []string
+		if !e.omitProgLabel {
+			keys = append(keys, "prog")
+			vals = append(vals, m.Program)
+		}
+		keys = append(keys, m.Keys...)
+		vals = append(vals, r.Labels...)
+		pM, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(e.promName(m.Name), help, keys, nil),
+			promTypeForKind(m.Kind),
+			staleNaN,
+			vals...)
+		if err != nil {
+			glog.Warning(err)
+			continue
+		}
+		c <- pM
+	}
+}
+
+// collectQuantiles sends the estimated quantiles of the histogram datum d to
+// the channel, as a gauge named after the metric with a `_quantile' suffix.
+func (e *Exporter) collectQuantiles(c chan<- prometheus.Metric, m *metrics.Metric, name, source string, d datum.Datum, keys, vals []string, emitTimestamp bool) {
+	if len(e.quantiles) == 0 {
+		return
+	}
+	desc := prometheus.NewDesc(name+"_quantile",
+		fmt.Sprintf("quantile estimates of %s defined at %s", m.Name, source), append(keys, "quantile"), nil)
+	for _, q := range e.quantiles {
+		pM, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue,
+			datum.GetBucketsQuantile(d, q),
+			append(vals, strconv.FormatFloat(q, 'g', -1, 64))...)
+		if err != nil {
+			glog.Warning(err)
+			return
+		}
+		if emitTimestamp {
+			c <- prometheus.NewMetricWithTimestamp(d.TimeUTC(), pM)
+		} else {
+			c <- pM
+		}
+	}
+}
+
+// promHelp returns the help text of the metric, or a description of where it
+// was defined if no help text has been set.
+func promHelp(m *metrics.Metric, source string) string {
+	if m.Help != "" {
+		return m.Help
+	}
+	return fmt.Sprintf("defined at %s", source)
+}
+
+// exemplarTraceLabel is the label of the trace ID in exported exemplars.
+const exemplarTraceLabel = "trace_id"
+
+// exemplarHistogram is a histogram that also writes the exemplars of its
+// buckets, which are rendered in the OpenMetrics format.
+type exemplarHistogram struct {
+	prometheus.Metric
+	exemplars map[float64]datum.Exemplar // Exemplars by the upper bound of their bucket.
+}
+
+// Write implements the prometheus.Metric interface.
+func (h *exemplarHistogram) Write(out *dto.Metric) error {
+	if err := h.Metric.Write(out); err != nil {
+		return err
+	}
+	for _, b := range out.GetHistogram().GetBucket() {
+		e, ok := h.exemplars[b.GetUpperBound()]
+		if !ok {
+			continue
+		}
+		b.Exemplar = &dto.Exemplar{
+			Label: []*dto.LabelPair{{
+				Name:  proto.String(exemplarTraceLabel),
+				Value: proto.String(e.TraceID),
+			}},
+			Value:     proto.Float64(e.Value),
+			Timestamp: &timestamp.Timestamp{Seconds: e.Time.Unix(), Nanos: int32(e.Time.Nanosecond())},
+		}
+	}
+	return nil
+}
+
 func promTypeForKind(k metrics.Kind) prometheus.ValueType {
 	switch k {
 	case metrics.Counter:
@@ -4,17 +4,25 @@
 package exporter
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"math"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 )
 
 var handlePrometheusTests = []struct {
@@ -109,7 +117,71 @@ foo{} 1
 				Kind:        metrics.Text,
 				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("hi", time.Unix(0, 0))}}},
 		},
-		"",
+		`# HELP foo defined at 
+# TYPE foo gauge
+foo{text="hi"} 1
+`,
+	},
+	{"dimensioned text",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:    "last_error",
+				Program: "test",
+				Kind:    metrics.Text,
+				Keys:    []string{"host"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"a"}, Value: datum.MakeString("connection refused", time.Unix(0, 0))},
+					{Labels: []string{"b"}, Value: datum.MakeString("", time.Unix(0, 0))},
+				}},
+		},
+		`# HELP last_error defined at 
+# TYPE last_error gauge
+last_error{host="a",text="connection refused"} 1
+last_error{host="b",text=""} 1
+`,
+	},
+	{"text invalid utf8",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Text,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("bad\xffbyte", time.Unix(0, 0))}}},
+		},
+		`# HELP foo defined at 
+# TYPE foo gauge
+foo{text="bad�byte"} 1
+`,
+	},
+	{"invalid label value",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Counter,
+				Keys:    []string{"a"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"bad\xff"}, Value: datum.MakeInt(1, time.Unix(0, 0))},
+					{Labels: []string{"good"}, Value: datum.MakeInt(2, time.Unix(0, 0))},
+				},
+			},
+			{
+				Name:        "bar",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(3, time.Unix(0, 0))}},
+			},
+		},
+		`# HELP bar defined at 
+# TYPE bar counter
+bar{} 3
+# HELP foo defined at 
+# TYPE foo counter
+foo{a="good"} 2
+`,
 	},
 	{"quotes",
 		false,
@@ -254,3 +326,335 @@ func TestHandlePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePrometheusQuantiles(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:    "foo",
+		Program: "test",
+		Kind:    metrics.Histogram,
+		Keys:    []string{"a"},
+		LabelValues: []*metrics.LabelValue{
+			{
+				Labels: []string{"bar"},
+				Value: &datum.Buckets{
+					Buckets: []datum.BucketCount{
+						{Range: datum.Range{Min: 0, Max: 1},
+							Count: 2},
+						{Range: datum.Range{Min: 1, Max: 2},
+							Count: 6},
+						{Range: datum.Range{Min: 2, Max: math.Inf(+1)},
+							Count: 2},
+					},
+					Count: 10,
+					Sum:   14,
+				},
+			},
+		},
+		Source: "location.mtail:37",
+	}))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), HistogramQuantiles(0.5, 0.8, 0.99))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP foo defined at location.mtail:37
+# TYPE foo histogram
+foo_bucket{a="bar",le="1"} 2
+foo_bucket{a="bar",le="2"} 8
+foo_bucket{a="bar",le="+Inf"} 10
+foo_sum{a="bar"} 14
+foo_count{a="bar"} 10
+# HELP foo_quantile quantile estimates of foo defined at location.mtail:37
+# TYPE foo_quantile gauge
+foo_quantile{a="bar",quantile="0.5"} 1.5
+foo_quantile{a="bar",quantile="0.8"} 2
+foo_quantile{a="bar",quantile="0.99"} 2
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusHelp(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int)
+	m.SetSource("location.mtail:37")
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel())
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP foo defined at location.mtail:37
+# TYPE foo counter
+foo 1
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	m.SetHelp("requests to the upstream backend")
+	expected = `# HELP foo requests to the upstream backend
+# TYPE foo counter
+foo 1
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusExemplars(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:    "foo",
+		Program: "test",
+		Kind:    metrics.Histogram,
+		LabelValues: []*metrics.LabelValue{
+			{
+				Value: &datum.Buckets{
+					Buckets: []datum.BucketCount{
+						{Range: datum.Range{Min: 0, Max: 1},
+							Count:    2,
+							Exemplar: &datum.Exemplar{TraceID: "abc", Value: 0.5, Time: time.Unix(1343124840, 0)}},
+						{Range: datum.Range{Min: 1, Max: math.Inf(+1)},
+							Count: 1},
+					},
+					Count: 3,
+					Sum:   4,
+				},
+			},
+		},
+		Source: "location.mtail:37",
+	}))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel())
+	testutil.FatalIfErr(t, err)
+	reg := prometheus.NewRegistry()
+	testutil.FatalIfErr(t, reg.Register(e))
+	mfs, err := reg.Gather()
+	testutil.FatalIfErr(t, err)
+	var b bytes.Buffer
+	for _, mf := range mfs {
+		_, err := expfmt.MetricFamilyToOpenMetrics(&b, mf)
+		testutil.FatalIfErr(t, err)
+	}
+	expected := `# HELP foo defined at location.mtail:37
+# TYPE foo histogram
+foo_bucket{le="1.0"} 2 # {trace_id="abc"} 0.5 1.34312484e+09
+foo_bucket{le="+Inf"} 3
+foo_sum 4.0
+foo_count 3
+`
+	testutil.ExpectNoDiff(t, expected, b.String())
+	cancel()
+	wg.Wait()
+}
+
+func TestPrometheusStaleMarkers(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Gauge, metrics.Int, "a")
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), StaleMarkers())
+	testutil.FatalIfErr(t, err)
+
+	d, err := m.GetDatum("old")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now().Add(-time.Hour))
+	d, err = m.GetDatum("new")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 2, time.Now())
+	testutil.FatalIfErr(t, ms.SetExpiry("foo", "test", time.Minute))
+	testutil.FatalIfErr(t, ms.Gc())
+
+	reg := prometheus.NewRegistry()
+	testutil.FatalIfErr(t, reg.Register(e))
+	h := e.PrometheusHandler(reg, promhttp.HandlerOpts{})
+
+	// The text format can't carry the markers, so has none.
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	if body := response.Body.String(); strings.Contains(body, `a="old"`) || !strings.Contains(body, `a="new"`) {
+		t.Errorf("unexpected text exposition %q", body)
+	}
+
+	// collect returns the value of each series scraped in the protobuf
+	// format, by label value.
+	collect := func() map[string]float64 {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		request.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+		h.ServeHTTP(response, request)
+		values := make(map[string]float64)
+		dec := expfmt.NewDecoder(response.Body, expfmt.FmtProtoDelim)
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "a" {
+						values[l.GetValue()] = m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return values
+	}
+
+	values := collect()
+	if len(values) != 2 {
+		t.Fatalf("expected 2 series, got %v", values)
+	}
+	if values["new"] != 2 {
+		t.Errorf("new: got %g, expected 2", values["new"])
+	}
+	if math.Float64bits(values["old"]) != math.Float64bits(staleNaN) {
+		t.Errorf("old: got %g, expected a staleness marker", values["old"])
+	}
+
+	// The marker is only sent once.
+	values = collect()
+	if _, ok := values["old"]; ok || len(values) != 1 {
+		t.Errorf("expected only the new series, got %v", values)
+	}
+}
+
+func TestPrometheusString(t *testing.T) {
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests_total", "test", metrics.Counter, metrics.Int, "code")
+	c.Source = "test.mtail:3"
+	testutil.FatalIfErr(t, ms.Add(c))
+	d, err := c.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(0, 0))
+	d, err = c.GetDatum("500")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	g := metrics.NewMetric("temperature", "test", metrics.Gauge, metrics.Float)
+	g.Source = "test.mtail:5"
+	testutil.FatalIfErr(t, ms.Add(g))
+	d, err = g.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetFloat(d, 21.5, time.Unix(0, 0))
+
+	got, err := PrometheusString(ms)
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP requests_total defined at test.mtail:3
+# TYPE requests_total counter
+requests_total{code="200",prog="test"} 3
+requests_total{code="500",prog="test"} 1
+# HELP temperature defined at test.mtail:5
+# TYPE temperature gauge
+temperature{prog="test"} 21.5
+`
+	testutil.ExpectNoDiff(t, expected, got)
+}
+
+func TestPrometheusStringGatherError(t *testing.T) {
+	// Metrics of the same name with different keys can't be gathered into
+	// one family.
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		metrics.NewMetric("requests_total", "a", metrics.Counter, metrics.Int, "code"),
+		metrics.NewMetric("requests_total", "b", metrics.Counter, metrics.Int, "method"),
+	} {
+		testutil.FatalIfErr(t, ms.Add(m))
+		d, err := m.GetDatum("x")
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, time.Unix(0, 0))
+	}
+	if _, err := PrometheusString(ms); err == nil {
+		t.Error("expected a gather error")
+	}
+}
+
+func TestWriteProtobuf(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests_total", "test", metrics.Counter, metrics.Int, "code")
+	c.Source = "test.mtail:3"
+	testutil.FatalIfErr(t, ms.Add(c))
+	d, err := c.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, ts)
+	h := &metrics.Metric{
+		Name:    "latency_seconds",
+		Program: "test",
+		Kind:    metrics.Histogram,
+		Source:  "test.mtail:5",
+		LabelValues: []*metrics.LabelValue{
+			{Value: datum.MakeBuckets([]datum.Range{{Min: 0, Max: 1}, {Min: 1, Max: math.Inf(+1)}}, ts)},
+		},
+	}
+	h.LabelValues[0].Value.(*datum.Buckets).Observe(0.5, ts)
+	h.LabelValues[0].Value.(*datum.Buckets).Observe(2, ts)
+	testutil.FatalIfErr(t, ms.Add(h))
+
+	var b bytes.Buffer
+	testutil.FatalIfErr(t, WriteProtobuf(ms, &b))
+	var got []*dto.MetricFamily
+	dec := expfmt.NewDecoder(&b, expfmt.FmtProtoDelim)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			break
+		} else {
+			testutil.FatalIfErr(t, err)
+		}
+		got = append(got, mf)
+	}
+
+	progLabel := &dto.LabelPair{Name: proto.String("prog"), Value: proto.String("test")}
+	expected := []*dto.MetricFamily{
+		{
+			Name: proto.String("latency_seconds"),
+			Help: proto.String("defined at test.mtail:5"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{progLabel},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(2),
+					SampleSum:   proto.Float64(2.5),
+					Bucket: []*dto.Bucket{
+						{CumulativeCount: proto.Uint64(1), UpperBound: proto.Float64(1)},
+						{CumulativeCount: proto.Uint64(2), UpperBound: proto.Float64(math.Inf(+1))},
+					},
+				},
+				TimestampMs: proto.Int64(1343124840000),
+			}},
+		},
+		{
+			Name: proto.String("requests_total"),
+			Help: proto.String("defined at test.mtail:3"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}, progLabel},
+				Counter:     &dto.Counter{Value: proto.Float64(3)},
+				TimestampMs: proto.Int64(1343124840000),
+			}},
+		},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %d families, expected %d: %v", len(got), len(expected), got)
+	}
+	for i := range expected {
+		if !proto.Equal(expected[i], got[i]) {
+			t.Errorf("family %d: got %s, expected %s", i, proto.MarshalTextString(got[i]), proto.MarshalTextString(expected[i]))
+		}
+	}
+}
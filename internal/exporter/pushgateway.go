@@ -0,0 +1,113 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"expvar"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	pushgatewayURL = flag.String("pushgateway_url", "",
+		"URL of a Prometheus Pushgateway to push metrics to, such as http://localhost:9091.")
+	pushgatewayJob = flag.String("pushgateway_job", "mtail",
+		"Value of the job grouping key of the metrics pushed to the Pushgateway.")
+	pushgatewayInstance = flag.String("pushgateway_instance", "",
+		"Value of the instance grouping key of the metrics pushed to the Pushgateway.  Defaults to the hostname.")
+	pushgatewayDeleteOnShutdown = flag.Bool("pushgateway_delete_on_shutdown", false,
+		"Delete the metrics pushed to the Pushgateway when mtail shuts down, so that they don't outlive it.")
+
+	pushgatewayExportTotal   = expvar.NewInt("pushgateway_export_total")
+	pushgatewayExportSuccess = expvar.NewInt("pushgateway_export_success")
+)
+
+// pushgatewayTarget is a Prometheus Pushgateway and the grouping key under
+// which the metrics are pushed to it.
+type pushgatewayTarget struct {
+	url              string // The base URL of the Pushgateway.
+	job, instance    string
+	deleteOnShutdown bool
+}
+
+// groupURL returns the URL of the group of metrics with the target's
+// grouping key.  Values that can't be placed in a path segment as they are
+// use the base64 encoding understood by the Pushgateway.
+func (p *pushgatewayTarget) groupURL() string {
+	var b strings.Builder
+	b.WriteString(strings.TrimSuffix(p.url, "/"))
+	b.WriteString("/metrics")
+	for _, l := range []struct{ name, value string }{{"job", p.job}, {"instance", p.instance}} {
+		b.WriteString("/" + l.name)
+		switch {
+		case l.value == "":
+			b.WriteString("@base64/=")
+		case strings.Contains(l.value, "/"):
+			b.WriteString("@base64/" + base64.RawURLEncoding.EncodeToString([]byte(l.value)))
+		default:
+			b.WriteString("/" + url.PathEscape(l.value))
+		}
+	}
+	return b.String()
+}
+
+// pushgatewayBody returns the metrics in the store in the Prometheus text
+// exposition format, as they are exported to Prometheus by Collect, but
+// without timestamps.
+func (e *Exporter) pushgatewayBody() ([]byte, error) {
+	var b bytes.Buffer
+	// The Pushgateway rejects pushed metrics with timestamps.
+	if err := e.writePrometheus(&b, expfmt.FmtText, false); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// pushToGateway replaces the metrics in the target's group on the
+// Pushgateway with the metrics in the store, with a PUT request.
+func (e *Exporter) pushToGateway(p *pushgatewayTarget) error {
+	pushgatewayExportTotal.Add(1)
+	body, err := e.pushgatewayBody()
+	if err != nil {
+		return err
+	}
+	if err := pushgatewayRequest(http.MethodPut, p.groupURL(), body); err != nil {
+		return err
+	}
+	pushgatewayExportSuccess.Add(1)
+	return nil
+}
+
+// deleteFromGateway removes the target's group of metrics from the
+// Pushgateway.
+func (e *Exporter) deleteFromGateway(p *pushgatewayTarget) error {
+	return pushgatewayRequest(http.MethodDelete, p.groupURL(), nil)
+}
+
+func pushgatewayRequest(method, u string, body []byte) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", string(expfmt.FmtText))
+	}
+	client := &http.Client{Timeout: *writeDeadline}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("%s %s failed: %s", method, u, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestPushToGateway(t *testing.T) {
+	type request struct {
+		method, path, body string
+	}
+	var requests []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.FatalIfErr(t, err)
+		requests = append(requests, request{r.Method, r.URL.EscapedPath(), string(b)})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "code")
+	d, err := m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, ms.Add(m))
+	// Timestamps are left out of the push even when they are exported.
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), EmitTimestamp())
+	testutil.FatalIfErr(t, err)
+
+	p := &pushgatewayTarget{srv.URL + "/", "batch", "gunstar:3903", true}
+	testutil.FatalIfErr(t, e.pushToGateway(p))
+	testutil.FatalIfErr(t, e.deleteFromGateway(p))
+	expected := []request{
+		{"PUT", "/metrics/job/batch/instance/gunstar:3903", "# HELP requests defined at \n" +
+			"# TYPE requests counter\n" +
+			"requests{code=\"200\",prog=\"test\"} 3\n"},
+		{"DELETE", "/metrics/job/batch/instance/gunstar:3903", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, requests, testutil.AllowUnexported(request{}))
+}
+
+func TestPushgatewayGroupURL(t *testing.T) {
+	for _, tc := range []struct {
+		target   pushgatewayTarget
+		expected string
+	}{
+		{pushgatewayTarget{url: "http://pgw:9091", job: "mtail", instance: "gunstar"}, "http://pgw:9091/metrics/job/mtail/instance/gunstar"},
+		// Values with slashes are base64 encoded, and empty values are `='.
+		{pushgatewayTarget{url: "http://pgw:9091", job: "a/b", instance: ""}, "http://pgw:9091/metrics/job@base64/YS9i/instance@base64/="},
+		{pushgatewayTarget{url: "http://pgw:9091", job: "batch job", instance: "gunstar"}, "http://pgw:9091/metrics/job/batch%20job/instance/gunstar"},
+	} {
+		testutil.ExpectNoDiff(t, tc.expected, tc.target.groupURL())
+	}
+}
@@ -24,7 +24,7 @@ var (
 
 // metricToStatsd encodes a metric in the statsd text protocol format.  The
 // metric lock is held before entering this function.
-func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet, _ time.Duration) string {
+func metricToStatsd(hostname, name string, m *metrics.Metric, l *metrics.LabelSet, _ time.Duration) string {
 	var t string
 	switch m.Kind {
 	case metrics.Counter:
@@ -37,6 +37,6 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet, _ t
 	return fmt.Sprintf("%s%s.%s:%s|%s",
 		*statsdPrefix,
 		m.Program,
-		formatLabels(m.Name, l.Labels, ".", ".", "_"),
+		formatLabels(name, l.Labels, ".", ".", "_"),
 		l.Datum.ValueString(), t)
 }
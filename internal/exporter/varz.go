@@ -34,7 +34,7 @@ func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 		lc := make(chan *metrics.LabelSet)
 		go m.EmitLabelSets(lc)
 		for l := range lc {
-			line := metricToVarz(m, l, e.omitProgLabel, e.hostname)
+			line := metricToVarz(e.exportName(m.Name), m, l, e.omitProgLabel, e.sortLabels, e.hostname)
 			fmt.Fprint(w, line)
 		}
 		m.RUnlock()
@@ -42,7 +42,7 @@ func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func metricToVarz(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, hostname string) string {
+func metricToVarz(name string, m *metrics.Metric, l *metrics.LabelSet, omitProgLabel, sortLabels bool, hostname string) string {
 	s := make([]string, 0, len(l.Labels)+2)
 	for k, v := range l.Labels {
 		s = append(s, fmt.Sprintf("%s=%s", k, v))
@@ -52,8 +52,11 @@ func metricToVarz(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, ho
 		s = append(s, fmt.Sprintf("prog=%s", m.Program))
 	}
 	s = append(s, fmt.Sprintf("instance=%s", hostname))
+	if sortLabels {
+		sort.Strings(s)
+	}
 	return fmt.Sprintf(varzFormat,
-		m.Name,
+		name,
 		strings.Join(s, ","),
 		l.Datum.ValueString())
 }
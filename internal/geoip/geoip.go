@@ -0,0 +1,136 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package geoip implements a country lookup for IP addresses, backed by a
+// database file that is loaded lazily on the first lookup.
+//
+// The database is a CSV file with one network in CIDR notation and its ISO
+// country code per line:
+//
+//	1.0.0.0/24,AU
+//	2001:200::/32,JP
+//
+// This is not the MaxMind GeoLite2 Country CSV format, whose blocks files
+// refer to countries by geoname ID; those must first be joined with the
+// locations file to produce the country code for each network.
+//
+// Blank lines and lines beginning with `#' are ignored.
+package geoip
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Database resolves IP addresses to country codes.
+type Database struct {
+	path string
+
+	once sync.Once
+
+	mu      sync.RWMutex              // protects following fields
+	err     error                     // Error from loading the database.
+	nets    map[int]map[string]string // Country codes keyed by prefix length, then network address.
+	lengths []int                     // Prefix lengths present in nets, longest first.
+}
+
+// New creates a Database that reads from the file at path.  The file is not
+// read until the first lookup.
+func New(path string) *Database {
+	return &Database{path: path}
+}
+
+// Country returns the ISO country code of the longest matching network
+// containing ip, or the empty string if no network matches.
+func (d *Database) Country(ip net.IP) (string, error) {
+	d.once.Do(d.load)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.err != nil {
+		return "", d.err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := len(ip) * 8
+	for _, ones := range d.lengths {
+		if ones > bits {
+			continue
+		}
+		network := ip.Mask(net.CIDRMask(ones, bits))
+		if cc, ok := d.nets[ones][network.String()]; ok {
+			return cc, nil
+		}
+	}
+	return "", nil
+}
+
+// Reload reads the database file again, and replaces the networks in use
+// once it has been read in full, so lookups in progress see either the old
+// or the new database.  If the file can't be read the old database is kept.
+func (d *Database) Reload() error {
+	nets, lengths, err := read(d.path)
+	if err != nil {
+		return err
+	}
+	// A reload before the first lookup makes the initial load unnecessary.
+	d.once.Do(func() {})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nets, d.lengths, d.err = nets, lengths, nil
+	return nil
+}
+
+// load reads the database file for the first lookup.
+func (d *Database) load() {
+	nets, lengths, err := read(d.path)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nets, d.lengths, d.err = nets, lengths, err
+}
+
+// read parses the networks in the database file at path, and returns them
+// with their prefix lengths, longest first.
+func read(path string) (map[int]map[string]string, []int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open geoip database")
+	}
+	defer f.Close()
+	nets := make(map[int]map[string]string)
+	var lengths []int
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			return nil, nil, errors.Errorf("%s:%d: expecting network and country code", path, lineNum)
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "%s:%d", path, lineNum)
+		}
+		ones, _ := network.Mask.Size()
+		if _, ok := nets[ones]; !ok {
+			nets[ones] = make(map[string]string)
+			lengths = append(lengths, ones)
+		}
+		nets[ones][network.IP.String()] = strings.TrimSpace(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read geoip database")
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	return nets, lengths, nil
+}
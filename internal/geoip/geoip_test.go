@@ -0,0 +1,73 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+const testDatabase = `# network,country
+1.0.0.0/24,AU
+1.0.0.128/25,NZ
+2001:200::/32,JP
+`
+
+func TestCountry(t *testing.T) {
+	path := filepath.Join(testutil.TestTempDir(t), "geoip.csv")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(testDatabase), 0644))
+	d := New(path)
+	for _, tc := range []struct {
+		ip       string
+		expected string
+	}{
+		{"1.0.0.1", "AU"},
+		{"1.0.0.200", "NZ"},
+		{"1.0.1.1", ""},
+		{"2001:200::1", "JP"},
+		{"2001:201::1", ""},
+	} {
+		cc, err := d.Country(net.ParseIP(tc.ip))
+		testutil.FatalIfErr(t, err)
+		if cc != tc.expected {
+			t.Errorf("Country(%s): expected %q, got %q", tc.ip, tc.expected, cc)
+		}
+	}
+}
+
+func TestCountryMissingDatabase(t *testing.T) {
+	d := New(filepath.Join(testutil.TestTempDir(t), "missing.csv"))
+	if _, err := d.Country(net.ParseIP("1.0.0.1")); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(testutil.TestTempDir(t), "geoip.csv")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(testDatabase), 0644))
+	d := New(path)
+	ip := net.ParseIP("1.0.0.1")
+	cc, err := d.Country(ip)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "AU", cc)
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("1.0.0.0/16,CN\n"), 0644))
+	testutil.FatalIfErr(t, d.Reload())
+	cc, err = d.Country(ip)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "CN", cc)
+
+	// A database that can't be read leaves the old one in use.
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("1.0.0.0/16\n"), 0644))
+	if err := d.Reload(); err == nil {
+		t.Error("expected error for short line, got nil")
+	}
+	cc, err = d.Country(ip)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "CN", cc)
+}
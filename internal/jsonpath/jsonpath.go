@@ -0,0 +1,102 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package jsonpath implements a small subset of JSON path expressions, like
+// `$.user.ids[0]', for extracting single values from JSON documents.
+package jsonpath
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Path is a compiled JSON path.  Its steps are either object keys (string) or
+// array indexes (int).
+type Path []interface{}
+
+// Compile parses a path like `$.user.ids[0]' into its steps.
+func Compile(path string) (Path, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Errorf("JSON path %q does not start with $", path)
+	}
+	var steps Path
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, errors.Errorf("empty key in JSON path %q", path)
+			}
+			steps = append(steps, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated index in JSON path %q", path)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, errors.Errorf("invalid index %q in JSON path %q", rest[1:end], path)
+			}
+			steps = append(steps, i)
+			rest = rest[end+1:]
+		default:
+			return nil, errors.Errorf("unexpected %q in JSON path %q", rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// Lookup returns the value in the JSON document doc at the path as a string.
+// Strings are returned without quotes, and numbers as written in the
+// document.  The empty string is returned if the document is not valid JSON,
+// or has no value at the path.
+func (p Path) Lookup(doc string) string {
+	d := json.NewDecoder(strings.NewReader(doc))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return ""
+	}
+	for _, step := range p {
+		switch s := step.(type) {
+		case string:
+			o, ok := v.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			if v, ok = o[s]; !ok {
+				return ""
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || s >= len(a) {
+				return ""
+			}
+			v = a[s]
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package jsonpath
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestLookup(t *testing.T) {
+	doc := `{"user": {"id": "alice", "ids": [3, 4], "admin": true}}`
+	for path, expected := range map[string]string{
+		"$.user.id":     "alice",
+		"$.user.ids[1]": "4",
+		"$.user.admin":  "true",
+		"$.user.ids":    "[3,4]",
+		"$.user.name":   "",
+		"$.user.ids[2]": "",
+	} {
+		p, err := Compile(path)
+		testutil.FatalIfErr(t, err)
+		if got := p.Lookup(doc); got != expected {
+			t.Errorf("%q: got %q, expected %q", path, got, expected)
+		}
+	}
+}
+
+func TestCompileInvalidPath(t *testing.T) {
+	for _, path := range []string{"user.id", "$.user..id", "$.users[x]", "$.users[0", "$user"} {
+		if _, err := Compile(path); err == nil {
+			t.Errorf("%q: expected error, got nil", path)
+		}
+	}
+}
@@ -17,3 +17,22 @@ type LogLine struct {
 func New(ctx context.Context, filename string, line string) *LogLine {
 	return &LogLine{ctx, filename, line}
 }
+
+type fieldsKey struct{}
+
+// WithFields returns a copy of ctx that carries the structured fields of a log
+// line, for sources such as the systemd journal that send fields with each
+// line.
+func WithFields(ctx context.Context, fields map[string]string) context.Context {
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// Fields returns the structured fields carried by the context of a log line,
+// or nil if there are none.
+func Fields(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsKey{}).(map[string]string)
+	return fields
+}
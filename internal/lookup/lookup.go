@@ -0,0 +1,92 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package lookup implements static lookup tables for programs, loaded from a
+// file.
+//
+// The file is a CSV file with the name of a table, a key, and the value of
+// that key in the table on each line:
+//
+//	codes,404,client_error
+//	codes,503,server_error
+//
+// Blank lines and lines beginning with `#' are ignored.
+package lookup
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tables holds the named lookup tables read from a file.
+type Tables struct {
+	path string
+
+	mu     sync.RWMutex                 // protects tables
+	tables map[string]map[string]string // Values keyed by table name, then key.
+}
+
+// Load reads the lookup tables from the file at path.
+func Load(path string) (*Tables, error) {
+	tables, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Tables{path: path, tables: tables}, nil
+}
+
+// Reload reads the lookup tables from the file again, and replaces the
+// tables in use once the file has been read in full, so lookups in progress
+// see either the old or the new tables.  If the file can't be read the old
+// tables are kept.
+func (t *Tables) Reload() error {
+	tables, err := read(t.path)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tables = tables
+	return nil
+}
+
+// Lookup returns the value of key in the named table, and whether it was
+// found.
+func (t *Tables) Lookup(table, key string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v, ok := t.tables[table][key]
+	return v, ok
+}
+
+// read parses the tables in the file at path.
+func read(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lookup tables")
+	}
+	defer f.Close()
+	tables := make(map[string]map[string]string)
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", path)
+		}
+		if _, ok := tables[record[0]]; !ok {
+			tables[record[0]] = make(map[string]string)
+		}
+		tables[record[0]][record[1]] = record[2]
+	}
+	return tables, nil
+}
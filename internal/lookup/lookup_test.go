@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package lookup
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+const testTables = `# table,key,value
+codes,404,client_error
+codes, 503, server_error
+
+users,"root,admin",superuser
+`
+
+func TestLookup(t *testing.T) {
+	path := filepath.Join(testutil.TestTempDir(t), "tables.csv")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(testTables), 0644))
+	tables, err := Load(path)
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		table, key string
+		expected   string
+		found      bool
+	}{
+		{"codes", "404", "client_error", true},
+		{"codes", "503", "server_error", true},
+		{"codes", "200", "", false},
+		{"users", "root,admin", "superuser", true},
+		{"missing", "404", "", false},
+	} {
+		v, ok := tables.Lookup(tc.table, tc.key)
+		if v != tc.expected || ok != tc.found {
+			t.Errorf("Lookup(%q, %q): expected %q, %v, got %q, %v", tc.table, tc.key, tc.expected, tc.found, v, ok)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := testutil.TestTempDir(t)
+	if _, err := Load(filepath.Join(dir, "missing.csv")); err == nil {
+		t.Error("expected error for missing file, got nil")
+	}
+	path := filepath.Join(dir, "short.csv")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("codes,404\n"), 0644))
+	if _, err := Load(path); err == nil {
+		t.Error("expected error for short line, got nil")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(testutil.TestTempDir(t), "tables.csv")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(testTables), 0644))
+	tables, err := Load(path)
+	testutil.FatalIfErr(t, err)
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("codes,404,not_found\n"), 0644))
+	testutil.FatalIfErr(t, tables.Reload())
+	if v, ok := tables.Lookup("codes", "404"); v != "not_found" || !ok {
+		t.Errorf("Lookup after reload: expected \"not_found\", true, got %q, %v", v, ok)
+	}
+	if _, ok := tables.Lookup("codes", "503"); ok {
+		t.Error("Lookup after reload: expected removed key to be missing")
+	}
+
+	// Tables that can't be read leave the old ones in use.
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("codes,404\n"), 0644))
+	if err := tables.Reload(); err == nil {
+		t.Error("expected error for short line, got nil")
+	}
+	if v, ok := tables.Lookup("codes", "404"); v != "not_found" || !ok {
+		t.Errorf("Lookup after failed reload: expected \"not_found\", true, got %q, %v", v, ok)
+	}
+}
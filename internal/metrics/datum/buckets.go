@@ -6,6 +6,8 @@ package datum
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -18,8 +20,17 @@ type Range struct {
 }
 
 type BucketCount struct {
-	Range Range
-	Count uint64
+	Range    Range
+	Count    uint64
+	Exemplar *Exemplar // The most recent exemplar of an observation in this bucket, if any.
+}
+
+// Exemplar is an example observation in a histogram bucket, identifying the
+// trace that produced it.
+type Exemplar struct {
+	TraceID string
+	Value   float64
+	Time    time.Time
 }
 
 func (r *Range) Contains(v float64) bool {
@@ -56,6 +67,39 @@ func (d *Buckets) Observe(v float64, ts time.Time) {
 	d.stamp(ts)
 }
 
+// ObserveWeighted records the value v as if it had been observed weight times.
+func (d *Buckets) ObserveWeighted(v float64, weight uint64, ts time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, b := range d.Buckets {
+		if b.Range.Contains(v) {
+			d.Buckets[i].Count += weight
+			break
+		}
+	}
+
+	d.Count += weight
+	d.Sum += v * float64(weight)
+
+	d.stamp(ts)
+}
+
+// SetExemplar records an exemplar of the observation v with the trace ID
+// traceID at time ts, replacing any earlier exemplar of the bucket that
+// contains v.
+func (d *Buckets) SetExemplar(v float64, traceID string, ts time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, b := range d.Buckets {
+		if b.Range.Contains(v) {
+			d.Buckets[i].Exemplar = &Exemplar{TraceID: traceID, Value: v, Time: ts}
+			break
+		}
+	}
+}
+
 func (d *Buckets) GetCount() uint64 {
 	d.RLock()
 	defer d.RUnlock()
@@ -73,7 +117,7 @@ func (d *Buckets) AddBucket(r Range) {
 	d.Lock()
 	defer d.Unlock()
 
-	d.Buckets = append(d.Buckets, BucketCount{r, 0})
+	d.Buckets = append(d.Buckets, BucketCount{Range: r})
 }
 
 func (d *Buckets) GetBuckets() map[Range]uint64 {
@@ -87,6 +131,65 @@ func (d *Buckets) GetBuckets() map[Range]uint64 {
 	return b
 }
 
+// Quantile estimates the q-quantile of the observations, for 0 <= q <= 1,
+// by linear interpolation within the bucket that contains it.  If that is
+// the overflow bucket, its lower bound is returned.  NaN is returned if there
+// are no observations.
+func (d *Buckets) Quantile(q float64) float64 {
+	d.RLock()
+	defer d.RUnlock()
+
+	buckets := make([]BucketCount, len(d.Buckets))
+	copy(buckets, d.Buckets)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Range.Max < buckets[j].Range.Max })
+
+	total := uint64(0)
+	for _, b := range buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(total)
+	cum := 0.
+	for _, b := range buckets {
+		if b.Count == 0 || cum+float64(b.Count) < rank {
+			cum += float64(b.Count)
+			continue
+		}
+		if math.IsInf(b.Range.Max, +1) {
+			return b.Range.Min
+		}
+		return b.Range.Min + (b.Range.Max-b.Range.Min)*(rank-cum)/float64(b.Count)
+	}
+	return buckets[len(buckets)-1].Range.Max
+}
+
+// Rank estimates the fraction of the observations that are less than or equal
+// to v, by linear interpolation within the bucket that contains it.
+// Observations in the overflow bucket are only counted when v is +Inf.  Zero
+// is returned if there are no observations.
+func (d *Buckets) Rank(v float64) float64 {
+	d.RLock()
+	defer d.RUnlock()
+
+	total := uint64(0)
+	below := 0.
+	for _, b := range d.Buckets {
+		total += b.Count
+		switch {
+		case v >= b.Range.Max:
+			below += float64(b.Count)
+		case v > b.Range.Min && !math.IsInf(b.Range.Max, +1):
+			below += float64(b.Count) * (v - b.Range.Min) / (b.Range.Max - b.Range.Min)
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return below / float64(total)
+}
+
 func (d *Buckets) MarshalJSON() ([]byte, error) {
 	d.RLock()
 	defer d.RUnlock()
@@ -45,3 +45,75 @@ func TestMakeBucket(t *testing.T) {
 		t.Errorf("missing buckets from BucketsByMax: expected %d, got %v", len(r)+1, len(bs))
 	}
 }
+
+func TestBucketsQuantile(t *testing.T) {
+	r := []datum.Range{
+		{0, 10},
+		{10, 20},
+		{20, 30},
+		{30, 40},
+	}
+	b := datum.MakeBuckets(r, time.Unix(0, 0))
+	// A uniform distribution of 1..40, and one overflow.
+	for v := 1; v <= 40; v++ {
+		datum.Observe(b, float64(v), time.Unix(0, 0))
+	}
+	// The estimates are compared to the true quantiles of the distribution,
+	// within the resolution of the buckets.
+	for _, tc := range []struct {
+		q        float64
+		expected float64
+	}{
+		{0.25, 10.25},
+		{0.5, 20.5},
+		{0.95, 38.05},
+	} {
+		got := datum.GetBucketsQuantile(b, tc.q)
+		if math.Abs(got-tc.expected) > 1 {
+			t.Errorf("quantile %v: expected %v, got %v", tc.q, tc.expected, got)
+		}
+	}
+	datum.Observe(b, 100, time.Unix(0, 0))
+	if got := datum.GetBucketsQuantile(b, 1); got != 40 {
+		t.Errorf("quantile 1 in overflow bucket: expected 40, got %v", got)
+	}
+
+	empty := datum.MakeBuckets(r, time.Unix(0, 0))
+	if got := datum.GetBucketsQuantile(empty, 0.5); !math.IsNaN(got) {
+		t.Errorf("quantile of no observations: expected NaN, got %v", got)
+	}
+}
+
+func TestBucketsRank(t *testing.T) {
+	r := []datum.Range{
+		{0, 10},
+		{10, 20},
+		{20, 30},
+		{30, 40},
+	}
+	b := datum.MakeBuckets(r, time.Unix(0, 0))
+	if got := datum.GetBucketsRank(b, 10); got != 0 {
+		t.Errorf("rank of no observations: expected 0, got %v", got)
+	}
+	// A uniform distribution of 1..40, and one overflow.
+	for v := 1; v <= 40; v++ {
+		datum.Observe(b, float64(v), time.Unix(0, 0))
+	}
+	datum.Observe(b, 100, time.Unix(0, 0))
+	for _, tc := range []struct {
+		v        float64
+		expected float64
+	}{
+		{-1, 0},
+		{0, 0},
+		{15, 15. / 41},
+		{20, 20. / 41},
+		{40, 40. / 41},
+		{1000, 40. / 41},
+		{math.Inf(+1), 1},
+	} {
+		if got := datum.GetBucketsRank(b, tc.v); math.Abs(got-tc.expected) > 1e-9 {
+			t.Errorf("rank of %v: expected %v, got %v", tc.v, tc.expected, got)
+		}
+	}
+}
@@ -4,6 +4,7 @@
 package datum
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"sort"
@@ -24,21 +25,81 @@ type Datum interface {
 
 	// Time returns the timestamp of the Datum as time.Time in UTC
 	TimeUTC() time.Time
+
+	// Version returns the version of the last change to the Datum.
+	Version() uint64
 }
 
 // BaseDatum is a struct used to record timestamps across all Datum implementations.
 type BaseDatum struct {
-	Time int64 // nanoseconds since unix epoch
+	Time    int64        // nanoseconds since unix epoch
+	version uint64       // The value of versions when this datum was last changed.
+	aux     atomic.Value // An auxState kept for this datum by the program that updates it.
+}
+
+// auxState wraps the auxiliary state of a datum, so that the atomic.Value
+// holding it always stores the same type.
+type auxState struct {
+	v interface{}
+}
+
+// Aux returns the auxiliary state a program keeps for datum d, like the
+// sketch of the strings added to it by uniq(), or nil if there is none.  The
+// state belongs to the datum, so it is removed with it, and carried over with
+// it when its program is reloaded.
+func Aux(d Datum) interface{} {
+	b, ok := d.(interface{ base() *BaseDatum })
+	if !ok {
+		return nil
+	}
+	s, _ := b.base().aux.Load().(auxState)
+	return s.v
+}
+
+// SetAux sets the auxiliary state a program keeps for datum d.
+func SetAux(d Datum, v interface{}) {
+	if b, ok := d.(interface{ base() *BaseDatum }); ok {
+		b.base().aux.Store(auxState{v})
+	}
+}
+
+// Expirer is implemented by the auxiliary state of a datum whose value
+// changes as time passes without updates, like the strings counted by
+// activeuniq() within a window of time.  Expire brings the value of d up to
+// date at the wall clock time now.
+type Expirer interface {
+	Expire(d Datum, now time.Time)
+}
+
+func (d *BaseDatum) base() *BaseDatum {
+	return d
 }
 
 var zeroTime time.Time
 
+// versions counts the changes made to all datums, so that the version of a
+// datum orders its last change against those of every other datum.
+var versions uint64
+
 func (d *BaseDatum) stamp(timestamp time.Time) {
 	if timestamp.IsZero() {
 		atomic.StoreInt64(&d.Time, time.Now().UTC().UnixNano())
 	} else {
 		atomic.StoreInt64(&d.Time, timestamp.UnixNano())
 	}
+	atomic.StoreUint64(&d.version, atomic.AddUint64(&versions, 1))
+}
+
+// Version returns the version of the last change to this Datum.  A datum
+// changed after another has a greater version.
+func (d *BaseDatum) Version() uint64 {
+	return atomic.LoadUint64(&d.version)
+}
+
+// CurrentVersion returns the version of the last change to any datum.  Every
+// datum changed after it is called has a greater version.
+func CurrentVersion() uint64 {
+	return atomic.LoadUint64(&versions)
 }
 
 // TimeString returns the timestamp of this Datum as a string.
@@ -51,6 +112,25 @@ func (d *BaseDatum) TimeUTC() time.Time {
 	return time.Unix(tNsec/1e9, tNsec%1e9)
 }
 
+// MarshalJSONRFC3339Nano returns a JSON encoding of d like its MarshalJSON,
+// but with the timestamp encoded as an RFC3339 string with nanoseconds
+// instead of as nanoseconds since the Unix epoch.
+func MarshalJSONRFC3339Nano(d Datum) ([]byte, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	fields["Time"], err = json.Marshal(d.TimeUTC().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
 // NewInt creates a new zero integer datum.
 func NewInt() Datum {
 	return MakeInt(0, zeroTime)
@@ -112,6 +192,20 @@ func MakeBuckets(buckets []Range, ts time.Time) Datum {
 	return d
 }
 
+// NumericValue returns the value of d as a float64, if d has a numeric value.
+// Histograms are represented by their sum.
+func NumericValue(d Datum) (float64, bool) {
+	switch d := d.(type) {
+	case *Int:
+		return float64(d.Get()), true
+	case *Float:
+		return d.Get(), true
+	case *Buckets:
+		return d.GetSum(), true
+	}
+	return 0, false
+}
+
 // GetInt returns the integer value of a datum, or error.
 func GetInt(d Datum) int64 {
 	switch d := d.(type) {
@@ -235,6 +329,47 @@ func GetBucketsSum(d Datum) float64 {
 	}
 }
 
+// GetBucketsQuantile returns an estimate of the q-quantile of observations
+// in d, or panics if d is not a BucketsDatum.
+func GetBucketsQuantile(d Datum, q float64) float64 {
+	switch d := d.(type) {
+	case *Buckets:
+		return d.Quantile(q)
+	default:
+		panic(fmt.Sprintf("datum %v is not a Buckets", d))
+	}
+}
+
+// GetBucketsRank returns an estimate of the fraction of observations in d
+// that are less than or equal to v, or panics if d is not a BucketsDatum.
+func GetBucketsRank(d Datum, v float64) float64 {
+	switch d := d.(type) {
+	case *Buckets:
+		return d.Rank(v)
+	default:
+		panic(fmt.Sprintf("datum %v is not a Buckets", d))
+	}
+}
+
+// GetBucketsExemplarsByMax returns a map of the exemplars of the buckets that
+// have one by their upper bounds, or panics if d is not a BucketsDatum.
+func GetBucketsExemplarsByMax(d Datum) map[float64]Exemplar {
+	switch d := d.(type) {
+	case *Buckets:
+		d.RLock()
+		defer d.RUnlock()
+		exemplars := make(map[float64]Exemplar)
+		for _, b := range d.Buckets {
+			if b.Exemplar != nil {
+				exemplars[b.Range.Max] = *b.Exemplar
+			}
+		}
+		return exemplars
+	default:
+		panic(fmt.Sprintf("datum %v is not a Buckets", d))
+	}
+}
+
 // GetBucketsCumByMax returns a map of cumulative bucket observations by their
 // upper bonds, or panics if d is not a BucketsDatum.
 func GetBucketsCumByMax(d Datum) map[float64]uint64 {
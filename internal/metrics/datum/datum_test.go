@@ -58,3 +58,19 @@ func TestMarshalJSON(t *testing.T) {
 		testutil.ExpectNoDiff(t, tc.expected, string(b))
 	}
 }
+
+func TestAux(t *testing.T) {
+	d := MakeInt(1, time.Unix(0, 0))
+	if a := Aux(d); a != nil {
+		t.Errorf("expected no state, got %v", a)
+	}
+	SetAux(d, 2.5)
+	if a := Aux(d); a != 2.5 {
+		t.Errorf("got %v, expected 2.5", a)
+	}
+	// State of a different type replaces it.
+	SetAux(d, "x")
+	if a := Aux(d); a != "x" {
+		t.Errorf("got %v, expected x", a)
+	}
+}
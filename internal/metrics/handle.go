@@ -0,0 +1,120 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// CounterHandle updates a counter metric in a Store, for programs that embed
+// mtail and record their own metrics alongside those of mtail programs.  It
+// is safe for concurrent use.
+type CounterHandle struct {
+	m *Metric
+}
+
+// GaugeHandle updates a gauge metric in a Store.  It is safe for concurrent
+// use.
+type GaugeHandle struct {
+	m *Metric
+}
+
+// Counter returns a handle to the counter named name from the program prog.
+// It is an error if there is no such metric, or if it is not a counter.
+func (s *Store) Counter(name, prog string) (*CounterHandle, error) {
+	m, err := s.findNumericMetric(name, prog, Counter)
+	if err != nil {
+		return nil, err
+	}
+	return &CounterHandle{m}, nil
+}
+
+// Gauge returns a handle to the gauge named name from the program prog.  It
+// is an error if there is no such metric, or if it is not a gauge.
+func (s *Store) Gauge(name, prog string) (*GaugeHandle, error) {
+	m, err := s.findNumericMetric(name, prog, Gauge)
+	if err != nil {
+		return nil, err
+	}
+	return &GaugeHandle{m}, nil
+}
+
+// findNumericMetric returns the metric named name from the program prog if
+// it is of the given kind and has an Int or Float type.
+func (s *Store) findNumericMetric(name, prog string, kind Kind) (*Metric, error) {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil {
+		return nil, errors.Errorf("No metric %q from program %q", name, prog)
+	}
+	if m.Kind != kind {
+		return nil, errors.Errorf("Metric %q is a %s, not a %s", name, m.Kind, kind)
+	}
+	if m.Type != Int && m.Type != Float {
+		return nil, errors.Errorf("Metric %q has non-numeric type %s", name, m.Type)
+	}
+	return m, nil
+}
+
+// Metric returns the metric updated by the handle.
+func (h *CounterHandle) Metric() *Metric {
+	return h.m
+}
+
+// Inc adds one to the counter with the given label values.
+func (h *CounterHandle) Inc(labels ...string) error {
+	return h.m.increment(1, labels...)
+}
+
+// Add adds delta to the counter with the given label values.  A counter can't
+// be decreased, so delta must not be negative.
+func (h *CounterHandle) Add(delta float64, labels ...string) error {
+	if delta < 0 {
+		return errors.Errorf("Can't decrease counter %q by %g", h.m.Name, -delta)
+	}
+	return h.m.increment(delta, labels...)
+}
+
+// Metric returns the metric updated by the handle.
+func (h *GaugeHandle) Metric() *Metric {
+	return h.m
+}
+
+// Set sets the gauge with the given label values to v.
+func (h *GaugeHandle) Set(v float64, labels ...string) error {
+	if h.m.Type == Int && v != math.Trunc(v) {
+		return errors.Errorf("Can't set Int metric %q to %g", h.m.Name, v)
+	}
+	d, err := h.m.GetDatum(labels...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	switch h.m.Type {
+	case Int:
+		datum.SetInt(d, int64(v), now)
+	case Float:
+		datum.SetFloat(d, v, now)
+	}
+	return nil
+}
+
+// Add adds delta, which may be negative, to the gauge with the given label
+// values.
+func (h *GaugeHandle) Add(delta float64, labels ...string) error {
+	return h.m.increment(delta, labels...)
+}
+
+// Inc adds one to the gauge with the given label values.
+func (h *GaugeHandle) Inc(labels ...string) error {
+	return h.m.increment(1, labels...)
+}
+
+// Dec subtracts one from the gauge with the given label values.
+func (h *GaugeHandle) Dec(labels ...string) error {
+	return h.m.increment(-1, labels...)
+}
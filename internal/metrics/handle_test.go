@@ -0,0 +1,143 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestCounterHandle(t *testing.T) {
+	s := NewStore()
+	testutil.FatalIfErr(t, s.Add(NewMetric("requests", "prog", Counter, Int, "code")))
+	testutil.FatalIfErr(t, s.Add(NewMetric("bytes", "prog", Counter, Float)))
+
+	requests, err := s.Counter("requests", "prog")
+	testutil.FatalIfErr(t, err)
+	bytes, err := s.Counter("bytes", "prog")
+	testutil.FatalIfErr(t, err)
+
+	const workers, incs = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incs; j++ {
+				if err := requests.Inc("200"); err != nil {
+					t.Error(err)
+				}
+				if err := bytes.Add(0.5); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	testutil.FatalIfErr(t, requests.Add(3, "500"))
+
+	d, err := requests.Metric().GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != workers*incs {
+		t.Errorf("requests{200}: got %d, expected %d", got, workers*incs)
+	}
+	d, err = requests.Metric().GetDatum("500")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 3 {
+		t.Errorf("requests{500}: got %d, expected 3", got)
+	}
+	d, err = bytes.Metric().GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetFloat(d); got != workers*incs*0.5 {
+		t.Errorf("bytes: got %g, expected %g", got, workers*incs*0.5)
+	}
+
+	if err := requests.Add(-1, "200"); err == nil {
+		t.Error("expected error decreasing a counter")
+	}
+	if err := requests.Add(0.5, "200"); err == nil {
+		t.Error("expected error adding a fraction to an Int counter")
+	}
+	if err := requests.Inc(); err == nil {
+		t.Error("expected error for missing label values")
+	}
+}
+
+func TestGaugeHandle(t *testing.T) {
+	s := NewStore()
+	testutil.FatalIfErr(t, s.Add(NewMetric("connections", "prog", Gauge, Int, "server")))
+	testutil.FatalIfErr(t, s.Add(NewMetric("temperature", "prog", Gauge, Float)))
+
+	connections, err := s.Gauge("connections", "prog")
+	testutil.FatalIfErr(t, err)
+	temperature, err := s.Gauge("temperature", "prog")
+	testutil.FatalIfErr(t, err)
+
+	testutil.FatalIfErr(t, connections.Set(10, "a"))
+	const workers, incs = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < incs; j++ {
+				var err error
+				if i%2 == 0 {
+					err = connections.Inc("a")
+				} else {
+					err = connections.Dec("a")
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				if err := temperature.Add(0.25); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	d, err := connections.Metric().GetDatum("a")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 10 {
+		t.Errorf("connections{a}: got %d, expected 10", got)
+	}
+	d, err = temperature.Metric().GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetFloat(d); got != workers*incs*0.25 {
+		t.Errorf("temperature: got %g, expected %g", got, workers*incs*0.25)
+	}
+
+	testutil.FatalIfErr(t, temperature.Set(-3.5))
+	testutil.FatalIfErr(t, temperature.Add(-1))
+	if got := datum.GetFloat(d); got != -4.5 {
+		t.Errorf("temperature: got %g, expected -4.5", got)
+	}
+	if err := connections.Set(1.5, "a"); err == nil {
+		t.Error("expected error setting an Int gauge to a fraction")
+	}
+}
+
+func TestHandleLookupErrors(t *testing.T) {
+	s := NewStore()
+	testutil.FatalIfErr(t, s.Add(NewMetric("requests", "prog", Counter, Int)))
+	testutil.FatalIfErr(t, s.Add(NewMetric("version", "prog", Gauge, String)))
+
+	if _, err := s.Counter("missing", "prog"); err == nil {
+		t.Error("expected error for missing counter")
+	}
+	if _, err := s.Counter("requests", "other"); err == nil {
+		t.Error("expected error for counter from another program")
+	}
+	if _, err := s.Gauge("requests", "prog"); err == nil {
+		t.Error("expected error for gauge handle to a counter")
+	}
+	if _, err := s.Gauge("version", "prog"); err == nil {
+		t.Error("expected error for gauge handle to a string metric")
+	}
+}
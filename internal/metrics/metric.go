@@ -89,7 +89,13 @@ type Metric struct {
 	Keys        []string      `json:",omitempty"`
 	LabelValues []*LabelValue `json:",omitempty"`
 	Source      string        `json:",omitempty"`
+	Help        string        `json:",omitempty"` // If set, describes the metric in exported metadata.
 	Buckets     []datum.Range `json:",omitempty"`
+	Cumulative  bool          `json:",omitempty"` // If set, assigned values are raw counts that may reset.
+	Rollup      bool          `json:",omitempty"` // If set, increments are also totalled in the datum with all empty labels.
+	Max         *float64      `json:",omitempty"` // If set, values set above it are clamped to it.
+	// Expiry is the default Expiry given to new LabelValues.
+	Expiry time.Duration `json:",omitempty"`
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -125,14 +131,23 @@ Loop:
 // GetDatum returns the datum named by a sequence of string label values from a
 // Metric.  If the sequence of label values does not yet exist, it is created.
 func (m *Metric) GetDatum(labelvalues ...string) (d datum.Datum, err error) {
+	d, _, err = m.CreateDatum(labelvalues...)
+	return d, err
+}
+
+// CreateDatum returns the datum named by a sequence of string label values
+// from a Metric like GetDatum, and whether it was created by this call.  The
+// lookup and creation are done under one lock, so only one caller creates it.
+func (m *Metric) CreateDatum(labelvalues ...string) (d datum.Datum, created bool, err error) {
 	if len(labelvalues) != len(m.Keys) {
-		return nil, errors.Errorf("Label values requested (%q) not same length as keys for metric %v", labelvalues, m)
+		return nil, false, errors.Errorf("Label values requested (%q) not same length as keys for metric %v", labelvalues, m)
 	}
 	m.Lock()
 	defer m.Unlock()
 	if lv := m.FindLabelValueOrNil(labelvalues); lv != nil {
 		d = lv.Value
 	} else {
+		created = true
 		switch m.Type {
 		case Int:
 			d = datum.NewInt()
@@ -147,9 +162,9 @@ func (m *Metric) GetDatum(labelvalues ...string) (d datum.Datum, err error) {
 			}
 			d = datum.NewBuckets(buckets)
 		}
-		m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labelvalues, Value: d})
+		m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labelvalues, Value: d, Expiry: m.Expiry})
 	}
-	return d, nil
+	return d, created, nil
 }
 
 // RemoveDatum removes the Datum described by labelvalues from the Metric m.
@@ -253,6 +268,28 @@ func (m *Metric) String() string {
 	return fmt.Sprintf("Metric: name=%s program=%s kind=%v type=%s hidden=%v keys=%v labelvalues=%v source=%s buckets=%v", m.Name, m.Program, m.Kind, m.Type, m.Hidden, m.Keys, m.LabelValues, m.Source, m.Buckets)
 }
 
+// Version returns the greatest version of the datums of the metric, which is
+// that of its last change, or zero if it has no datums.
+func (m *Metric) Version() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	var v uint64
+	for _, lv := range m.LabelValues {
+		if dv := lv.Value.Version(); dv > v {
+			v = dv
+		}
+	}
+	return v
+}
+
+// SetHelp sets the help text of a metric, which replaces the source as the
+// description of the metric when exported.
+func (m *Metric) SetHelp(help string) {
+	m.Lock()
+	defer m.Unlock()
+	m.Help = help
+}
+
 // SetSource sets the source of a metric, describing where in user programmes it was defined.
 func (m *Metric) SetSource(source string) {
 	m.Lock()
@@ -142,6 +142,35 @@ func TestFindLabelValueOrNil(t *testing.T) {
 	}
 }
 
+func TestCreateDatumConcurrent(t *testing.T) {
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, c, err := m.CreateDatum("1")
+			if err != nil {
+				t.Error(err)
+			}
+			if c {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("datum created %d times, expected 1", created)
+	}
+	if len(m.LabelValues) != 1 {
+		t.Errorf("unexpected label values: %v", m.LabelValues)
+	}
+}
+
 func timeGenerator(rand *rand.Rand) time.Time {
 	months := []time.Month{
 		time.January, time.February, time.March,
@@ -191,7 +220,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 			return false
 		}
 
-		return testutil.ExpectNoDiff(t, m, r, testutil.IgnoreUnexported(sync.RWMutex{}))
+		return testutil.ExpectNoDiff(t, m, r, testutil.IgnoreUnexported(sync.RWMutex{}, datum.BaseDatum{}))
 	}
 	if err := quick.Check(f, nil); err != nil {
 		t.Error(err)
@@ -201,7 +230,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 func TestTimer(t *testing.T) {
 	m := NewMetric("test", "prog", Timer, Int)
 	n := NewMetric("test", "prog", Timer, Int)
-	testutil.ExpectNoDiff(t, m, n, testutil.IgnoreUnexported(sync.RWMutex{}))
+	testutil.ExpectNoDiff(t, m, n, testutil.IgnoreUnexported(sync.RWMutex{}, datum.BaseDatum{}))
 	d, _ := m.GetDatum()
 	datum.IncIntBy(d, 1, time.Now().UTC())
 	lv := m.FindLabelValueOrNil([]string{})
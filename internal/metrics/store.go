@@ -7,11 +7,16 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/pkg/errors"
 )
 
@@ -20,6 +25,17 @@ type Store struct {
 	searchMu sync.RWMutex // read for iterate and insert, write for delete
 	insertMu sync.Mutex   // locked for insert and delete, unlocked for iterate
 	Metrics  map[string][]*Metric
+
+	removedMu        sync.Mutex          // guards the following fields
+	removed          []RemovedLabelValue // LabelValues removed by Gc and not yet taken
+	removedRetention time.Duration       // How long removed LabelValues are remembered; zero if they are not.
+}
+
+// RemovedLabelValue describes a LabelValue removed from a Metric by Gc.
+type RemovedLabelValue struct {
+	Metric *Metric
+	Labels []string
+	Time   time.Time // When the LabelValue was removed.
 }
 
 // NewStore returns a new metric Store.
@@ -61,8 +77,10 @@ func (s *Store) Add(m *Metric) error {
 			glog.V(2).Infof("v keys: %v m.keys: %v", v.Keys, m.Keys)
 			// If a set of label keys has changed, discard
 			// old metric completely, w/o even copying old
-			// data, as they are now incompatible.
-			if len(v.Keys) != len(m.Keys) || !reflect.DeepEqual(v.Keys, m.Keys) {
+			// data, as they are now incompatible.  The same keys in a
+			// different order are compatible, with the labels reordered.
+			perm, ok := keyPermutation(v.Keys, m.Keys)
+			if !ok {
 				break
 			}
 			glog.V(2).Infof("v buckets: %v m.buckets: %v", v.Buckets, m.Buckets)
@@ -73,8 +91,12 @@ func (s *Store) Add(m *Metric) error {
 				glog.V(2).Infof("Labels: %d %s", j, oldLabel.Labels)
 				d, err := v.GetDatum(oldLabel.Labels...)
 				if err == nil {
-					if err = m.RemoveDatum(oldLabel.Labels...); err == nil {
-						m.LabelValues = append(m.LabelValues, &LabelValue{Labels: oldLabel.Labels, Value: d})
+					labels := make([]string, len(perm))
+					for k, p := range perm {
+						labels[k] = oldLabel.Labels[p]
+					}
+					if err = m.RemoveDatum(labels...); err == nil {
+						m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labels, Value: d})
 					}
 				}
 			}
@@ -92,6 +114,65 @@ func (s *Store) Add(m *Metric) error {
 	return nil
 }
 
+// AddWithReplace adds the metric to the store, replacing any metric with the
+// same name and program.  Unlike Add, the type and keys of the existing metric
+// are not checked, and none of its data is copied into the new metric.  The
+// kind must still match that of any metrics of the same name from other
+// programs.
+func (s *Store) AddWithReplace(m *Metric) error {
+	if m == nil {
+		return errors.New("no metric to add")
+	}
+	s.insertMu.Lock()
+	defer s.insertMu.Unlock()
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	glog.V(1).Infof("Replacing metric %v", m)
+	kept := s.Metrics[m.Name][:0:0]
+	for _, v := range s.Metrics[m.Name] {
+		if v.Program == m.Program {
+			continue
+		}
+		if v.Kind != m.Kind {
+			return errors.Errorf("Metric %s has different kind %v to existing %v.", m.Name, m.Kind, v.Kind)
+		}
+		kept = append(kept, v)
+	}
+	s.Metrics[m.Name] = append(kept, m)
+	return nil
+}
+
+// keyPermutation returns, for each key in to, the index of the same key in
+// from.  ok is false if from and to are not the same set of keys.
+func keyPermutation(from, to []string) (perm []int, ok bool) {
+	if len(from) != len(to) {
+		return nil, false
+	}
+	perm = make([]int, len(to))
+	for i := range to {
+		perm[i] = i
+	}
+	if reflect.DeepEqual(from, to) {
+		return perm, true
+	}
+	index := make(map[string]int, len(from))
+	for i, k := range from {
+		index[k] = i
+	}
+	if len(index) != len(from) {
+		return nil, false
+	}
+	for i, k := range to {
+		j, ok := index[k]
+		if !ok {
+			return nil, false
+		}
+		perm[i] = j
+		delete(index, k)
+	}
+	return perm, true
+}
+
 // FindMetricOrNil returns a metric in a store, or returns nil if not found.
 func (s *Store) FindMetricOrNil(name, prog string) *Metric {
 	s.searchMu.RLock()
@@ -109,6 +190,106 @@ func (s *Store) FindMetricOrNil(name, prog string) *Metric {
 	return nil
 }
 
+// SetExpiry sets the expiry duration of every LabelValue of the named metric,
+// and the default expiry for LabelValues created afterwards.  A duration of
+// zero disables expiry.
+func (s *Store) SetExpiry(name, prog string, d time.Duration) error {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil {
+		return errors.Errorf("No metric %q from program %q", name, prog)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.Expiry = d
+	for _, lv := range m.LabelValues {
+		lv.Expiry = d
+	}
+	return nil
+}
+
+// IncrementMetric adds delta to the datum with the given label values of the
+// named metric from the program prog, creating the datum if it does not yet
+// exist, as a program's `+=' would.  An Int datum can only be incremented by
+// a whole number.  If the metric is a rollup metric, its rollup datum is also
+// incremented.
+func (s *Store) IncrementMetric(name, prog string, delta float64, labels ...string) error {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil {
+		return errors.Errorf("No metric %q from program %q", name, prog)
+	}
+	return m.increment(delta, labels...)
+}
+
+// increment adds delta to the datum of m with the given label values, and to
+// its rollup datum if m is a rollup metric.
+func (m *Metric) increment(delta float64, labels ...string) error {
+	if m.Type != Int && m.Type != Float {
+		return errors.Errorf("Can't increment metric %q of type %s", m.Name, m.Type)
+	}
+	if m.Type == Int && delta != math.Trunc(delta) {
+		return errors.Errorf("Can't increment Int metric %q by %g", m.Name, delta)
+	}
+	ds := make([]datum.Datum, 0, 2)
+	d, err := m.GetDatum(labels...)
+	if err != nil {
+		return err
+	}
+	ds = append(ds, d)
+	if m.Rollup && strings.Join(labels, "") != "" {
+		// The rollup datum is the one with every label empty.
+		r, err := m.GetDatum(make([]string, len(labels))...)
+		if err != nil {
+			return err
+		}
+		ds = append(ds, r)
+	}
+	now := time.Now()
+	for _, d := range ds {
+		switch m.Type {
+		case Int:
+			datum.IncIntBy(d, int64(delta), now)
+		case Float:
+			// A Float datum has no atomic increment, so the metric lock
+			// serialises concurrent increments.
+			m.Lock()
+			datum.SetFloat(d, datum.GetFloat(d)+delta, now)
+			m.Unlock()
+		}
+	}
+	return nil
+}
+
+// RenameMetric renames the metric old from the program prog to new, keeping
+// all of its LabelValues and their datums.  It is an error if a metric named
+// new already exists.
+func (s *Store) RenameMetric(old, prog, new string) error {
+	if new == "" {
+		return errors.Errorf("Can't rename metric %q to an empty name", old)
+	}
+	s.insertMu.Lock()
+	defer s.insertMu.Unlock()
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	if len(s.Metrics[new]) > 0 {
+		return errors.Errorf("Metric %q already exists", new)
+	}
+	for i, m := range s.Metrics[old] {
+		if m.Program != prog {
+			continue
+		}
+		s.Metrics[old] = append(s.Metrics[old][:i], s.Metrics[old][i+1:]...)
+		if len(s.Metrics[old]) == 0 {
+			delete(s.Metrics, old)
+		}
+		m.Lock()
+		m.Name = new
+		m.Unlock()
+		s.Metrics[new] = append(s.Metrics[new], m)
+		return nil
+	}
+	return errors.Errorf("No metric %q from program %q", old, prog)
+}
+
 // ClearMetrics empties the store of all metrics.
 func (s *Store) ClearMetrics() {
 	s.insertMu.Lock()
@@ -129,6 +310,18 @@ func (s *Store) MarshalJSON() (b []byte, err error) {
 	return json.Marshal(ms)
 }
 
+// MarshalMetric returns a JSON byte string representing the named metric from
+// the program prog, or an error if the Store does not contain it.
+func (s *Store) MarshalMetric(name, prog string) ([]byte, error) {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil {
+		return nil, errors.Errorf("No metric %q from program %q", name, prog)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return json.Marshal(m)
+}
+
 // Range calls f sequentially for each Metric present in the store.
 // The Metric is not locked when f is called.
 // If f returns non nil error, Range stops the iteration.
@@ -146,27 +339,167 @@ func (s *Store) Range(f func(*Metric) error) error {
 	return nil
 }
 
+// MetricNames returns the names of the metrics in the store, in sorted order.
+// A name shared by metrics from several programs appears once.
+func (s *Store) MetricNames() []string {
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	s.Range(func(m *Metric) error {
+		if _, ok := seen[m.Name]; !ok {
+			seen[m.Name] = struct{}{}
+			names = append(names, m.Name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+// RangeSorted calls f sequentially for each Metric present in the store, in
+// order of Name and then Program, so that the order is the same between
+// calls.  The Metric is not locked when f is called.  If f returns non nil
+// error, RangeSorted stops the iteration.
+func (s *Store) RangeSorted(f func(*Metric) error) error {
+	s.searchMu.RLock()
+	ms := make([]*Metric, 0, len(s.Metrics))
+	for _, ml := range s.Metrics {
+		ms = append(ms, ml...)
+	}
+	s.searchMu.RUnlock()
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Name != ms[j].Name {
+			return ms[i].Name < ms[j].Name
+		}
+		return ms[i].Program < ms[j].Program
+	})
+	for _, m := range ms {
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RLockedRange calls f sequentially for each Metric present in the store,
+// holding the Metric's read lock for the duration of the call.  f must not
+// modify the Metric.  If f returns non nil error, RLockedRange stops the
+// iteration.
+func (s *Store) RLockedRange(f func(*Metric) error) error {
+	return s.Range(func(m *Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		return f(m)
+	})
+}
+
+// TrackRemoved makes Gc remember the LabelValues it removes, so that they can
+// be retrieved with TakeRemoved, for example to mark their series as stale.
+// Removed LabelValues that are not taken within the retention duration d are
+// forgotten.  A duration of zero stops tracking.
+func (s *Store) TrackRemoved(d time.Duration) {
+	s.removedMu.Lock()
+	defer s.removedMu.Unlock()
+	s.removedRetention = d
+	if d <= 0 {
+		s.removed = nil
+	}
+}
+
+// TakeRemoved returns the LabelValues removed by Gc since the last call, and
+// forgets them.
+func (s *Store) TakeRemoved() []RemovedLabelValue {
+	s.removedMu.Lock()
+	defer s.removedMu.Unlock()
+	removed := s.removed
+	s.removed = nil
+	return removed
+}
+
+// recordRemoved remembers that the LabelValue with the given labels was
+// removed from m at now, if removed LabelValues are being tracked, and forgets
+// those removed longer ago than the retention duration.
+func (s *Store) recordRemoved(m *Metric, labels []string, now time.Time) {
+	s.removedMu.Lock()
+	defer s.removedMu.Unlock()
+	if s.removedRetention <= 0 {
+		return
+	}
+	i := 0
+	for i < len(s.removed) && now.Sub(s.removed[i].Time) > s.removedRetention {
+		i++
+	}
+	s.removed = append(s.removed[i:], RemovedLabelValue{Metric: m, Labels: labels, Time: now})
+}
+
 // Gc iterates through the Store looking for metrics that have been marked
 // for expiry, and removing them if their expiration time has passed.
 func (s *Store) Gc() error {
 	glog.Info("Running Store.Expire()")
 	now := time.Now()
 	return s.Range(func(m *Metric) error {
+		// Collect the expired LabelValues first, as removing them modifies
+		// m.LabelValues.
+		expired := make([]*LabelValue, 0)
 		for _, lv := range m.LabelValues {
+			if e, ok := datum.Aux(lv.Value).(datum.Expirer); ok {
+				e.Expire(lv.Value, now)
+			}
 			if lv.Expiry <= 0 {
 				continue
 			}
 			if now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
-				err := m.RemoveDatum(lv.Labels...)
-				if err != nil {
-					return err
-				}
+				expired = append(expired, lv)
+			}
+		}
+		for _, lv := range expired {
+			err := m.RemoveDatum(lv.Labels...)
+			if err != nil {
+				return err
 			}
+			s.recordRemoved(m, lv.Labels, now)
 		}
 		return nil
 	})
 }
 
+// Prune removes the LabelValues of counters whose value is below threshold,
+// returning the number removed.  Other kinds of metric are not pruned.
+func (s *Store) Prune(threshold float64) (int, error) {
+	removed := 0
+	err := s.Range(func(m *Metric) error {
+		if m.Kind != Counter {
+			return nil
+		}
+		// Collect the low LabelValues first, as removing them modifies
+		// m.LabelValues.
+		m.RLock()
+		low := make([]*LabelValue, 0)
+		for _, lv := range m.LabelValues {
+			var v float64
+			switch d := lv.Value.(type) {
+			case *datum.Int:
+				v = float64(d.Get())
+			case *datum.Float:
+				v = d.Get()
+			default:
+				continue
+			}
+			if v < threshold {
+				low = append(low, lv)
+			}
+		}
+		m.RUnlock()
+		for _, lv := range low {
+			if err := m.RemoveDatum(lv.Labels...); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
 // StartGcLoop runs a permanent goroutine to expire metrics every duration.
 func (s *Store) StartGcLoop(ctx context.Context, duration time.Duration) {
 	if duration <= 0 {
@@ -205,3 +538,190 @@ func (s *Store) WriteMetrics(w io.Writer) error {
 	}
 	return nil
 }
+
+// WriteMetricsFiltered dumps the current state of the metrics in the store
+// whose names are in the allowlist in JSON format to the io.Writer, in the
+// same format as WriteMetrics.  An allowlist entry ending in `*' matches all
+// the metric names that start with the rest of the entry.
+func (s *Store) WriteMetricsFiltered(w io.Writer, allow []string) error {
+	s.searchMu.RLock()
+	ms := make(map[string][]*Metric)
+	for name, ml := range s.Metrics {
+		if nameAllowed(name, allow) {
+			ms[name] = ml
+		}
+	}
+	b, err := json.MarshalIndent(ms, "", "  ")
+	s.searchMu.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal metrics into json")
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return errors.Wrap(err, "failed to write metrics")
+	}
+	return nil
+}
+
+// nameAllowed returns true if the metric name matches an entry of the
+// allowlist, either exactly or by a prefix wildcard.
+func nameAllowed(name string, allow []string) bool {
+	for _, a := range allow {
+		if strings.HasSuffix(a, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(a, "*")) {
+				return true
+			}
+		} else if name == a {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelValueSnapshot is a copy of the labels and numeric value of a single
+// LabelValue, taken at the time it was read from the Store.
+type LabelValueSnapshot struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// TopN returns copies of the n label-values of the named metric with the
+// highest values, in descending order.  Non-numeric values are skipped.
+// Ties are returned in no particular order.
+func (s *Store) TopN(name, prog string, n int) []LabelValueSnapshot {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil || n <= 0 {
+		return nil
+	}
+	m.RLock()
+	r := make([]LabelValueSnapshot, 0, len(m.LabelValues))
+	for _, lv := range m.LabelValues {
+		v, ok := datum.NumericValue(lv.Value)
+		if !ok {
+			continue
+		}
+		r = append(r, LabelValueSnapshot{Labels: zip(m.Keys, lv.Labels), Value: v})
+	}
+	m.RUnlock()
+	sort.Slice(r, func(i, j int) bool { return r[i].Value > r[j].Value })
+	if len(r) > n {
+		r = r[:n]
+	}
+	return r
+}
+
+// Query returns copies of the label-values of the named metric whose labels
+// match all of the matchers, a map of label name to exact label value.  A
+// matcher on a label the metric does not have never matches.  Non-numeric
+// values are skipped.
+func (s *Store) Query(name, prog string, matchers map[string]string) []LabelValueSnapshot {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil {
+		return nil
+	}
+	m.RLock()
+	defer m.RUnlock()
+	var r []LabelValueSnapshot
+Loop:
+	for _, lv := range m.LabelValues {
+		labels := zip(m.Keys, lv.Labels)
+		for k, want := range matchers {
+			if got, ok := labels[k]; !ok || got != want {
+				continue Loop
+			}
+		}
+		v, ok := datum.NumericValue(lv.Value)
+		if !ok {
+			continue
+		}
+		r = append(r, LabelValueSnapshot{Labels: labels, Value: v})
+	}
+	return r
+}
+
+// SumByLabel returns the sum of the values of the named metric's
+// label-values, grouped by the value of the given label.  If the metric
+// doesn't have the label, all values are summed under the empty string.
+// Non-numeric values are skipped, and histograms count as their sum.
+func (s *Store) SumByLabel(name, prog, label string) map[string]float64 {
+	m := s.FindMetricOrNil(name, prog)
+	if m == nil {
+		return nil
+	}
+	m.RLock()
+	defer m.RUnlock()
+	i := -1
+	for j, k := range m.Keys {
+		if k == label {
+			i = j
+			break
+		}
+	}
+	r := make(map[string]float64)
+	for _, lv := range m.LabelValues {
+		v, ok := datum.NumericValue(lv.Value)
+		if !ok {
+			continue
+		}
+		group := ""
+		if i >= 0 && i < len(lv.Labels) {
+			group = lv.Labels[i]
+		}
+		r[group] += v
+	}
+	return r
+}
+
+// Approximate sizes in bytes of the parts of a Metric, for EstimateMemory.
+const (
+	metricSize     = int64(unsafe.Sizeof(Metric{}))
+	labelValueSize = int64(unsafe.Sizeof(LabelValue{}))
+	stringSize     = int64(unsafe.Sizeof(""))
+	pointerSize    = int64(unsafe.Sizeof(&LabelValue{}))
+	intSize        = int64(unsafe.Sizeof(datum.Int{}))
+	floatSize      = int64(unsafe.Sizeof(datum.Float{}))
+	stringDSize    = int64(unsafe.Sizeof(datum.String{}))
+	bucketsSize    = int64(unsafe.Sizeof(datum.Buckets{}))
+	bucketSize     = int64(unsafe.Sizeof(datum.BucketCount{}))
+)
+
+// EstimateMemory returns a rough estimate of the bytes used by the metrics in
+// the Store, counting the metrics, their keys, and the labels and datums of
+// each label-value.  It does not count allocator overhead or the Store's own
+// maps, so it is a lower bound useful for spotting growth rather than an
+// exact measure.
+func (s *Store) EstimateMemory() int64 {
+	var n int64
+	_ = s.Range(func(m *Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		n += metricSize + int64(len(m.Name)+len(m.Program)+len(m.Source)+len(m.Help))
+		for _, k := range m.Keys {
+			n += stringSize + int64(len(k))
+		}
+		for _, lv := range m.LabelValues {
+			n += pointerSize + labelValueSize
+			for _, l := range lv.Labels {
+				n += stringSize + int64(len(l))
+			}
+			n += datumSize(lv.Value)
+		}
+		return nil
+	})
+	return n
+}
+
+// datumSize returns the approximate size in bytes of the datum d.
+func datumSize(d datum.Datum) int64 {
+	switch d := d.(type) {
+	case *datum.Int:
+		return intSize
+	case *datum.Float:
+		return floatSize
+	case *datum.String:
+		return stringDSize + int64(len(d.Get()))
+	case *datum.Buckets:
+		return bucketsSize + int64(len(d.Buckets))*bucketSize
+	}
+	return 0
+}
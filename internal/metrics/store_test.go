@@ -4,6 +4,11 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -88,6 +93,101 @@ func TestAddMetricDifferentType(t *testing.T) {
 	}
 }
 
+func TestAddMetricReorderedKeys(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a", "b")
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("1", "2")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 12, time.Unix(1, 0))
+	d, err = m.GetDatum("3", "4")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 34, time.Unix(1, 0))
+
+	m1 := NewMetric("foo", "prog", Counter, Int, "b", "a")
+	testutil.FatalIfErr(t, s.Add(m1))
+	if len(s.Metrics["foo"]) != 1 {
+		t.Fatalf("should have 1 metric: %v", s.Metrics)
+	}
+	for _, tc := range []struct {
+		labels   []string
+		expected int64
+	}{
+		{[]string{"2", "1"}, 12},
+		{[]string{"4", "3"}, 34},
+	} {
+		lv := m1.FindLabelValueOrNil(tc.labels)
+		if lv == nil {
+			t.Errorf("%v: no label value carried over: %v", tc.labels, m1.LabelValues)
+			continue
+		}
+		if v := datum.GetInt(lv.Value); v != tc.expected {
+			t.Errorf("%v: unexpected value %d, expected %d", tc.labels, v, tc.expected)
+		}
+	}
+	if len(m1.LabelValues) != 2 {
+		t.Errorf("unexpected label values: %v", m1.LabelValues)
+	}
+
+	// A different set of keys discards the old data.
+	m2 := NewMetric("foo", "prog", Counter, Int, "b", "c")
+	testutil.FatalIfErr(t, s.Add(m2))
+	if len(m2.LabelValues) != 0 {
+		t.Errorf("unexpected label values carried over: %v", m2.LabelValues)
+	}
+}
+
+func TestAddWithReplace(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a", "b")
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("1", "2")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 12, time.Unix(1, 0))
+	other := NewMetric("foo", "other", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(other))
+
+	// Replacing with reordered keys doesn't carry over the data as Add does.
+	m1 := NewMetric("foo", "prog", Counter, Int, "b", "a")
+	testutil.FatalIfErr(t, s.AddWithReplace(m1))
+	if len(s.Metrics["foo"]) != 2 {
+		t.Fatalf("should have 2 metrics: %v", s.Metrics)
+	}
+	if got := s.FindMetricOrNil("foo", "prog"); got != m1 {
+		t.Errorf("replacement not found, got %v", got)
+	}
+	if got := s.FindMetricOrNil("foo", "other"); got != other {
+		t.Errorf("metric of other program replaced, got %v", got)
+	}
+	if len(m1.LabelValues) != 0 {
+		t.Errorf("unexpected label values carried over: %v", m1.LabelValues)
+	}
+
+	// A different kind fails while another program has the name.
+	if err := s.AddWithReplace(NewMetric("foo", "prog", Gauge, Int)); err == nil {
+		t.Error("expected error replacing with a different kind")
+	}
+	if got := s.FindMetricOrNil("foo", "prog"); got != m1 {
+		t.Errorf("metric replaced despite error, got %v", got)
+	}
+
+	// Redeclaring with a different type and kind replaces the metric.
+	testutil.FatalIfErr(t, s.AddWithReplace(NewMetric("baz", "prog", Counter, Int)))
+	m2 := NewMetric("baz", "prog", Gauge, Float)
+	testutil.FatalIfErr(t, s.AddWithReplace(m2))
+	if len(s.Metrics["baz"]) != 1 || s.Metrics["baz"][0] != m2 {
+		t.Errorf("should have only the replacement: %v", s.Metrics["baz"])
+	}
+
+	testutil.FatalIfErr(t, s.AddWithReplace(NewMetric("bar", "prog", Counter, Int)))
+	if len(s.Metrics["bar"]) != 1 {
+		t.Errorf("should have 1 metric: %v", s.Metrics["bar"])
+	}
+	if err := s.AddWithReplace(nil); err == nil {
+		t.Error("expected error adding nil metric")
+	}
+}
+
 func TestExpireMetric(t *testing.T) {
 	s := NewStore()
 	m := NewMetric("foo", "prog", Counter, Int, "a", "b", "c")
@@ -124,3 +224,463 @@ func TestExpireMetric(t *testing.T) {
 		t.Logf("Store: %#v", s)
 	}
 }
+
+func TestSetExpiry(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("old")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now().Add(-time.Hour))
+
+	if err := s.SetExpiry("bar", "prog", time.Minute); err == nil {
+		t.Error("expected error setting expiry on unknown metric")
+	}
+	testutil.FatalIfErr(t, s.SetExpiry("foo", "prog", 10*time.Minute))
+
+	// Created after SetExpiry, so inherits the new default.
+	d, err = m.GetDatum("new")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now().Add(-time.Hour))
+	// Recently updated, so should survive.
+	d, err = m.GetDatum("recent")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now().Add(-time.Minute))
+
+	testutil.FatalIfErr(t, s.Gc())
+	for _, tc := range []struct {
+		label   string
+		expired bool
+	}{
+		{"old", true},
+		{"new", true},
+		{"recent", false},
+	} {
+		lv := m.FindLabelValueOrNil([]string{tc.label})
+		if tc.expired && lv != nil {
+			t.Errorf("%s: lv not expired: %#v", tc.label, lv)
+		}
+		if !tc.expired && lv == nil {
+			t.Errorf("%s: lv expired", tc.label)
+		}
+	}
+}
+
+func TestMarshalMetric(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("1")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 37, time.Unix(0, 0))
+	testutil.FatalIfErr(t, s.Add(NewMetric("bar", "prog", Counter, Int)))
+
+	b, err := s.MarshalMetric("foo", "prog")
+	testutil.FatalIfErr(t, err)
+	expected := `{"Name":"foo","Program":"prog","Kind":1,"Type":0,"Keys":["a"],"LabelValues":[{"Labels":["1"],"Value":{"Value":37,"Time":0}}]}`
+	testutil.ExpectNoDiff(t, expected, string(b))
+
+	if _, err := s.MarshalMetric("foo", "otherprog"); err == nil {
+		t.Error("expected error marshaling metric from another program")
+	}
+	if _, err := s.MarshalMetric("baz", "prog"); err == nil {
+		t.Error("expected error marshaling unknown metric")
+	}
+}
+
+func TestWriteMetricsFiltered(t *testing.T) {
+	s := NewStore()
+	for _, name := range []string{"http_requests_total", "http_errors_total", "httpd_restarts", "bytes_total"} {
+		testutil.FatalIfErr(t, s.Add(NewMetric(name, "prog", Counter, Int)))
+	}
+	var b bytes.Buffer
+	testutil.FatalIfErr(t, s.WriteMetricsFiltered(&b, []string{"http_*", "bytes_total", "missing"}))
+
+	var ms map[string]json.RawMessage
+	testutil.FatalIfErr(t, json.Unmarshal(b.Bytes(), &ms))
+	names := make([]string, 0, len(ms))
+	for name := range ms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	testutil.ExpectNoDiff(t, []string{"bytes_total", "http_errors_total", "http_requests_total"}, names)
+
+	b.Reset()
+	testutil.FatalIfErr(t, s.WriteMetricsFiltered(&b, nil))
+	testutil.ExpectNoDiff(t, "{}", b.String())
+}
+
+func TestIncrementMetric(t *testing.T) {
+	s := NewStore()
+	c := NewMetric("requests", "prog", Counter, Int, "code")
+	c.Rollup = true
+	testutil.FatalIfErr(t, s.Add(c))
+	f := NewMetric("bytes", "prog", Counter, Float)
+	testutil.FatalIfErr(t, s.Add(f))
+	testutil.FatalIfErr(t, s.Add(NewMetric("version", "prog", Text, String)))
+
+	testutil.FatalIfErr(t, s.IncrementMetric("requests", "prog", 1, "200"))
+	testutil.FatalIfErr(t, s.IncrementMetric("requests", "prog", 2, "200"))
+	testutil.FatalIfErr(t, s.IncrementMetric("requests", "prog", 1, "500"))
+	testutil.FatalIfErr(t, s.IncrementMetric("bytes", "prog", 1.5))
+	testutil.FatalIfErr(t, s.IncrementMetric("bytes", "prog", 0.25))
+
+	for _, tc := range []struct {
+		labels   []string
+		expected int64
+	}{{[]string{"200"}, 3}, {[]string{"500"}, 1}, {[]string{""}, 4}} {
+		d, err := c.GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if datum.GetInt(d) != tc.expected {
+			t.Errorf("requests%v: got %d, expected %d", tc.labels, datum.GetInt(d), tc.expected)
+		}
+	}
+	d, err := f.GetDatum()
+	testutil.FatalIfErr(t, err)
+	if datum.GetFloat(d) != 1.75 {
+		t.Errorf("bytes: got %g, expected 1.75", datum.GetFloat(d))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		delta  float64
+		labels []string
+	}{
+		{"missing", 1, nil},
+		{"requests", 0.5, []string{"200"}},
+		{"requests", 1, nil},
+		{"version", 1, nil},
+	} {
+		if err := s.IncrementMetric(tc.name, "prog", tc.delta, tc.labels...); err == nil {
+			t.Errorf("%s %g %v: expected error", tc.name, tc.delta, tc.labels)
+		}
+	}
+}
+
+func TestRLockedRangeConcurrentMutation(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			d, err := m.GetDatum(fmt.Sprintf("%d", i%10))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			datum.IncIntBy(d, 1, time.Now())
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		err := s.RLockedRange(func(m *Metric) error {
+			for _, lv := range m.LabelValues {
+				_ = lv.Value.ValueString()
+			}
+			return nil
+		})
+		testutil.FatalIfErr(t, err)
+	}
+	wg.Wait()
+
+	count := 0
+	testutil.FatalIfErr(t, s.RLockedRange(func(m *Metric) error {
+		count += len(m.LabelValues)
+		return nil
+	}))
+	if count != 10 {
+		t.Errorf("expected 10 label values, got %d", count)
+	}
+}
+
+func TestRenameMetric(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("requests", "prog", Counter, Int, "code")
+	d, err := m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, time.Unix(0, 0))
+	testutil.FatalIfErr(t, s.Add(m))
+	other := NewMetric("requests", "other", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(other))
+	testutil.FatalIfErr(t, s.Add(NewMetric("errors", "prog", Counter, Int)))
+
+	testutil.FatalIfErr(t, s.RenameMetric("requests", "prog", "http_requests"))
+	r := s.FindMetricOrNil("http_requests", "prog")
+	if r == nil {
+		t.Fatal("renamed metric not found")
+	}
+	if r.Name != "http_requests" {
+		t.Errorf("unexpected name %q", r.Name)
+	}
+	d, err = r.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	if datum.GetInt(d) != 3 {
+		t.Errorf("got %d, expected 3", datum.GetInt(d))
+	}
+	if s.FindMetricOrNil("requests", "prog") != nil {
+		t.Error("metric still found under its old name")
+	}
+	if s.FindMetricOrNil("requests", "other") != other {
+		t.Error("metric of the same name from another program was renamed")
+	}
+
+	for _, tc := range []struct {
+		old, prog, new string
+	}{
+		{"missing", "prog", "foo"},
+		{"requests", "prog", "foo"},
+		{"requests", "other", "errors"},
+		{"requests", "other", ""},
+	} {
+		if err := s.RenameMetric(tc.old, tc.prog, tc.new); err == nil {
+			t.Errorf("RenameMetric(%q, %q, %q): expected error", tc.old, tc.prog, tc.new)
+		}
+	}
+}
+
+func TestRangeSorted(t *testing.T) {
+	metrics := []*Metric{
+		NewMetric("foo", "b", Counter, Int),
+		NewMetric("bar", "a", Counter, Int),
+		NewMetric("foo", "a", Counter, Int),
+		NewMetric("baz", "c", Gauge, Int),
+	}
+	expected := []string{"bar/a", "baz/c", "foo/a", "foo/b"}
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		s := NewStore()
+		for _, i := range order {
+			testutil.FatalIfErr(t, s.Add(metrics[i]))
+		}
+		for n := 0; n < 2; n++ {
+			var got []string
+			testutil.FatalIfErr(t, s.RangeSorted(func(m *Metric) error {
+				got = append(got, m.Name+"/"+m.Program)
+				return nil
+			}))
+			testutil.ExpectNoDiff(t, expected, got)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	f := NewMetric("bar", "prog", Counter, Float, "a")
+	testutil.FatalIfErr(t, s.Add(f))
+	g := NewMetric("baz", "prog", Gauge, Int, "a")
+	testutil.FatalIfErr(t, s.Add(g))
+	ts := time.Now()
+	for label, v := range map[string]int64{"1": 1, "2": 2, "5": 5, "10": 10} {
+		d, err := m.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, v, ts)
+		d, err = g.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, v, ts)
+	}
+	for label, v := range map[string]float64{"0.5": 0.5, "4.5": 4.5, "7.5": 7.5} {
+		d, err := f.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		datum.SetFloat(d, v, ts)
+	}
+
+	n, err := s.Prune(5)
+	testutil.FatalIfErr(t, err)
+	if n != 4 {
+		t.Errorf("expected 4 label values pruned, got %d", n)
+	}
+	labels := func(m *Metric) []string {
+		r := []string{}
+		for _, lv := range m.LabelValues {
+			r = append(r, lv.Labels[0])
+		}
+		return r
+	}
+	sortStrings := testutil.SortSlices(func(a, b string) bool { return a < b })
+	testutil.ExpectNoDiff(t, []string{"10", "5"}, labels(m), sortStrings)
+	testutil.ExpectNoDiff(t, []string{"7.5"}, labels(f), sortStrings)
+	testutil.ExpectNoDiff(t, []string{"1", "10", "2", "5"}, labels(g), sortStrings)
+}
+
+func TestTopN(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "code")
+	testutil.FatalIfErr(t, s.Add(m))
+	for code, v := range map[string]int64{"200": 37, "301": 2, "404": 12, "500": 5, "503": 1} {
+		d, err := m.GetDatum(code)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, v, time.Now())
+	}
+
+	r := s.TopN("foo", "prog", 3)
+	expected := []LabelValueSnapshot{
+		{Labels: map[string]string{"code": "200"}, Value: 37},
+		{Labels: map[string]string{"code": "404"}, Value: 12},
+		{Labels: map[string]string{"code": "500"}, Value: 5},
+	}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	if r := s.TopN("foo", "prog", 10); len(r) != 5 {
+		t.Errorf("expected all 5 label values, got %d: %v", len(r), r)
+	}
+	if r := s.TopN("bar", "prog", 3); r != nil {
+		t.Errorf("expected nil for missing metric, got %v", r)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "method", "path")
+	testutil.FatalIfErr(t, s.Add(m))
+	for _, lv := range []struct {
+		method, path string
+		v            int64
+	}{
+		{"GET", "/x", 1},
+		{"POST", "/x", 2},
+		{"GET", "/y", 3},
+	} {
+		d, err := m.GetDatum(lv.method, lv.path)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, lv.v, time.Now())
+	}
+
+	byValue := testutil.SortSlices(func(a, b LabelValueSnapshot) bool { return a.Value < b.Value })
+	for _, tc := range []struct {
+		name     string
+		matchers map[string]string
+		expected []LabelValueSnapshot
+	}{
+		{"no matchers", nil, []LabelValueSnapshot{
+			{Labels: map[string]string{"method": "GET", "path": "/x"}, Value: 1},
+			{Labels: map[string]string{"method": "POST", "path": "/x"}, Value: 2},
+			{Labels: map[string]string{"method": "GET", "path": "/y"}, Value: 3},
+		}},
+		{"one matcher", map[string]string{"path": "/x"}, []LabelValueSnapshot{
+			{Labels: map[string]string{"method": "GET", "path": "/x"}, Value: 1},
+			{Labels: map[string]string{"method": "POST", "path": "/x"}, Value: 2},
+		}},
+		{"all matchers", map[string]string{"path": "/x", "method": "GET"}, []LabelValueSnapshot{
+			{Labels: map[string]string{"method": "GET", "path": "/x"}, Value: 1},
+		}},
+		{"no match", map[string]string{"path": "/z"}, nil},
+		{"missing label", map[string]string{"code": "200"}, nil},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.ExpectNoDiff(t, tc.expected, s.Query("foo", "prog", tc.matchers), byValue)
+		})
+	}
+	if r := s.Query("bar", "prog", nil); r != nil {
+		t.Errorf("expected nil for missing metric, got %v", r)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	s := NewStore()
+	empty := s.EstimateMemory()
+	if empty != 0 {
+		t.Errorf("expected empty store to use no memory, got %d", empty)
+	}
+	m := NewMetric("foo", "prog", Counter, Int, "path")
+	testutil.FatalIfErr(t, s.Add(m))
+	last := s.EstimateMemory()
+	if last <= empty {
+		t.Errorf("estimate did not grow after adding a metric: %d", last)
+	}
+	for _, path := range []string{"/a", "/b", "/a/much/longer/path"} {
+		_, err := m.GetDatum(path)
+		testutil.FatalIfErr(t, err)
+		n := s.EstimateMemory()
+		if n <= last {
+			t.Errorf("estimate did not grow after adding %q: %d <= %d", path, n, last)
+		}
+		last = n
+	}
+}
+
+func TestTrackRemoved(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Gauge, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	expire := func(label string) {
+		d, err := m.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, time.Now().Add(-time.Hour))
+		testutil.FatalIfErr(t, s.SetExpiry("foo", "prog", time.Minute))
+		testutil.FatalIfErr(t, s.Gc())
+	}
+
+	// Removals aren't remembered until tracking is enabled.
+	expire("untracked")
+	if r := s.TakeRemoved(); len(r) != 0 {
+		t.Errorf("expected no removed label values, got %v", r)
+	}
+
+	s.TrackRemoved(time.Hour)
+	expire("tracked")
+	r := s.TakeRemoved()
+	if len(r) != 1 || r[0].Metric != m {
+		t.Fatalf("expected one removed label value of foo, got %v", r)
+	}
+	testutil.ExpectNoDiff(t, []string{"tracked"}, r[0].Labels)
+	if r := s.TakeRemoved(); len(r) != 0 {
+		t.Errorf("expected removed label values to be taken once, got %v", r)
+	}
+
+	// Removals older than the retention are forgotten.
+	s.TrackRemoved(time.Nanosecond)
+	expire("first")
+	time.Sleep(time.Millisecond)
+	expire("second")
+	r = s.TakeRemoved()
+	if len(r) != 1 {
+		t.Fatalf("expected one removed label value, got %v", r)
+	}
+	testutil.ExpectNoDiff(t, []string{"second"}, r[0].Labels)
+}
+
+func TestMetricNames(t *testing.T) {
+	s := NewStore()
+	testutil.ExpectNoDiff(t, []string{}, s.MetricNames())
+	for _, m := range []*Metric{
+		NewMetric("requests", "web", Counter, Int),
+		NewMetric("errors", "web", Counter, Int),
+		NewMetric("requests", "api", Counter, Int),
+		NewMetric("bytes", "api", Counter, Int),
+		NewMetric("latency", "api", Histogram, Float),
+	} {
+		testutil.FatalIfErr(t, s.Add(m))
+	}
+	testutil.ExpectNoDiff(t, []string{"bytes", "errors", "latency", "requests"}, s.MetricNames())
+}
+
+func TestSumByLabel(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "method", "path")
+	testutil.FatalIfErr(t, s.Add(m))
+	for _, lv := range []struct {
+		method, path string
+		v            int64
+	}{
+		{"GET", "/x", 1},
+		{"POST", "/x", 2},
+		{"GET", "/y", 3},
+	} {
+		d, err := m.GetDatum(lv.method, lv.path)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, lv.v, time.Now())
+	}
+
+	testutil.ExpectNoDiff(t, map[string]float64{"GET": 4, "POST": 2}, s.SumByLabel("foo", "prog", "method"))
+	testutil.ExpectNoDiff(t, map[string]float64{"/x": 3, "/y": 3}, s.SumByLabel("foo", "prog", "path"))
+	// A label the metric doesn't have groups everything under "".
+	testutil.ExpectNoDiff(t, map[string]float64{"": 6}, s.SumByLabel("foo", "prog", "code"))
+	if r := s.SumByLabel("bar", "prog", "method"); r != nil {
+		t.Errorf("expected nil for a missing metric, got %v", r)
+	}
+}
@@ -5,6 +5,7 @@ package mtail_test
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
@@ -50,6 +51,30 @@ func TestBasicTail(t *testing.T) {
 	wg.Wait()
 }
 
+func TestBasicTailByteCount(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir := testutil.TestTempDir(t)
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath("../../examples/linecount.mtail"))
+	defer stopM()
+
+	logFile := filepath.Join(logDir, "log")
+
+	// Each line is counted with its newline.
+	lines := []string{"a", "bcd", "", "efghij"}
+	byteCountCheck := m.ExpectMapExpvarDeltaWithDeadline("log_bytes_total", logFile, 2+4+1+7)
+
+	f := testutil.TestOpenFile(t, logFile)
+	m.PollWatched(1) // Force sync to EOF
+
+	for _, line := range lines {
+		testutil.WriteString(t, f, line+"\n")
+	}
+	m.PollWatched(1) // Expect to read all lines here.
+
+	byteCountCheck()
+}
+
 func TestNewLogDoesNotMatchIsIgnored(t *testing.T) {
 	testutil.SkipIfShort(t)
 	workdir := testutil.TestTempDir(t)
@@ -71,3 +96,25 @@ func TestNewLogDoesNotMatchIsIgnored(t *testing.T) {
 
 	logCountCheck()
 }
+
+func TestBasicTailTCP(t *testing.T) {
+	testutil.SkipIfShort(t)
+	// Find a free port to listen on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	addr := l.Addr().String()
+	testutil.FatalIfErr(t, l.Close())
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.TCPListenAddresses(addr), mtail.ProgramPath("../../examples/linecount.mtail"))
+	defer stopM()
+
+	lineCountCheck := m.ExpectProgMetricDeltaWithDeadline("lines_total", "linecount.mtail", 3)
+
+	c, err := net.Dial("tcp", addr)
+	testutil.FatalIfErr(t, err)
+	_, err = c.Write([]byte("1\n2\n3\n"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.Close())
+
+	lineCountCheck()
+}
@@ -117,7 +117,7 @@ func TestExamplePrograms(t *testing.T) {
 				return nil
 			})
 
-			testutil.ExpectNoDiff(t, goldenStore, storeList, testutil.SortSlices(metrics.MetricsLess), testutil.IgnoreUnexported(metrics.Metric{}, sync.RWMutex{}, datum.String{}))
+			testutil.ExpectNoDiff(t, goldenStore, storeList, testutil.SortSlices(metrics.MetricsLess), testutil.IgnoreUnexported(metrics.Metric{}, sync.RWMutex{}, datum.String{}, datum.BaseDatum{}))
 		})
 	}
 }
@@ -250,7 +250,7 @@ func TestFilePipeStreamComparison(t *testing.T) {
 			})
 
 			// Ignore the datum.Time field as well, as the results will be unstable otherwise.
-			testutil.ExpectNoDiff(t, fileMetrics, pipeMetrics, testutil.SortSlices(metrics.MetricsLess), testutil.IgnoreUnexported(metrics.Metric{}, sync.RWMutex{}, datum.String{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time"))
+			testutil.ExpectNoDiff(t, fileMetrics, pipeMetrics, testutil.SortSlices(metrics.MetricsLess), testutil.IgnoreUnexported(metrics.Metric{}, sync.RWMutex{}, datum.String{}, datum.BaseDatum{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time"))
 		})
 	}
 }
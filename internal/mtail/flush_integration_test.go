@@ -0,0 +1,73 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+// lockedBuffer is a bytes.Buffer that is safe to write to and read from
+// concurrently.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func TestFlushInOneShotMode(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir := testutil.TestTempDir(t)
+
+	progPath := filepath.Join(workdir, "batch.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(progPath, []byte(`counter batches_total
+/^end of batch$/ {
+  batches_total++
+  flush()
+}
+`), 0644))
+	logPath := filepath.Join(workdir, "log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logPath, []byte("a\nb\nend of batch\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waker, _ := waker.NewTest(ctx, 0) // oneshot means we should never need to wake the stream
+	var out lockedBuffer
+	m, err := mtail.New(ctx, metrics.NewStore(), mtail.ProgramPath(progPath), mtail.LogPathPatterns(logPath), mtail.OneShot, mtail.FlushOutput(&out), mtail.LogPatternPollWaker(waker), mtail.LogstreamPollWaker(waker))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, m.Run())
+
+	// The Server never writes to the flush output at shutdown, so anything
+	// written there came from the program's flush().
+	check := func() (bool, error) {
+		return strings.Contains(out.String(), `"Name": "batches_total"`), nil
+	}
+	ok, err := testutil.DoOrTimeout(check, 10*time.Second, 10*time.Millisecond)
+	testutil.FatalIfErr(t, err)
+	if !ok {
+		t.Errorf("metrics not written after flush, output: %q", out.String())
+	}
+}
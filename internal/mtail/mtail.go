@@ -6,6 +6,7 @@ package mtail
 import (
 	"context"
 	"expvar"
+	"io"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -14,7 +15,9 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/geoip"
 	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/lookup"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/tailer"
 	"github.com/google/mtail/internal/vm"
@@ -44,6 +47,9 @@ type Server struct {
 	buildInfo          BuildInfo // go build information
 	programPath        string    // path to programs to load
 	logPathPatterns    []string  // list of patterns to watch for log files to tail
+	tcpListenAddresses []string  // list of addresses to accept connections sending log lines on
+	eventLogChannels   []string  // list of Windows Event Log channels to read events from
+	journal            bool      // if set, read log lines from the systemd journal
 	ignoreRegexPattern string
 
 	oneShot      bool // if set, mtail reads log files from the beginning, once, then exits
@@ -52,15 +58,40 @@ type Server struct {
 	dumpAstTypes bool // if set, mtail prints the program syntax tree after type checking
 	dumpBytecode bool // if set, mtail prints the program bytecode after code generation
 
-	overrideLocation     *time.Location // Timezone location to use when parsing timestamps
-	staleLogGcWaker      waker.Waker    // Wake to run stale log gc
-	logPatternPollWaker  waker.Waker    // Wake to poll for log patterns
-	logstreamPollWaker   waker.Waker    // Wake idle logstreams to poll sfor new data
-	metricPushInterval   time.Duration  // Interval between metric pushes
-	syslogUseCurrentYear bool           // if set, use the current year for timestamps that have no year information
-	omitMetricSource     bool           // if set, do not link the source program to a metric
-	omitProgLabel        bool           // if set, do not put the program name in the metric labels
-	emitMetricTimestamp  bool           // if set, emit the metric's recorded timestamp
+	overrideLocation       *time.Location // Timezone location to use when parsing timestamps
+	staleLogGcWaker        waker.Waker    // Wake to run stale log gc
+	logPatternPollWaker    waker.Waker    // Wake to poll for log patterns
+	logstreamPollWaker     waker.Waker    // Wake idle logstreams to poll sfor new data
+	metricPushInterval     time.Duration  // Interval between metric pushes
+	syslogUseCurrentYear   bool           // if set, use the current year for timestamps that have no year information
+	omitMetricSource       bool           // if set, do not link the source program to a metric
+	programPrefix          bool           // if set, prefix metric names with their program's name
+	omitProgLabel          bool           // if set, do not put the program name in the metric labels
+	sortLabels             bool           // if set, render exported labels in alphabetical order
+	openMetrics            bool           // if set, serve the OpenMetrics format to collectors that accept it
+	emitMetricTimestamp    bool           // if set, emit the metric's recorded timestamp
+	staleMarkers           bool           // if set, export a staleness marker for each expired series
+	jsonDeltaExport        bool           // if set, export only changed metrics to named JSON consumers
+	histogramQuantiles     []float64      // quantiles estimated from histograms for export
+	bucketOverflowCounters bool           // if set, count the observations above the largest bucket of each histogram
+	buildTags              []string       // tags selecting the `# +build' sections of programs
+	geoipDatabase          string         // path to the database used to look up IP address countries
+	lookupTables           string         // path to the file of tables used by lookup()
+	lineRateLimit          float64        // if positive, the lines per second delivered to programs from each log
+	lineRateLimitBurst     int            // the burst of lines allowed over the line rate limit
+	lineDeadline           time.Duration  // if positive, the longest a program may spend on one line
+	ruleTiming             bool           // if set, the time spent matching each rule's patterns is recorded
+	lineQueueLength        int            // if positive, the number of lines buffered for each program
+	maxLineLength          int            // if positive, the length in bytes beyond which lines are truncated
+	metricNameOld          string         // if not empty, replaced by metricNameNew in exported metric names
+	metricNameNew          string
+
+	jsonTimestampFormat exporter.JSONTimestampFormat // encoding of timestamps in the JSON export
+
+	reloaders []reloader // external data files used by programs, reloaded on SIGHUP
+
+	flushRequests chan struct{} // pending requests from programs to flush metrics
+	flushOutput   io.Writer     // in one-shot mode, flushed metrics are written here
 }
 
 // initLoader constructs a new program loader and performs the initial load of program files in the program directory.
@@ -89,9 +120,47 @@ func (m *Server) initLoader() error {
 	if m.omitMetricSource {
 		opts = append(opts, vm.OmitMetricSource())
 	}
+	if m.bucketOverflowCounters {
+		opts = append(opts, vm.BucketOverflowCounters())
+	}
+	if m.programPrefix {
+		opts = append(opts, vm.ProgramPrefix())
+	}
 	if m.overrideLocation != nil {
 		opts = append(opts, vm.OverrideLocation(m.overrideLocation))
 	}
+	if len(m.buildTags) > 0 {
+		opts = append(opts, vm.BuildTags(m.buildTags...))
+	}
+	if m.lineRateLimit > 0 {
+		opts = append(opts, vm.LineRateLimit(m.lineRateLimit, m.lineRateLimitBurst))
+	}
+	if m.lineDeadline > 0 {
+		opts = append(opts, vm.LineDeadline(m.lineDeadline))
+	}
+	if m.ruleTiming {
+		opts = append(opts, vm.RuleTiming())
+	}
+	if m.lineQueueLength > 0 {
+		opts = append(opts, vm.LineQueueLength(m.lineQueueLength))
+	}
+	if m.geoipDatabase != "" {
+		d := geoip.New(m.geoipDatabase)
+		opts = append(opts, vm.Countries(d))
+		m.reloaders = append(m.reloaders, d)
+	}
+	if m.lookupTables != "" {
+		t, err := lookup.Load(m.lookupTables)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, vm.Tables(t))
+		m.reloaders = append(m.reloaders, t)
+	}
+	opts = append(opts, vm.OnFlush(m.requestFlush))
+	if len(m.reloaders) > 0 {
+		opts = append(opts, vm.OnReload(m.ReloadData))
+	}
 	var err error
 	m.l, err = vm.NewLoader(m.lines, &m.wg, m.programPath, m.store, opts...)
 	if err != nil {
@@ -114,9 +183,27 @@ func (m *Server) initExporter() (err error) {
 	if m.emitMetricTimestamp {
 		opts = append(opts, exporter.EmitTimestamp())
 	}
+	if m.sortLabels {
+		opts = append(opts, exporter.SortLabels())
+	}
+	if m.staleMarkers {
+		opts = append(opts, exporter.StaleMarkers())
+	}
+	if m.jsonDeltaExport {
+		opts = append(opts, exporter.DeltaExport())
+	}
+	if m.jsonTimestampFormat != exporter.JSONTimestampUnixNano {
+		opts = append(opts, exporter.JSONTimestamps(m.jsonTimestampFormat))
+	}
+	if len(m.histogramQuantiles) > 0 {
+		opts = append(opts, exporter.HistogramQuantiles(m.histogramQuantiles...))
+	}
 	if m.metricPushInterval > 0 {
 		opts = append(opts, exporter.PushInterval(m.metricPushInterval))
 	}
+	if m.metricNameOld != "" {
+		opts = append(opts, exporter.MetricNameReplace(m.metricNameOld, m.metricNameNew))
+	}
 	m.e, err = exporter.New(m.ctx, &m.wg, m.store, opts...)
 	if err != nil {
 		return err
@@ -133,20 +220,90 @@ func (m *Server) initExporter() (err error) {
 
 // initTailer sets up and starts a Tailer for this Server.
 func (m *Server) initTailer() (err error) {
-	opts := []tailer.Option{
+	var opts []tailer.Option
+	// The line length limit must be set before any logs are opened.
+	if m.maxLineLength > 0 {
+		opts = append(opts, tailer.MaxLineLength(m.maxLineLength))
+	}
+	opts = append(opts,
 		tailer.IgnoreRegex(m.ignoreRegexPattern),
 		tailer.LogPatterns(m.logPathPatterns),
 		tailer.LogPatternPollWaker(m.logPatternPollWaker),
 		tailer.StaleLogGcWaker(m.staleLogGcWaker),
 		tailer.LogstreamPollWaker(m.logstreamPollWaker),
-	}
+		tailer.TCPListenAddresses(m.tcpListenAddresses),
+		tailer.EventLogChannels(m.eventLogChannels),
+	)
 	if m.oneShot {
 		opts = append(opts, tailer.OneShot)
 	}
+	if m.journal {
+		opts = append(opts, tailer.Journal)
+	}
 	m.t, err = tailer.New(m.ctx, &m.wg, m.lines, opts...)
 	return
 }
 
+// requestFlush asks for the metrics to be exported as soon as possible,
+// without waiting for the next push interval.  Requests made while one is
+// already pending are coalesced.
+func (m *Server) requestFlush() {
+	select {
+	case m.flushRequests <- struct{}{}:
+	default:
+	}
+}
+
+// startFlushLoop runs a goroutine that handles flush requests until the
+// Server's context is cancelled.
+func (m *Server) startFlushLoop() {
+	go func() {
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-m.flushRequests:
+				m.flush()
+			}
+		}
+	}()
+}
+
+// reloader is an external data file used by programs, which can be read
+// again while the programs run.
+type reloader interface {
+	Reload() error
+}
+
+// dataReloads counts the reloads of external data files on SIGHUP.
+var dataReloads = expvar.NewInt("data_reloads_total")
+
+// ReloadData reads the external data files used by programs again, such as
+// the GeoIP database and the lookup tables.  Each file is replaced in full
+// once it has been read, and a file that can't be read is left as it was.  It
+// is called by the loader on SIGHUP, before the programs are reloaded.
+func (m *Server) ReloadData() {
+	for _, r := range m.reloaders {
+		if err := r.Reload(); err != nil {
+			glog.Warningf("reload failed, keeping the previous data: %s", err)
+		}
+	}
+	dataReloads.Add(1)
+}
+
+// flush pushes the metrics to the exporter's push targets, or in one-shot
+// mode writes them to the flush output.
+func (m *Server) flush() {
+	if m.e != nil {
+		m.e.PushMetrics()
+	}
+	if m.oneShot && m.flushOutput != nil {
+		if err := m.store.WriteMetrics(m.flushOutput); err != nil {
+			glog.Info(err)
+		}
+	}
+}
+
 // initHttpServer begins the http server.
 func (m *Server) initHttpServer() error {
 	initDone := make(chan struct{})
@@ -161,9 +318,13 @@ func (m *Server) initHttpServer() error {
 	mux.HandleFunc("/favicon.ico", FaviconHandler)
 	mux.Handle("/", m)
 	mux.Handle("/progz", http.HandlerFunc(m.l.ProgzHandler))
+	mux.Handle("/eval", http.HandlerFunc(m.l.EvalHandler))
+	mux.Handle("/progz/pause", http.HandlerFunc(m.l.PauseHandler))
+	mux.Handle("/progz/reload", http.HandlerFunc(m.l.ReloadHandler))
 	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
-	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	mux.Handle("/metrics", m.e.PrometheusHandler(m.reg, promhttp.HandlerOpts{EnableOpenMetrics: m.openMetrics}))
 	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
+	mux.HandleFunc("/check", http.HandlerFunc(m.e.HandleCheck))
 	mux.Handle("/debug/vars", expvar.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -227,20 +388,26 @@ func New(ctx context.Context, store *metrics.Store, options ...Option) (*Server,
 		// Using a non-pedantic registry means we can be looser with metrics that
 		// are not fully specified at startup.
 		reg: prometheus.NewRegistry(),
+
+		flushRequests: make(chan struct{}, 1),
 	}
 
 	// TODO(jaq): Should these move to initExporter?
 	expvarDescs := map[string]*prometheus.Desc{
 		// internal/tailer/file.go
-		"log_errors_total":    prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
-		"log_rotations_total": prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
-		"log_truncates_total": prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
-		"log_lines_total":     prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_errors_total":          prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
+		"log_rotations_total":       prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
+		"log_truncates_total":       prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
+		"log_lines_total":           prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_bytes_total":           prometheus.NewDesc("log_bytes_total", "number of bytes read per log file", []string{"logfile"}, nil),
+		"max_line_bytes":            prometheus.NewDesc("max_line_bytes", "length in bytes of the longest line read per log file", []string{"file"}, nil),
+		"log_lines_truncated_total": prometheus.NewDesc("log_lines_truncated_total", "number of lines truncated to the maximum line length per log file", []string{"logfile"}, nil),
 		// internal/vm/loader.go
 		"lines_total":               prometheus.NewDesc("lines_total", "number of lines received by the program loader", nil, nil),
 		"prog_loads_total":          prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
 		"prog_load_errors_total":    prometheus.NewDesc("prog_load_errors_total", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
 		"prog_runtime_errors_total": prometheus.NewDesc("prog_runtime_errors_total", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"prog_line_timeouts_total":  prometheus.NewDesc("prog_line_timeouts_total", "number of lines abandoned for exceeding the line deadline per program source filename", []string{"prog"}, nil),
 	}
 	m.reg.MustRegister(
 		prometheus.NewGoCollector(),
@@ -254,6 +421,7 @@ func New(ctx context.Context, store *metrics.Store, options ...Option) (*Server,
 	if err := m.initExporter(); err != nil {
 		return nil, err
 	}
+	m.startFlushLoop()
 	if err := m.initLoader(); err != nil {
 		return nil, err
 	}
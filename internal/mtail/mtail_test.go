@@ -28,3 +28,18 @@ func TestBuildInfo(t *testing.T) {
 		t.Errorf("Unexpected build info string, want: %q, got: %q", buildInfoWant, buildInfoGot)
 	}
 }
+
+func TestLineQueueLength(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if err := LineQueueLength(n).apply(&Server{}); err == nil {
+			t.Errorf("LineQueueLength(%d): expected error", n)
+		}
+	}
+	m := &Server{}
+	if err := LineQueueLength(10).apply(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.lineQueueLength != 10 {
+		t.Errorf("unexpected line queue length %d", m.lineQueueLength)
+	}
+}
@@ -5,10 +5,12 @@ package mtail
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/jaeger"
+	"github.com/google/mtail/internal/exporter"
 	"github.com/google/mtail/internal/waker"
 	"go.opencensus.io/trace"
 )
@@ -38,6 +40,32 @@ func (opt logPathPatterns) apply(m *Server) error {
 	return nil
 }
 
+// TCPListenAddresses sets the addresses on which the Server accepts TCP
+// connections that send newline delimited log lines.
+func TCPListenAddresses(addresses ...string) Option {
+	return tcpListenAddresses(addresses)
+}
+
+type tcpListenAddresses []string
+
+func (opt tcpListenAddresses) apply(m *Server) error {
+	m.tcpListenAddresses = opt
+	return nil
+}
+
+// EventLogChannels sets the channels of the Windows Event Log that the Server
+// reads events from.
+func EventLogChannels(channels ...string) Option {
+	return eventLogChannels(channels)
+}
+
+type eventLogChannels []string
+
+func (opt eventLogChannels) apply(m *Server) error {
+	m.eventLogChannels = opt
+	return nil
+}
+
 // IgnoreRegexPattern sets the regex pattern to ignore files.
 type IgnoreRegexPattern string
 
@@ -141,6 +169,145 @@ func (opt logstreamPollWaker) apply(m *Server) error {
 	return nil
 }
 
+// FlushOutput sets the writer that the metric store is written to when a
+// program calls `flush()' in one-shot mode.
+func FlushOutput(w io.Writer) Option {
+	return &flushOutput{w}
+}
+
+type flushOutput struct {
+	io.Writer
+}
+
+func (opt flushOutput) apply(m *Server) error {
+	m.flushOutput = opt.Writer
+	return nil
+}
+
+// BuildTags sets the tags used to select the `# +build' sections of programs
+// in the Server.
+func BuildTags(tags ...string) Option {
+	return buildTags(tags)
+}
+
+type buildTags []string
+
+func (opt buildTags) apply(m *Server) error {
+	m.buildTags = opt
+	return nil
+}
+
+// GeoIPDatabase sets the path of the database the Server uses to look up the
+// country of IP addresses.  The database is loaded on first use.
+type GeoIPDatabase string
+
+func (opt GeoIPDatabase) apply(m *Server) error {
+	m.geoipDatabase = string(opt)
+	return nil
+}
+
+// LookupTables sets the path of the file of tables the Server uses for the
+// lookup() builtin.  The file is loaded at startup.
+type LookupTables string
+
+func (opt LookupTables) apply(m *Server) error {
+	m.lookupTables = string(opt)
+	return nil
+}
+
+// LineDeadline sets the longest time a program may spend processing one line
+// before abandoning it.
+type LineDeadline time.Duration
+
+func (opt LineDeadline) apply(m *Server) error {
+	m.lineDeadline = time.Duration(opt)
+	return nil
+}
+
+// LineQueueLength sets the number of lines buffered for each program before
+// the Server waits for the program to catch up.  It must be positive.
+type LineQueueLength int
+
+func (opt LineQueueLength) apply(m *Server) error {
+	if opt <= 0 {
+		return fmt.Errorf("line queue length must be positive, not %d", int(opt))
+	}
+	m.lineQueueLength = int(opt)
+	return nil
+}
+
+// MaxLineLength sets the length in bytes beyond which lines read from logs are
+// truncated before they are sent to the programs.
+type MaxLineLength int
+
+func (opt MaxLineLength) apply(m *Server) error {
+	m.maxLineLength = int(opt)
+	return nil
+}
+
+// LineRateLimit sets the Server to deliver at most rate lines per second from
+// each log to the programs, allowing bursts of up to burst lines.  Excess
+// lines are dropped.
+func LineRateLimit(rate float64, burst int) Option {
+	return lineRateLimit{rate, burst}
+}
+
+type lineRateLimit struct {
+	rate  float64
+	burst int
+}
+
+func (opt lineRateLimit) apply(m *Server) error {
+	m.lineRateLimit = opt.rate
+	m.lineRateLimitBurst = opt.burst
+	return nil
+}
+
+// HistogramQuantiles sets the Server to export estimates of the given
+// quantiles of each histogram.
+func HistogramQuantiles(quantiles ...float64) Option {
+	return histogramQuantiles(quantiles)
+}
+
+type histogramQuantiles []float64
+
+func (opt histogramQuantiles) apply(m *Server) error {
+	m.histogramQuantiles = opt
+	return nil
+}
+
+// MetricNameReplace sets the Server to replace every occurrence of old with
+// new in the names of exported metrics.
+func MetricNameReplace(old, new string) Option {
+	return &metricNameReplace{old, new}
+}
+
+type metricNameReplace struct {
+	old, new string
+}
+
+func (opt *metricNameReplace) apply(m *Server) error {
+	m.metricNameOld = opt.old
+	m.metricNameNew = opt.new
+	return nil
+}
+
+// JSONTimestampFormat sets the encoding of timestamps in the Server's JSON
+// export, either "unix" for nanoseconds since the epoch, or "rfc3339nano".
+type JSONTimestampFormat string
+
+func (opt JSONTimestampFormat) apply(m *Server) error {
+	switch opt {
+	case "", "unix":
+		m.jsonTimestampFormat = exporter.JSONTimestampUnixNano
+	case "rfc3339nano":
+		m.jsonTimestampFormat = exporter.JSONTimestampRFC3339Nano
+	default:
+		return fmt.Errorf("unknown JSON timestamp format %q", string(opt))
+	}
+	return nil
+}
+
 type niladicOption struct {
 	applyfunc func(m *Server) error
 }
@@ -156,6 +323,13 @@ var OneShot = &niladicOption{
 		return nil
 	}}
 
+// Journal sets the Server to read log lines from the systemd journal.
+var Journal = &niladicOption{
+	func(m *Server) error {
+		m.journal = true
+		return nil
+	}}
+
 // CompileOnly sets compile-only mode in the Server.
 var CompileOnly = &niladicOption{
 	func(m *Server) error {
@@ -205,6 +379,63 @@ var OmitMetricSource = &niladicOption{
 		return nil
 	}}
 
+// ProgramPrefix sets the Server to prefix the names of exported metrics with
+// the base name of the program file that defines them.
+var ProgramPrefix = &niladicOption{
+	func(m *Server) error {
+		m.programPrefix = true
+		return nil
+	}}
+
+// SortLabels sets the Server to render the labels of exported metrics in
+// alphabetical order.
+var SortLabels = &niladicOption{
+	func(m *Server) error {
+		m.sortLabels = true
+		return nil
+	}}
+
+// OpenMetrics sets the Server to serve the OpenMetrics format from /metrics
+// to collectors that ask for it, which includes the exemplars of histograms.
+var OpenMetrics = &niladicOption{
+	func(m *Server) error {
+		m.openMetrics = true
+		return nil
+	}}
+
+// PrometheusStaleMarkers sets the Server to export a staleness marker to
+// Prometheus for each series removed by metric expiry.  Only scrapes in the
+// protobuf exposition format get the markers.
+var PrometheusStaleMarkers = &niladicOption{
+	func(m *Server) error {
+		m.staleMarkers = true
+		return nil
+	}}
+
+// JSONDeltaExport sets the Server to export only the metrics changed since the
+// last export to each JSON consumer that names itself.
+var JSONDeltaExport = &niladicOption{
+	func(m *Server) error {
+		m.jsonDeltaExport = true
+		return nil
+	}}
+
+// RuleTiming sets the Server to record the time programs spend matching
+// regular expressions, by named rule.
+var RuleTiming = &niladicOption{
+	func(m *Server) error {
+		m.ruleTiming = true
+		return nil
+	}}
+
+// BucketOverflowCounters sets the Server to export a counter of the
+// observations above the largest bucket boundary of each histogram.
+var BucketOverflowCounters = &niladicOption{
+	func(m *Server) error {
+		m.bucketOverflowCounters = true
+		return nil
+	}}
+
 // EmitMetricTimestamp tells the Server to export the metric's timestamp.
 var EmitMetricTimestamp = &niladicOption{
 	func(m *Server) error {
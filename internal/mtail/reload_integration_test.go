@@ -0,0 +1,68 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail_test
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestReloadLookupTablesOnSighup(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir := testutil.TestTempDir(t)
+
+	progPath := filepath.Join(workdir, "reload.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(progPath, []byte(`text code
+/^(\S+)$/ {
+  code = lookup("codes", $1)
+}
+`), 0644))
+	tablesPath := filepath.Join(workdir, "tables.csv")
+	testutil.FatalIfErr(t, ioutil.WriteFile(tablesPath, []byte("codes,404,client_error\n"), 0644))
+
+	// Find a free port to listen on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	addr := l.Addr().String()
+	testutil.FatalIfErr(t, l.Close())
+
+	m, stopM := mtail.TestStartServer(t, 0, mtail.TCPListenAddresses(addr), mtail.ProgramPath(progPath), mtail.LookupTables(tablesPath))
+	defer stopM()
+
+	c, err := net.Dial("tcp", addr)
+	testutil.FatalIfErr(t, err)
+	defer c.Close()
+	expectCode := func(line, want string) {
+		t.Helper()
+		_, err := c.Write([]byte(line + "\n"))
+		testutil.FatalIfErr(t, err)
+		check := func() (bool, error) {
+			return datum.GetString(m.GetProgramMetric("code", "reload.mtail")) == want, nil
+		}
+		ok, err := testutil.DoOrTimeout(check, 10*time.Second, 10*time.Millisecond)
+		testutil.FatalIfErr(t, err)
+		if !ok {
+			t.Fatalf("after %q: expected code %q, got %q", line, want, datum.GetString(m.GetProgramMetric("code", "reload.mtail")))
+		}
+	}
+	expectCode("404", "client_error")
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(tablesPath, []byte("codes,404,not_found\n"), 0644))
+	reloadCheck := m.ExpectExpvarDeltaWithDeadline("data_reloads_total", 1)
+	testutil.FatalIfErr(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+	reloadCheck()
+
+	expectCode("404", "not_found")
+}
@@ -48,6 +48,8 @@ func TestMakeServer(tb testing.TB, wakers int, options ...Option) *TestServer {
 	expvar.Get("lines_total").(*expvar.Int).Set(0)
 	expvar.Get("log_count").(*expvar.Int).Set(0)
 	expvar.Get("log_lines_total").(*expvar.Map).Init()
+	expvar.Get("log_bytes_total").(*expvar.Map).Init()
+	expvar.Get("max_line_bytes").(*expvar.Map).Init()
 	expvar.Get("log_opens_total").(*expvar.Map).Init()
 	expvar.Get("log_closes_total").(*expvar.Map).Init()
 	expvar.Get("file_truncates_total").(*expvar.Map).Init()
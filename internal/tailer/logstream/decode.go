@@ -7,17 +7,41 @@ import (
 	"bytes"
 	"context"
 	"expvar"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
 )
 
-// logLines counts the number of lines read per log file
-var logLines = expvar.NewMap("log_lines_total")
+var (
+	// logLines counts the number of lines read per log file
+	logLines = expvar.NewMap("log_lines_total")
+	// logBytes counts the number of bytes read per log file, including newlines
+	logBytes = expvar.NewMap("log_bytes_total")
+	// maxLineBytes records the length of the longest line read per log file, excluding newlines
+	maxLineBytes   = expvar.NewMap("max_line_bytes")
+	maxLineBytesMu sync.Mutex // serialises updates to maxLineBytes
+	// logLinesTruncated counts the number of lines truncated to the maximum line length per log file
+	logLinesTruncated = expvar.NewMap("log_lines_truncated_total")
+)
+
+// lineBuffer holds the text of a partial line as it is decoded.  Lines longer
+// than max bytes are truncated to the last whole character within the limit.
+type lineBuffer struct {
+	bytes.Buffer
+	max     int // If positive, the length in bytes beyond which lines are truncated.
+	dropped int // The length of the text discarded past the limit from the current line.
+}
+
+// newLineBuffer creates a lineBuffer that truncates lines to max bytes.  A
+// max of zero or less leaves lines unlimited.
+func newLineBuffer(max int) *lineBuffer {
+	return &lineBuffer{max: max}
+}
 
 // decodeAndSend transforms the byte addary `b` into unicode in `partial`, sending to the llp as each newline is decoded.
-func decodeAndSend(ctx context.Context, lines chan<- *logline.LogLine, pathname string, n int, b []byte, partial *bytes.Buffer) {
+func decodeAndSend(ctx context.Context, lines chan<- *logline.LogLine, pathname string, n int, b []byte, partial *lineBuffer) {
 	var (
 		rune  rune
 		width int
@@ -26,6 +50,12 @@ func decodeAndSend(ctx context.Context, lines chan<- *logline.LogLine, pathname
 		rune, width = utf8.DecodeRune(b[i:])
 		switch {
 		case rune != '\n':
+			// Past the limit the rest of the line is only counted, so an
+			// overlong line doesn't grow the buffer without bound.
+			if partial.max > 0 && partial.Len() > partial.max {
+				partial.dropped += width
+				break
+			}
 			partial.WriteRune(rune)
 		default:
 			sendLine(ctx, pathname, partial, lines)
@@ -33,9 +63,38 @@ func decodeAndSend(ctx context.Context, lines chan<- *logline.LogLine, pathname
 	}
 }
 
-func sendLine(ctx context.Context, pathname string, partial *bytes.Buffer, lines chan<- *logline.LogLine) {
+func sendLine(ctx context.Context, pathname string, partial *lineBuffer, lines chan<- *logline.LogLine) {
 	glog.V(2).Infof("sendline")
+	length := partial.Len() + partial.dropped
 	logLines.Add(pathname, 1)
+	logBytes.Add(pathname, int64(length+1))
+	updateMaxLineBytes(pathname, int64(length))
+	if partial.max > 0 && partial.Len() > partial.max {
+		b := partial.Bytes()
+		n := partial.max
+		for n > 0 && !utf8.RuneStart(b[n]) {
+			n--
+		}
+		partial.Truncate(n)
+		logLinesTruncated.Add(pathname, 1)
+	}
 	lines <- logline.New(ctx, pathname, partial.String())
 	partial.Reset()
+	partial.dropped = 0
+}
+
+// updateMaxLineBytes records n as the longest line length for pathname if it
+// is longer than the current longest.
+func updateMaxLineBytes(pathname string, n int64) {
+	maxLineBytesMu.Lock()
+	defer maxLineBytesMu.Unlock()
+	if v, ok := maxLineBytes.Get(pathname).(*expvar.Int); ok {
+		if v.Value() < n {
+			v.Set(n)
+		}
+		return
+	}
+	v := new(expvar.Int)
+	v.Set(n)
+	maxLineBytes.Set(pathname, v)
 }
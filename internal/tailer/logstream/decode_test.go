@@ -0,0 +1,65 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"expvar"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestMaxLineBytes(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+	partial := newLineBuffer(0)
+	for _, tc := range []struct {
+		input    string
+		expected int64
+	}{
+		{"abc\n", 3},
+		{"a\n", 3},
+		{"abcdefgh\nab\n", 8},
+		{"abcdef\n", 8},
+		{"ab", 8},
+		{"cdefghij\n", 10}, // Completes a partial line.
+	} {
+		b := []byte(tc.input)
+		decodeAndSend(context.Background(), lines, "maxlinebytes.log", len(b), b, partial)
+		for len(lines) > 0 {
+			<-lines
+		}
+		got := maxLineBytes.Get("maxlinebytes.log").(*expvar.Int).Value()
+		if got != tc.expected {
+			t.Errorf("after %q: expected max_line_bytes %d, got %d", tc.input, tc.expected, got)
+		}
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+	partial := newLineBuffer(8)
+	// The overlong line arrives in two reads, and the second ends in a
+	// multibyte character that straddles the limit.
+	for _, input := range []string{"short\nabcdef", "ghijklmnop\n", "abcdefgé\n"} {
+		b := []byte(input)
+		decodeAndSend(context.Background(), lines, "maxlinelength.log", len(b), b, partial)
+	}
+	var got []string
+	for len(lines) > 0 {
+		got = append(got, (<-lines).Line)
+	}
+	testutil.ExpectNoDiff(t, []string{"short", "abcdefgh", "abcdefg"}, got)
+	if truncated := logLinesTruncated.Get("maxlinelength.log").(*expvar.Int).Value(); truncated != 2 {
+		t.Errorf("expected 2 truncated lines, got %d", truncated)
+	}
+	// The longest line is recorded at its length before truncation.
+	if max := maxLineBytes.Get("maxlinelength.log").(*expvar.Int).Value(); max != 16 {
+		t.Errorf("expected max_line_bytes 16, got %d", max)
+	}
+	if bytes := logBytes.Get("maxlinelength.log").(*expvar.Int).Value(); bytes != 33 {
+		t.Errorf("expected 33 bytes read, got %d", bytes)
+	}
+}
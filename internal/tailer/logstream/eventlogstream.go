@@ -0,0 +1,150 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+)
+
+// EventLogPrefix begins the names given to the lines read from a channel of
+// the Windows Event Log, which are followed by the channel name, like
+// `eventlog:Application'.
+const EventLogPrefix = "eventlog:"
+
+// eventRecord is an event read from a channel of the Windows Event Log.
+type eventRecord struct {
+	Message  string // The rendered message of the event, which may be empty.
+	EventID  uint32
+	Provider string // The name of the provider that logged the event.
+	Channel  string
+}
+
+// eventReader reads events from a channel of the Windows Event Log.
+type eventReader interface {
+	// Read returns the next event, waiting until one is logged.  After the
+	// reader is closed it returns io.EOF.
+	Read() (*eventRecord, error)
+	// Close ends a Read in progress, and may be called from any goroutine.
+	Close() error
+}
+
+// eventLogStream reads events from a channel of the Windows Event Log, and
+// sends each event's message as a log line.  The event ID, provider and
+// channel of the event are sent as the `event_id', `provider' and `channel'
+// fields of the line, in its context.
+type eventLogStream struct {
+	ctx   context.Context
+	lines chan<- *logline.LogLine
+
+	name string      // The name of the lines read
+	r    eventReader // The events of the channel
+
+	mu           sync.RWMutex // protects following fields
+	completed    bool         // This eventlogstream is completed and can no longer be used.
+	lastReadTime time.Time    // Last time an event was read
+
+	stopOnce sync.Once     // Ensure stopChan only closed once.
+	stopChan chan struct{} // Close to start graceful shutdown.
+}
+
+func newEventLogStream(ctx context.Context, wg *sync.WaitGroup, channel string, r eventReader, lines chan<- *logline.LogLine) *eventLogStream {
+	es := &eventLogStream{
+		ctx:          ctx,
+		lines:        lines,
+		name:         EventLogPrefix + channel,
+		r:            r,
+		lastReadTime: time.Now(),
+		stopChan:     make(chan struct{}),
+	}
+	es.stream(wg)
+	return es
+}
+
+// LastReadTime returns the current time while the stream is reading, as a
+// quiet channel is not stale.
+func (es *eventLogStream) LastReadTime() time.Time {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	if !es.completed {
+		return time.Now()
+	}
+	return es.lastReadTime
+}
+
+func (es *eventLogStream) stream(wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	// Close the reader on a stop or cancellation, to end the read loop.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-es.stopChan:
+		case <-es.ctx.Done():
+		case <-done:
+			return
+		}
+		if err := es.r.Close(); err != nil {
+			glog.V(2).Info(err)
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		logOpens.Add(es.name, 1)
+		es.read()
+		logCloses.Add(es.name, 1)
+		es.mu.Lock()
+		es.completed = true
+		es.mu.Unlock()
+	}()
+}
+
+// read sends the message of each event read until the reader is closed or
+// fails.
+func (es *eventLogStream) read() {
+	for {
+		rec, err := es.r.Read()
+		if err != nil {
+			if err != io.EOF {
+				glog.Infof("%s: %s", es.name, err)
+				logErrors.Add(es.name, 1)
+			}
+			return
+		}
+		es.mu.Lock()
+		es.lastReadTime = time.Now()
+		es.mu.Unlock()
+		msg := strings.TrimRight(rec.Message, "\r\n")
+		logBytes.Add(es.name, int64(len(msg)))
+		logLines.Add(es.name, 1)
+		updateMaxLineBytes(es.name, int64(len(msg)))
+		fields := map[string]string{
+			"event_id": strconv.FormatUint(uint64(rec.EventID), 10),
+			"provider": rec.Provider,
+			"channel":  rec.Channel,
+		}
+		es.lines <- logline.New(logline.WithFields(es.ctx, fields), es.name, msg)
+	}
+}
+
+func (es *eventLogStream) IsComplete() bool {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.completed
+}
+
+func (es *eventLogStream) Stop() {
+	es.stopOnce.Do(func() {
+		close(es.stopChan)
+	})
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package logstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// NewEventLogStream is not supported, as the Windows Event Log is only
+// available on Windows.
+func NewEventLogStream(ctx context.Context, wg *sync.WaitGroup, channel string, lines chan<- *logline.LogLine) (LogStream, error) {
+	return nil, errors.New("the Windows Event Log can only be read on Windows")
+}
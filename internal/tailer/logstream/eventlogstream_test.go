@@ -0,0 +1,103 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// stubEventReader returns the events sent on its channel, in place of a
+// subscription to the Windows Event Log.
+type stubEventReader struct {
+	events    chan *eventRecord
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStubEventReader() *stubEventReader {
+	return &stubEventReader{events: make(chan *eventRecord), closed: make(chan struct{})}
+}
+
+func (r *stubEventReader) Read() (*eventRecord, error) {
+	select {
+	case rec := <-r.events:
+		return rec, nil
+	case <-r.closed:
+		return nil, io.EOF
+	}
+}
+
+func (r *stubEventReader) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestEventLogStreamRead(t *testing.T) {
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := newStubEventReader()
+	es := newEventLogStream(ctx, &wg, "Application", r, lines)
+
+	go func() {
+		for _, rec := range []*eventRecord{
+			{Message: "The service entered the running state.\r\n", EventID: 7036, Provider: "Service Control Manager", Channel: "Application"},
+			// An event whose provider has no message resources.
+			{EventID: 1000, Provider: "Application Error", Channel: "Application"},
+		} {
+			r.events <- rec
+		}
+	}()
+
+	var received []*logline.LogLine
+	var fields []map[string]string
+	for i := 0; i < 2; i++ {
+		select {
+		case l := <-lines:
+			received = append(received, l)
+			fields = append(fields, logline.Fields(l.Context))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", received)
+		}
+	}
+	expected := []*logline.LogLine{
+		{nil, "eventlog:Application", "The service entered the running state."},
+		{nil, "eventlog:Application", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	expectedFields := []map[string]string{
+		{"event_id": "7036", "provider": "Service Control Manager", "channel": "Application"},
+		{"event_id": "1000", "provider": "Application Error", "channel": "Application"},
+	}
+	testutil.ExpectNoDiff(t, expectedFields, fields)
+
+	// Cancellation closes the reader, which completes the stream.
+	cancel()
+	wg.Wait()
+	if !es.IsComplete() {
+		t.Errorf("expecting eventlogstream to be complete because cancelled")
+	}
+}
+
+func TestEventLogStreamStop(t *testing.T) {
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	es := newEventLogStream(ctx, &wg, "System", newStubEventReader(), lines)
+	es.Stop()
+	wg.Wait()
+	if !es.IsComplete() {
+		t.Errorf("expecting eventlogstream to be complete because stopped")
+	}
+}
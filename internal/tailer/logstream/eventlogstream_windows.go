@@ -0,0 +1,257 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package logstream
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modwevtapi = windows.NewLazySystemDLL("wevtapi.dll")
+
+	procEvtSubscribe             = modwevtapi.NewProc("EvtSubscribe")
+	procEvtNext                  = modwevtapi.NewProc("EvtNext")
+	procEvtClose                 = modwevtapi.NewProc("EvtClose")
+	procEvtCreateRenderContext   = modwevtapi.NewProc("EvtCreateRenderContext")
+	procEvtRender                = modwevtapi.NewProc("EvtRender")
+	procEvtOpenPublisherMetadata = modwevtapi.NewProc("EvtOpenPublisherMetadata")
+	procEvtFormatMessage         = modwevtapi.NewProc("EvtFormatMessage")
+)
+
+// Constants from winevt.h.
+const (
+	evtSubscribeToFutureEvents = 1
+	evtRenderContextSystem     = 1
+	evtRenderEventValues       = 0
+	evtFormatMessageEvent      = 1
+
+	// Indexes of the system properties rendered in evtRenderContextSystem.
+	evtSystemProviderName = 0
+	evtSystemEventID      = 2
+	evtSystemPropertyEnd  = 18
+
+	evtVarTypeString = 1
+	evtVarTypeUInt16 = 6
+
+	// The size of an EVT_VARIANT, a union of 8 bytes followed by a count
+	// and type of 4 bytes each.
+	evtVariantSize = 16
+)
+
+// eventBatchSize is the largest number of events fetched from a subscription
+// at once.
+const eventBatchSize = 16
+
+// NewEventLogStream creates a LogStream that subscribes to new events in the
+// named channel of the Windows Event Log, like `Application' or `System',
+// and sends their messages to the `lines' channel.  The LogStream will watch
+// `ctx' for a cancellation signal, and notify the `wg' when it is Done.
+func NewEventLogStream(ctx context.Context, wg *sync.WaitGroup, channel string, lines chan<- *logline.LogLine) (LogStream, error) {
+	r, err := newWindowsEventReader(channel)
+	if err != nil {
+		logErrors.Add(EventLogPrefix+channel, 1)
+		return nil, err
+	}
+	return newEventLogStream(ctx, wg, channel, r, lines), nil
+}
+
+// windowsEventReader reads events from a subscription to a channel with the
+// wevtapi functions.
+type windowsEventReader struct {
+	channel    string
+	signal     windows.Handle     // Set by the subscription when there are new events.
+	sub        uintptr            // The subscription.
+	renderCtx  uintptr            // The context for rendering the system properties of events.
+	publishers map[string]uintptr // Metadata handles of providers by name, used to format messages; zero if unavailable.
+	pending    []*eventRecord     // Events fetched but not yet read.
+
+	mu       sync.Mutex     // protects following fields
+	quit     windows.Handle // Set by Close.
+	released bool           // The handles have been closed.
+}
+
+func newWindowsEventReader(channel string) (*windowsEventReader, error) {
+	if err := modwevtapi.Load(); err != nil {
+		return nil, err
+	}
+	path, err := windows.UTF16PtrFromString(channel)
+	if err != nil {
+		return nil, err
+	}
+	query, err := windows.UTF16PtrFromString("*")
+	if err != nil {
+		return nil, err
+	}
+	r := &windowsEventReader{channel: channel, publishers: make(map[string]uintptr)}
+	// The signal starts set, so that the first Read checks for events.
+	if r.signal, err = windows.CreateEvent(nil, 1, 1, nil); err != nil {
+		return nil, err
+	}
+	if r.quit, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		r.release()
+		return nil, err
+	}
+	r.sub, _, err = procEvtSubscribe.Call(0, uintptr(r.signal), uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(query)), 0, 0, 0, evtSubscribeToFutureEvents)
+	if r.sub == 0 {
+		r.release()
+		return nil, errors.Wrapf(err, "subscribing to %s", channel)
+	}
+	r.renderCtx, _, err = procEvtCreateRenderContext.Call(0, 0, evtRenderContextSystem)
+	if r.renderCtx == 0 {
+		r.release()
+		return nil, errors.Wrap(err, "creating render context")
+	}
+	return r, nil
+}
+
+// Read returns the next event, waiting for the subscription to signal new
+// events when there are none.  The handles are released when Read returns
+// io.EOF or an error.
+func (r *windowsEventReader) Read() (*eventRecord, error) {
+	for len(r.pending) == 0 {
+		var events [eventBatchSize]uintptr
+		var returned uint32
+		ret, _, err := procEvtNext.Call(r.sub, eventBatchSize, uintptr(unsafe.Pointer(&events[0])), 0, 0, uintptr(unsafe.Pointer(&returned)))
+		if ret == 0 {
+			if err != windows.ERROR_NO_MORE_ITEMS {
+				r.release()
+				return nil, errors.Wrapf(err, "reading %s", r.channel)
+			}
+			ev, err := windows.WaitForMultipleObjects([]windows.Handle{r.quit, r.signal}, false, windows.INFINITE)
+			if err != nil {
+				r.release()
+				return nil, err
+			}
+			if ev == windows.WAIT_OBJECT_0 {
+				r.release()
+				return nil, io.EOF
+			}
+			if err := windows.ResetEvent(r.signal); err != nil {
+				r.release()
+				return nil, err
+			}
+			continue
+		}
+		for _, event := range events[:returned] {
+			rec, err := r.render(event)
+			procEvtClose.Call(event)
+			if err != nil {
+				glog.V(1).Infof("%s%s: %s", EventLogPrefix, r.channel, err)
+				continue
+			}
+			r.pending = append(r.pending, rec)
+		}
+	}
+	rec := r.pending[0]
+	r.pending = r.pending[1:]
+	return rec, nil
+}
+
+// render returns the record of the event, with its provider and ID from its
+// system properties, and its message formatted by its provider.
+func (r *windowsEventReader) render(event uintptr) (*eventRecord, error) {
+	var used, count uint32
+	// The first call finds the size of the buffer needed.
+	procEvtRender.Call(r.renderCtx, event, evtRenderEventValues, 0, 0, uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&count)))
+	if used < evtSystemPropertyEnd*evtVariantSize {
+		used = evtSystemPropertyEnd * evtVariantSize
+	}
+	buf := make([]byte, used)
+	ret, _, err := procEvtRender.Call(r.renderCtx, event, evtRenderEventValues, uintptr(used), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&count)))
+	if ret == 0 {
+		return nil, errors.Wrap(err, "rendering event")
+	}
+	rec := &eventRecord{Channel: r.channel}
+	if count > evtSystemProviderName {
+		v := buf[evtSystemProviderName*evtVariantSize:]
+		if binary.LittleEndian.Uint32(v[12:]) == evtVarTypeString {
+			rec.Provider = windows.UTF16PtrToString(*(**uint16)(unsafe.Pointer(&v[0])))
+		}
+	}
+	if count > evtSystemEventID {
+		v := buf[evtSystemEventID*evtVariantSize:]
+		if binary.LittleEndian.Uint32(v[12:]) == evtVarTypeUInt16 {
+			rec.EventID = uint32(binary.LittleEndian.Uint16(v))
+		}
+	}
+	rec.Message = r.formatMessage(rec.Provider, event)
+	return rec, nil
+}
+
+// formatMessage returns the message of the event formatted from the message
+// resources of its provider, or the empty string if it can't be formatted.
+func (r *windowsEventReader) formatMessage(provider string, event uintptr) string {
+	pm, ok := r.publishers[provider]
+	if !ok {
+		if p, err := windows.UTF16PtrFromString(provider); err == nil {
+			pm, _, _ = procEvtOpenPublisherMetadata.Call(0, uintptr(unsafe.Pointer(p)), 0, 0, 0)
+		}
+		// A provider that can't be opened isn't tried again.
+		r.publishers[provider] = pm
+	}
+	if pm == 0 {
+		return ""
+	}
+	var used uint32
+	// The first call finds the size of the buffer needed, in characters.
+	procEvtFormatMessage.Call(pm, event, 0, 0, 0, evtFormatMessageEvent, 0, 0, uintptr(unsafe.Pointer(&used)))
+	if used == 0 {
+		return ""
+	}
+	buf := make([]uint16, used)
+	ret, _, _ := procEvtFormatMessage.Call(pm, event, 0, 0, 0, evtFormatMessageEvent, uintptr(used), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)))
+	if ret == 0 {
+		return ""
+	}
+	return windows.UTF16ToString(buf)
+}
+
+// Close sets the quit event, which ends a Read in progress.
+func (r *windowsEventReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.released {
+		return nil
+	}
+	return windows.SetEvent(r.quit)
+}
+
+// release closes the handles of the reader.
+func (r *windowsEventReader) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.released {
+		return
+	}
+	r.released = true
+	for _, pm := range r.publishers {
+		if pm != 0 {
+			procEvtClose.Call(pm)
+		}
+	}
+	if r.renderCtx != 0 {
+		procEvtClose.Call(r.renderCtx)
+	}
+	if r.sub != 0 {
+		procEvtClose.Call(r.sub)
+	}
+	if r.quit != 0 {
+		windows.CloseHandle(r.quit)
+	}
+	if r.signal != 0 {
+		windows.CloseHandle(r.signal)
+	}
+}
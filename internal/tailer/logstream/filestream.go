@@ -4,7 +4,6 @@
 package logstream
 
 import (
-	"bytes"
 	"context"
 	"expvar"
 	"io"
@@ -37,7 +36,8 @@ type fileStream struct {
 	ctx   context.Context
 	lines chan<- *logline.LogLine
 
-	pathname string // Given name for the underlying file on the filesystem
+	pathname      string // Given name for the underlying file on the filesystem
+	maxLineLength int    // If positive, the length in bytes beyond which lines are truncated
 
 	mu           sync.RWMutex // protects following fields.
 	lastReadTime time.Time    // Last time a log line was read from this file
@@ -47,9 +47,11 @@ type fileStream struct {
 	stopChan chan struct{} // Close to start graceful shutdown.
 }
 
-// newFileStream creates a new log stream from a regular file.
-func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool) (LogStream, error) {
-	fs := &fileStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+// newFileStream creates a new log stream from a regular file.  Lines from the
+// stream carry the pathname in their `filename' field.
+func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool, maxLineLength int) (LogStream, error) {
+	ctx = logline.WithFields(ctx, map[string]string{"filename": pathname})
+	fs := &fileStream{ctx: ctx, pathname: pathname, maxLineLength: maxLineLength, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
 	if err := fs.stream(ctx, wg, waker, fi, streamFromStart); err != nil {
 		return nil, err
 	}
@@ -82,7 +84,7 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 		glog.V(2).Infof("%v: seeked to end", fd)
 	}
 	b := make([]byte, defaultReadBufferSize)
-	partial := bytes.NewBufferString("")
+	partial := newLineBuffer(fs.maxLineLength)
 	started := make(chan struct{})
 	var total int
 	wg.Add(1)
@@ -27,7 +27,7 @@ func TestFileStreamRead(t *testing.T) {
 	lines := make(chan *logline.LogLine, 1)
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
-	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1)
 
@@ -42,6 +42,9 @@ func TestFileStreamRead(t *testing.T) {
 		{context.TODO(), name, "yo"},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	if got := logline.Fields(received[0].Context)["filename"]; got != name {
+		t.Errorf("filename field: got %q, expected %q", got, name)
+	}
 
 	if !fs.IsComplete() {
 		t.Errorf("expecting filestream to be complete because stopped")
@@ -63,7 +66,7 @@ func TestFileStreamRotation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
 
-	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1)
 
@@ -106,7 +109,7 @@ func TestFileStreamTruncation(t *testing.T) {
 	lines := make(chan *logline.LogLine, 3)
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
-	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1) // Synchronise past first read after seekToEnd
 
@@ -146,7 +149,7 @@ func TestFileStreamFinishedBecauseCancel(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
 
-	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1) // Synchronise past first read after seekToEnd
 
@@ -179,7 +182,7 @@ func TestFileStreamPartialRead(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
 
-	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1)
 
@@ -225,7 +228,7 @@ func TestFileStreamOpenFailure(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, _ := waker.NewTest(ctx, 0)
 
-	_, err = logstream.New(ctx, &wg, waker, name, lines, true)
+	_, err = logstream.New(ctx, &wg, waker, name, lines, true, 0)
 	if err == nil || !os.IsPermission(err) {
 		t.Errorf("Expected a permission denied error, got: %v", err)
 	}
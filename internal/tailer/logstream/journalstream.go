@@ -0,0 +1,257 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+)
+
+// JournalName is the name given to the lines read from the systemd journal.
+const JournalName = "journald"
+
+// maxJournalEntryBytes is the longest journal entry that can be read.
+const maxJournalEntryBytes = 1 << 20
+
+// journalStream reads entries from the systemd journal, as exported in JSON
+// by `journalctl --output=json', and sends each entry's MESSAGE as a log
+// line.  The other fields of the entry, such as _SYSTEMD_UNIT, are sent as
+// the fields of the line, in its context.
+type journalStream struct {
+	ctx   context.Context
+	lines chan<- *logline.LogLine
+
+	r    io.ReadCloser // The JSON entries, one per line
+	wait func() error  // Called after r is exhausted to wait for the reader to exit, if not nil
+	kill func()        // Called on stop or cancellation to end the reader, and after it exits, if not nil
+
+	mu           sync.RWMutex // protects following fields
+	completed    bool         // This journalstream is completed and can no longer be used.
+	lastReadTime time.Time    // Last time an entry was read from the journal
+
+	stopOnce sync.Once     // Ensure stopChan only closed once.
+	stopChan chan struct{} // Close to start graceful shutdown.
+}
+
+// NewJournalStream creates a LogStream that follows the systemd journal by
+// running journalctl, and sends the messages of new entries to the `lines'
+// channel.  The LogStream will watch `ctx' for a cancellation signal, and
+// notify the `wg' when it is Done.
+func NewJournalStream(ctx context.Context, wg *sync.WaitGroup, lines chan<- *logline.LogLine) (LogStream, error) {
+	return startJournalStream(ctx, wg, lines, "journalctl", "--follow", "--output=json", "--lines=0")
+}
+
+// startJournalStream runs the command name with args, and streams the journal
+// entries that it writes to its standard output.  The command is killed when
+// the stream is stopped, as an idle journalctl would otherwise not notice
+// that its output was closed until it next wrote an entry.
+func startJournalStream(ctx context.Context, wg *sync.WaitGroup, lines chan<- *logline.LogLine, name string, args ...string) (*journalStream, error) {
+	cmdCtx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(cmdCtx, name, args...)
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		logErrors.Add(JournalName, 1)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		logErrors.Add(JournalName, 1)
+		return nil, err
+	}
+	return newJournalStream(ctx, wg, r, cmd.Wait, cancel, lines), nil
+}
+
+func newJournalStream(ctx context.Context, wg *sync.WaitGroup, r io.ReadCloser, wait func() error, kill func(), lines chan<- *logline.LogLine) *journalStream {
+	js := &journalStream{
+		ctx:          ctx,
+		lines:        lines,
+		r:            r,
+		wait:         wait,
+		kill:         kill,
+		lastReadTime: time.Now(),
+		stopChan:     make(chan struct{}),
+	}
+	js.stream(wg)
+	return js
+}
+
+// LastReadTime returns the current time while the stream is reading, as a
+// quiet journal is not stale.
+func (js *journalStream) LastReadTime() time.Time {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if !js.completed {
+		return time.Now()
+	}
+	return js.lastReadTime
+}
+
+func (js *journalStream) stream(wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	// Close the reader and kill its process on a stop or cancellation, to
+	// end the read loop.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-js.stopChan:
+		case <-js.ctx.Done():
+		case <-done:
+			return
+		}
+		if err := js.r.Close(); err != nil {
+			glog.V(2).Info(err)
+		}
+		if js.kill != nil {
+			js.kill()
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		logOpens.Add(JournalName, 1)
+		js.read()
+		if js.wait != nil {
+			if err := js.wait(); err != nil {
+				select {
+				case <-js.stopChan:
+				case <-js.ctx.Done():
+				default:
+					glog.Info(err)
+					logErrors.Add(JournalName, 1)
+				}
+			}
+		}
+		if js.kill != nil {
+			js.kill()
+		}
+		logCloses.Add(JournalName, 1)
+		js.mu.Lock()
+		js.completed = true
+		js.mu.Unlock()
+	}()
+}
+
+// read sends the message of each journal entry read until the reader is
+// closed or exhausted.
+func (js *journalStream) read() {
+	s := bufio.NewScanner(js.r)
+	s.Buffer(make([]byte, defaultReadBufferSize), maxJournalEntryBytes)
+	for s.Scan() {
+		b := s.Bytes()
+		logBytes.Add(JournalName, int64(len(b)+1))
+		line, err := parseJournalEntry(js.ctx, b)
+		if err != nil {
+			glog.V(1).Infof("%s: %s", JournalName, err)
+			logErrors.Add(JournalName, 1)
+			continue
+		}
+		js.mu.Lock()
+		js.lastReadTime = time.Now()
+		js.mu.Unlock()
+		if line == nil {
+			continue
+		}
+		logLines.Add(JournalName, 1)
+		updateMaxLineBytes(JournalName, int64(len(line.Line)))
+		js.lines <- line
+	}
+	if err := s.Err(); err != nil {
+		select {
+		case <-js.stopChan:
+		case <-js.ctx.Done():
+		default:
+			glog.Info(err)
+			logErrors.Add(JournalName, 1)
+		}
+	}
+}
+
+// parseJournalEntry decodes a journal entry in journalctl's JSON export
+// format into a log line.  Field values are strings, or arrays of bytes for
+// values that are not valid UTF-8; fields with other values, such as null for
+// fields that were too large to export, are skipped.  An entry with no
+// MESSAGE returns a nil line.
+func parseJournalEntry(ctx context.Context, b []byte) (*logline.LogLine, error) {
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(entry))
+	for k, raw := range entry {
+		if string(raw) == "null" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			fields[k] = s
+			continue
+		}
+		var buf []byte
+		var ints []int
+		if err := json.Unmarshal(raw, &ints); err == nil {
+			for _, i := range ints {
+				buf = append(buf, byte(i))
+			}
+			fields[k] = string(buf)
+		}
+	}
+	msg, ok := fields["MESSAGE"]
+	if !ok {
+		return nil, nil
+	}
+	delete(fields, "MESSAGE")
+	addSyslogFields(fields)
+	return logline.New(logline.WithFields(ctx, fields), JournalName, msg), nil
+}
+
+// syslogSeverities are the names of the syslog severity levels, indexed by
+// their number.
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// syslogFacilities are the names of the syslog facilities, indexed by their
+// number.
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// addSyslogFields adds the `severity', `facility', and `unit' fields from the
+// numeric PRIORITY and SYSLOG_FACILITY fields and the _SYSTEMD_UNIT field of
+// a journal entry, so that programs can use the same names as for syslog.
+func addSyslogFields(fields map[string]string) {
+	if n, err := strconv.Atoi(fields["PRIORITY"]); err == nil && n >= 0 && n < len(syslogSeverities) {
+		fields["severity"] = syslogSeverities[n]
+	}
+	if n, err := strconv.Atoi(fields["SYSLOG_FACILITY"]); err == nil && n >= 0 && n < len(syslogFacilities) {
+		fields["facility"] = syslogFacilities[n]
+	}
+	if unit, ok := fields["_SYSTEMD_UNIT"]; ok {
+		fields["unit"] = unit
+	}
+}
+
+func (js *journalStream) IsComplete() bool {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.completed
+}
+
+func (js *journalStream) Stop() {
+	js.stopOnce.Do(func() {
+		close(js.stopChan)
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestJournalStreamRead(t *testing.T) {
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A stub journal, in place of journalctl's output.
+	r, w := io.Pipe()
+	js := newJournalStream(ctx, &wg, r, nil, nil, lines)
+
+	go func() {
+		for _, entry := range []string{
+			`{"MESSAGE":"started","_SYSTEMD_UNIT":"nginx.service","PRIORITY":"6","SYSLOG_FACILITY":"3"}`,
+			// An entry with no message is skipped.
+			`{"_SYSTEMD_UNIT":"nginx.service"}`,
+			// Values that aren't valid UTF-8 are arrays of bytes, and
+			// oversized values are null.
+			`{"MESSAGE":[104,105],"_SYSTEMD_UNIT":"sshd.service","_CMDLINE":null}`,
+			`not json`,
+		} {
+			if _, err := w.Write([]byte(entry + "\n")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var received []*logline.LogLine
+	var fields []map[string]string
+	for i := 0; i < 2; i++ {
+		select {
+		case l := <-lines:
+			received = append(received, l)
+			fields = append(fields, logline.Fields(l.Context))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", received)
+		}
+	}
+	expected := []*logline.LogLine{
+		{nil, JournalName, "started"},
+		{nil, JournalName, "hi"},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	expectedFields := []map[string]string{
+		{"_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "6", "SYSLOG_FACILITY": "3", "severity": "info", "facility": "daemon", "unit": "nginx.service"},
+		{"_SYSTEMD_UNIT": "sshd.service", "unit": "sshd.service"},
+	}
+	testutil.ExpectNoDiff(t, expectedFields, fields)
+
+	// The stream completes when the journal reader is exhausted.
+	wg.Wait()
+	if !js.IsComplete() {
+		t.Errorf("expecting journalstream to be complete because the journal ended")
+	}
+	cancel()
+}
+
+func TestJournalStreamStop(t *testing.T) {
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, _ := io.Pipe()
+	js := newJournalStream(ctx, &wg, r, nil, nil, lines)
+	js.Stop()
+	wg.Wait()
+	if !js.IsComplete() {
+		t.Errorf("expecting journalstream to be complete because stopped")
+	}
+}
+
+func TestJournalStreamStopIdleCommand(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found")
+	}
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A journalctl that never writes an entry, so never finds that its
+	// output is closed.
+	js, err := startJournalStream(ctx, &wg, lines, "sleep", "3600")
+	testutil.FatalIfErr(t, err)
+	js.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the idle command to be stopped")
+	}
+	if !js.IsComplete() {
+		t.Errorf("expecting journalstream to be complete because stopped")
+	}
+}
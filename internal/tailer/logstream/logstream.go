@@ -45,9 +45,10 @@ const defaultReadBufferSize = 4096
 // New creates a LogStream from the file object located at the absolute path
 // `pathname`.  The LogStream will watch `ctx` for a cancellation signal, and
 // notify the `wg` when it is Done.  Log lines will be sent to the `lines`
-// channel.  `seekToStart` is only used for testing and only works for regular
-// files that can be seeked.
-func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines chan<- *logline.LogLine, streamFromStart bool) (LogStream, error) {
+// channel, truncated to `maxLineLength` bytes unless it is zero.
+// `seekToStart` is only used for testing and only works for regular files that
+// can be seeked.
+func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines chan<- *logline.LogLine, streamFromStart bool, maxLineLength int) (LogStream, error) {
 	fi, err := os.Stat(pathname)
 	if err != nil {
 		logErrors.Add(pathname, 1)
@@ -55,11 +56,11 @@ func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname st
 	}
 	switch m := fi.Mode(); {
 	case m.IsRegular():
-		return newFileStream(ctx, wg, waker, pathname, fi, lines, streamFromStart)
+		return newFileStream(ctx, wg, waker, pathname, fi, lines, streamFromStart, maxLineLength)
 	case m&os.ModeType == os.ModeNamedPipe:
-		return newPipeStream(ctx, wg, waker, pathname, fi, lines)
+		return newPipeStream(ctx, wg, waker, pathname, fi, lines, maxLineLength)
 	case m&os.ModeType == os.ModeSocket:
-		return newSocketStream(ctx, wg, waker, pathname, fi, lines)
+		return newSocketStream(ctx, wg, waker, pathname, fi, lines, maxLineLength)
 	default:
 		return nil, fmt.Errorf("unsupported file object type at %q", pathname)
 	}
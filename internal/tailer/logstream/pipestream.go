@@ -4,7 +4,6 @@
 package logstream
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -22,15 +21,19 @@ type pipeStream struct {
 	ctx   context.Context
 	lines chan<- *logline.LogLine
 
-	pathname string // Given name for the underlying named pipe on the filesystem
+	pathname      string // Given name for the underlying named pipe on the filesystem
+	maxLineLength int    // If positive, the length in bytes beyond which lines are truncated
 
 	mu           sync.RWMutex // protects following fields
 	completed    bool         // This pipestream is completed and can no longer be used.
 	lastReadTime time.Time    // Last time a log line was read from this named pipe
 }
 
-func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine) (LogStream, error) {
-	ps := &pipeStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines}
+// newPipeStream creates a new log stream from a named pipe.  Lines from the
+// stream carry the pathname in their `filename' field.
+func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, maxLineLength int) (LogStream, error) {
+	ctx = logline.WithFields(ctx, map[string]string{"filename": pathname})
+	ps := &pipeStream{ctx: ctx, pathname: pathname, maxLineLength: maxLineLength, lastReadTime: time.Now(), lines: lines}
 	if err := ps.stream(ctx, wg, waker, fi); err != nil {
 		return nil, err
 	}
@@ -70,7 +73,7 @@ func (ps *pipeStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 		}()
 		b := make([]byte, 0, defaultReadBufferSize)
 		capB := cap(b)
-		partial := bytes.NewBufferString("")
+		partial := newLineBuffer(ps.maxLineLength)
 		var timedout bool
 		for {
 			// Set idle timeout
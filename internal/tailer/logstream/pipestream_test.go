@@ -29,7 +29,7 @@ func TestPipeStreamReadCompletedBecauseClosed(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker := waker.NewTestAlways()
 
-	ps, err := logstream.New(ctx, &wg, waker, name, lines, false)
+	ps, err := logstream.New(ctx, &wg, waker, name, lines, false, 0)
 	testutil.FatalIfErr(t, err)
 
 	f, err := os.OpenFile(name, os.O_WRONLY, os.ModeNamedPipe)
@@ -68,7 +68,7 @@ func TestPipeStreamReadCompletedBecauseCancel(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker := waker.NewTestAlways()
 
-	ps, err := logstream.New(ctx, &wg, waker, name, lines, false)
+	ps, err := logstream.New(ctx, &wg, waker, name, lines, false, 0)
 	testutil.FatalIfErr(t, err)
 
 	f, err := os.OpenFile(name, os.O_WRONLY, os.ModeNamedPipe)
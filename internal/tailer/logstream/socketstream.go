@@ -4,7 +4,6 @@
 package logstream
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -22,7 +21,8 @@ type socketStream struct {
 	ctx   context.Context
 	lines chan<- *logline.LogLine
 
-	pathname string // Given name for the underlying socket path on the filesystem
+	pathname      string // Given name for the underlying socket path on the filesystem
+	maxLineLength int    // If positive, the length in bytes beyond which lines are truncated
 
 	mu           sync.RWMutex // protects following fields
 	completed    bool         // This pipestream is completed and can no longer be used.
@@ -32,8 +32,8 @@ type socketStream struct {
 	stopChan chan struct{} // Close to start graceful shutdown.
 }
 
-func newSocketStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine) (LogStream, error) {
-	ss := &socketStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+func newSocketStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, maxLineLength int) (LogStream, error) {
+	ss := &socketStream{ctx: ctx, pathname: pathname, maxLineLength: maxLineLength, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
 	if err := ss.stream(ctx, wg, waker, fi); err != nil {
 		return nil, err
 	}
@@ -72,7 +72,7 @@ func (ss *socketStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wa
 		}()
 		b := make([]byte, 0, defaultReadBufferSize)
 		capB := cap(b)
-		partial := bytes.NewBufferString("")
+		partial := newLineBuffer(ss.maxLineLength)
 		var timedout bool
 		for {
 			if err := c.SetReadDeadline(time.Now().Add(defaultReadTimeout)); err != nil {
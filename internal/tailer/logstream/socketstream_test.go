@@ -28,7 +28,7 @@ func TestSocketStreamRead(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
 
-	ss, err := logstream.New(ctx, &wg, waker, name, lines, false)
+	ss, err := logstream.New(ctx, &wg, waker, name, lines, false, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1) // Synchronise past socket creation
 
@@ -69,7 +69,7 @@ func TestSocketStreamCompletedBecauseSocketClosed(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
 
-	ss, err := logstream.New(ctx, &wg, waker, name, lines, false)
+	ss, err := logstream.New(ctx, &wg, waker, name, lines, false, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1) // Synchronise past socket creation
 
@@ -113,7 +113,7 @@ func TestSocketStreamCompletedBecauseCancel(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	waker, awaken := waker.NewTest(ctx, 1)
 
-	ss, err := logstream.New(ctx, &wg, waker, name, lines, false)
+	ss, err := logstream.New(ctx, &wg, waker, name, lines, false, 0)
 	testutil.FatalIfErr(t, err)
 	awaken(1) // Synchronise past socket creation
 
@@ -0,0 +1,214 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+)
+
+// defaultConnIdleTimeout is how long a TCP connection may go without sending
+// any data before it is closed.
+const defaultConnIdleTimeout = 5 * time.Minute
+
+// tcpStream listens on a TCP address, and reads newline delimited log lines
+// from every connection accepted.  The lines from all connections are sent
+// with the name of the listener, `tcp://' followed by the address.
+type tcpStream struct {
+	ctx   context.Context
+	lines chan<- *logline.LogLine
+
+	name     string       // Name given to lines read from the stream
+	listener net.Listener // The listening socket
+
+	idleTimeout   time.Duration // Connections with no reads for this long are closed
+	maxLineLength int           // If positive, the length in bytes beyond which lines are truncated
+
+	mu           sync.RWMutex          // protects following fields
+	completed    bool                  // This tcpstream is completed and can no longer be used.
+	lastReadTime time.Time             // Last time a log line was read from any connection
+	conns        map[net.Conn]struct{} // The open connections
+	stopping     bool                  // The listener is closing, so no new connections are read
+
+	stopOnce sync.Once     // Ensure stopChan only closed once.
+	stopChan chan struct{} // Close to start graceful shutdown.
+}
+
+// NewTCPStream creates a LogStream that listens for TCP connections on
+// address, and sends the lines read from them to the `lines' channel.  Lines
+// longer than `maxLineLength' bytes are truncated, unless it is zero.  The
+// LogStream will watch `ctx' for a cancellation signal, and notify the `wg'
+// when it is Done.
+func NewTCPStream(ctx context.Context, wg *sync.WaitGroup, address string, lines chan<- *logline.LogLine, maxLineLength int) (LogStream, error) {
+	return newTCPStream(ctx, wg, address, lines, defaultConnIdleTimeout, maxLineLength)
+}
+
+func newTCPStream(ctx context.Context, wg *sync.WaitGroup, address string, lines chan<- *logline.LogLine, idleTimeout time.Duration, maxLineLength int) (*tcpStream, error) {
+	name := "tcp://" + address
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logErrors.Add(name, 1)
+		return nil, err
+	}
+	ts := &tcpStream{
+		ctx:           ctx,
+		lines:         lines,
+		name:          name,
+		listener:      l,
+		idleTimeout:   idleTimeout,
+		maxLineLength: maxLineLength,
+		lastReadTime:  time.Now(),
+		conns:         make(map[net.Conn]struct{}),
+		stopChan:      make(chan struct{}),
+	}
+	glog.V(2).Infof("listening for log lines on %v", l.Addr())
+	ts.stream(wg)
+	return ts, nil
+}
+
+// LastReadTime returns the current time while the stream is listening, as a
+// listener is not stale when it receives no lines.
+func (ts *tcpStream) LastReadTime() time.Time {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if !ts.completed {
+		return time.Now()
+	}
+	return ts.lastReadTime
+}
+
+func (ts *tcpStream) stream(wg *sync.WaitGroup) {
+	var connWg sync.WaitGroup
+	// Close the listener and all the connections on a stop or cancellation.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ts.stopChan:
+		case <-ts.ctx.Done():
+		}
+		if err := ts.listener.Close(); err != nil {
+			glog.Info(err)
+		}
+		ts.mu.Lock()
+		ts.stopping = true
+		for c := range ts.conns {
+			if err := c.Close(); err != nil {
+				glog.V(2).Info(err)
+			}
+		}
+		ts.mu.Unlock()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			connWg.Wait()
+			ts.mu.Lock()
+			ts.completed = true
+			ts.mu.Unlock()
+		}()
+		for {
+			c, err := ts.listener.Accept()
+			if err != nil {
+				select {
+				case <-ts.stopChan:
+				case <-ts.ctx.Done():
+				default:
+					glog.Info(err)
+					logErrors.Add(ts.name, 1)
+				}
+				return
+			}
+			ts.mu.Lock()
+			if ts.stopping {
+				ts.mu.Unlock()
+				if err := c.Close(); err != nil {
+					glog.V(2).Info(err)
+				}
+				continue
+			}
+			ts.conns[c] = struct{}{}
+			ts.mu.Unlock()
+			logOpens.Add(ts.name, 1)
+			connWg.Add(1)
+			go func() {
+				defer connWg.Done()
+				ts.read(c)
+			}()
+		}
+	}()
+}
+
+// read sends the lines read from the connection c until it is closed, or idle
+// for longer than the idle timeout.
+func (ts *tcpStream) read(c net.Conn) {
+	glog.V(2).Infof("%s: accepted connection from %v", ts.name, c.RemoteAddr())
+	var total int
+	defer func() {
+		glog.V(2).Infof("%s: read total %d bytes from %v", ts.name, total, c.RemoteAddr())
+		ts.mu.Lock()
+		delete(ts.conns, c)
+		ts.mu.Unlock()
+		if err := c.Close(); err != nil {
+			glog.V(2).Info(err)
+		}
+		logCloses.Add(ts.name, 1)
+	}()
+	b := make([]byte, defaultReadBufferSize)
+	partial := newLineBuffer(ts.maxLineLength)
+	for {
+		if err := c.SetReadDeadline(time.Now().Add(ts.idleTimeout)); err != nil {
+			glog.V(2).Infof("%s: %s", ts.name, err)
+		}
+		n, err := c.Read(b)
+		if n > 0 {
+			total += n
+			decodeAndSend(ts.ctx, ts.lines, ts.name, n, b[:n], partial)
+			ts.mu.Lock()
+			ts.lastReadTime = time.Now()
+			ts.mu.Unlock()
+		}
+		if err != nil {
+			var nerr net.Error
+			switch {
+			case err == io.EOF:
+			case errors.As(err, &nerr) && nerr.Timeout():
+				glog.V(2).Infof("%s: closing idle connection from %v", ts.name, c.RemoteAddr())
+			default:
+				select {
+				case <-ts.stopChan:
+				case <-ts.ctx.Done():
+				default:
+					glog.Info(err)
+					logErrors.Add(ts.name, 1)
+				}
+			}
+			// A dropped connection may leave an unterminated last line.
+			if partial.Len() > 0 {
+				sendLine(ts.ctx, ts.name, partial, ts.lines)
+			}
+			return
+		}
+	}
+}
+
+func (ts *tcpStream) IsComplete() bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.completed
+}
+
+func (ts *tcpStream) Stop() {
+	ts.stopOnce.Do(func() {
+		close(ts.stopChan)
+	})
+}
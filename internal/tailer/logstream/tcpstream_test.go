@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestTCPStreamRead(t *testing.T) {
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ts, err := newTCPStream(ctx, &wg, "127.0.0.1:0", lines, time.Minute, 0)
+	testutil.FatalIfErr(t, err)
+	addr := ts.listener.Addr().String()
+
+	c1, err := net.Dial("tcp", addr)
+	testutil.FatalIfErr(t, err)
+	c2, err := net.Dial("tcp", addr)
+	testutil.FatalIfErr(t, err)
+	_, err = c1.Write([]byte("1\n2\n"))
+	testutil.FatalIfErr(t, err)
+	_, err = c2.Write([]byte("3\n"))
+	testutil.FatalIfErr(t, err)
+	// A dropped connection sends its unterminated last line.
+	_, err = c1.Write([]byte("4"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c1.Close())
+
+	received := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		select {
+		case l := <-lines:
+			if l.Filename != ts.name {
+				t.Errorf("unexpected line filename %q, expected %q", l.Filename, ts.name)
+			}
+			received[l.Line] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", received)
+		}
+	}
+	testutil.ExpectNoDiff(t, map[string]bool{"1": true, "2": true, "3": true, "4": true}, received)
+
+	cancel()
+	wg.Wait()
+	close(lines)
+
+	if !ts.IsComplete() {
+		t.Errorf("expecting tcpstream to be complete because cancellation")
+	}
+}
+
+func TestTCPStreamIdleConnectionClosed(t *testing.T) {
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ts, err := newTCPStream(ctx, &wg, "127.0.0.1:0", lines, 10*time.Millisecond, 0)
+	testutil.FatalIfErr(t, err)
+
+	c, err := net.Dial("tcp", ts.listener.Addr().String())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	// The server closes the idle connection, so the read sees EOF.
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected idle connection to be closed")
+	}
+
+	ts.Stop()
+	wg.Wait()
+	cancel()
+	if !ts.IsComplete() {
+		t.Errorf("expecting tcpstream to be complete because stopped")
+	}
+}
@@ -39,7 +39,8 @@ type Tailer struct {
 	globPatterns       map[string]struct{} // glob patterns to match newly created logs in dir paths against
 	ignoreRegexPattern *regexp.Regexp
 
-	oneShot bool
+	oneShot       bool
+	maxLineLength int // If positive, the length in bytes beyond which lines are truncated.
 
 	pollMu sync.Mutex // protects Poll()
 
@@ -66,6 +67,9 @@ func (n *niladicOption) apply(t *Tailer) error {
 // OneShot puts the tailer in one-shot mode, where sources are read once from the start and then closed.
 var OneShot = &niladicOption{func(t *Tailer) error { t.oneShot = true; return nil }}
 
+// Journal makes the tailer follow the systemd journal, by running journalctl.
+var Journal = &niladicOption{func(t *Tailer) error { return t.FollowJournal() }}
+
 // LogPatterns sets the glob patterns to use to match pathnames.
 type LogPatterns []string
 
@@ -86,6 +90,42 @@ func (opt IgnoreRegex) apply(t *Tailer) error {
 	return nil
 }
 
+// MaxLineLength sets the length in bytes beyond which lines read from logs are
+// truncated.  It applies to the logs tailed after it is set, so it must come
+// before the options that open logs.
+type MaxLineLength int
+
+func (opt MaxLineLength) apply(t *Tailer) error {
+	t.maxLineLength = int(opt)
+	return nil
+}
+
+// TCPListenAddresses sets the addresses on which to accept TCP connections to
+// read log lines from.
+type TCPListenAddresses []string
+
+func (opt TCPListenAddresses) apply(t *Tailer) error {
+	for _, address := range opt {
+		if err := t.ListenTCP(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventLogChannels sets the channels of the Windows Event Log to read events
+// from.
+type EventLogChannels []string
+
+func (opt EventLogChannels) apply(t *Tailer) error {
+	for _, channel := range opt {
+		if err := t.FollowEventLog(channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // StaleLogGcWaker triggers garbage collection runs for stale logs in the tailer.
 func StaleLogGcWaker(w waker.Waker) Option {
 	return &staleLogGcWaker{w}
@@ -144,7 +184,10 @@ func New(ctx context.Context, wg *sync.WaitGroup, lines chan<- *logline.LogLine,
 	if err := t.SetOption(options...); err != nil {
 		return nil, err
 	}
-	if len(t.globPatterns) == 0 {
+	t.logstreamsMu.RLock()
+	listening := len(t.logstreams) > 0
+	t.logstreamsMu.RUnlock()
+	if len(t.globPatterns) == 0 && !listening {
 		glog.Info("No patterns to tail, tailer done.")
 		close(t.lines)
 		return t, nil
@@ -247,7 +290,7 @@ func (t *Tailer) TailPath(pathname string) error {
 		logCount.Add(-1) // Removing the current entry before re-adding.
 		glog.V(2).Infof("Existing logstream is finished, creating a new one.")
 	}
-	l, err := logstream.New(t.ctx, &t.wg, t.logstreamPollWaker, pathname, t.lines, t.oneShot)
+	l, err := logstream.New(t.ctx, &t.wg, t.logstreamPollWaker, pathname, t.lines, t.oneShot, t.maxLineLength)
 	if err != nil {
 		return err
 	}
@@ -261,6 +304,62 @@ func (t *Tailer) TailPath(pathname string) error {
 	return nil
 }
 
+// ListenTCP starts accepting TCP connections on address, reading newline
+// delimited log lines from each connection.  The lines are named
+// `tcp://address'.
+func (t *Tailer) ListenTCP(address string) error {
+	t.logstreamsMu.Lock()
+	defer t.logstreamsMu.Unlock()
+	l, err := logstream.NewTCPStream(t.ctx, &t.wg, address, t.lines, t.maxLineLength)
+	if err != nil {
+		return err
+	}
+	t.logstreams["tcp://"+address] = l
+	glog.Infof("Listening for log lines on tcp://%s", address)
+	logCount.Add(1)
+	return nil
+}
+
+// FollowJournal starts reading new entries from the systemd journal, sending
+// the message of each entry as a log line named `journald'.  The other fields
+// of each entry are carried in the context of the line.
+func (t *Tailer) FollowJournal() error {
+	t.logstreamsMu.Lock()
+	defer t.logstreamsMu.Unlock()
+	if _, ok := t.logstreams[logstream.JournalName]; ok {
+		return nil
+	}
+	l, err := logstream.NewJournalStream(t.ctx, &t.wg, t.lines)
+	if err != nil {
+		return err
+	}
+	t.logstreams[logstream.JournalName] = l
+	glog.Info("Following the systemd journal")
+	logCount.Add(1)
+	return nil
+}
+
+// FollowEventLog starts reading new events from the named channel of the
+// Windows Event Log, sending the message of each event as a log line named
+// after the channel, like `eventlog:Application'.  The event ID and provider
+// of each event are carried in the context of the line.
+func (t *Tailer) FollowEventLog(channel string) error {
+	name := logstream.EventLogPrefix + channel
+	t.logstreamsMu.Lock()
+	defer t.logstreamsMu.Unlock()
+	if _, ok := t.logstreams[name]; ok {
+		return nil
+	}
+	l, err := logstream.NewEventLogStream(t.ctx, &t.wg, channel, t.lines)
+	if err != nil {
+		return err
+	}
+	t.logstreams[name] = l
+	glog.Infof("Following the %s channel of the Windows Event Log", channel)
+	logCount.Add(1)
+	return nil
+}
+
 // Gc removes logstreams that have had no reads for 24h or more.
 func (t *Tailer) Gc() error {
 	t.logstreamsMu.Lock()
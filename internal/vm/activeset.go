@@ -0,0 +1,119 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// maxActiveKeys is the most keys that an activeSet holds; the least recently
+// seen are forgotten first.
+const maxActiveKeys = 100000
+
+// activeSet holds the distinct keys seen within a sliding window of time,
+// and the time each was last seen.  It is kept as the auxiliary state of the
+// datum counting them, and is expired by the store's garbage collection as
+// well as by its program, so it has its own lock.
+type activeSet struct {
+	window time.Duration
+
+	mu     sync.Mutex               // protects the following fields
+	order  *list.List               // Keys by the time they were last seen, most recent first.
+	keys   map[string]*list.Element // Elements of order by key.
+	latest time.Time                // The most recent time any key was seen.
+	seen   time.Time                // The wall clock time when latest was set, to advance it between lines.
+}
+
+type activeKey struct {
+	key  string
+	last time.Time
+}
+
+func newActiveSet(window time.Duration) *activeSet {
+	return &activeSet{window: window, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// Add records that key was seen at time now, when the wall clock read wall,
+// expires the keys not seen within the window before the most recent time,
+// and returns the number of keys left.  Keys seen out of order keep the
+// order sorted, and an older sighting of a key doesn't change when it was
+// last seen.
+func (a *activeSet) Add(key string, now, wall time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.After(a.latest) {
+		a.latest = now
+		a.seen = wall
+	}
+	if e, ok := a.keys[key]; ok {
+		k := e.Value.(*activeKey)
+		if now.After(k.last) {
+			k.last = now
+			a.order.Remove(e)
+			a.insert(k)
+		}
+	} else {
+		a.insert(&activeKey{key, now})
+		if a.order.Len() > maxActiveKeys {
+			a.remove(a.order.Back())
+		}
+	}
+	a.expire(a.latest)
+	return a.order.Len()
+}
+
+// Expire implements datum.Expirer.  It forgets the keys not seen within the
+// window, which slides on from the most recent time a key was seen by the
+// wall clock time passed since then, and updates d if any were forgotten.
+func (a *activeSet) Expire(d datum.Datum, wall time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.latest.IsZero() {
+		return
+	}
+	now := a.latest.Add(wall.Sub(a.seen))
+	n := a.order.Len()
+	a.expire(now)
+	if a.order.Len() != n {
+		datum.SetInt(d, int64(a.order.Len()), now)
+	}
+}
+
+// insert adds k to the order after the keys seen more recently than it.
+// Keys are usually seen in order, so it is usually put at the front.
+func (a *activeSet) insert(k *activeKey) {
+	for e := a.order.Front(); e != nil; e = e.Next() {
+		if !e.Value.(*activeKey).last.After(k.last) {
+			a.keys[k.key] = a.order.InsertBefore(k, e)
+			return
+		}
+	}
+	a.keys[k.key] = a.order.PushBack(k)
+}
+
+// expire removes the keys last seen more than the window before now.
+func (a *activeSet) expire(now time.Time) {
+	for e := a.order.Back(); e != nil; e = a.order.Back() {
+		if now.Sub(e.Value.(*activeKey).last) <= a.window {
+			return
+		}
+		a.remove(e)
+	}
+}
+
+func (a *activeSet) remove(e *list.Element) {
+	a.order.Remove(e)
+	delete(a.keys, e.Value.(*activeKey).key)
+}
+
+// Len returns the number of keys seen within the window.
+func (a *activeSet) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.order.Len()
+}
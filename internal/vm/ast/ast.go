@@ -59,6 +59,7 @@ type CondStmt struct {
 	Truth Node
 	Else  Node
 	Scope *symbol.Scope // a conditional expression can cause new variables to be defined
+	Name  string        // the name of the rule, if the condition is named
 }
 
 func (n *CondStmt) Pos() *position.Position {
@@ -211,6 +212,9 @@ type VarDecl struct {
 	Buckets      []float64
 	Kind         metrics.Kind
 	ExportedName string
+	Cumulative   bool     // Assignments are raw values from a counter that may reset.
+	Rollup       bool     // Increments are also added to a total across all label values.
+	Max          *float64 // If not nil, the largest value that may be set.
 	Symbol       *symbol.Symbol
 }
 
@@ -263,6 +267,20 @@ func (n *FloatLit) Type() types.Type {
 	return types.Float
 }
 
+// DurationLit is a duration literal, like `5m', which is only accepted as
+// the last argument of a builtin.
+type DurationLit struct {
+	P position.Position
+	D time.Duration
+}
+
+func (n *DurationLit) Pos() *position.Position {
+	return &n.P
+}
+func (n *DurationLit) Type() types.Type {
+	return types.Duration
+}
+
 // patternExprNode is the top of a pattern expression
 type PatternExpr struct {
 	Expr    Node
@@ -343,6 +361,26 @@ func (n *DecoStmt) Type() types.Type {
 	return types.None
 }
 
+// ForeachStmt runs Block once for each field of the string Str split at the
+// separator Sep, with the field bound to the loop variable Name.
+type ForeachStmt struct {
+	P      position.Position
+	Name   string
+	Str    Node
+	Sep    Node
+	Block  Node
+	Scope  *symbol.Scope  // Contains the loop variable.
+	Symbol *symbol.Symbol // The loop variable.
+}
+
+func (n *ForeachStmt) Pos() *position.Position {
+	return MergePosition(&n.P, n.Block.Pos())
+}
+
+func (n *ForeachStmt) Type() types.Type {
+	return types.None
+}
+
 type NextStmt struct {
 	P position.Position
 }
@@ -429,6 +467,22 @@ func (n *StopStmt) Type() types.Type {
 	return types.None
 }
 
+// PreprocessStmt replaces the matches of a regular expression in each input
+// line before the program runs.
+type PreprocessStmt struct {
+	P           position.Position
+	Pattern     string
+	Replacement string
+}
+
+func (n *PreprocessStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *PreprocessStmt) Type() types.Type {
+	return types.None
+}
+
 // MergePosition returns the union of two positions such that the result contains both inputs.
 func MergePosition(a, b *position.Position) *position.Position {
 	if a == nil {
@@ -73,6 +73,11 @@ func Walk(v Visitor, node Node) Node {
 	case *DecoStmt:
 		n.Block = Walk(v, n.Block)
 
+	case *ForeachStmt:
+		n.Str = Walk(v, n.Str)
+		n.Sep = Walk(v, n.Sep)
+		n.Block = Walk(v, n.Block)
+
 	case *ConvExpr:
 		n.N = Walk(v, n.N)
 
@@ -82,7 +87,7 @@ func Walk(v Visitor, node Node) Node {
 	case *PatternFragment:
 		n.Expr = Walk(v, n.Expr)
 
-	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt:
+	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *DurationLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt, *PreprocessStmt:
 		// These nodes are terminals, thus have no children to walk.
 
 	default:
@@ -0,0 +1,144 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/mtail/internal/vm/checker"
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/parser"
+)
+
+// EdgeKind describes the condition under which control passes along an Edge.
+type EdgeKind int
+
+const (
+	// Next is the edge to the following block when execution falls through.
+	Next EdgeKind = iota
+	// Matched is the edge taken when the match register is set.
+	Matched
+	// NotMatched is the edge taken when the match register is not set.
+	NotMatched
+	// Jump is the edge of an unconditional jump.
+	Jump
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case Next:
+		return "next"
+	case Matched:
+		return "matched"
+	case NotMatched:
+		return "notmatched"
+	case Jump:
+		return "jump"
+	}
+	return "unknown"
+}
+
+// BasicBlock is a sequence of instructions with a single entry and a single
+// exit.  Start and End are the program counters of the first instruction and
+// one past the last instruction in the block.
+type BasicBlock struct {
+	Start, End int
+	Instrs     []code.Instr
+}
+
+// Edge is a transfer of control from the block at index From to the block at
+// index To in the CFG.
+type Edge struct {
+	From, To int
+	Kind     EdgeKind
+}
+
+// CFG is the control flow graph of a compiled program, made of the basic
+// blocks of the program in program order and the edges between them.
+type CFG struct {
+	Blocks []BasicBlock
+	Edges  []Edge
+}
+
+// CompileCFG compiles a program from the input and returns the control flow
+// graph of its bytecode, or a list of compile errors.
+func CompileCFG(name string, r io.Reader) (*CFG, error) {
+	name = filepath.Base(name)
+	ast, err := parser.Parse(name, r)
+	if err != nil {
+		return nil, err
+	}
+	if ast, err = checker.Check(ast); err != nil {
+		return nil, err
+	}
+	obj, err := codegen.CodeGen(name, ast)
+	if err != nil {
+		return nil, err
+	}
+	return buildCFG(obj.Program), nil
+}
+
+// buildCFG splits the program into basic blocks at jump targets and after
+// jump and stop instructions, and links the blocks by their jumps and
+// fallthroughs.  Jumps to the end of the program leave the graph, and so
+// have no edge.
+func buildCFG(prog []code.Instr) *CFG {
+	cfg := &CFG{}
+	if len(prog) == 0 {
+		return cfg
+	}
+	leaders := map[int]bool{0: true}
+	for pc, i := range prog {
+		switch i.Opcode {
+		case code.Jnm, code.Jm, code.Jmp:
+			leaders[i.Operand.(int)] = true
+			leaders[pc+1] = true
+		case code.Stop:
+			leaders[pc+1] = true
+		}
+	}
+	starts := make([]int, 0, len(leaders))
+	for pc := range leaders {
+		if pc < len(prog) {
+			starts = append(starts, pc)
+		}
+	}
+	sort.Ints(starts)
+
+	blockAt := make(map[int]int, len(starts))
+	for b, start := range starts {
+		end := len(prog)
+		if b+1 < len(starts) {
+			end = starts[b+1]
+		}
+		blockAt[start] = b
+		cfg.Blocks = append(cfg.Blocks, BasicBlock{Start: start, End: end, Instrs: prog[start:end]})
+	}
+
+	addEdge := func(from, pc int, kind EdgeKind) {
+		if to, ok := blockAt[pc]; ok {
+			cfg.Edges = append(cfg.Edges, Edge{From: from, To: to, Kind: kind})
+		}
+	}
+	for b, block := range cfg.Blocks {
+		last := prog[block.End-1]
+		switch last.Opcode {
+		case code.Jnm:
+			addEdge(b, block.End, Matched)
+			addEdge(b, last.Operand.(int), NotMatched)
+		case code.Jm:
+			addEdge(b, block.End, NotMatched)
+			addEdge(b, last.Operand.(int), Matched)
+		case code.Jmp:
+			addEdge(b, last.Operand.(int), Jump)
+		case code.Stop:
+		default:
+			addEdge(b, block.End, Next)
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm"
+)
+
+func TestCompileCFG(t *testing.T) {
+	r := strings.NewReader(`counter a
+counter b
+/foo/ {
+  a++
+} else {
+  b++
+}
+`)
+	cfg, err := vm.CompileCFG("test", r)
+	testutil.FatalIfErr(t, err)
+
+	var blocks [][2]int
+	for _, b := range cfg.Blocks {
+		if len(b.Instrs) != b.End-b.Start {
+			t.Errorf("block %v has %d instructions", b, len(b.Instrs))
+		}
+		blocks = append(blocks, [2]int{b.Start, b.End})
+	}
+	// The match and its jump, the then block ending in a jump over the else
+	// block, and the else block.
+	expectedBlocks := [][2]int{{0, 2}, {2, 8}, {8, 11}}
+	if diff := testutil.Diff(expectedBlocks, blocks); diff != "" {
+		t.Errorf("blocks diff:\n%s", diff)
+	}
+	// The jump at the end of the then block leaves the program, so has no edge.
+	expectedEdges := []vm.Edge{
+		{From: 0, To: 1, Kind: vm.Matched},
+		{From: 0, To: 2, Kind: vm.NotMatched},
+	}
+	if diff := testutil.Diff(expectedEdges, cfg.Edges); diff != "" {
+		t.Errorf("edges diff:\n%s", diff)
+	}
+}
+
+func TestCompileCFGError(t *testing.T) {
+	_, err := vm.CompileCFG("test", strings.NewReader("bad program"))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/jsonpath"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/errors"
 	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/position"
 	"github.com/google/mtail/internal/vm/symbol"
 	"github.com/google/mtail/internal/vm/types"
 )
@@ -25,10 +27,19 @@ type checker struct {
 
 	decoScopes []*symbol.Scope // A stack of scopes used for resolving symbols in decorated nodes
 
-	errors errors.ErrorList
+	errors   errors.ErrorList
+	warnings errors.ErrorList // Problems that don't stop the program compiling.
 
 	depth   int
 	tooDeep bool
+
+	builtinArgs int // Depth of nested builtin argument lists; patterns in them don't declare capture groups.
+
+	kinds map[*symbol.Symbol]metrics.Kind // Kinds of the metrics declared, for the statements that only apply to some.
+
+	rules map[string]*position.Position // Positions of the named rules, to find duplicate names.
+
+	condition ast.Node // The condition of the innermost conditional statement, the only place sample() can be used.
 }
 
 // Check performs a semantic check of the astNode, and returns a potentially
@@ -36,12 +47,20 @@ type checker struct {
 // semantically valid.  At the completion of Check, the symbol table and type
 // annotation are also complete.
 func Check(node ast.Node) (ast.Node, error) {
-	c := &checker{}
+	node, _, err := CheckWarnings(node)
+	return node, err
+}
+
+// CheckWarnings performs a semantic check like Check, and also returns a list
+// of warnings about parts of the program that are valid but probably
+// mistakes, such as metrics that are declared but never used.
+func CheckWarnings(node ast.Node) (ast.Node, errors.ErrorList, error) {
+	c := &checker{kinds: make(map[*symbol.Symbol]metrics.Kind), rules: make(map[string]*position.Position)}
 	node = ast.Walk(c, node)
 	if len(c.errors) > 0 {
-		return node, c.errors
+		return node, c.warnings, c.errors
 	}
-	return node, nil
+	return node, c.warnings, nil
 }
 
 // VisitBefore performs most of the symbol table construction, so that symbols
@@ -66,9 +85,19 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.CondStmt:
 		n.Scope = symbol.NewScope(c.scope)
 		c.scope = n.Scope
+		c.condition = n.Cond
 		glog.V(2).Infof("Created new scope %v in condstmt", n.Scope)
 		return c, n
 
+	case *ast.ForeachStmt:
+		n.Scope = symbol.NewScope(c.scope)
+		c.scope = n.Scope
+		n.Symbol = symbol.NewSymbol(n.Name, symbol.LoopSymbol, &n.P)
+		n.Symbol.Type = types.String
+		c.scope.Insert(n.Symbol)
+		glog.V(2).Infof("Created new scope %v in foreachstmt", n.Scope)
+		return c, n
+
 	case *ast.CaprefTerm:
 		if n.Symbol == nil {
 			sym := c.scope.Lookup(n.Name, symbol.CaprefSymbol)
@@ -96,6 +125,7 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.depth--
 			return nil, n
 		}
+		c.kinds[n.Symbol] = n.Kind
 		var rType types.Type
 		switch n.Kind {
 		case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram:
@@ -114,6 +144,26 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.depth--
 			return nil, n
 		}
+		if n.Cumulative && n.Kind != metrics.Counter {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't make non-counter metric `%s' cumulative.", n.Name))
+			c.depth--
+			return nil, n
+		}
+		if n.Max != nil && n.Kind != metrics.Gauge {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't set a maximum for metric `%s'; only gauges can have a maximum.", n.Name))
+		}
+		if n.Kind == metrics.Text {
+			for _, k := range n.Keys {
+				if k == "text" {
+					// The value of a text metric is exported in this label.
+					c.errors.Add(n.Pos(), fmt.Sprintf("Can't use `text' as a key of text metric `%s'; it holds the exported value.", n.Name))
+				}
+			}
+		}
+		if n.Rollup && (n.Kind != metrics.Counter || len(n.Keys) == 0) {
+			// The declaration is otherwise valid, so keep checking its uses.
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't roll up metric `%s'; only dimensioned counters can be rolled up.", n.Name))
+		}
 		if len(n.Keys) > 0 {
 			// One type per key
 			keyTypes := make([]types.Type, 0, len(n.Keys))
@@ -130,7 +180,11 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 
 	case *ast.IdTerm:
 		if n.Symbol == nil {
-			if sym := c.scope.Lookup(n.Name, symbol.VarSymbol); sym != nil {
+			if sym := c.scope.Lookup(n.Name, symbol.LoopSymbol); sym != nil {
+				glog.V(2).Infof("found loopsymbol sym %v", sym)
+				sym.Used = true
+				n.Symbol = sym
+			} else if sym := c.scope.Lookup(n.Name, symbol.VarSymbol); sym != nil {
 				glog.V(2).Infof("found varsymbol sym %v", sym)
 				sym.Used = true
 				n.Symbol = sym
@@ -220,6 +274,18 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.DelStmt:
 		n.N = ast.Walk(c, n.N)
 		return c, n
+
+	case *ast.BuiltinExpr:
+		c.builtinArgs++
+		// The first argument to sethelp() names the whole metric, so it is
+		// never indexed.
+		if n.Name == "sethelp" && n.Args != nil {
+			args := n.Args.(*ast.ExprList).Children
+			if ix, ok := args[0].(*ast.IndexedExpr); ok && len(ix.Index.(*ast.ExprList).Children) == 0 {
+				args[0] = ix.Lhs
+			}
+		}
+		return c, n
 	}
 	return c, node
 }
@@ -240,6 +306,12 @@ func (c *checker) checkSymbolUsage() {
 				glog.Infof("declaration of capture group reference `%s' at %s appears to be unused", sym.Name, sym.Pos)
 				continue
 			}
+			if sym.Kind == symbol.VarSymbol || sym.Kind == symbol.LoopSymbol {
+				// An unused metric is still exported, so the program can
+				// run, but it's often a misspelling of one that is used.
+				c.warnings.Add(sym.Pos, fmt.Sprintf("Declaration of %s `%s' here is never used.", sym.Kind, sym.Name))
+				continue
+			}
 			c.errors.Add(sym.Pos, fmt.Sprintf("Declaration of %s `%s' here is never used.", sym.Kind, sym.Name))
 		}
 	}
@@ -261,9 +333,21 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		return n
 
 	case *ast.CondStmt:
+		if n.Name != "" {
+			if pos, ok := c.rules[n.Name]; ok {
+				c.errors.Add(n.Cond.Pos(), fmt.Sprintf("Redeclaration of rule `%s' previously declared at %s", n.Name, pos))
+			} else {
+				c.rules[n.Name] = n.Cond.Pos()
+			}
+		}
 		switch n.Cond.(type) {
 		case *ast.BinaryExpr, *ast.PatternExpr, *ast.PatternFragment, *ast.OtherwiseStmt:
 			// OK as conditions
+		case *ast.BuiltinExpr:
+			// Builtins that return Bool, like isnew(), are OK as conditions
+			if !types.Equals(n.Cond.Type(), types.Bool) && !types.IsErrorType(n.Cond.Type()) {
+				c.errors.Add(n.Cond.Pos(), fmt.Sprintf("Can't interpret %s as a boolean expression here.\n\tTry using comparison operators to make the condition explicit.", n.Cond.Type()))
+			}
 		default:
 			c.errors.Add(n.Cond.Pos(), fmt.Sprintf("Can't interpret %s as a boolean expression here.\n\tTry using comparison operators to make the condition explicit.", n.Cond.Type()))
 		}
@@ -272,6 +356,18 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		c.scope = n.Scope.Parent
 		return n
 
+	case *ast.ForeachStmt:
+		if !types.Equals(n.Str.Type(), types.String) && !types.IsErrorType(n.Str.Type()) {
+			c.errors.Add(n.Str.Pos(), fmt.Sprintf("Expecting a String to split, not %s.", n.Str.Type()))
+		}
+		if !types.Equals(n.Sep.Type(), types.String) && !types.IsErrorType(n.Sep.Type()) {
+			c.errors.Add(n.Sep.Pos(), fmt.Sprintf("Expecting a String separator for split, not %s.", n.Sep.Type()))
+		}
+		c.checkSymbolUsage()
+		// Pop the scope.
+		c.scope = n.Scope.Parent
+		return n
+
 	case *ast.DecoStmt:
 		// Don't check symbol usage here because the decorator is only partially defined.
 		// Pop the scope.
@@ -417,11 +513,66 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				glog.V(2).Infof("Emitting convnode %+v", conv)
 			}
 
+		case parser.COMMA:
+			// Range bounds
+			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
+			// ⇒ O ⊢ e : lub(Tl, Tr)
+			rType = types.LeastUpperBound(lT, rT)
+			if types.IsErrorType(rType) {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't use %s and %s as the bounds of a range.", lT, rT))
+				n.SetType(types.Error)
+				return n
+			}
+			if reversedRange(n.Lhs, n.Rhs) {
+				c.errors.Add(n.Pos(), "Range lower bound is greater than its upper bound.")
+				n.SetType(types.Error)
+				return n
+			}
+
+		case parser.IN:
+			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
+			// Tl <= Tr , Tr <= Tl
+			// ⇒ O ⊢ e : Bool
+			rType = types.Bool
+			t := types.LeastUpperBound(lT, rT)
+			if types.IsErrorType(t) {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't compare LHS of type %s with a range of type %s.", lT, rT))
+				n.SetType(t)
+				return n
+			}
+			// Promote the value and each bound to the common type.
+			if !types.Equals(t, lT) {
+				conv := &ast.ConvExpr{N: n.Lhs}
+				conv.SetType(t)
+				n.Lhs = conv
+			}
+			bounds := n.Rhs.(*ast.BinaryExpr)
+			if !types.Equals(t, bounds.Lhs.Type()) {
+				conv := &ast.ConvExpr{N: bounds.Lhs}
+				conv.SetType(t)
+				bounds.Lhs = conv
+			}
+			if !types.Equals(t, bounds.Rhs.Type()) {
+				conv := &ast.ConvExpr{N: bounds.Rhs}
+				conv.SetType(t)
+				bounds.Rhs = conv
+			}
+			bounds.SetType(t)
+
 		case parser.ASSIGN, parser.ADD_ASSIGN:
 			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
 			// Tr <= Tl
 			// ⇒ O ⊢ e : Tl
 			glog.V(2).Infof("lt %q, rt %q", lT, rT)
+			if types.Equals(rT, types.None) {
+				if b, ok := n.Rhs.(*ast.BuiltinExpr); ok {
+					c.errors.Add(n.Rhs.Pos(), fmt.Sprintf("Can't assign the result of %s(), which has no value.\n\tTry calling it on its own, as it updates its metric itself.", b.Name))
+				} else {
+					c.errors.Add(n.Rhs.Pos(), "Can't assign an expression which has no value.")
+				}
+				n.SetType(types.Error)
+				return n
+			}
 			rType = lT
 			// TODO(jaq): the rT <= lT relationship is not correctly encoded here.
 			t := types.LeastUpperBound(lT, rT)
@@ -432,17 +583,73 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				n.SetType(types.Error)
 				return n
 			}
+			var id *ast.IdTerm
 			switch v := n.Lhs.(type) {
 			case *ast.IdTerm:
-				v.Lvalue = true
+				id = v
 			case *ast.IndexedExpr:
-				v.Lhs.(*ast.IdTerm).Lvalue = true
+				id = v.Lhs.(*ast.IdTerm)
 			default:
 				glog.V(2).Infof("The lhs is a %T %v", n.Lhs, n.Lhs)
 				c.errors.Add(n.Lhs.Pos(), "Can't assign to this expression on the left.")
 				n.SetType(types.Error)
 				return n
 			}
+			id.Lvalue = true
+			if r, ok := n.Rhs.(*ast.BinaryExpr); ok && r.Op == parser.EXEMPLAR && c.kinds[id.Symbol] != metrics.Histogram {
+				c.errors.Add(r.Rhs.Pos(), fmt.Sprintf("Can't record an exemplar for `%s', which is not a histogram.", id.Name))
+				n.SetType(types.Error)
+				return n
+			}
+			rhs := n.Rhs
+			if r, ok := rhs.(*ast.BinaryExpr); ok && r.Op == parser.EXEMPLAR {
+				rhs = r.Lhs
+			}
+			if r, ok := rhs.(*ast.BinaryExpr); ok && r.Op == parser.BY && c.kinds[id.Symbol] != metrics.Histogram {
+				c.errors.Add(r.Rhs.Pos(), fmt.Sprintf("Can't observe a weighted value in `%s', which is not a histogram.", id.Name))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case parser.AT:
+			// O ⊢ e1 : Tl, O ⊢ e2 : Int | None
+			// ⇒ O ⊢ e : Tl
+			rType = lT
+			if !types.Equals(rT, types.Int) && !types.Equals(rT, types.None) {
+				c.errors.Add(n.Rhs.Pos(), fmt.Sprintf("Can't use %s as a timestamp.\n\tTry using an integer Unix time, or `strptime()' to parse one.", rT))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case parser.BY:
+			// O ⊢ e1 : Int | Float, O ⊢ e2 : Int
+			// ⇒ O ⊢ e : Float
+			rType = types.Float
+			if !types.Equals(types.LeastUpperBound(types.Int, rT), types.Int) {
+				c.errors.Add(n.Rhs.Pos(), fmt.Sprintf("Can't use %s as a weight.\n\tTry using an integer count of observations.", rT))
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(types.LeastUpperBound(rType, lT), rType) {
+				c.errors.Add(n.Lhs.Pos(), fmt.Sprintf("Can't observe %s in a histogram.", lT))
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(rType, lT) {
+				conv := &ast.ConvExpr{N: n.Lhs}
+				conv.SetType(rType)
+				n.Lhs = conv
+			}
+
+		case parser.EXEMPLAR:
+			// O ⊢ e1 : T, O ⊢ e2 : String
+			// ⇒ O ⊢ e : T
+			rType = lT
+			if !types.Equals(rT, types.String) {
+				c.errors.Add(n.Rhs.Pos(), fmt.Sprintf("Can't use %s as an exemplar.\n\tTry using a string trace ID.", rT))
+				n.SetType(types.Error)
+				return n
+			}
 
 		case parser.CONCAT:
 			rType = types.Pattern
@@ -625,6 +832,7 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		return n
 
 	case *ast.BuiltinExpr:
+		c.builtinArgs--
 		typs := []types.Type{}
 		if args, ok := n.Args.(*ast.ExprList); ok {
 			for _, arg := range args.Children {
@@ -634,6 +842,16 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		rType := types.NewVariable()
 		typs = append(typs, rType)
 
+		// Only activeuniq() takes a window of time as its last argument.
+		if args, ok := n.Args.(*ast.ExprList); ok && n.Name != "activeuniq" {
+			last := args.Children[len(args.Children)-1]
+			if _, ok := last.(*ast.DurationLit); ok {
+				c.errors.Add(last.Pos(), fmt.Sprintf("Can't use a duration as an argument of %s().", n.Name))
+				n.SetType(types.Error)
+				return n
+			}
+		}
+
 		fn := types.Function(typs...)
 		fresh := types.FreshType(types.Builtins[n.Name])
 		err := types.Unify(fresh, fn)
@@ -645,6 +863,18 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		n.SetType(rType)
 
 		switch n.Name {
+		case "capcount", "captures":
+			// capcount() and captures() read the groups of the innermost
+			// regular expression match, which is bound as the whole match
+			// capture group so that code generation can find the pattern.
+			sym := c.scope.Lookup("0", symbol.CaprefSymbol)
+			if sym == nil {
+				c.errors.Add(n.Pos(), fmt.Sprintf("%s() reads the capture groups of a regular expression match, but none is visible to this scope.\n\tTry using %s() in the block of a regular expression condition.", n.Name, n.Name))
+				n.SetType(types.Error)
+				return n
+			}
+			n.Args = &ast.ExprList{Children: []ast.Node{&ast.CaprefTerm{P: n.P, Name: "0", Symbol: sym}}}
+
 		case "strptime":
 			if !types.Equals(fn.Args[1], types.String) {
 				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting a format string for argument 2 of strptime(), not %v.", fn.Args[1]))
@@ -673,12 +903,259 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
-		case "tolower":
+		case "matchcount", "matches", "subst":
+			if _, ok := n.Args.(*ast.ExprList).Children[1].(*ast.PatternExpr); !ok {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting a regular expression for argument 2 of %s(), not %v.", n.Name, fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "sethelp":
+			id, ok := n.Args.(*ast.ExprList).Children[0].(*ast.IdTerm)
+			if !ok || id.Symbol == nil || id.Symbol.Kind != symbol.VarSymbol {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a metric for argument 1 of sethelp().")
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(fn.Args[1], types.String) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting a String for argument 2 of sethelp(), not %v.", fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "sample":
+			// The increments in a sample block are scaled by the period
+			// over the sample size, so both must be known at compile time,
+			// and the sample must decide alone whether the block runs.
+			if n != c.condition {
+				c.errors.Add(n.Pos(), "Can't use sample() except as the whole condition of a block.\n\tTry nesting the sample block inside a block with the other conditions.")
+				n.SetType(types.Error)
+				return n
+			}
+			args := n.Args.(*ast.ExprList).Children
+			k, kok := args[0].(*ast.IntLit)
+			p, pok := args[1].(*ast.IntLit)
+			if !kok || !pok {
+				c.errors.Add(n.Pos(), "Expecting integer constants for the arguments of sample().")
+				n.SetType(types.Error)
+				return n
+			}
+			if k.I <= 0 || p.I < k.I || p.I%k.I != 0 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't sample %d in %d lines.\n\tTry a sample size that divides the period, like sample(1, %d).", k.I, p.I, p.I))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "consistentsample":
+			args := n.Args.(*ast.ExprList).Children
 			if !types.Equals(fn.Args[0], types.String) {
-				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of tolower(), not %v.", fn.Args[0]))
+				c.errors.Add(args[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of consistentsample(), not %v.", fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(fn.Args[1], types.Int) && !types.Equals(fn.Args[1], types.Float) {
+				c.errors.Add(args[1].Pos(), fmt.Sprintf("Expecting a numeric value for argument 2 of consistentsample(), not %v.", fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+			var rate float64
+			switch r := args[1].(type) {
+			case *ast.FloatLit:
+				rate = r.F
+			case *ast.IntLit:
+				rate = float64(r.I)
+			}
+			if rate < 0 || rate > 1 {
+				c.errors.Add(args[1].Pos(), fmt.Sprintf("The rate of consistentsample() must be between 0 and 1, not %v.", rate))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "timediff":
+			// Each argument sets the time register, which is read back as
+			// its time value.
+			for i, arg := range n.Args.(*ast.ExprList).Children {
+				if b, ok := arg.(*ast.BuiltinExpr); !ok || (b.Name != "strptime" && b.Name != "settime") {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a call to strptime() or settime() for argument %d of timediff().", i+1))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+
+		case "isnew":
+			ix, ok := n.Args.(*ast.ExprList).Children[0].(*ast.IndexedExpr)
+			if !ok || len(ix.Index.(*ast.ExprList).Children) == 0 {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting an index of a dimensioned metric for argument 1 of isnew().")
+				n.SetType(types.Error)
+				return n
+			}
+			ix.Lhs.(*ast.IdTerm).Lvalue = true
+
+		case "pathsegment":
+			if !types.Equals(fn.Args[0], types.String) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of pathsegment(), not %v.", fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(fn.Args[1], types.Int) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting an Int for argument 2 of pathsegment(), not %v.", fn.Args[1]))
 				n.SetType(types.Error)
 				return n
 			}
+
+		case "commafy", "statusclass":
+			if !types.Equals(fn.Args[0], types.Int) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting an Int for argument 1 of %s(), not %v.", n.Name, fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "div":
+			for i, arg := range n.Args.(*ast.ExprList).Children {
+				if !types.Equals(fn.Args[i], types.Int) {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting an Int for argument %d of div(), not %v.", i+1, fn.Args[i]))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+
+		case "round":
+			if !types.Equals(fn.Args[0], types.Int) && !types.Equals(fn.Args[0], types.Float) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a numeric value for argument 1 of round(), not %v.", fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(fn.Args[1], types.Int) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting an Int for argument 2 of round(), not %v.", fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "uniq":
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if ix, ok := arg.(*ast.IndexedExpr); ok {
+				arg = ix.Lhs
+			}
+			id, ok := arg.(*ast.IdTerm)
+			if !ok || id.Symbol == nil || c.kinds[id.Symbol] != metrics.Gauge {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a gauge for argument 1 of uniq().")
+				n.SetType(types.Error)
+				return n
+			}
+			id.Lvalue = true
+			if !types.Equals(fn.Args[1], types.String) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting a String for argument 2 of uniq(), not %v.", fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "activeuniq":
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if ix, ok := arg.(*ast.IndexedExpr); ok {
+				arg = ix.Lhs
+			}
+			id, ok := arg.(*ast.IdTerm)
+			if !ok || id.Symbol == nil || c.kinds[id.Symbol] != metrics.Gauge {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a gauge for argument 1 of activeuniq().")
+				n.SetType(types.Error)
+				return n
+			}
+			id.Lvalue = true
+			if !types.Equals(fn.Args[1], types.String) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting a String for argument 2 of activeuniq(), not %v.", fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+			if w := n.Args.(*ast.ExprList).Children[2].(*ast.DurationLit); w.D <= 0 {
+				c.errors.Add(w.Pos(), fmt.Sprintf("The window of activeuniq() must be longer than zero, not %s.", w.D))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "ewma":
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if ix, ok := arg.(*ast.IndexedExpr); ok {
+				arg = ix.Lhs
+			}
+			id, ok := arg.(*ast.IdTerm)
+			if !ok || id.Symbol == nil || c.kinds[id.Symbol] != metrics.Gauge {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a gauge for argument 1 of ewma().")
+				n.SetType(types.Error)
+				return n
+			}
+			id.Lvalue = true
+			for i := 1; i < 3; i++ {
+				if !types.Equals(fn.Args[i], types.Int) && !types.Equals(fn.Args[i], types.Float) {
+					c.errors.Add(n.Args.(*ast.ExprList).Children[i].Pos(), fmt.Sprintf("Expecting a numeric value for argument %d of ewma(), not %v.", i+1, fn.Args[i]))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+			var alpha float64
+			switch a := n.Args.(*ast.ExprList).Children[2].(type) {
+			case *ast.FloatLit:
+				alpha = a.F
+			case *ast.IntLit:
+				alpha = float64(a.I)
+			default:
+				alpha = 1
+			}
+			if alpha <= 0 || alpha > 1 {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[2].Pos(), fmt.Sprintf("The smoothing factor of ewma() must be greater than 0 and at most 1, not %v.", alpha))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "log":
+			if !types.Equals(fn.Args[0], types.String) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of log(), not %v.", fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "percentilerank":
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if ix, ok := arg.(*ast.IndexedExpr); ok {
+				arg = ix.Lhs
+			}
+			id, ok := arg.(*ast.IdTerm)
+			if !ok || id.Symbol == nil || c.kinds[id.Symbol] != metrics.Histogram {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a histogram for argument 1 of percentilerank().")
+				n.SetType(types.Error)
+				return n
+			}
+			id.Lvalue = true
+			if !types.Equals(fn.Args[1], types.Int) && !types.Equals(fn.Args[1], types.Float) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[1].Pos(), fmt.Sprintf("Expecting a numeric value for argument 2 of percentilerank(), not %v.", fn.Args[1]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "jsonpath":
+			for i, arg := range n.Args.(*ast.ExprList).Children {
+				if !types.Equals(fn.Args[i], types.String) {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a String for argument %d of %s(), not %v.", i+1, n.Name, fn.Args[i]))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+			// If the path is defined at compile time, check that it is valid.
+			if p, ok := n.Args.(*ast.ExprList).Children[1].(*ast.StringLit); ok {
+				if _, err := jsonpath.Compile(p.Text); err != nil {
+					c.errors.Add(p.Pos(), err.Error())
+					n.SetType(types.Error)
+					return n
+				}
+			}
+
+		case "base64decode", "contains", "default", "geocountry", "hasprefix", "hassuffix", "journalfield", "lookup", "meta", "normalize", "parseduration", "tolower", "trim", "trimleft", "trimright", "urldecode":
+			for i, arg := range n.Args.(*ast.ExprList).Children {
+				if !types.Equals(fn.Args[i], types.String) {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a String for argument %d of %s(), not %v.", i+1, n.Name, fn.Args[i]))
+					n.SetType(types.Error)
+					return n
+				}
+			}
 		}
 		return n
 
@@ -703,6 +1180,20 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		n.Pattern = pe.pattern.String()
 		return n
 
+	case *ast.PreprocessStmt:
+		if c.scope.Parent != nil {
+			c.errors.Add(n.Pos(), "Can't preprocess lines from inside a block.\n\tTry moving the preprocess statement to the top level of the program.")
+			return n
+		}
+		if len(n.Pattern) > kMaxRegexpLen {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Exceeded maximum regular expression pattern length of %d bytes with %d.\n\tExcessively long patterns are likely to cause compilation and runtime performance problems.", kMaxRegexpLen, len(n.Pattern)))
+			return n
+		}
+		if _, err := types.ParseRegexp(n.Pattern); err != nil {
+			c.errors.Add(n.Pos(), err.Error())
+		}
+		return n
+
 	case *ast.DelStmt:
 		if ix, ok := n.N.(*ast.IndexedExpr); ok {
 			if len(ix.Index.(*ast.ExprList).Children) == 0 {
@@ -718,6 +1209,31 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 	return node
 }
 
+// reversedRange returns true if the range bounds lo and hi are both numeric
+// literals or both string literals, and lo is greater than hi.
+func reversedRange(lo, hi ast.Node) bool {
+	if l, ok := lo.(*ast.StringLit); ok {
+		if h, ok := hi.(*ast.StringLit); ok {
+			return l.Text > h.Text
+		}
+		return false
+	}
+	l, lok := numericLit(lo)
+	h, hok := numericLit(hi)
+	return lok && hok && l > h
+}
+
+// numericLit returns the value of n if it is an integer or float literal.
+func numericLit(n ast.Node) (float64, bool) {
+	switch v := n.(type) {
+	case *ast.IntLit:
+		return float64(v.I), true
+	case *ast.FloatLit:
+		return v.F, true
+	}
+	return 0, false
+}
+
 // checkRegex is a helper method to compile and check a regular expression, and
 // to generate its capture groups as symbols.
 func (c *checker) checkRegex(pattern string, n ast.Node) {
@@ -727,6 +1243,11 @@ func (c *checker) checkRegex(pattern string, n ast.Node) {
 		return
 	}
 	if reAst, err := types.ParseRegexp(pattern); err == nil {
+		if c.builtinArgs > 0 {
+			// Patterns passed to builtins are not matched against the
+			// input, so have no capture groups to refer to.
+			return
+		}
 		// We reserve the names of the capturing groups as declarations
 		// of those symbols, so that future CAPREF tokens parsed can
 		// retrieve their value.  By recording them in the symbol table, we
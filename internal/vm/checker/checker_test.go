@@ -57,8 +57,11 @@ var checkerInvalidPrograms = []struct {
 
 	{"duplicate declaration",
 		"counter foo\ncounter foo\n",
-		[]string{"duplicate declaration:2:9-11: Redeclaration of metric `foo' previously declared at duplicate declaration:1:9-11",
-			"duplicate declaration:1:9-11: Declaration of variable `foo' here is never used."}},
+		[]string{"duplicate declaration:2:9-11: Redeclaration of metric `foo' previously declared at duplicate declaration:1:9-11"}},
+
+	{"duplicate rule name",
+		"counter foo\nrule a: /a/ {\n  foo++\n}\nrule a: /b/ {\n  foo++\n}\n",
+		[]string{"duplicate rule name:5:9-11: Redeclaration of rule `a' previously declared at duplicate rule name:2:9-11"}},
 
 	{"indexedExpr parameter count",
 		`counter n
@@ -124,8 +127,7 @@ const ID /bar/
 /asdf/ {
 }
 `,
-		[]string{"unused symbols:1:9-11: Declaration of variable `foo' here is never used.",
-			"unused symbols:2:7-8: Declaration of named pattern constant `ID' here is never used."}},
+		[]string{"unused symbols:2:7-8: Declaration of named pattern constant `ID' here is never used."}},
 	{"invalid del index count",
 		`gauge t by x, y
 /.*/ {
@@ -242,6 +244,184 @@ l++=l
 		`tolower(2)
 `, []string{"tolower non string:1:9: Expecting a String for argument 1 of tolower(), not Int."}},
 
+	{"urldecode non string",
+		`urldecode(2)
+`, []string{"urldecode non string:1:11: Expecting a String for argument 1 of urldecode(), not Int."}},
+
+	{"geocountry non string",
+		`geocountry(2)
+`, []string{"geocountry non string:1:12: Expecting a String for argument 1 of geocountry(), not Int."}},
+
+	{"default non string fallback",
+		`default("", 2)
+`, []string{"default non string fallback:1:13: Expecting a String for argument 2 of default(), not Int."}},
+
+	{"jsonpath invalid path",
+		`jsonpath("{}", "user.id")
+`, []string{"jsonpath invalid path:1:16-24: JSON path \"user.id\" does not start with $"}},
+
+	{"jsonpath non string path",
+		`jsonpath("{}", 1)
+`, []string{"jsonpath non string path:1:16: Expecting a String for argument 2 of jsonpath(), not Int."}},
+
+	{"base64decode non string",
+		`base64decode(2)
+`, []string{"base64decode non string:1:14: Expecting a String for argument 1 of base64decode(), not Int."}},
+
+	{"journalfield non string",
+		`journalfield(1)
+`, []string{"journalfield non string:1:14: Expecting a String for argument 1 of journalfield(), not Int."}},
+
+	{"preprocess in block",
+		"/foo/ {\n  preprocess /bar/ \"\"\n}\n",
+		[]string{"preprocess in block:2:3-18: Can't preprocess lines from inside a block.", "\tTry moving the preprocess statement to the top level of the program."}},
+
+	{"in reversed range",
+		"/(\\d+)/ {\n  $1 in [299, 200] {\n  }\n}\n",
+		[]string{"in reversed range:2:10-17: Range lower bound is greater than its upper bound."}},
+
+	{"trimright non string cutset",
+		`trimright("a ", 2)
+`, []string{"trimright non string cutset:1:17: Expecting a String for argument 2 of trimright(), not Int."}},
+
+	{"matches string pattern",
+		"/(\\S+)/ {\n  matches($1, \"a\") {\n  }\n}\n",
+		[]string{"matches string pattern:2:15-17: Expecting a regular expression for argument 2 of matches(), not String."}},
+
+	{"pathsegment string index",
+		"counter foo by s\n/(\\S+)/ {\n  foo[pathsegment($1, \"a\")]++\n}\n",
+		[]string{"pathsegment string index:3:23-25: Expecting an Int for argument 2 of pathsegment(), not String."}},
+
+	{"uniq counter",
+		"counter foo\n/(\\S+)/ {\n  uniq(foo, $1)\n}\n",
+		[]string{"uniq counter:3:8-10: Expecting a gauge for argument 1 of uniq()."}},
+
+	{"uniq assigned",
+		"gauge foo\n/(\\S+)/ {\n  foo = uniq(foo, $1)\n}\n",
+		[]string{"uniq assigned:3:21: Can't assign the result of uniq(), which has no value.",
+			"\tTry calling it on its own, as it updates its metric itself."}},
+
+	{"ewma counter",
+		"counter foo\n/(\\d+)/ {\n  ewma(foo, $1, 0.5)\n}\n",
+		[]string{"ewma counter:3:8-10: Expecting a gauge for argument 1 of ewma()."}},
+
+	{"ewma alpha out of range",
+		"gauge foo\n/(\\d+)/ {\n  ewma(foo, $1, 1.5)\n}\n",
+		[]string{"ewma alpha out of range:3:17-19: The smoothing factor of ewma() must be greater than 0 and at most 1, not 1.5."}},
+
+	{"round string places",
+		"gauge foo\n/(\\d+\\.\\d+)/ {\n  foo = round($1, \"a\")\n}\n",
+		[]string{"round string places:3:19-21: Expecting an Int for argument 2 of round(), not String."}},
+
+	{"div string default",
+		"gauge foo\n/(\\d+) (\\d+)/ {\n  foo = div($1, $2, \"none\")\n}\n",
+		[]string{"div string default:3:21-26: Expecting an Int for argument 3 of div(), not String."}},
+
+	{"commafy float",
+		"text foo\n/(\\d+)/ {\n  foo = commafy(1.5)\n}\n",
+		[]string{"commafy float:3:17-19: Expecting an Int for argument 1 of commafy(), not Float."}},
+
+	{"statusclass string",
+		"counter foo by class\n/(\\S+)/ {\n  foo[statusclass($1)]++\n}\n",
+		[]string{"statusclass string:3:19-20: Expecting an Int for argument 1 of statusclass(), not String."}},
+
+	{"activeuniq counter",
+		"counter foo\n/(\\S+)/ {\n  activeuniq(foo, $1, 5m)\n}\n",
+		[]string{"activeuniq counter:3:14-16: Expecting a gauge for argument 1 of activeuniq()."}},
+
+	{"activeuniq zero window",
+		"gauge foo\n/(\\S+)/ {\n  activeuniq(foo, $1, 0s)\n}\n",
+		[]string{"activeuniq zero window:3:23-24: The window of activeuniq() must be longer than zero, not 0s."}},
+
+	{"activeuniq assigned",
+		"gauge foo\n/(\\S+)/ {\n  foo = activeuniq(foo, $1, 5m)\n}\n",
+		[]string{"activeuniq assigned:3:31: Can't assign the result of activeuniq(), which has no value.",
+			"\tTry calling it on its own, as it updates its metric itself."}},
+
+	{"duration argument",
+		"gauge foo\n/(\\S+)/ {\n  uniq(foo, 5m)\n}\n",
+		[]string{"duration argument:3:13-14: Can't use a duration as an argument of uniq()."}},
+
+	{"consistentsample rate out of range",
+		"counter foo\n/(\\S+)/ {\n  consistentsample($1, 2) {\n    foo++\n  }\n}\n",
+		[]string{"consistentsample rate out of range:3:24: The rate of consistentsample() must be between 0 and 1, not 2."}},
+
+	{"consistentsample int key",
+		"counter foo\n/(\\d+)/ {\n  consistentsample($1, 0.5) {\n    foo++\n  }\n}\n",
+		[]string{"consistentsample int key:3:20-21: Expecting a String for argument 1 of consistentsample(), not Int."}},
+
+	{"hasprefix int prefix",
+		"counter foo\n/(\\S+)/ {\n  hasprefix($1, 1) {\n    foo++\n  }\n}\n",
+		[]string{"hasprefix int prefix:3:17: Expecting a String for argument 2 of hasprefix(), not Int."}},
+
+	{"percentilerank gauge",
+		"gauge foo\ngauge bar\n/(\\d+)/ {\n  bar = percentilerank(foo, $1)\n}\n",
+		[]string{"percentilerank gauge:4:24-26: Expecting a histogram for argument 1 of percentilerank()."}},
+
+	{"log int message",
+		"/(\\d+)/ {\n  log(1, $1)\n}\n",
+		[]string{"log int message:2:7: Expecting a String for argument 1 of log(), not Int."}},
+
+	{"foreach split int",
+		"counter foo\n/(\\d+)/ {\n  foreach f in split(1, \" \") {\n    foo++\n  }\n}\n",
+		[]string{"foreach split int:3:22: Expecting a String to split, not Int."}},
+
+	{"timediff starttimer",
+		"gauge foo\n/(\\S+)/ {\n  foo = timediff(starttimer($1), strptime($1, \"2006-01-02\"))\n}\n",
+		[]string{"timediff starttimer:3:31: Expecting a call to strptime() or settime() for argument 1 of timediff()."}},
+
+	{"sample uneven",
+		"counter foo\n/(\\d+)/ {\n  sample(3, 50) {\n    foo++\n  }\n}\n",
+		[]string{
+			"sample uneven:3:15: Can't sample 3 in 50 lines.",
+			"\tTry a sample size that divides the period, like sample(1, 50)."}},
+
+	{"sample in compound condition",
+		"counter foo\n/(\\d+)/ && sample(1, 10) {\n  foo++\n}\n",
+		[]string{
+			"sample in compound condition:2:24: Can't use sample() except as the whole condition of a block.",
+			"\tTry nesting the sample block inside a block with the other conditions."}},
+
+	{"sample as value",
+		"gauge foo\n/(\\d+)/ {\n  foo = sample(1, 10)\n}\n",
+		[]string{
+			"sample as value:3:21: Can't use sample() except as the whole condition of a block.",
+			"\tTry nesting the sample block inside a block with the other conditions."}},
+
+	{"capcount outside match",
+		"counter foo\nfoo += capcount()\n",
+		[]string{"capcount outside match:2:17: capcount() reads the capture groups of a regular expression match, but none is visible to this scope.",
+			"\tTry using capcount() in the block of a regular expression condition."}},
+
+	{"captures outside match",
+		"text foo\nfoo = captures()\n",
+		[]string{"captures outside match:2:16: captures() reads the capture groups of a regular expression match, but none is visible to this scope.",
+			"\tTry using captures() in the block of a regular expression condition."}},
+
+	{"matchcount string pattern",
+		"counter foo\n/(\\S+)/ {\n  foo += matchcount($1, \"a\")\n}\n",
+		[]string{"matchcount string pattern:3:25-27: Expecting a regular expression for argument 2 of matchcount(), not String."}},
+
+	{"sethelp non metric",
+		"counter foo\n/(\\S+)/ {\n  foo++\n  sethelp($1, \"a\")\n}\n",
+		[]string{"sethelp non metric:4:11-12: Expecting a metric for argument 1 of sethelp()."}},
+
+	{"max counter",
+		"counter foo max 10\n/(\\d+)/ {\n  foo++\n}\n",
+		[]string{"max counter:1:9-11: Can't set a maximum for metric `foo'; only gauges can have a maximum."}},
+
+	{"text key of text metric",
+		"text foo by \"text\"\n/(.*)/ {\n  foo[$1] = $1\n}\n",
+		[]string{"text key of text metric:1:6-8: Can't use `text' as a key of text metric `foo'; it holds the exported value."}},
+
+	{"rollup gauge",
+		"gauge foo by a rollup\n/(\\d+)/ {\n  foo[$1]++\n}\n",
+		[]string{"rollup gauge:1:7-9: Can't roll up metric `foo'; only dimensioned counters can be rolled up."}},
+
+	{"rollup without keys",
+		"counter foo rollup\n/(\\d+)/ {\n  foo++\n}\n",
+		[]string{"rollup without keys:1:9-11: Can't roll up metric `foo'; only dimensioned counters can be rolled up."}},
+
 	{"dec non var",
 		`strptime("", "")--
 `, []string{"dec non var:1:16: Expecting a variable here."}},
@@ -254,6 +434,38 @@ l++=l
 	{"cmp to None",
 		`strptime("","")<5{}
 `, []string{"cmp to None:1:15-17: Can't compare LHS of type None with RHS of type Int."}},
+
+	{"set at string timestamp",
+		"gauge foo\n/(\\d+) (\\S+)/ {\n  foo = $1 at $2\n}\n",
+		[]string{"set at string timestamp:3:15-16: Can't use String as a timestamp.", "\tTry using an integer Unix time, or `strptime()' to parse one."}},
+
+	{"observe with string weight",
+		"histogram foo buckets 1, 2\n/(\\d+) (\\S+)/ {\n  foo = $1 by $2\n}\n",
+		[]string{"observe with string weight:3:15-16: Can't use String as a weight.", "\tTry using an integer count of observations."}},
+
+	{"weighted gauge",
+		"gauge foo\n/(\\d+) (\\d+)/ {\n  foo = $1 by $2\n}\n",
+		[]string{"weighted gauge:3:15-16: Can't observe a weighted value in `foo', which is not a histogram."}},
+
+	{"exemplar of gauge",
+		"gauge foo\n/(\\d+) (\\w+)/ {\n  foo = $1 exemplar $2\n}\n",
+		[]string{"exemplar of gauge:3:21-22: Can't record an exemplar for `foo', which is not a histogram."}},
+
+	{"exemplar not string",
+		"histogram foo buckets 1, 2\n/(\\d+)/ {\n  foo = $1 exemplar 3\n}\n",
+		[]string{"exemplar not string:3:21: Can't use Int as an exemplar.", "\tTry using a string trace ID."}},
+
+	{"cumulative gauge",
+		"gauge foo cumulative\n/(\\d+)/ {\n  foo = $1\n}\n",
+		[]string{"cumulative gauge:1:7-9: Can't make non-counter metric `foo' cumulative."}},
+
+	{"isnew scalar",
+		"counter foo\nisnew(foo) {\n  foo++\n}\n",
+		[]string{"isnew scalar:2:7-9: Expecting an index of a dimensioned metric for argument 1 of isnew()."}},
+
+	{"subst string pattern",
+		"text foo\n/(\\S+)/ {\n  foo = subst($1, \"a\", \"b\")\n}\n",
+		[]string{"subst string pattern:3:19-21: Expecting a regular expression for argument 2 of subst(), not String."}},
 }
 
 func TestCheckInvalidPrograms(t *testing.T) {
@@ -283,6 +495,19 @@ func TestCheckInvalidPrograms(t *testing.T) {
 	}
 }
 
+func TestCheckWarnings(t *testing.T) {
+	ast, err := parser.Parse("unused", strings.NewReader(`counter requests
+counter reqeusts
+/GET/ {
+  requests++
+}
+`))
+	testutil.FatalIfErr(t, err)
+	_, warnings, err := checker.CheckWarnings(ast)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "unused:2:9-16: Declaration of variable `reqeusts' here is never used.", warnings.Error())
+}
+
 var checkerValidPrograms = []struct {
 	name    string
 	program string
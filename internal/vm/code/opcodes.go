@@ -74,66 +74,218 @@ const (
 	Fcmp // floating point compare
 	Scmp // string compare
 
+	Flush // Request an immediate export of the metrics.
+
+	Observe // Pop a weight, a value, and a histogram datum off the stack, and observe the value weight times.
+
+	Cset // Set a cumulative counter from a raw value that may have been reset.
+
+	Urldecode // Decode the percent-encoded string at the top of the stack.
+
+	Isnew // Pop `operand' keys and metric off stack, and push true if there was no datum at metric[key,...], creating it.
+
+	// Duration timers
+	Starttimer // Record the timestamp register as the start time of the timer named at the top of the stack.
+	Hastimer   // Push true if the timer named at the top of the stack has been started.
+	Stoptimer  // Push the seconds elapsed since the timer named at the top of the stack was started, and remove it.
+
+	Subst // Replace matches of the regular expression at operand in the string second from top of stack with the string at the top.
+
+	Geocountry // Look up the country code of the IP address at the top of the stack.
+
+	Default // Replace the empty string below the top of the stack with the top of the stack.
+
+	Jsonpath // Extract the value at the JSON path at the top of the stack from the JSON document below it.
+
+	Base64decode // Decode the base64 encoded string at the top of the stack.
+
+	Matchcount // Count the matches of the regular expression at operand in the string at the top of stack.
+
+	Sethelp // Set the help text of the metric second from top of stack to the string at the top.
+
+	Hour // Push the hour of day of the timestamp at the top of stack.
+
+	Weekday // Push the day of week of the timestamp at the top of stack, with Sunday as 0.
+
+	Trim // Trim leading and trailing whitespace from the string at the top of stack.
+
+	Trimleft // Trim leading characters in the cutset at the top of stack from the string second from top.
+
+	Trimright // Trim trailing characters in the cutset at the top of stack from the string second from top.
+
+	Journalfield // Push the value of the journal field of the input line named by the string at the top of stack.
+
+	Inrange // Compare the third from top of stack with the bounds second from top and at top, and push true if it is within them, inclusive.
+
+	Parseduration // Parse the duration string at the top of stack, and push its length in seconds.
+
+	Matches // Push whether the string at the top of stack matches the regular expression at operand.
+
+	Uniq // Add the string at the top of stack to the distinct value sketch of the datum second from top, and set the datum to the estimated count.
+
+	Lookup // Look up the string at the top of stack in the table named by the string second from top, and push the value found.
+
+	Setexemplar // Set the exemplar register to the trace ID string at TOS, to be recorded by the next histogram observation.
+
+	Pathsegment // Push the path segment of the string second from top numbered by the integer at the top of stack.
+
+	Ewma // Update the datum third from top with the value second from top, smoothed by the factor at the top of stack.
+
+	Round // Round the number second from top to the number of decimal places at the top of stack, rounding half to even.
+
+	Setrule  // Set the rule register to the rule name in the operand.
+	Rulename // Push the name of the innermost named rule being executed.
+
+	Meta // Push the value of the metadata field of the input line named at the top of stack.
+
+	Div // Divide the integer third from top by the integer second from top, or push the default at the top of stack if the divisor is zero.
+
+	Commafy // Format an integer with comma-separated thousands
+
+	Hasprefix // Push whether a string begins with a prefix
+
+	Hassuffix // Push whether a string ends with a suffix
+
+	Contains // Push whether a string contains a substring
+
+	Percentilerank // Push the fraction of a histogram's observations at or below a value
+
+	Log // Write a rate-limited message and value to the log
+
+	Split     // Split a string at a separator into the fields of the loop in the operand slot
+	Nextfield // Advance the loop in the operand slot to its next field, pushing whether there is one
+	Field     // Push the current field of the loop in the operand slot
+
+	Timereg // Push the time register as a time value
+
+	Timediff // Push the seconds from the first to the second of two time values
+
+	Sample // Push whether a line is in a random sample of k in n
+
+	Normalize // Normalize a string to Unicode Normalization Form C
+
+	Capcount // Push the number of capture groups that participated in the match of the regexp in the operand.
+
+	Statusclass // Push the class, like 2xx, of the HTTP status code at TOS.
+
+	Captures // Push the named capture groups that participated in the match of the regexp in the operand, as a JSON object.
+
+	Hashsample // Push whether the hash of a key falls in a sample of a fraction of all keys
+
+	Activeuniq // Add a key to the keys seen within the window in the operand by the datum below it, and set the datum to their number
+
 	lastOpcode
 )
 
 var opNames = map[Opcode]string{
-	Stop:        "stop",
-	Match:       "match",
-	Smatch:      "smatch",
-	Cmp:         "cmp",
-	Jnm:         "jnm",
-	Jm:          "jm",
-	Jmp:         "jmp",
-	Inc:         "inc",
-	Strptime:    "strptime",
-	Timestamp:   "timestamp",
-	Settime:     "settime",
-	Push:        "push",
-	Capref:      "capref",
-	Str:         "str",
-	Sset:        "sset",
-	Iset:        "iset",
-	Iadd:        "iadd",
-	Isub:        "isub",
-	Imul:        "imul",
-	Idiv:        "idiv",
-	Imod:        "imod",
-	Ipow:        "ipow",
-	Shl:         "shl",
-	Shr:         "shr",
-	And:         "and",
-	Or:          "or",
-	Xor:         "xor",
-	Not:         "not",
-	Neg:         "neg",
-	Mload:       "mload",
-	Dload:       "dload",
-	Iget:        "iget",
-	Fget:        "fget",
-	Sget:        "sget",
-	Tolower:     "tolower",
-	Length:      "length",
-	Cat:         "cat",
-	Setmatched:  "setmatched",
-	Otherwise:   "otherwise",
-	Del:         "del",
-	Fadd:        "fadd",
-	Fsub:        "fsub",
-	Fmul:        "fmul",
-	Fdiv:        "fdiv",
-	Fmod:        "fmod",
-	Fpow:        "fpow",
-	Fset:        "fset",
-	Getfilename: "getfilename",
-	I2f:         "i2f",
-	S2i:         "s2i",
-	S2f:         "s2f",
-	I2s:         "i2s",
-	F2s:         "f2s",
-	Icmp:        "icmp",
-	Fcmp:        "fcmp",
-	Scmp:        "scmp",
+	Stop:           "stop",
+	Match:          "match",
+	Smatch:         "smatch",
+	Cmp:            "cmp",
+	Jnm:            "jnm",
+	Jm:             "jm",
+	Jmp:            "jmp",
+	Inc:            "inc",
+	Strptime:       "strptime",
+	Timestamp:      "timestamp",
+	Settime:        "settime",
+	Push:           "push",
+	Capref:         "capref",
+	Str:            "str",
+	Sset:           "sset",
+	Iset:           "iset",
+	Iadd:           "iadd",
+	Isub:           "isub",
+	Imul:           "imul",
+	Idiv:           "idiv",
+	Imod:           "imod",
+	Ipow:           "ipow",
+	Shl:            "shl",
+	Shr:            "shr",
+	And:            "and",
+	Or:             "or",
+	Xor:            "xor",
+	Not:            "not",
+	Neg:            "neg",
+	Mload:          "mload",
+	Dload:          "dload",
+	Iget:           "iget",
+	Fget:           "fget",
+	Sget:           "sget",
+	Tolower:        "tolower",
+	Length:         "length",
+	Cat:            "cat",
+	Setmatched:     "setmatched",
+	Otherwise:      "otherwise",
+	Del:            "del",
+	Fadd:           "fadd",
+	Fsub:           "fsub",
+	Fmul:           "fmul",
+	Fdiv:           "fdiv",
+	Fmod:           "fmod",
+	Fpow:           "fpow",
+	Fset:           "fset",
+	Getfilename:    "getfilename",
+	I2f:            "i2f",
+	S2i:            "s2i",
+	S2f:            "s2f",
+	I2s:            "i2s",
+	F2s:            "f2s",
+	Icmp:           "icmp",
+	Fcmp:           "fcmp",
+	Scmp:           "scmp",
+	Flush:          "flush",
+	Observe:        "observe",
+	Cset:           "cset",
+	Urldecode:      "urldecode",
+	Isnew:          "isnew",
+	Starttimer:     "starttimer",
+	Hastimer:       "hastimer",
+	Stoptimer:      "stoptimer",
+	Subst:          "subst",
+	Geocountry:     "geocountry",
+	Default:        "default",
+	Jsonpath:       "jsonpath",
+	Base64decode:   "base64decode",
+	Matchcount:     "matchcount",
+	Sethelp:        "sethelp",
+	Hour:           "hour",
+	Weekday:        "weekday",
+	Trim:           "trim",
+	Trimleft:       "trimleft",
+	Trimright:      "trimright",
+	Journalfield:   "journalfield",
+	Inrange:        "inrange",
+	Parseduration:  "parseduration",
+	Matches:        "matches",
+	Uniq:           "uniq",
+	Lookup:         "lookup",
+	Setexemplar:    "setexemplar",
+	Pathsegment:    "pathsegment",
+	Ewma:           "ewma",
+	Round:          "round",
+	Setrule:        "setrule",
+	Rulename:       "rulename",
+	Meta:           "meta",
+	Div:            "div",
+	Commafy:        "commafy",
+	Hasprefix:      "hasprefix",
+	Hassuffix:      "hassuffix",
+	Contains:       "contains",
+	Percentilerank: "percentilerank",
+	Log:            "log",
+	Split:          "split",
+	Nextfield:      "nextfield",
+	Field:          "field",
+	Timereg:        "timereg",
+	Timediff:       "timediff",
+	Sample:         "sample",
+	Normalize:      "normalize",
+	Capcount:       "capcount",
+	Statusclass:    "statusclass",
+	Captures:       "captures",
+	Hashsample:     "hashsample",
+	Activeuniq:     "activeuniq",
 }
 
 func (o Opcode) String() string {
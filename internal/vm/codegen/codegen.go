@@ -31,6 +31,9 @@ type codegen struct {
 
 	l     []int           // Label table for recording jump destinations.
 	decos []*ast.DecoStmt // Decorator stack to unwind when entering decorated blocks.
+	rules []string        // Names of the enclosing named rules, innermost last.
+	loops int             // Number of foreach loops, which each get a field slot.
+	scale int64           // If greater than one, increments are multiplied by it, in a sample block.
 }
 
 // CodeGen is the function that compiles the program to bytecode and data.
@@ -161,6 +164,9 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 		m.Hidden = n.Hidden
+		m.Cumulative = n.Cumulative
+		m.Rollup = n.Rollup
+		m.Max = n.Max
 		n.Symbol.Binding = m
 		n.Symbol.Addr = len(c.obj.Metrics)
 		c.obj.Metrics = append(c.obj.Metrics, m)
@@ -169,19 +175,52 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.CondStmt:
 		lElse := c.newLabel()
 		lEnd := c.newLabel()
+		// A named rule is set before its condition, so that the time spent
+		// matching its pattern is attributed to it.
+		outer := ""
+		if len(c.rules) > 0 {
+			outer = c.rules[len(c.rules)-1]
+		}
+		if n.Name != "" {
+			c.emit(n, code.Setrule, n.Name)
+			c.rules = append(c.rules, n.Name)
+		}
 		if n.Cond != nil {
 			n.Cond = ast.Walk(c, n.Cond)
 			c.emit(n, code.Jnm, lElse)
 		}
+		// Scale the increments in a sample block by the period over the
+		// sample size, so that the counts estimate those of every line.
+		scale := c.scale
+		if b, ok := n.Cond.(*ast.BuiltinExpr); ok && b.Name == "sample" {
+			args := b.Args.(*ast.ExprList).Children
+			if c.scale == 0 {
+				c.scale = 1
+			}
+			c.scale *= args[1].(*ast.IntLit).I / args[0].(*ast.IntLit).I
+		}
 		// Set matched flag false for children.
 		c.emit(n, code.Setmatched, false)
 		n.Truth = ast.Walk(c, n.Truth)
+		c.scale = scale
+		if n.Name != "" {
+			c.rules = c.rules[:len(c.rules)-1]
+		}
+		// Restore the name of the enclosing rule on the way to the else
+		// block or the end; without an else block the true branch falls
+		// through to the restore after lElse.
+		if n.Name != "" && n.Else != nil {
+			c.emit(n, code.Setrule, outer)
+		}
 		// Re-set matched flag to true for rest of current block.
 		c.emit(n, code.Setmatched, true)
 		if n.Else != nil {
 			c.emit(n, code.Jmp, lEnd)
 		}
 		c.setLabel(lElse)
+		if n.Name != "" {
+			c.emit(n, code.Setrule, outer)
+		}
 		if n.Else != nil {
 			n.Else = ast.Walk(c, n.Else)
 		}
@@ -213,7 +252,38 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		c.emit(n, code.Stop, nil)
 
+	case *ast.PreprocessStmt:
+		re, err := regexp.Compile(n.Pattern)
+		if err != nil {
+			c.errorf(n.Pos(), "%s", err)
+			return nil, n
+		}
+		c.obj.Preprocess = append(c.obj.Preprocess, object.Replacement{Regexp: re, Replacement: n.Replacement})
+
+	case *ast.ForeachStmt:
+		// Split the string into the fields of a new slot, then run the block
+		// once per field until Nextfield finds no more.
+		n.Str = ast.Walk(c, n.Str)
+		n.Sep = ast.Walk(c, n.Sep)
+		slot := c.loops
+		c.loops++
+		n.Symbol.Addr = slot
+		c.emit(n, code.Split, slot)
+		lLoop := c.newLabel()
+		lEnd := c.newLabel()
+		c.setLabel(lLoop)
+		c.emit(n, code.Nextfield, slot)
+		c.emit(n, code.Jnm, lEnd)
+		n.Block = ast.Walk(c, n.Block)
+		c.emit(n, code.Jmp, lLoop)
+		c.setLabel(lEnd)
+		return nil, n
+
 	case *ast.IdTerm:
+		if n.Symbol != nil && n.Symbol.Kind == symbol.LoopSymbol {
+			c.emit(n, code.Field, n.Symbol.Addr)
+			break
+		}
 		if n.Symbol == nil || n.Symbol.Kind != symbol.VarSymbol {
 			break
 		}
@@ -305,6 +375,67 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.OtherwiseStmt:
 		c.emit(n, code.Otherwise, nil)
 
+	case *ast.BuiltinExpr:
+		if n.Name == "sethelp" {
+			// Load only the metric, not a datum, as the help text belongs to
+			// the metric itself.
+			args := n.Args.(*ast.ExprList).Children
+			c.emit(n, code.Mload, args[0].(*ast.IdTerm).Symbol.Addr)
+			ast.Walk(c, args[1])
+			c.emit(n, code.Sethelp, nil)
+			return nil, n
+		}
+		if n.Name == "capcount" || n.Name == "captures" {
+			// The checker binds the whole match of the innermost regular
+			// expression as the argument; only its index is needed.
+			cr := n.Args.(*ast.ExprList).Children[0].(*ast.CaprefTerm)
+			c.emit(n, builtin[n.Name], cr.Symbol.Binding.(*ast.PatternExpr).Index)
+			return nil, n
+		}
+		if n.Name == "activeuniq" {
+			// The window is a constant, so it is the operand.
+			args := n.Args.(*ast.ExprList).Children
+			ast.Walk(c, args[0])
+			ast.Walk(c, args[1])
+			c.emit(n, code.Activeuniq, args[2].(*ast.DurationLit).D)
+			return nil, n
+		}
+		if n.Name == "timediff" {
+			// Read back the time register set by each argument.
+			for _, arg := range n.Args.(*ast.ExprList).Children {
+				ast.Walk(c, arg)
+				c.emit(n, code.Timereg, nil)
+			}
+			c.emit(n, code.Timediff, nil)
+			return nil, n
+		}
+		if n.Name != "subst" && n.Name != "matchcount" && n.Name != "matches" {
+			break
+		}
+		// The pattern is not matched against the input, so compile it
+		// without emitting a match instruction.
+		args := n.Args.(*ast.ExprList).Children
+		pe := args[1].(*ast.PatternExpr)
+		re, err := regexp.Compile(pe.Pattern)
+		if err != nil {
+			c.errorf(n.Pos(), "%s", err)
+			return nil, n
+		}
+		c.obj.Regexps = append(c.obj.Regexps, re)
+		pe.Index = len(c.obj.Regexps) - 1
+		ast.Walk(c, args[0])
+		switch n.Name {
+		case "matchcount":
+			c.emit(n, code.Matchcount, pe.Index)
+			return nil, n
+		case "matches":
+			c.emit(n, code.Matches, pe.Index)
+			return nil, n
+		}
+		ast.Walk(c, args[2])
+		c.emit(n, code.Subst, pe.Index)
+		return nil, n
+
 	case *ast.DelStmt:
 		if n.Expiry > 0 {
 			c.emit(n, code.Push, n.Expiry)
@@ -395,13 +526,56 @@ func getOpcodeForType(op int, opT types.Type) (code.Opcode, error) {
 }
 
 var builtin = map[string]code.Opcode{
-	"getfilename": code.Getfilename,
-	"len":         code.Length,
-	"settime":     code.Settime,
-	"strptime":    code.Strptime,
-	"strtol":      code.S2i,
-	"timestamp":   code.Timestamp,
-	"tolower":     code.Tolower,
+	"activeuniq":       code.Activeuniq,
+	"base64decode":     code.Base64decode,
+	"capcount":         code.Capcount,
+	"captures":         code.Captures,
+	"commafy":          code.Commafy,
+	"consistentsample": code.Hashsample,
+	"contains":         code.Contains,
+	"default":          code.Default,
+	"div":              code.Div,
+	"ewma":             code.Ewma,
+	"flush":            code.Flush,
+	"geocountry":       code.Geocountry,
+	"getfilename":      code.Getfilename,
+	"hasprefix":        code.Hasprefix,
+	"hassuffix":        code.Hassuffix,
+	"hastimer":         code.Hastimer,
+	"hour":             code.Hour,
+	"isnew":            code.Isnew,
+	"journalfield":     code.Journalfield,
+	"jsonpath":         code.Jsonpath,
+	"len":              code.Length,
+	"log":              code.Log,
+	"lookup":           code.Lookup,
+	"matchcount":       code.Matchcount,
+	"matches":          code.Matches,
+	"meta":             code.Meta,
+	"normalize":        code.Normalize,
+	"parseduration":    code.Parseduration,
+	"pathsegment":      code.Pathsegment,
+	"percentilerank":   code.Percentilerank,
+	"round":            code.Round,
+	"rulename":         code.Rulename,
+	"sample":           code.Sample,
+	"sethelp":          code.Sethelp,
+	"settime":          code.Settime,
+	"starttimer":       code.Starttimer,
+	"statusclass":      code.Statusclass,
+	"stoptimer":        code.Stoptimer,
+	"strptime":         code.Strptime,
+	"strtol":           code.S2i,
+	"subst":            code.Subst,
+	"timediff":         code.Timediff,
+	"timestamp":        code.Timestamp,
+	"tolower":          code.Tolower,
+	"trim":             code.Trim,
+	"trimleft":         code.Trimleft,
+	"trimright":        code.Trimright,
+	"uniq":             code.Uniq,
+	"urldecode":        code.Urldecode,
+	"weekday":          code.Weekday,
 }
 
 func (c *codegen) VisitAfter(node ast.Node) ast.Node {
@@ -426,14 +600,33 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
+		case "isnew":
+			// overwrite the dload instruction
+			pc := c.pc()
+			if c.obj.Program[pc].Opcode != code.Dload {
+				c.errorf(n.Pos(), "internal compiler error: expecting a dload for isnew but saw a %s instead", c.obj.Program[pc].Opcode)
+				return n
+			}
+			c.obj.Program[pc].Opcode = code.Isnew
+
 		default:
 			c.emit(n, builtin[n.Name], arglen)
 		}
 	case *ast.UnaryExpr:
 		switch n.Op {
 		case parser.INC:
+			if c.scale > 1 {
+				c.emit(n, code.Push, c.scale)
+				c.emit(n, code.Inc, 0)
+				break
+			}
 			c.emit(n, code.Inc, nil)
 		case parser.DEC:
+			if c.scale > 1 {
+				c.emit(n, code.Push, c.scale)
+				c.emit(n, code.Dec, 0)
+				break
+			}
 			c.emit(n, code.Dec, nil)
 		case parser.NOT:
 			c.emit(n, code.Neg, nil)
@@ -489,8 +682,16 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 			// When operand is not nil, inc pops the delta from the stack.
 			switch {
 			case types.Equals(n.Type(), types.Int):
+				if c.scale > 1 {
+					c.emit(n, code.Push, c.scale)
+					c.emit(n, code.Imul, nil)
+				}
 				c.emit(n, code.Inc, 0)
 			case types.Equals(n.Type(), types.Float), types.Equals(n.Type(), types.String):
+				if c.scale > 1 && types.Equals(n.Type(), types.Float) {
+					c.emit(n, code.Push, float64(c.scale))
+					c.emit(n, code.Fmul, nil)
+				}
 				// Already walked the lhs and rhs of this expression
 				opcode, err := getOpcodeForType(parser.PLUS, n.Type())
 				if err != nil {
@@ -510,6 +711,21 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 		case parser.PLUS, parser.MINUS, parser.MUL, parser.DIV, parser.MOD, parser.POW, parser.ASSIGN:
+			rhs := n.Rhs
+			if r, ok := rhs.(*ast.BinaryExpr); ok && r.Op == parser.EXEMPLAR {
+				rhs = r.Lhs
+			}
+			if r, ok := rhs.(*ast.BinaryExpr); ok && r.Op == parser.BY {
+				// A weighted observation leaves the value and weight on the stack.
+				c.emit(n, code.Observe, nil)
+				return n
+			}
+			if n.Op == parser.ASSIGN {
+				if m := lvalueMetric(n.Lhs); m != nil && m.Cumulative {
+					c.emit(n, code.Cset, nil)
+					return n
+				}
+			}
 			opcode, err := getOpcodeForType(n.Op, n.Type())
 			if err != nil {
 				c.errorf(n.Pos(), "%s", err)
@@ -542,6 +758,26 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 			c.obj.Program[c.pc()].Opcode = code.Smatch
 			c.emit(n, code.Not, nil)
 
+		case parser.AT:
+			// A None-typed timestamp expression like strptime() has already
+			// stored into the time register, otherwise it's on the stack.
+			if types.Equals(n.Rhs.Type(), types.Int) {
+				c.emit(n, code.Settime, 1)
+			}
+
+		case parser.BY:
+			// skip, handled by the assignment.
+
+		case parser.EXEMPLAR:
+			// The trace ID is recorded by the observation in the assignment.
+			c.emit(n, code.Setexemplar, nil)
+
+		case parser.IN:
+			c.emit(n, code.Inrange, nil)
+
+		case parser.COMMA:
+			// skip, the range bounds are compared by inrange.
+
 		case parser.CONCAT:
 			// skip
 
@@ -558,6 +794,20 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 	return node
 }
 
+// lvalueMetric returns the metric bound to the assignment target n, or nil if
+// there is none.
+func lvalueMetric(n ast.Node) *metrics.Metric {
+	if i, ok := n.(*ast.IndexedExpr); ok {
+		n = i.Lhs
+	}
+	id, ok := n.(*ast.IdTerm)
+	if !ok || id.Symbol == nil {
+		return nil
+	}
+	m, _ := id.Symbol.Binding.(*metrics.Metric)
+	return m
+}
+
 func (c *codegen) emitConversion(n ast.Node, inType, outType types.Type) error {
 	glog.V(2).Infof("Conversion: %q to %q", inType, outType)
 	switch {
@@ -13,6 +13,7 @@ import (
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/object"
 	"github.com/google/mtail/internal/vm/parser"
 )
 
@@ -467,6 +468,958 @@ getfilename()
 		},
 	},
 
+	{"subst", `text path
+/GET (\S+)/ {
+  path = subst($1, /\d+/, ":id")
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Subst, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"urldecode", `text path
+/GET (\S+)/ {
+  path = urldecode($1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Urldecode, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"default", `counter requests_total by method
+/^(\S+) (GET)?/ {
+  requests_total[default($2, "unknown")]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 2, 2},
+			{code.Str, 0, 2},
+			{code.Default, 2, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Inc, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"jsonpath", `counter requests_total by user
+/^(?P<json>\{.*\})$/ {
+  requests_total[jsonpath($json, "$.user.id")]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Jsonpath, 2, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Inc, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"base64decode", `text user
+/token=(\S+)/ {
+  user = base64decode($1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Base64decode, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"matchcount", `counter c
+/(.*)/ {
+  c += matchcount($1, /,/)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Matchcount, 1, 2},
+			{code.Inc, 0, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"sethelp", `counter c by a
+/(.*)/ {
+  sethelp(c, $1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 8, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Sethelp, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"hour", `gauge h
+/(.*)/ {
+  h = hour(timestamp())
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 9, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Timestamp, 0, 2},
+			{code.Hour, 1, 2},
+			{code.Iset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"trim", `text t
+/(.*)/ {
+  t = trim($1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Trim, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"trimleft", `text t
+/(.*)/ {
+  t = trimleft($1, "0")
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Trimleft, 2, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"journalfield", `text unit
+// {
+  unit = journalfield("_SYSTEMD_UNIT")
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 9, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Str, 0, 2},
+			{code.Journalfield, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"meta", `text severity
+// {
+  severity = meta("severity")
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 9, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Str, 0, 2},
+			{code.Meta, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"in range", `counter c
+/(\d+)/ {
+  $1 in [200, 299] {
+    c++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 16, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Push, int64(200), 2},
+			{code.Push, int64(299), 2},
+			{code.Inrange, nil, 2},
+			{code.Jnm, 15, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"parseduration", `gauge latency
+/(.*)/ {
+  latency = parseduration($1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Parseduration, 1, 2},
+			{code.Fset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"matches", `counter c
+/(.*)/ {
+  matches($1, /\.php$/) {
+    c++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 13, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Matches, 1, 2},
+			{code.Jnm, 12, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"uniq", `gauge clients by host
+/(?P<host>\S+) (?P<ip>\S+)/ {
+  uniq(clients[$host], $ip)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 2, 2},
+			{code.Uniq, 2, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"ewma", `gauge latency
+/(\d+)/ {
+  ewma(latency, $1, 0.5)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Push, 0.5, 2},
+			{code.Ewma, 3, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"round", `gauge latency by bucket
+/(\d+\.\d+)/ {
+  latency[string(round($1, 1))] = $1
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 16, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2f, nil, 2},
+			{code.Push, int64(1), 2},
+			{code.Round, 2, 2},
+			{code.F2s, nil, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2f, nil, 2},
+			{code.Fset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"named rules", `counter hits by name
+rule errors: /error/ {
+  hits[rulename()]++
+  rule timeouts: /timeout/ {
+    hits[rulename()]++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Setrule, "errors", 1},
+			{code.Match, 0, 1},
+			{code.Jnm, 19, 1},
+			{code.Setmatched, false, 1},
+			{code.Rulename, 0, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Inc, nil, 2},
+			{code.Setrule, "timeouts", 3},
+			{code.Match, 1, 3},
+			{code.Jnm, 17, 3},
+			{code.Setmatched, false, 3},
+			{code.Rulename, 0, 4},
+			{code.Mload, 0, 4},
+			{code.Dload, 1, 4},
+			{code.Inc, nil, 4},
+			{code.Setmatched, true, 3},
+			{code.Setrule, "errors", 3},
+			{code.Setmatched, true, 1},
+			{code.Setrule, "", 1},
+		},
+	},
+
+	{"div", `gauge ratio
+/(\d+) (\d+)/ {
+  ratio = div($1, $2, 0)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 15, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 2, 2},
+			{code.S2i, nil, 2},
+			{code.Push, int64(0), 2},
+			{code.Div, 3, 2},
+			{code.Iset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"commafy", `text last_bytes
+/(\d+)/ {
+  last_bytes = commafy($1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Commafy, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"hasprefix", `counter c
+/(.*)/ {
+  hasprefix($1, "GET") {
+    c++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 14, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Hasprefix, 2, 2},
+			{code.Jnm, 13, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"hassuffix", `counter c
+/(.*)/ {
+  hassuffix($1, ".php") {
+    c++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 14, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Hassuffix, 2, 2},
+			{code.Jnm, 13, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"contains", `counter c
+/(.*)/ {
+  contains($1, "/v1/") {
+    c++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 14, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Contains, 2, 2},
+			{code.Jnm, 13, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"percentilerank", `histogram latency buckets 10, 100
+gauge rank
+/(\d+)/ {
+  rank = percentilerank(latency, $1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 2},
+			{code.Jnm, 13, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 1, 3},
+			{code.Dload, 0, 3},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Push, 0, 3},
+			{code.Capref, 1, 3},
+			{code.S2i, nil, 3},
+			{code.Percentilerank, 2, 3},
+			{code.Fset, nil, 3},
+			{code.Setmatched, true, 2},
+		},
+	},
+
+	{"log", `/(\d+)/ {
+  log("got", $1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 0},
+			{code.Jnm, 9, 0},
+			{code.Setmatched, false, 0},
+			{code.Str, 0, 1},
+			{code.Push, 0, 1},
+			{code.Capref, 1, 1},
+			{code.S2i, nil, 1},
+			{code.Log, 2, 1},
+			{code.Setmatched, true, 0},
+		},
+	},
+
+	{"foreach split", `counter fields by field
+/(.*)/ {
+  foreach f in split($1, " ") {
+    fields[f]++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 15, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Split, 0, 2},
+			{code.Nextfield, 0, 2},
+			{code.Jnm, 14, 2},
+			{code.Field, 0, 3},
+			{code.Mload, 0, 3},
+			{code.Dload, 1, 3},
+			{code.Inc, nil, 3},
+			{code.Jmp, 7, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"timediff", `gauge duration
+/^(\S+) (\S+)$/ {
+  duration = timediff(strptime($1, "2006-01-02T15:04:05Z07:00"), strptime($2, "2006-01-02T15:04:05Z07:00"))
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 18, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Str, 0, 2},
+			{code.Strptime, 2, 2},
+			{code.Timereg, nil, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 2, 2},
+			{code.Str, 1, 2},
+			{code.Strptime, 2, 2},
+			{code.Timereg, nil, 2},
+			{code.Timediff, nil, 2},
+			{code.Fset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"sample", `counter requests
+counter bytes
+/(\d+)/ {
+  sample(1, 50) {
+    requests++
+    bytes += $1
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 2},
+			{code.Jnm, 22, 2},
+			{code.Setmatched, false, 2},
+			{code.Push, int64(1), 3},
+			{code.Push, int64(50), 3},
+			{code.Sample, 2, 3},
+			{code.Jnm, 21, 3},
+			{code.Setmatched, false, 3},
+			{code.Mload, 0, 4},
+			{code.Dload, 0, 4},
+			{code.Push, int64(50), 4},
+			{code.Inc, 0, 4},
+			{code.Mload, 1, 5},
+			{code.Dload, 0, 5},
+			{code.Push, 0, 5},
+			{code.Capref, 1, 5},
+			{code.S2i, nil, 5},
+			{code.Push, int64(50), 5},
+			{code.Imul, nil, 5},
+			{code.Inc, 0, 5},
+			{code.Setmatched, true, 3},
+			{code.Setmatched, true, 2},
+		},
+	},
+
+	{"normalize", `counter visits by city
+/city=(\S+)/ {
+  visits[normalize($1)]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Normalize, 1, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Inc, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"capcount", `gauge groups
+/(a)|(b)(c)/ {
+  groups = capcount()
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 8, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Capcount, 0, 2},
+			{code.Iset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"statusclass", `counter requests by class
+/(\d+)/ {
+  requests[statusclass($1)]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Statusclass, 1, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Inc, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"activeuniq", `gauge active_users
+/user=(\S+)/ {
+  activeuniq(active_users, $1, 5m)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 9, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Activeuniq, 5 * time.Minute, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"consistentsample", `counter sampled
+/user=(\S+)/ {
+  consistentsample($1, 0.25) {
+    sampled++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 14, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Push, 0.25, 2},
+			{code.Hashsample, 2, 2},
+			{code.Jnm, 13, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"captures", `text last
+/(?P<a>a)|(?P<b>b)/ {
+  last = captures()
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 8, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Captures, 0, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"pathsegment", `counter requests by section
+/GET (\S+)/ {
+  requests[pathsegment($1, 1)]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 11, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Push, int64(1), 2},
+			{code.Pathsegment, 2, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 1, 2},
+			{code.Inc, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"geocountry", `text country
+/^(\S+) / {
+  country = geocountry($1)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Geocountry, 1, 2},
+			{code.Sset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"isnew", `hidden counter seen by session
+counter sessions
+/session=(\S+)/ {
+  isnew(seen[$1]) {
+    sessions++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 2},
+			{code.Jnm, 14, 2},
+			{code.Setmatched, false, 2},
+			{code.Push, 0, 3},
+			{code.Capref, 1, 3},
+			{code.Mload, 0, 3},
+			{code.Isnew, 1, 3},
+			{code.Jnm, 13, 3},
+			{code.Setmatched, false, 3},
+			{code.Mload, 1, 4},
+			{code.Dload, 0, 4},
+			{code.Inc, nil, 4},
+			{code.Setmatched, true, 3},
+			{code.Setmatched, true, 2},
+		},
+	},
+
+	{"duration timers", `gauge g
+/(\w+) start/ {
+  starttimer($1)
+}
+/(\w+) end/ {
+  hastimer($1) {
+    g = stoptimer($1)
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 7, 1},
+			{code.Setmatched, false, 1},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.Starttimer, 1, 2},
+			{code.Setmatched, true, 1},
+			{code.Match, 1, 4},
+			{code.Jnm, 23, 4},
+			{code.Setmatched, false, 4},
+			{code.Push, 1, 5},
+			{code.Capref, 1, 5},
+			{code.Hastimer, 1, 5},
+			{code.Jnm, 22, 5},
+			{code.Setmatched, false, 5},
+			{code.Mload, 0, 6},
+			{code.Dload, 0, 6},
+			{code.Push, 1, 6},
+			{code.Capref, 1, 6},
+			{code.Stoptimer, 1, 6},
+			{code.Fset, nil, 6},
+			{code.Setmatched, true, 5},
+			{code.Setmatched, true, 4},
+		},
+	},
+
+	{"flush", `
+flush()
+`,
+		[]code.Instr{
+			{code.Flush, 0, 1},
+		},
+	},
+
+	{"add assign expression", `counter foo
+/(\d+)/ {
+  foo += $1 * 2
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 12, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Push, int64(2), 2},
+			{code.Imul, nil, 2},
+			{code.Inc, 0, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"cumulative counter", `counter c cumulative
+/(\d+)/ {
+  c = $1
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 10, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Cset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"weighted observe", `histogram h buckets 1, 2
+/(\d+) (\d+)/ {
+  h = $1 by $2
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 14, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.I2f, nil, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 2, 2},
+			{code.S2i, nil, 2},
+			{code.Observe, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
+	{"observe with exemplar", `histogram h buckets 1, 2
+/(\d+) (\w+)/ {
+  h = $1 exemplar $2
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 13, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 1, 2},
+			{code.S2i, nil, 2},
+			{code.Push, 0, 2},
+			{code.Capref, 2, 2},
+			{code.Setexemplar, nil, 2},
+			{code.Iset, nil, 2},
+			{code.Setmatched, true, 1},
+		},
+	},
+
 	{"dimensioned counter",
 		`counter c by a,b,c
 /(\d) (\d) (\d)/ {
@@ -854,6 +1807,17 @@ stop
 `, []code.Instr{
 		{code.Stop, nil, 1},
 	}},
+	{"drop", `
+/^debug/ {
+  drop
+}
+`, []code.Instr{
+		{code.Match, 0, 1},
+		{code.Jnm, 5, 1},
+		{code.Setmatched, false, 1},
+		{code.Stop, nil, 2},
+		{code.Setmatched, true, 1},
+	}},
 	{"stop inside", `
 // {
 stop
@@ -899,6 +1863,46 @@ foo += $value_ms / 1000.0
 		{code.Fset, nil, 3},
 		{code.Setmatched, true, 2},
 	}},
+	{"set at timestamp", `
+gauge temp
+/(\d+) (\d+)/ {
+  temp = $1 at $2
+}`, []code.Instr{
+		{code.Match, 0, 2},
+		{code.Jnm, 14, 2},
+		{code.Setmatched, false, 2},
+		{code.Mload, 0, 3},
+		{code.Dload, 0, 3},
+		{code.Push, 0, 3},
+		{code.Capref, 1, 3},
+		{code.S2i, nil, 3},
+		{code.Push, 0, 3},
+		{code.Capref, 2, 3},
+		{code.S2i, nil, 3},
+		{code.Settime, 1, 3},
+		{code.Iset, nil, 3},
+		{code.Setmatched, true, 2},
+	}},
+	{"set at strptime", `
+gauge temp
+/(\d+) (\S+)/ {
+  temp = $1 at strptime($2, "2006-01-02T15:04:05")
+}`, []code.Instr{
+		{code.Match, 0, 2},
+		{code.Jnm, 14, 2},
+		{code.Setmatched, false, 2},
+		{code.Mload, 0, 3},
+		{code.Dload, 0, 3},
+		{code.Push, 0, 3},
+		{code.Capref, 1, 3},
+		{code.S2i, nil, 3},
+		{code.Push, 0, 3},
+		{code.Capref, 2, 3},
+		{code.Str, 0, 3},
+		{code.Strptime, 2, 3},
+		{code.Iset, nil, 3},
+		{code.Setmatched, true, 2},
+	}},
 }
 
 func TestCodegen(t *testing.T) {
@@ -921,3 +1925,68 @@ func TestCodegen(t *testing.T) {
 		})
 	}
 }
+
+func TestCodegenRegexFlags(t *testing.T) {
+	compile := func(name, source string) *object.Object {
+		ast, err := parser.Parse(name, strings.NewReader(source))
+		testutil.FatalIfErr(t, err)
+		ast, err = checker.Check(ast)
+		testutil.FatalIfErr(t, err)
+		obj, err := codegen.CodeGen(name, ast)
+		testutil.FatalIfErr(t, err)
+		return obj
+	}
+	flagged := compile("flagged", "counter errors\n/error/i {\n  errors++\n}\n")
+	inline := compile("inline", "counter errors\n/(?i)error/ {\n  errors++\n}\n")
+
+	testutil.ExpectNoDiff(t, inline.Program, flagged.Program, testutil.AllowUnexported(code.Instr{}))
+
+	for _, line := range []string{"error", "ERROR", "An Error occurred", "no problems"} {
+		if inline.Regexps[0].MatchString(line) != flagged.Regexps[0].MatchString(line) {
+			t.Errorf("%q: /error/i matched %v, /(?i)error/ matched %v", line, flagged.Regexps[0].MatchString(line), inline.Regexps[0].MatchString(line))
+		}
+	}
+}
+
+func TestCodegenBlockSharesMatch(t *testing.T) {
+	source := `counter total
+counter errors by kind
+/error (\S+)/ {
+  total++
+  errors[$1]++
+}
+`
+	ast, err := parser.Parse("shared", strings.NewReader(source))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen("shared", ast)
+	testutil.FatalIfErr(t, err)
+
+	matches := 0
+	for _, i := range obj.Program {
+		if i.Opcode == code.Match {
+			matches++
+		}
+	}
+	if matches != 1 {
+		t.Fatalf("expected one match instruction, got %d:\n%v", matches, obj.Program)
+	}
+	// The match and its jump guard the whole block, so that both increments
+	// are skipped when the pattern doesn't match.
+	if obj.Program[0].Opcode != code.Match || obj.Program[1].Opcode != code.Jnm {
+		t.Fatalf("expected the block to begin with match and jnm, got %v", obj.Program[:2])
+	}
+	if target := obj.Program[1].Operand.(int); target != len(obj.Program) {
+		t.Errorf("jnm jumps to %d, not past the block at %d", target, len(obj.Program))
+	}
+	incs := 0
+	for _, i := range obj.Program[2:] {
+		if i.Opcode == code.Inc {
+			incs++
+		}
+	}
+	if incs != 2 {
+		t.Errorf("expected two increments in the block, got %d", incs)
+	}
+}
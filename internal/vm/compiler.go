@@ -4,6 +4,7 @@
 package vm
 
 import (
+	"bytes"
 	"io"
 	"path/filepath"
 	"time"
@@ -16,11 +17,22 @@ import (
 
 // Compile compiles a program from the input into a virtual machine or a list
 // of compile errors.  It takes the program's name and the metric store as
-// additional arguments to build the virtual machine.
-func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location) (*VM, error) {
-	name = filepath.Base(name)
+// additional arguments to build the virtual machine.  The optional tags
+// select which `# +build' sections of the program are compiled.
+func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location, tags ...string) (*VM, error) {
+	return compile(filepath.Base(name), input, emitAst, emitAstTypes, syslogUseCurrentYear, loc, tags...)
+}
+
+// CompileBytes compiles the program source in src into a virtual machine or a
+// list of compile errors.  Unlike Compile, the name is used exactly as given
+// in the VM and in the positions of compile errors, so it need not be a file
+// name.
+func CompileBytes(name string, src []byte) (*VM, error) {
+	return compile(name, bytes.NewReader(src), false, false, false, nil)
+}
 
-	ast, err := parser.Parse(name, input)
+func compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location, tags ...string) (*VM, error) {
+	ast, err := parser.Parse(name, input, tags...)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +41,8 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 		glog.Infof("%s AST:\n%s", name, s.Dump(ast))
 	}
 
-	if ast, err = checker.Check(ast); err != nil {
+	ast, warnings, err := checker.CheckWarnings(ast)
+	if err != nil {
 		return nil, err
 	}
 	if emitAstTypes {
@@ -44,5 +57,8 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 	}
 
 	vm := New(name, obj, syslogUseCurrentYear, loc)
+	for _, w := range warnings {
+		vm.warnings = append(vm.warnings, w.Error())
+	}
 	return vm, nil
 }
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/vm"
 )
 
@@ -38,3 +39,111 @@ func TestCompileCodegen(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCompileWarnings(t *testing.T) {
+	r := strings.NewReader(`counter i
+counter unused
+// {
+  i++
+}`)
+	v, err := vm.Compile("test", r, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"test:2:9-14: Declaration of variable `unused' here is never used."}
+	testutil.ExpectNoDiff(t, expected, v.Warnings())
+}
+
+func TestCompileBuildTags(t *testing.T) {
+	prog := `counter j
+# +build prod
+counter i
+// {
+  i++
+}
+# +end
+/x/ {
+  j++
+}
+`
+	without, err := vm.Compile("test", strings.NewReader(prog), false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with, err := vm.Compile("test", strings.NewReader(prog), false, false, false, nil, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if without.DumpByteCode() == with.DumpByteCode() {
+		t.Errorf("expected differing bytecode with and without build tag, got:\n%s", with.DumpByteCode())
+	}
+	if len(without.DumpByteCode()) >= len(with.DumpByteCode()) {
+		t.Errorf("excluded section emitted bytecode:\n%s", without.DumpByteCode())
+	}
+}
+
+func TestCompileUnterminatedBuildTag(t *testing.T) {
+	r := strings.NewReader(`counter i
+# +build prod
+// {
+  i++
+}`)
+	_, err := vm.Compile("test", r, false, false, false, nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestCompileUnterminatedIncludedBuildTag(t *testing.T) {
+	r := strings.NewReader(`counter i
+# +build prod
+// {
+  i++
+}`)
+	_, err := vm.Compile("test", r, false, false, false, nil, "prod")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestCompileUnexpectedBuildEnd(t *testing.T) {
+	r := strings.NewReader(`counter i
+// {
+  i++
+}
+# +end
+`)
+	_, err := vm.Compile("test", r, false, false, false, nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestCompileBytes(t *testing.T) {
+	_, err := vm.CompileBytes("generated/prog 1", []byte(`counter i
+// {
+  i++
+}`))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileBytesErrorPositions(t *testing.T) {
+	_, err := vm.CompileBytes("generated/prog 1", []byte(`counter i
+// {
+  j++
+}`))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	// Each error starts with its position; hints are indented.
+	for _, line := range strings.Split(err.Error(), "\n") {
+		if !strings.HasPrefix(line, "generated/prog 1:") && !strings.HasPrefix(line, "\t") {
+			t.Errorf("error position does not use the given name: %q", line)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "generated/prog 1:3:3: ") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+// fixtureInputPrefix marks the lines of a fixture that are input to the
+// program.
+const fixtureInputPrefix = "> "
+
+var fixtureExpectRe = regexp.MustCompile(`^([^\s{]+)(?:{([^}]*)})?\s+(.+)$`)
+
+// fixtureExpectation is the expected value of one datum of a metric.
+type fixtureExpectation struct {
+	line   int
+	series string // The metric name and labels as written in the fixture.
+	name   string
+	labels map[string]string
+	value  string
+}
+
+// RunFixture compiles the program from prog, runs the input lines of the
+// fixture through it, and compares the metrics with the values expected by
+// the fixture.  It returns a description of each mismatch, which is empty if
+// the program passes, or an error if the program or fixture are invalid, or
+// the program has a runtime error.
+//
+// In the fixture, lines beginning with `> ' are input to the program, blank
+// lines and lines beginning with `#' are ignored, and every other line is an
+// expected metric value, like `requests_total{code=200} 3'.  Each value is
+// checked against the metrics after the input lines above it, so a fixture
+// can check the values as they change step by step.  Numbers are compared by
+// value, and text by string.
+func RunFixture(name string, prog, fixture io.Reader) ([]string, error) {
+	v, err := Compile(name, prog, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []string
+	scanner := bufio.NewScanner(fixture)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		text := scanner.Text()
+		if strings.HasPrefix(text, fixtureInputPrefix) {
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), name, strings.TrimPrefix(text, fixtureInputPrefix)))
+			if s := v.RuntimeErrorString(); s != "" {
+				return nil, errors.Errorf("%d: runtime error: %s", lineNum, s)
+			}
+			continue
+		}
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		e, err := parseFixtureExpectation(lineNum, text)
+		if err != nil {
+			return nil, err
+		}
+		if msg := v.checkExpectation(e); msg != "" {
+			mismatches = append(mismatches, fmt.Sprintf("%d: %s", e.line, msg))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mismatches, nil
+}
+
+// parseFixtureExpectation parses an expected metric value on line number n
+// of a fixture.
+func parseFixtureExpectation(n int, text string) (fixtureExpectation, error) {
+	match := fixtureExpectRe.FindStringSubmatch(text)
+	if match == nil {
+		return fixtureExpectation{}, errors.Errorf("%d: expecting a metric name, optional labels, and value", n)
+	}
+	e := fixtureExpectation{line: n, series: match[1], name: match[1], labels: make(map[string]string), value: match[3]}
+	if match[2] != "" {
+		e.series += "{" + match[2] + "}"
+		for _, pair := range strings.Split(match[2], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fixtureExpectation{}, errors.Errorf("%d: expecting a label like key=value, not %q", n, pair)
+			}
+			e.labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return e, nil
+}
+
+// checkExpectation returns a description of how the metrics of the VM don't
+// match the expectation, or the empty string if they do.
+func (v *VM) checkExpectation(e fixtureExpectation) string {
+	var m *metrics.Metric
+	for _, c := range v.m {
+		if c.Name == e.name {
+			m = c
+			break
+		}
+	}
+	if m == nil {
+		return fmt.Sprintf("no metric %q", e.name)
+	}
+	if len(e.labels) != len(m.Keys) {
+		return fmt.Sprintf("metric %q has keys %v", e.name, m.Keys)
+	}
+	values := make([]string, len(m.Keys))
+	for i, k := range m.Keys {
+		val, ok := e.labels[k]
+		if !ok {
+			return fmt.Sprintf("metric %q has keys %v", e.name, m.Keys)
+		}
+		values[i] = val
+	}
+	lv := m.FindLabelValueOrNil(values)
+	if lv == nil || lv.Value == nil {
+		return fmt.Sprintf("%s: no value, expected %s", e.series, e.value)
+	}
+	got := lv.Value.ValueString()
+	if got == e.value {
+		return ""
+	}
+	if m.Type != metrics.String {
+		g, gerr := strconv.ParseFloat(got, 64)
+		w, werr := strconv.ParseFloat(e.value, 64)
+		if gerr == nil && werr == nil && g == w {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s: got %s, expected %s", e.series, got, e.value)
+}
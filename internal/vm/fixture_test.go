@@ -0,0 +1,87 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+const fixtureProg = `counter requests_total by code
+gauge latency
+text last_path
+/^GET (?P<path>\S+) (?P<code>\d+) (?P<latency>\d+\.\d+)$/ {
+  requests_total[$code]++
+  latency = $latency
+  last_path = $path
+}
+`
+
+var fixtureTests = []struct {
+	name     string
+	fixture  string
+	expected []string
+}{
+	{"pass", `# Two requests.
+> GET /index.html 200 0.25
+> GET /missing 404 1.50
+
+requests_total{code=200} 1
+requests_total{code=404} 1
+latency 1.5
+last_path /missing
+`, nil},
+
+	{"steps", `> GET /index.html 200 0.25
+requests_total{code=200} 1
+latency 0.25
+> GET /index.html 200 0.75
+requests_total{code=200} 2
+latency 0.75
+`, nil},
+
+	{"step fail", `> GET /index.html 200 0.25
+latency 0.75
+> GET /index.html 200 0.75
+latency 0.75
+`, []string{
+		"2: latency: got 0.25, expected 0.75",
+	}},
+
+	{"fail", `> GET /index.html 200 0.25
+requests_total{code=200} 2
+requests_total{code=500} 1
+requests_total 1
+latency 0.5
+missing 1
+`, []string{
+		"2: requests_total{code=200}: got 1, expected 2",
+		"3: requests_total{code=500}: no value, expected 1",
+		`4: metric "requests_total" has keys [code]`,
+		"5: latency: got 0.25, expected 0.5",
+		`6: no metric "missing"`,
+	}},
+}
+
+func TestRunFixture(t *testing.T) {
+	for _, tc := range fixtureTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mismatches, err := RunFixture("fixture", strings.NewReader(fixtureProg), strings.NewReader(tc.fixture))
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, mismatches)
+		})
+	}
+}
+
+func TestRunFixtureErrors(t *testing.T) {
+	if _, err := RunFixture("fixture", strings.NewReader("counter"), strings.NewReader("")); err == nil {
+		t.Error("expected compile error")
+	}
+	if _, err := RunFixture("fixture", strings.NewReader(fixtureProg), strings.NewReader("latency\n")); err == nil {
+		t.Error("expected fixture error")
+	}
+}
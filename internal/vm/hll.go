@@ -0,0 +1,77 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits used to choose a register of a
+// hyperLogLog, which gives 2^hllPrecision registers of one byte each, and a
+// standard error of about 1.04/sqrt(2^hllPrecision), or 1.6%.
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+// hyperLogLog estimates the number of distinct strings added to it, in a
+// fixed amount of memory regardless of how many there are.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+
+	sum   float64 // Sum of 2^-r over the registers r, kept up to date by Add.
+	zeros int     // Number of registers that are zero.
+}
+
+// newHyperLogLog returns an empty hyperLogLog.
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{sum: hllRegisters, zeros: hllRegisters}
+}
+
+// Add adds the string s to the set of values, and returns true if the
+// estimate changed.
+func (h *hyperLogLog) Add(s string) bool {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := mix64(f.Sum64())
+	i := x >> (64 - hllPrecision)
+	// The sentinel bit bounds the run of leading zeros when the remaining
+	// bits are all zero.
+	w := x<<hllPrecision | 1<<(hllPrecision-1)
+	rho := uint8(bits.LeadingZeros64(w) + 1)
+	r := h.registers[i]
+	if rho <= r {
+		return false
+	}
+	if r == 0 {
+		h.zeros--
+	}
+	h.sum += 1/float64(uint64(1)<<rho) - 1/float64(uint64(1)<<r)
+	h.registers[i] = rho
+	return true
+}
+
+// Estimate returns the estimated number of distinct values added.
+func (h *hyperLogLog) Estimate() int64 {
+	const m = float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / h.sum
+	if e <= 2.5*m && h.zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		e = m * math.Log(m/float64(h.zeros))
+	}
+	return int64(math.Round(e))
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads the bits of the FNV
+// hash so that both the register index and the run of zeros are uniform.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -14,6 +14,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"html/template"
@@ -23,6 +24,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -44,10 +46,16 @@ var (
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors    = expvar.NewMap("prog_load_errors_total")
 	progRuntimeErrors = expvar.NewMap("prog_runtime_errors_total")
+	progLineTimeouts  = expvar.NewMap("prog_line_timeouts_total")
+	progQueueFull     = expvar.NewMap("prog_line_queue_full_total")
 )
 
 const (
 	fileExt = ".mtail"
+
+	// defaultLineQueueLength is the number of lines buffered for each
+	// program before the loader waits for it to catch up.
+	defaultLineQueueLength = 1000
 )
 
 // LoadAllPrograms loads all programs in a directory and starts watching the
@@ -215,7 +223,7 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		glog.V(1).Infof("contents match, not recompiling %q", name)
 		return nil
 	}
-	v, errs := Compile(name, &buf, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation)
+	v, errs := Compile(name, &buf, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation, l.buildTags...)
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Errorf("compile failed for %s:\n%s", name, errs)
@@ -225,16 +233,27 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		return errors.Errorf("Internal error: Compilation failed for %s: No program returned, but no errors.", name)
 	}
 
+	for _, w := range v.Warnings() {
+		glog.Warningf("%s: %s", name, w)
+	}
+
 	if l.dumpBytecode {
 		glog.Info("Dumping program objects and bytecode\n", v.DumpByteCode())
 	}
 
+	if l.bucketOverflowCounters {
+		v.addBucketOverflowCounters()
+	}
+
 	// Load the metrics from the compilation into the global metric storage for export.
 	for _, m := range v.m {
 		if !m.Hidden {
 			if l.omitMetricSource {
 				m.Source = ""
 			}
+			if l.programPrefix {
+				m.Name = programPrefix(name) + m.Name
+			}
 			err := l.ms.Add(m)
 			if err != nil {
 				return err
@@ -255,7 +274,12 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	if handle, ok := l.handles[name]; ok {
 		close(handle.lines)
 	}
-	lines := make(chan *logline.LogLine)
+	v.flush = l.flush
+	v.countries = l.countries
+	v.tables = l.tables
+	v.lineDeadline = l.lineDeadline
+	v.ruleTiming = l.ruleTiming
+	lines := make(chan *logline.LogLine, l.lineQueueLength)
 	l.handles[name] = &vmHandle{contentHash: contentHash, vm: v, lines: lines}
 	l.wg.Add(1)
 	go v.Run(lines, &l.wg)
@@ -278,8 +302,9 @@ type Loader struct {
 	reg         prometheus.Registerer // plce to reg metrics
 	programPath string                // Path that contains mtail programs.
 
-	handleMu sync.RWMutex         // guards accesses to handles
+	handleMu sync.RWMutex         // guards accesses to handles and paused
 	handles  map[string]*vmHandle // map of program names to virtual machines
+	paused   map[string]bool      // names of programs that are not processing lines
 
 	programErrorMu sync.RWMutex     // guards access to programErrors
 	programErrors  map[string]error // errors from the last compile attempt of the program
@@ -292,6 +317,18 @@ type Loader struct {
 	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
 	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
 	omitMetricSource     bool
+	buildTags            []string         // Tags selecting the `# +build' sections of programs to compile.
+	flush                func()           // Called by programs that execute flush().
+	reload               func()           // Called on SIGHUP before the programs are reloaded.
+	countries            CountryResolver  // Used by programs that call geocountry().
+	tables               TableResolver    // Used by programs that call lookup().
+	limiter              *lineRateLimiter // If not nil, limits the rate of lines from each log source.
+	lineDeadline         time.Duration    // If non-zero, programs abandon lines that take longer than this.
+	ruleTiming           bool             // If set, programs record the time of each match by rule.
+	lineQueueLength      int              // The number of lines buffered for each program.
+
+	bucketOverflowCounters bool // Export a counter of the observations above the top bucket of each histogram.
+	programPrefix          bool // Prefix the names of exported metrics with the name of their program.
 
 	signalQuit chan struct{} // When closed stops the signal handler goroutine.
 }
@@ -363,11 +400,141 @@ func OmitMetricSource() Option {
 	}
 }
 
+// BuildTags sets the tags used to select the `# +build' sections of programs
+// to compile.
+func BuildTags(tags ...string) Option {
+	return func(l *Loader) error {
+		l.buildTags = tags
+		return nil
+	}
+}
+
+// Countries sets the resolver used by the `geocountry()' builtin to look up
+// the country of an IP address.
+func Countries(r CountryResolver) Option {
+	return func(l *Loader) error {
+		l.countries = r
+		return nil
+	}
+}
+
+// Tables sets the tables used by the `lookup()' builtin.
+func Tables(r TableResolver) Option {
+	return func(l *Loader) error {
+		l.tables = r
+		return nil
+	}
+}
+
+// LineDeadline sets the longest time a program may spend processing one line.
+// Lines that take longer are abandoned and counted as timeouts.
+func LineDeadline(d time.Duration) Option {
+	return func(l *Loader) error {
+		if d < 0 {
+			return errors.Errorf("invalid line deadline %s", d)
+		}
+		l.lineDeadline = d
+		return nil
+	}
+}
+
+// RuleTiming instructs the Loader to record the time each program spends
+// matching regular expressions, by the named rule executing the match, in the
+// mtail_vm_rule_match_duration_seconds histogram.
+func RuleTiming() Option {
+	return func(l *Loader) error {
+		l.ruleTiming = true
+		return nil
+	}
+}
+
+// LineQueueLength sets the number of lines buffered for each program, so that
+// a slow program doesn't hold up the others until its queue is full.
+func LineQueueLength(n int) Option {
+	return func(l *Loader) error {
+		if n < 0 {
+			return errors.Errorf("invalid line queue length %d", n)
+		}
+		l.lineQueueLength = n
+		return nil
+	}
+}
+
+// BucketOverflowCounters instructs the Loader to export a counter for each
+// histogram, named after it with a `_bucket_overflow_total' suffix, of the
+// observations greater than its largest bucket boundary.
+func BucketOverflowCounters() Option {
+	return func(l *Loader) error {
+		l.bucketOverflowCounters = true
+		return nil
+	}
+}
+
+// ProgramPrefix instructs the Loader to prefix the name of each exported
+// metric with the base name of the program file that defines it, so that
+// programs can define metrics of the same name without colliding.
+func ProgramPrefix() Option {
+	return func(l *Loader) error {
+		l.programPrefix = true
+		return nil
+	}
+}
+
+// programPrefix returns the metric name prefix for the program file name,
+// which is the base name without its extension, with characters that are not
+// valid in a metric name replaced by underscores, and followed by an
+// underscore.
+func programPrefix(name string) string {
+	name = filepath.Base(name)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	prefix := strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	if prefix == "" || ('0' <= prefix[0] && prefix[0] <= '9') {
+		prefix = "_" + prefix
+	}
+	return prefix + "_"
+}
+
+// LineRateLimit sets the Loader to deliver at most rate lines per second from
+// each log source to the programs, allowing bursts of up to burst lines.
+// Lines over the limit are dropped.
+func LineRateLimit(rate float64, burst int) Option {
+	return func(l *Loader) error {
+		if rate <= 0 || burst < 1 {
+			return errors.Errorf("invalid line rate limit %v with burst %d", rate, burst)
+		}
+		l.limiter = newLineRateLimiter(rate, burst)
+		return nil
+	}
+}
+
+// OnFlush sets the function called when a program executes the `flush()'
+// builtin.  The function must not block.
+func OnFlush(f func()) Option {
+	return func(l *Loader) error {
+		l.flush = f
+		return nil
+	}
+}
+
+// OnReload sets the function called when the loader receives SIGHUP, before
+// it reloads the programs, so that the data they use can be reloaded too.
+func OnReload(f func()) Option {
+	return func(l *Loader) error {
+		l.reload = f
+		return nil
+	}
+}
+
 // PrometheusRegisterer passes in a registry for setting up exported metrics.
 func PrometheusRegisterer(reg prometheus.Registerer) Option {
 	return func(l *Loader) error {
 		l.reg = reg
-		l.reg.MustRegister(lineProcessingDurations)
+		l.reg.MustRegister(lineProcessingDurations, ruleMatchDurations)
 		return nil
 	}
 }
@@ -378,11 +545,13 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 		return nil, errors.New("loader needs a store")
 	}
 	l := &Loader{
-		ms:            store,
-		programPath:   programPath,
-		handles:       make(map[string]*vmHandle),
-		programErrors: make(map[string]error),
-		signalQuit:    make(chan struct{}),
+		ms:              store,
+		programPath:     programPath,
+		handles:         make(map[string]*vmHandle),
+		paused:          make(map[string]bool),
+		programErrors:   make(map[string]error),
+		signalQuit:      make(chan struct{}),
+		lineQueueLength: defaultLineQueueLength,
 	}
 	initDone := make(chan struct{})
 	defer close(initDone)
@@ -404,12 +573,7 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 		defer l.wg.Done() // signal to owner we're done
 		<-initDone
 		for line := range lines {
-			LineCount.Add(1)
-			l.handleMu.RLock()
-			for prog := range l.handles {
-				l.handles[prog].lines <- line
-			}
-			l.handleMu.RUnlock()
+			l.processLine(line)
 		}
 		glog.Info("END OF LINE")
 		close(l.signalQuit)
@@ -442,6 +606,9 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 			case <-l.signalQuit:
 				return
 			case <-n:
+				if l.reload != nil {
+					l.reload()
+				}
 				if err := l.LoadAllPrograms(); err != nil {
 					glog.Info(err)
 				}
@@ -455,6 +622,115 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 	return l, nil
 }
 
+// processLine sends the line to each program that isn't paused.  Each program
+// runs in its own goroutine, reading from a queue of lines, so a slow program
+// only holds up the others once its queue is full.
+func (l *Loader) processLine(line *logline.LogLine) {
+	LineCount.Add(1)
+	if l.limiter != nil && !l.limiter.allow(line.Filename) {
+		LineRateLimitDrops.Add(line.Filename, 1)
+		return
+	}
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	for prog := range l.handles {
+		if l.paused[prog] {
+			continue
+		}
+		select {
+		case l.handles[prog].lines <- line:
+		default:
+			// Wait for the program to catch up, rather than buffer without
+			// limit.
+			progQueueFull.Add(prog, 1)
+			l.handles[prog].lines <- line
+		}
+	}
+}
+
+// PauseProgram stops the named program from processing lines until it is
+// resumed.  The program's metrics are retained while it is paused.
+func (l *Loader) PauseProgram(name string) error {
+	return l.setPaused(name, true)
+}
+
+// ResumeProgram restarts processing of lines by the named paused program.
+func (l *Loader) ResumeProgram(name string) error {
+	return l.setPaused(name, false)
+}
+
+func (l *Loader) setPaused(name string, paused bool) error {
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+	if _, ok := l.handles[name]; !ok {
+		return errors.Errorf("no program named %q", name)
+	}
+	if paused {
+		l.paused[name] = true
+	} else {
+		delete(l.paused, name)
+	}
+	return nil
+}
+
+// PauseHandler pauses or resumes the program named in the `prog' form value,
+// according to the `action' form value, which must be `pause' or `resume'.
+func (l *Loader) PauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prog := r.FormValue("prog")
+	var err error
+	switch action := r.FormValue("action"); action {
+	case "pause":
+		err = l.PauseProgram(prog)
+	case "resume":
+		err = l.ResumeProgram(prog)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown action %q", action), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "%s %sd\n", prog, r.FormValue("action"))
+}
+
+// ReloadHandler recompiles the programs in the program path that have changed
+// since they were loaded, as on SIGHUP, and replies with the compile status
+// of each program.  The metrics of a reloaded program keep their data if they
+// are compatible with those of the old program, as with metrics.Store.Add.
+func (l *Loader) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if l.programPath == "" {
+		http.Error(w, "No program path to reload from", http.StatusBadRequest)
+		return
+	}
+	if err := l.LoadAllPrograms(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l.programErrorMu.RLock()
+	defer l.programErrorMu.RUnlock()
+	names := make([]string, 0, len(l.programErrors))
+	for name := range l.programErrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := l.programErrors[name]; err != nil {
+			fmt.Fprintf(w, "%s: %s\n", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s: ok\n", name)
+	}
+}
+
 // SetOption takes one or more option functions and applies them in order to Loader.
 func (l *Loader) SetOption(options ...Option) error {
 	for _, option := range options {
@@ -473,6 +749,7 @@ func (l *Loader) UnloadProgram(pathname string) {
 	if _, ok := l.handles[name]; ok {
 		delete(l.handles, name)
 	}
+	delete(l.paused, name)
 }
 
 func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
@@ -494,7 +771,104 @@ func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-type", "text/html")
 	fmt.Fprintf(w, "<ul>")
 	for prog := range l.handles {
-		fmt.Fprintf(w, "<li><a href=\"?prog=%s\">%s</a></li>", prog, prog)
+		status := ""
+		if l.paused[prog] {
+			status = " (paused)"
+		}
+		fmt.Fprintf(w, "<li><a href=\"?prog=%s\">%s</a>%s</li>", prog, prog, status)
 	}
 	fmt.Fprintf(w, "</ul>")
 }
+
+// evalChange describes a datum that was modified by an evaluation.
+type evalChange struct {
+	Metric string
+	Labels map[string]string `json:",omitempty"`
+	Before string            `json:",omitempty"`
+	After  string
+}
+
+// evalResult is the response body of the EvalHandler.
+type evalResult struct {
+	Matched      []string
+	Changes      []evalChange
+	RuntimeError string `json:",omitempty"`
+}
+
+// EvalHandler compiles the program given in the `prog` form value into a
+// throwaway VM, runs it against the log line in the `line` form value, and
+// reports the patterns that matched and the datums that changed as JSON.  No
+// loaded program or metric in the Loader's store is affected.
+func (l *Loader) EvalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v, err := Compile("eval", strings.NewReader(r.FormValue("prog")), false, false, l.syslogUseCurrentYear, l.overrideLocation, l.buildTags...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ms := metrics.NewStore()
+	for _, m := range v.m {
+		if err := ms.Add(m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	before := evalSnapshot(ms)
+	v.ProcessLogLine(r.Context(), logline.New(r.Context(), "eval", r.FormValue("line")))
+
+	result := evalResult{Matched: []string{}, Changes: []evalChange{}, RuntimeError: v.RuntimeErrorString()}
+	for i, re := range v.re {
+		if v.t.matches[i] != nil {
+			result.Matched = append(result.Matched, re.String())
+		}
+	}
+	after := evalSnapshot(ms)
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := after[key]
+		old, ok := before[key]
+		if ok && old.After == c.After {
+			continue
+		}
+		c.Before = old.After
+		result.Changes = append(result.Changes, c)
+	}
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		glog.Info(err)
+	}
+}
+
+// evalSnapshot records the current value of every datum in the store, keyed
+// by metric name and label values.
+func evalSnapshot(ms *metrics.Store) map[string]evalChange {
+	r := make(map[string]evalChange)
+	_ = ms.Range(func(m *metrics.Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		for _, lv := range m.LabelValues {
+			c := evalChange{Metric: m.Name, After: lv.Value.ValueString()}
+			if len(m.Keys) > 0 {
+				c.Labels = make(map[string]string, len(m.Keys))
+				for i, k := range m.Keys {
+					c.Labels[k] = lv.Labels[i]
+				}
+			}
+			r[m.Name+"\x00"+strings.Join(lv.Labels, "\x00")] = c
+		}
+		return nil
+	})
+	return r
+}
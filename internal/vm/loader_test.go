@@ -4,10 +4,17 @@
 package vm
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
@@ -50,6 +57,34 @@ func TestCompileAndRun(t *testing.T) {
 	wg.Wait()
 }
 
+func TestProgramPrefix(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, ProgramPrefix())
+	testutil.FatalIfErr(t, err)
+	for _, name := range []string{"web.mtail", "db-1.mtail", "9lives.mtail"} {
+		testutil.FatalIfErr(t, l.CompileAndRun(name, strings.NewReader("counter requests\n/GET/ {\n  requests++\n}\n")))
+	}
+	close(lines)
+	wg.Wait()
+
+	for _, tc := range []struct {
+		name, prog string
+	}{
+		{"web_requests", "web.mtail"},
+		{"db_1_requests", "db-1.mtail"},
+		{"_9lives_requests", "9lives.mtail"},
+	} {
+		if store.FindMetricOrNil(tc.name, tc.prog) == nil {
+			t.Errorf("metric %q from %q not found in store", tc.name, tc.prog)
+		}
+	}
+	if _, ok := store.Metrics["requests"]; ok {
+		t.Errorf("unprefixed metric found in store: %v", store.Metrics["requests"])
+	}
+}
+
 var testProgram = "/$/ {}\n"
 
 var testProgFiles = []string{
@@ -78,3 +113,261 @@ func TestLoadProg(t *testing.T) {
 	close(lines)
 	wg.Wait()
 }
+
+func TestEvalHandler(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store)
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		close(lines)
+		wg.Wait()
+	}()
+
+	form := url.Values{}
+	form.Set("prog", `counter lines
+counter bytes by method
+/^(?P<method>[A-Z]+) (?P<size>\d+)$/ {
+  lines++
+  bytes[$method] += $size
+}
+/^nomatch$/ {
+  lines++
+}
+`)
+	form.Set("line", "GET 37")
+	req := httptest.NewRequest("POST", "/eval", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	l.EvalHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var got evalResult
+	testutil.FatalIfErr(t, json.Unmarshal(w.Body.Bytes(), &got))
+	expected := evalResult{
+		Matched: []string{`^(?P<method>[A-Z]+) (?P<size>\d+)$`},
+		Changes: []evalChange{
+			{Metric: "bytes", Labels: map[string]string{"method": "GET"}, After: "37"},
+			{Metric: "lines", Before: "0", After: "1"},
+		},
+	}
+	testutil.ExpectNoDiff(t, expected, got)
+
+	if store.FindMetricOrNil("lines", "eval") != nil {
+		t.Errorf("eval metric leaked into the loader store")
+	}
+}
+
+func TestEvalHandlerCompileError(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store)
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		close(lines)
+		wg.Wait()
+	}()
+
+	form := url.Values{"prog": {"/unterminated"}, "line": {"foo"}}
+	req := httptest.NewRequest("POST", "/eval", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	l.EvalHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPauseProgram(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("count", strings.NewReader("counter lines_total\n// {\n  lines_total++\n}\n")))
+	m := store.FindMetricOrNil("lines_total", "count")
+	if m == nil {
+		t.Fatal("lines_total not found")
+	}
+	linesTotal := func() string {
+		d, err := m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		return d.ValueString()
+	}
+	expectLinesTotal := func(expected string) {
+		t.Helper()
+		ok, err := testutil.DoOrTimeout(func() (bool, error) {
+			return linesTotal() == expected, nil
+		}, time.Second, 10*time.Millisecond)
+		testutil.FatalIfErr(t, err)
+		if !ok {
+			t.Fatalf("expected lines_total %s, got %s", expected, linesTotal())
+		}
+	}
+
+	l.processLine(logline.New(context.Background(), "test", "line"))
+	expectLinesTotal("1")
+
+	form := url.Values{"prog": {"count"}, "action": {"pause"}}
+	req := httptest.NewRequest("POST", "/progz/pause", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	l.PauseHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	for i := 0; i < 3; i++ {
+		l.processLine(logline.New(context.Background(), "test", "line"))
+	}
+	if got := linesTotal(); got != "1" {
+		t.Errorf("paused program processed lines: lines_total %s", got)
+	}
+
+	testutil.FatalIfErr(t, l.ResumeProgram("count"))
+	for i := 0; i < 2; i++ {
+		l.processLine(logline.New(context.Background(), "test", "line"))
+	}
+	expectLinesTotal("3")
+
+	if err := l.PauseProgram("nonexistent"); err == nil {
+		t.Error("expected error pausing nonexistent program, got nil")
+	}
+	close(lines)
+	wg.Wait()
+}
+
+func TestProgramsProgressIndependently(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	l, err := NewLoader(lines, &wg, "", store, LineQueueLength(3), OnFlush(func() { <-release }))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("fast", strings.NewReader("counter fast_total\n// {\n  fast_total++\n}\n")))
+	// The slow program is stuck in flush() until released.
+	testutil.FatalIfErr(t, l.CompileAndRun("slow", strings.NewReader("counter slow_total\n// {\n  flush()\n  slow_total++\n}\n")))
+	expectTotal := func(name, prog, expected string) {
+		t.Helper()
+		m := store.FindMetricOrNil(name, prog)
+		if m == nil {
+			t.Fatalf("%s not found", name)
+		}
+		var got string
+		ok, err := testutil.DoOrTimeout(func() (bool, error) {
+			d, err := m.GetDatum()
+			if err != nil {
+				return false, err
+			}
+			got = d.ValueString()
+			return got == expected, nil
+		}, time.Second, 10*time.Millisecond)
+		testutil.FatalIfErr(t, err)
+		if !ok {
+			t.Fatalf("expected %s %s, got %s", name, expected, got)
+		}
+	}
+
+	// The slow program takes the first line and queues the next three,
+	// while the fast program processes all of them.
+	for i := 0; i < 4; i++ {
+		l.processLine(logline.New(context.Background(), "test", "line"))
+	}
+	expectTotal("fast_total", "fast", "4")
+	expectTotal("slow_total", "slow", "0")
+
+	// The slow program's queue is full, so the next line waits for it.
+	sent := make(chan struct{})
+	go func() {
+		l.processLine(logline.New(context.Background(), "test", "line"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("line sent to a program with a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if progQueueFull.Get("slow") == nil {
+		t.Error("expected prog_line_queue_full_total for slow")
+	}
+
+	close(release)
+	<-sent
+	expectTotal("slow_total", "slow", "5")
+	expectTotal("fast_total", "fast", "5")
+	close(lines)
+	wg.Wait()
+}
+
+func TestReloadHandler(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir := testutil.TestTempDir(t)
+	progPath := filepath.Join(tmpDir, "count.mtail")
+	f := testutil.TestOpenFile(t, progPath)
+	_, err := f.WriteString("counter lines_total\ncounter errors_total by code\n/^foo (\\d+)$/ {\n  lines_total++\n  errors_total[$1]++\n}\n")
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, f.Close())
+
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, tmpDir, store)
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		close(lines)
+		wg.Wait()
+	}()
+
+	expectValue := func(name, expected string, labels ...string) {
+		t.Helper()
+		var got string
+		ok, err := testutil.DoOrTimeout(func() (bool, error) {
+			m := store.FindMetricOrNil(name, "count.mtail")
+			if m == nil {
+				return false, nil
+			}
+			m.RLock()
+			lv := m.FindLabelValueOrNil(labels)
+			m.RUnlock()
+			if lv == nil {
+				got = "no value"
+				return expected == got, nil
+			}
+			got = lv.Value.ValueString()
+			return got == expected, nil
+		}, time.Second, 10*time.Millisecond)
+		testutil.FatalIfErr(t, err)
+		if !ok {
+			t.Fatalf("expected %s%v %s, got %s", name, labels, expected, got)
+		}
+	}
+
+	l.processLine(logline.New(context.Background(), "test", "foo 500"))
+	expectValue("lines_total", "1")
+	expectValue("errors_total", "1", "500")
+
+	// The edited program keeps lines_total, but changes the keys of errors_total.
+	testutil.FatalIfErr(t, ioutil.WriteFile(progPath, []byte("counter lines_total\ncounter errors_total by host\n/^bar (\\S+)$/ {\n  lines_total += 2\n  errors_total[$1]++\n}\n"), 0600))
+
+	req := httptest.NewRequest("POST", "/progz/reload", nil)
+	w := httptest.NewRecorder()
+	l.ReloadHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	testutil.ExpectNoDiff(t, "count.mtail: ok\n", w.Body.String())
+
+	l.processLine(logline.New(context.Background(), "test", "foo 500"))
+	l.processLine(logline.New(context.Background(), "test", "bar gunstar"))
+	expectValue("lines_total", "3")
+	expectValue("errors_total", "1", "gunstar")
+	expectValue("errors_total", "no value", "500")
+
+	req = httptest.NewRequest("GET", "/progz/reload", nil)
+	w = httptest.NewRecorder()
+	l.ReloadHandler(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %d", w.Code)
+	}
+}
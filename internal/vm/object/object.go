@@ -16,4 +16,14 @@ type Object struct {
 	Strings []string          // Static strings.
 	Regexps []*regexp.Regexp  // Static regular expressions.
 	Metrics []*metrics.Metric // Metrics accessible to this program.
+
+	Preprocess []Replacement // Replacements applied to each input line before the program runs.
+}
+
+// Replacement replaces the matches of a regular expression with the
+// replacement string, which may refer to capture groups as in
+// regexp.Expand.
+type Replacement struct {
+	Regexp      *regexp.Regexp
+	Replacement string
 }
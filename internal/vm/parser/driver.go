@@ -30,9 +30,11 @@ import (
 )
 
 // Parse reads the program named name from the input, and if successful returns
-// an ast.Node for the root of the AST, otherwise parser errors.
-func Parse(name string, input io.Reader) (ast.Node, error) {
-	p := newParser(name, input)
+// an ast.Node for the root of the AST, otherwise parser errors.  Sections of
+// the program guarded by a `# +build' pragma are only parsed if the pragma's
+// expression is satisfied by the given tags.
+func Parse(name string, input io.Reader, tags ...string) (ast.Node, error) {
+	p := newParser(name, input, tags...)
 	r := mtailParse(p)
 	if r != 0 || p.errors != nil {
 		return nil, p.errors
@@ -53,8 +55,8 @@ type parser struct {
 	pos    position.Position // Optionally contains the position of the start of a production
 }
 
-func newParser(name string, input io.Reader) *parser {
-	return &parser{name: name, l: NewLexer(name, input)}
+func newParser(name string, input io.Reader, tags ...string) *parser {
+	return &parser{name: name, l: NewLexer(name, input, tags...)}
 }
 
 func (p *parser) ErrorP(s string, pos *position.Position) {
@@ -95,7 +97,7 @@ func (p *parser) Lex(lval *mtailSymType) int {
 			p.Error(fmt.Sprintf("%s", err))
 			return INVALID
 		}
-	case LT, GT, LE, GE, NE, EQ, SHL, SHR, BITAND, BITOR, AND, OR, XOR, NOT, INC, DEC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, POW, MOD, CONCAT, MATCH, NOT_MATCH:
+	case LT, GT, LE, GE, NE, EQ, SHL, SHR, BITAND, BITOR, AND, OR, XOR, NOT, INC, DEC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, AT, POW, MOD, CONCAT, MATCH, NOT_MATCH:
 		lval.op = int(p.t.Kind)
 	default:
 		lval.text = p.t.Spelling
@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/vm/position"
@@ -17,38 +18,111 @@ import (
 
 // List of keywords.  Keep this list sorted!
 var keywords = map[string]Kind{
-	"after":     AFTER,
-	"as":        AS,
-	"buckets":   BUCKETS,
-	"by":        BY,
-	"const":     CONST,
-	"counter":   COUNTER,
-	"def":       DEF,
-	"del":       DEL,
-	"else":      ELSE,
-	"gauge":     GAUGE,
-	"hidden":    HIDDEN,
-	"histogram": HISTOGRAM,
-	"next":      NEXT,
-	"otherwise": OTHERWISE,
-	"stop":      STOP,
-	"text":      TEXT,
-	"timer":     TIMER,
+	"after":      AFTER,
+	"as":         AS,
+	"at":         AT,
+	"buckets":    BUCKETS,
+	"by":         BY,
+	"const":      CONST,
+	"counter":    COUNTER,
+	"cumulative": CUMULATIVE,
+	"def":        DEF,
+	"del":        DEL,
+	"drop":       STOP, // synonym for stop
+	"else":       ELSE,
+	"exemplar":   EXEMPLAR,
+	"gauge":      GAUGE,
+	"hidden":     HIDDEN,
+	"foreach":    FOREACH,
+	"histogram":  HISTOGRAM,
+	"in":         IN,
+	"next":       NEXT,
+	"otherwise":  OTHERWISE,
+	"preprocess": PREPROCESS,
+	"max":        MAX,
+	"rollup":     ROLLUP,
+	"split":      SPLIT,
+	"rule":       RULE,
+	"stop":       STOP,
+	"text":       TEXT,
+	"timer":      TIMER,
+}
+
+// contextualWords are the keywords and builtins that are only lexed as such
+// in the context they are used in, which is decided by the token before them
+// or the input after them.  Elsewhere they are identifiers, so that
+// they can still name metrics and label keys.
+var contextualWords = map[string]func(*Lexer) bool{
+	"at":         (*Lexer).afterOperand,
+	"cumulative": (*Lexer).inDeclModifiers,
+	"drop":       func(l *Lexer) bool { return l.atStatementStart() && isStatementEnd(l.peekNonBlank()) },
+	"exemplar":   (*Lexer).afterOperand,
+	"foreach":    func(l *Lexer) bool { r := l.peekNonBlank(); return l.atStatementStart() && (isAlpha(r) || r == '_') },
+	"in":         (*Lexer).afterOperand,
+	"log":        func(l *Lexer) bool { return l.peekNonBlank() == '(' },
+	"max":        func(l *Lexer) bool { r := l.peekNonBlank(); return isDigit(r) || r == '.' },
+	"preprocess": func(l *Lexer) bool { return l.atStatementStart() && l.peekNonBlank() == '/' },
+	"rollup":     (*Lexer).inDeclModifiers,
+	"rule":       (*Lexer).peekRuleName,
+	"split":      func(l *Lexer) bool { return l.peekNonBlank() == '(' },
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
+	"activeuniq",
+	"base64decode",
 	"bool",
+	"capcount",
+	"captures",
+	"commafy",
+	"consistentsample",
+	"contains",
+	"default",
+	"div",
+	"ewma",
 	"float",
+	"flush",
+	"geocountry",
 	"getfilename",
+	"hasprefix",
+	"hassuffix",
+	"hastimer",
+	"hour",
 	"int",
+	"isnew",
+	"journalfield",
+	"jsonpath",
 	"len",
+	"log",
+	"lookup",
+	"matchcount",
+	"matches",
+	"meta",
+	"normalize",
+	"parseduration",
+	"pathsegment",
+	"percentilerank",
+	"round",
+	"rulename",
+	"sample",
+	"sethelp",
 	"settime",
+	"starttimer",
+	"statusclass",
+	"stoptimer",
 	"string",
 	"strptime",
 	"strtol",
+	"subst",
+	"timediff",
 	"timestamp",
 	"tolower",
+	"trim",
+	"trimleft",
+	"trimright",
+	"uniq",
+	"urldecode",
+	"weekday",
 }
 
 // Dictionary returns a list of all keywords and builtins of the language.
@@ -82,17 +156,28 @@ type Lexer struct {
 	// The currently being lexed token.
 	startcol int             // Starting column of the current token.
 	text     strings.Builder // the text of the current token
+	prev     Kind            // The kind of the last token emitted, or NL at the start of a line.
+	decl     bool            // Whether the current line declares a metric.
 
 	tokens chan Token // Output channel for tokens emitted.
+
+	tags     map[string]bool // Build tags that select pragma-gated sections.
+	sections int             // The number of included `+build' sections not yet ended.
 }
 
-// NewLexer creates a new scanner type that reads the input provided.
-func NewLexer(name string, input io.Reader) *Lexer {
+// NewLexer creates a new scanner type that reads the input provided.  The
+// optional tags select which `# +build' sections of the program are lexed.
+func NewLexer(name string, input io.Reader, tags ...string) *Lexer {
 	l := &Lexer{
 		name:   name,
 		input:  bufio.NewReader(input),
 		state:  lexProg,
+		prev:   NL,
 		tokens: make(chan Token, 2),
+		tags:   make(map[string]bool, len(tags)),
+	}
+	for _, t := range tags {
+		l.tags[t] = true
 	}
 	return l
 }
@@ -115,6 +200,13 @@ func (l *Lexer) emit(kind Kind) {
 	pos := position.Position{l.name, l.line, l.startcol, l.col - 1}
 	glog.V(2).Infof("Emitting %v spelled %q at %v", kind, l.text.String(), pos)
 	l.tokens <- Token{kind, l.text.String(), pos}
+	l.prev = kind
+	switch kind {
+	case COUNTER, GAUGE, TIMER, TEXT, HISTOGRAM:
+		l.decl = true
+	case NL:
+		l.decl = false
+	}
 	// Reset the current token
 	l.text.Reset()
 	l.startcol = l.col
@@ -230,6 +322,9 @@ func lexProg(l *Lexer) stateFn {
 	case r == ',':
 		l.accept()
 		l.emit(COMMA)
+	case r == ':':
+		l.accept()
+		l.emit(COLON)
 	case r == '-':
 		l.accept()
 		switch r = l.next(); {
@@ -362,6 +457,10 @@ func lexProg(l *Lexer) stateFn {
 	case isAlpha(r):
 		return lexIdentifier
 	case r == eof:
+		if l.sections > 0 {
+			l.sections = 0
+			return l.errorf("Unterminated +build section, expecting \"# +end\"")
+		}
 		l.skip()
 		l.emit(EOF)
 		// Stop the machine, we're done.
@@ -379,21 +478,111 @@ func lexProg(l *Lexer) stateFn {
 // Lex a comment.
 func lexComment(l *Lexer) stateFn {
 	l.ignore()
+	var comment strings.Builder
 Loop:
 	for {
-		switch l.next() {
+		switch r := l.next(); r {
 		case '\n':
 			l.skip()
+			// The newline ending the comment isn't emitted, but it still
+			// ends the line for the contextual keywords.
+			l.prev = NL
+			l.decl = false
 			fallthrough
 		case eof:
 			break Loop
 		default:
+			comment.WriteRune(r)
 			l.ignore()
 		}
 	}
+	if expr, ok := buildPragma(comment.String()); ok {
+		if !l.matchTags(expr) {
+			return lexSkipSection
+		}
+		l.sections++
+	} else if isEndPragma(comment.String()) {
+		if l.sections == 0 {
+			return l.errorf("Unexpected \"# +end\" outside a +build section")
+		}
+		l.sections--
+	}
 	return lexProg
 }
 
+// buildPragma returns the tag expression of a `+build' pragma comment.
+func buildPragma(comment string) (string, bool) {
+	comment = strings.TrimSpace(comment)
+	if !strings.HasPrefix(comment, "+build") {
+		return "", false
+	}
+	expr := strings.TrimPrefix(comment, "+build")
+	if expr != "" && !isSpace([]rune(expr)[0]) {
+		return "", false
+	}
+	return strings.TrimSpace(expr), true
+}
+
+// isEndPragma returns true if the comment is a `+end' pragma.
+func isEndPragma(comment string) bool {
+	return strings.TrimSpace(comment) == "+end"
+}
+
+// matchTags reports whether the build tag expression is satisfied by the
+// lexer's tags.  As with Go build constraints, space separated options are
+// ORed, comma separated terms are ANDed, and a term prefixed with `!' is
+// negated.
+func (l *Lexer) matchTags(expr string) bool {
+	for _, option := range strings.Fields(expr) {
+		match := true
+		for _, term := range strings.Split(option, ",") {
+			if strings.HasPrefix(term, "!") {
+				match = match && !l.tags[term[1:]]
+			} else {
+				match = match && l.tags[term]
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Skip a section excluded by a `+build' pragma, up to and including the
+// matching `+end' pragma.  No tokens are emitted for the section, but line
+// positions are kept.
+func lexSkipSection(l *Lexer) stateFn {
+	depth := 1
+	var line strings.Builder
+	for {
+		r := l.next()
+		switch r {
+		case '\n', eof:
+			text := strings.TrimSpace(line.String())
+			line.Reset()
+			if strings.HasPrefix(text, "#") {
+				text = text[1:]
+				if _, ok := buildPragma(text); ok {
+					depth++
+				} else if isEndPragma(text) {
+					depth--
+				}
+			}
+			if depth == 0 {
+				l.ignore()
+				return lexProg
+			}
+			if r == eof {
+				return l.errorf("Unterminated +build section, expecting \"# +end\"")
+			}
+		default:
+			line.WriteRune(r)
+		}
+		l.ignore()
+	}
+}
+
 // Lex a numerical constant.
 func lexNumeric(l *Lexer) stateFn {
 	r := l.next()
@@ -534,7 +723,9 @@ Loop:
 			break Loop
 		}
 	}
-	if r, ok := keywords[l.text.String()]; ok {
+	if f, ok := contextualWords[l.text.String()]; ok && !f(l) {
+		l.emit(ID)
+	} else if r, ok := keywords[l.text.String()]; ok {
 		l.emit(r)
 	} else if r := sort.SearchStrings(builtins, l.text.String()); r >= 0 && r < len(builtins) && builtins[r] == l.text.String() {
 		l.emit(BUILTIN)
@@ -576,10 +767,120 @@ Loop:
 			l.accept()
 		}
 	}
+	flags := l.peekRegexFlags()
+	if flags != "" {
+		// Scope the flags to this pattern with a non-capturing group, so they
+		// don't leak into patterns concatenated after it.
+		pattern := l.text.String()
+		l.text.Reset()
+		l.text.WriteString("(?" + flags + ":" + pattern + ")")
+	}
 	l.emit(REGEX)
+	if flags != "" {
+		return lexRegexEnd(len(flags))
+	}
 	return lexProg
 }
 
+// regexFlags are the flags that may trail a regular expression, like `/foo/i`.
+const regexFlags = "ims"
+
+// peekNonBlank returns the next rune that is not a space or tab, without
+// consuming any input.
+func (l *Lexer) peekNonBlank() rune {
+	for i := 1; ; i++ {
+		b, err := l.input.Peek(i)
+		if err != nil {
+			return eof
+		}
+		if c := b[i-1]; c != ' ' && c != '\t' {
+			return rune(c)
+		}
+	}
+}
+
+// atStatementStart returns true if the last token emitted ends a line or opens
+// a block, so that the next token starts a statement.
+func (l *Lexer) atStatementStart() bool {
+	return l.prev == NL || l.prev == LCURLY
+}
+
+// afterOperand returns true if the last token emitted ends an operand, so
+// that a word following it must be an infix keyword rather than a name.
+func (l *Lexer) afterOperand() bool {
+	switch l.prev {
+	case ID, CAPREF, CAPREF_NAMED, STRING, INTLITERAL, FLOATLITERAL, DURATIONLITERAL, RPAREN, RSQUARE:
+		return true
+	}
+	return false
+}
+
+// inDeclModifiers returns true if the last token emitted ends the name, keys,
+// or a modifier of a metric declaration, so that a word following it must be
+// another modifier.
+func (l *Lexer) inDeclModifiers() bool {
+	return l.decl && (l.afterOperand() || l.prev == CUMULATIVE || l.prev == ROLLUP)
+}
+
+// peekRuleName returns true if the next input, after any blanks, is a rule
+// name: an identifier followed by a colon.  It doesn't consume any input.
+func (l *Lexer) peekRuleName() bool {
+	// The rule name is on the same line, which is normally all buffered.
+	b, _ := l.input.Peek(l.input.Size())
+	i := skipBlanks(b, 0)
+	j := i
+	for j < len(b) {
+		r, n := utf8.DecodeRune(b[j:])
+		if !isAlnum(r) && r != '_' {
+			break
+		}
+		j += n
+	}
+	if j == i || isDigit(rune(b[i])) {
+		return false
+	}
+	j = skipBlanks(b, j)
+	return j < len(b) && b[j] == ':'
+}
+
+// skipBlanks returns the index of the first byte of b from i that is not a
+// space or tab.
+func skipBlanks(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// peekRegexFlags returns any regex flags that immediately follow the trailing
+// slash of a regular expression, without consuming any input.
+func (l *Lexer) peekRegexFlags() string {
+	var flags strings.Builder
+	for i := 1; ; i++ {
+		b, err := l.input.Peek(i + 1)
+		if err != nil || b[0] != '/' || !strings.ContainsRune(regexFlags, rune(b[i])) {
+			break
+		}
+		flags.WriteByte(b[i])
+	}
+	return flags.String()
+}
+
+// lexRegexEnd returns a state that lexes the trailing slash of a regular
+// expression and the n flag runes following it, as a single DIV token.
+func lexRegexEnd(n int) stateFn {
+	return func(l *Lexer) stateFn {
+		l.next()
+		l.accept()
+		for i := 0; i < n; i++ {
+			l.next()
+			l.skip()
+		}
+		l.emit(DIV)
+		return lexProg
+	}
+}
+
 // Lex a decorator name. These are functiony templatey wrappers around blocks
 // of rules.
 func lexDecorator(l *Lexer) stateFn {
@@ -605,6 +906,11 @@ func isAlpha(r rune) bool {
 	return unicode.IsLetter(r)
 }
 
+// isStatementEnd reports whether r ends a statement.
+func isStatementEnd(r rune) bool {
+	return r == '\n' || r == '}' || r == '#' || r == eof
+}
+
 // isAlnum reports whether r is an alphanumeric rune.
 func isAlnum(r rune) bool {
 	return isAlpha(r) || isDigit(r)
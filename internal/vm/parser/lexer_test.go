@@ -29,7 +29,7 @@ var lexerTests = []lexerTest{
 		{EOF, "", position.Position{"comment", 0, 9, 9}}}},
 	{"comment not at col 1", "  # comment", []Token{
 		{EOF, "", position.Position{"comment not at col 1", 0, 11, 11}}}},
-	{"punctuation", "{}()[],", []Token{
+	{"punctuation", "{}()[],:", []Token{
 		{LCURLY, "{", position.Position{"punctuation", 0, 0, 0}},
 		{RCURLY, "}", position.Position{"punctuation", 0, 1, 1}},
 		{LPAREN, "(", position.Position{"punctuation", 0, 2, 2}},
@@ -37,7 +37,8 @@ var lexerTests = []lexerTest{
 		{LSQUARE, "[", position.Position{"punctuation", 0, 4, 4}},
 		{RSQUARE, "]", position.Position{"punctuation", 0, 5, 5}},
 		{COMMA, ",", position.Position{"punctuation", 0, 6, 6}},
-		{EOF, "", position.Position{"punctuation", 0, 7, 7}}}},
+		{COLON, ":", position.Position{"punctuation", 0, 7, 7}},
+		{EOF, "", position.Position{"punctuation", 0, 8, 8}}}},
 	{"operators", "- + = ++ += < > <= >= == != * / << >> & | ^ ~ ** % || && =~ !~ --", []Token{
 		{MINUS, "-", position.Position{"operators", 0, 0, 0}},
 		{PLUS, "+", position.Position{"operators", 0, 2, 2}},
@@ -66,6 +67,88 @@ var lexerTests = []lexerTest{
 		{NOT_MATCH, "!~", position.Position{"operators", 0, 60, 61}},
 		{DEC, "--", position.Position{"operators", 0, 63, 64}},
 		{EOF, "", position.Position{"operators", 0, 65, 65}}}},
+	{"contextual keywords",
+		"max 1 max\nsplit( split\nlog (log)\n", []Token{
+			{MAX, "max", position.Position{"contextual keywords", 0, 0, 2}},
+			{INTLITERAL, "1", position.Position{"contextual keywords", 0, 4, 4}},
+			{ID, "max", position.Position{"contextual keywords", 0, 6, 8}},
+			{NL, "\n", position.Position{"contextual keywords", 1, 9, -1}},
+			{SPLIT, "split", position.Position{"contextual keywords", 1, 0, 4}},
+			{LPAREN, "(", position.Position{"contextual keywords", 1, 5, 5}},
+			{ID, "split", position.Position{"contextual keywords", 1, 7, 11}},
+			{NL, "\n", position.Position{"contextual keywords", 2, 12, -1}},
+			{BUILTIN, "log", position.Position{"contextual keywords", 2, 0, 2}},
+			{LPAREN, "(", position.Position{"contextual keywords", 2, 4, 4}},
+			{ID, "log", position.Position{"contextual keywords", 2, 5, 7}},
+			{RPAREN, ")", position.Position{"contextual keywords", 2, 8, 8}},
+			{NL, "\n", position.Position{"contextual keywords", 3, 9, -1}},
+			{EOF, "", position.Position{"contextual keywords", 3, 0, 0}}}},
+	{"contextual infix keywords",
+		"at x at 1\nin $1 in\nexemplar \"x\" exemplar\n", []Token{
+			{ID, "at", position.Position{"contextual infix keywords", 0, 0, 1}},
+			{ID, "x", position.Position{"contextual infix keywords", 0, 3, 3}},
+			{AT, "at", position.Position{"contextual infix keywords", 0, 5, 6}},
+			{INTLITERAL, "1", position.Position{"contextual infix keywords", 0, 8, 8}},
+			{NL, "\n", position.Position{"contextual infix keywords", 1, 9, -1}},
+			{ID, "in", position.Position{"contextual infix keywords", 1, 0, 1}},
+			{CAPREF, "1", position.Position{"contextual infix keywords", 1, 3, 4}},
+			{IN, "in", position.Position{"contextual infix keywords", 1, 6, 7}},
+			{NL, "\n", position.Position{"contextual infix keywords", 2, 8, -1}},
+			{ID, "exemplar", position.Position{"contextual infix keywords", 2, 0, 7}},
+			{STRING, "x", position.Position{"contextual infix keywords", 2, 9, 11}},
+			{EXEMPLAR, "exemplar", position.Position{"contextual infix keywords", 2, 13, 20}},
+			{NL, "\n", position.Position{"contextual infix keywords", 3, 21, -1}},
+			{EOF, "", position.Position{"contextual infix keywords", 3, 0, 0}}}},
+	{"contextual rule keyword",
+		"rule r: rule\n", []Token{
+			{RULE, "rule", position.Position{"contextual rule keyword", 0, 0, 3}},
+			{ID, "r", position.Position{"contextual rule keyword", 0, 5, 5}},
+			{COLON, ":", position.Position{"contextual rule keyword", 0, 6, 6}},
+			{ID, "rule", position.Position{"contextual rule keyword", 0, 8, 11}},
+			{NL, "\n", position.Position{"contextual rule keyword", 1, 12, -1}},
+			{EOF, "", position.Position{"contextual rule keyword", 1, 0, 0}}}},
+	{"contextual drop keyword",
+		"drop\ndrop++\n", []Token{
+			{STOP, "drop", position.Position{"contextual drop keyword", 0, 0, 3}},
+			{NL, "\n", position.Position{"contextual drop keyword", 1, 4, -1}},
+			{ID, "drop", position.Position{"contextual drop keyword", 1, 0, 3}},
+			{INC, "++", position.Position{"contextual drop keyword", 1, 4, 5}},
+			{NL, "\n", position.Position{"contextual drop keyword", 2, 6, -1}},
+			{EOF, "", position.Position{"contextual drop keyword", 2, 0, 0}}}},
+	{"contextual foreach keyword",
+		"foreach f\nforeach++\n", []Token{
+			{FOREACH, "foreach", position.Position{"contextual foreach keyword", 0, 0, 6}},
+			{ID, "f", position.Position{"contextual foreach keyword", 0, 8, 8}},
+			{NL, "\n", position.Position{"contextual foreach keyword", 1, 9, -1}},
+			{ID, "foreach", position.Position{"contextual foreach keyword", 1, 0, 6}},
+			{INC, "++", position.Position{"contextual foreach keyword", 1, 7, 8}},
+			{NL, "\n", position.Position{"contextual foreach keyword", 2, 9, -1}},
+			{EOF, "", position.Position{"contextual foreach keyword", 2, 0, 0}}}},
+	{"contextual preprocess keyword",
+		"preprocess /\npreprocess++\n", []Token{
+			{PREPROCESS, "preprocess", position.Position{"contextual preprocess keyword", 0, 0, 9}},
+			{DIV, "/", position.Position{"contextual preprocess keyword", 0, 11, 11}},
+			{NL, "\n", position.Position{"contextual preprocess keyword", 1, 12, -1}},
+			{ID, "preprocess", position.Position{"contextual preprocess keyword", 1, 0, 9}},
+			{INC, "++", position.Position{"contextual preprocess keyword", 1, 10, 11}},
+			{NL, "\n", position.Position{"contextual preprocess keyword", 2, 12, -1}},
+			{EOF, "", position.Position{"contextual preprocess keyword", 2, 0, 0}}}},
+	{"contextual declaration keywords",
+		"counter rollup by rollup rollup\nx rollup\ncounter cumulative cumulative\n", []Token{
+			{COUNTER, "counter", position.Position{"contextual declaration keywords", 0, 0, 6}},
+			{ID, "rollup", position.Position{"contextual declaration keywords", 0, 8, 13}},
+			{BY, "by", position.Position{"contextual declaration keywords", 0, 15, 16}},
+			{ID, "rollup", position.Position{"contextual declaration keywords", 0, 18, 23}},
+			{ROLLUP, "rollup", position.Position{"contextual declaration keywords", 0, 25, 30}},
+			{NL, "\n", position.Position{"contextual declaration keywords", 1, 31, -1}},
+			{ID, "x", position.Position{"contextual declaration keywords", 1, 0, 0}},
+			{ID, "rollup", position.Position{"contextual declaration keywords", 1, 2, 7}},
+			{NL, "\n", position.Position{"contextual declaration keywords", 2, 8, -1}},
+			{COUNTER, "counter", position.Position{"contextual declaration keywords", 2, 0, 6}},
+			{ID, "cumulative", position.Position{"contextual declaration keywords", 2, 8, 17}},
+			{CUMULATIVE, "cumulative", position.Position{"contextual declaration keywords", 2, 19, 28}},
+			{NL, "\n", position.Position{"contextual declaration keywords", 3, 29, -1}},
+			{EOF, "", position.Position{"contextual declaration keywords", 3, 0, 0}}}},
 	{"keywords",
 		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\n", []Token{
 			{COUNTER, "counter", position.Position{"keywords", 0, 0, 6}},
@@ -171,6 +254,11 @@ var lexerTests = []lexerTest{
 		{REGEX, `foo\d/`, position.Position{"regex with escape and special char", 0, 1, 7}},
 		{DIV, "/", position.Position{"regex with escape and special char", 0, 8, 8}},
 		{EOF, "", position.Position{"regex with escape and special char", 0, 9, 9}}}},
+	{"regex with flags", "/asdf/is", []Token{
+		{DIV, "/", position.Position{"regex with flags", 0, 0, 0}},
+		{REGEX, "(?is:asdf)", position.Position{"regex with flags", 0, 1, 4}},
+		{DIV, "/", position.Position{"regex with flags", 0, 5, 7}},
+		{EOF, "", position.Position{"regex with flags", 0, 8, 8}}}},
 	{"capref", "$foo $1", []Token{
 		{CAPREF_NAMED, "foo", position.Position{"capref", 0, 0, 3}},
 		{CAPREF, "1", position.Position{"capref", 0, 5, 6}},
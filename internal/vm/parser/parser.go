@@ -49,51 +49,62 @@ const OTHERWISE = 57360
 const ELSE = 57361
 const STOP = 57362
 const BUCKETS = 57363
-const BUILTIN = 57364
-const REGEX = 57365
-const STRING = 57366
-const CAPREF = 57367
-const CAPREF_NAMED = 57368
-const ID = 57369
-const DECO = 57370
-const INTLITERAL = 57371
-const FLOATLITERAL = 57372
-const DURATIONLITERAL = 57373
-const INC = 57374
-const DEC = 57375
-const DIV = 57376
-const MOD = 57377
-const MUL = 57378
-const MINUS = 57379
-const PLUS = 57380
-const POW = 57381
-const SHL = 57382
-const SHR = 57383
-const LT = 57384
-const GT = 57385
-const LE = 57386
-const GE = 57387
-const EQ = 57388
-const NE = 57389
-const BITAND = 57390
-const XOR = 57391
-const BITOR = 57392
-const NOT = 57393
-const AND = 57394
-const OR = 57395
-const ADD_ASSIGN = 57396
-const ASSIGN = 57397
-const CONCAT = 57398
-const MATCH = 57399
-const NOT_MATCH = 57400
-const LCURLY = 57401
-const RCURLY = 57402
-const LPAREN = 57403
-const RPAREN = 57404
-const LSQUARE = 57405
-const RSQUARE = 57406
-const COMMA = 57407
-const NL = 57408
+const CUMULATIVE = 57364
+const ROLLUP = 57365
+const MAX = 57366
+const IN = 57367
+const PREPROCESS = 57368
+const EXEMPLAR = 57369
+const RULE = 57370
+const FOREACH = 57371
+const SPLIT = 57372
+const BUILTIN = 57373
+const REGEX = 57374
+const STRING = 57375
+const CAPREF = 57376
+const CAPREF_NAMED = 57377
+const ID = 57378
+const DECO = 57379
+const INTLITERAL = 57380
+const FLOATLITERAL = 57381
+const DURATIONLITERAL = 57382
+const INC = 57383
+const DEC = 57384
+const DIV = 57385
+const MOD = 57386
+const MUL = 57387
+const MINUS = 57388
+const PLUS = 57389
+const POW = 57390
+const SHL = 57391
+const SHR = 57392
+const LT = 57393
+const GT = 57394
+const LE = 57395
+const GE = 57396
+const EQ = 57397
+const NE = 57398
+const BITAND = 57399
+const XOR = 57400
+const BITOR = 57401
+const NOT = 57402
+const AND = 57403
+const OR = 57404
+const ADD_ASSIGN = 57405
+const ASSIGN = 57406
+const AT = 57407
+const CONCAT = 57408
+const MATCH = 57409
+const NOT_MATCH = 57410
+const LCURLY = 57411
+const RCURLY = 57412
+const LPAREN = 57413
+const RPAREN = 57414
+const LSQUARE = 57415
+const RSQUARE = 57416
+const COMMA = 57417
+const COLON = 57418
+const NL = 57419
 
 var mtailToknames = [...]string{
 	"$end",
@@ -117,6 +128,15 @@ var mtailToknames = [...]string{
 	"ELSE",
 	"STOP",
 	"BUCKETS",
+	"CUMULATIVE",
+	"ROLLUP",
+	"MAX",
+	"IN",
+	"PREPROCESS",
+	"EXEMPLAR",
+	"RULE",
+	"FOREACH",
+	"SPLIT",
 	"BUILTIN",
 	"REGEX",
 	"STRING",
@@ -151,6 +171,7 @@ var mtailToknames = [...]string{
 	"OR",
 	"ADD_ASSIGN",
 	"ASSIGN",
+	"AT",
 	"CONCAT",
 	"MATCH",
 	"NOT_MATCH",
@@ -161,6 +182,7 @@ var mtailToknames = [...]string{
 	"LSQUARE",
 	"RSQUARE",
 	"COMMA",
+	"COLON",
 	"NL",
 }
 
@@ -170,9 +192,9 @@ const mtailEofCode = 1
 const mtailErrCode = 2
 const mtailInitialStackSize = 16
 
-//line parser.y:651
+//line parser.y:750
 
-//  tokenpos returns the position of the current token.
+// tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position.Position {
 	return mtaillex.(*parser).t.Pos
 }
@@ -190,150 +212,182 @@ var mtailExca = [...]int{
 	-2, 0,
 	-1, 2,
 	1, 1,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
-	-1, 24,
-	66, 21,
-	-2, 66,
-	-1, 107,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
+	15, 135,
+	29, 135,
+	37, 135,
+	43, 135,
+	-2, 100,
+	-1, 28,
+	77, 25,
+	-2, 75,
+	-1, 117,
+	15, 135,
+	29, 135,
+	37, 135,
+	43, 135,
+	-2, 100,
 }
 
 const mtailPrivate = 57344
 
-const mtailLast = 233
+const mtailLast = 333
 
 var mtailAct = [...]int{
-	158, 21, 92, 64, 44, 29, 28, 43, 42, 27,
-	26, 30, 47, 93, 14, 41, 24, 91, 123, 46,
-	19, 154, 152, 153, 153, 88, 106, 53, 52, 168,
-	22, 167, 50, 51, 63, 89, 49, 13, 50, 51,
-	31, 28, 127, 94, 87, 49, 11, 25, 2, 20,
-	10, 15, 90, 12, 165, 33, 13, 36, 34, 35,
-	45, 60, 38, 39, 45, 11, 25, 142, 20, 10,
-	15, 113, 12, 105, 33, 114, 36, 34, 35, 45,
-	140, 38, 39, 161, 40, 80, 81, 103, 83, 82,
-	124, 124, 104, 133, 37, 50, 51, 112, 107, 16,
-	85, 86, 1, 40, 66, 68, 67, 131, 126, 28,
-	29, 28, 162, 37, 100, 101, 99, 130, 16, 102,
-	136, 24, 146, 28, 28, 19, 141, 143, 145, 144,
-	151, 150, 156, 155, 147, 148, 132, 149, 69, 116,
-	73, 74, 75, 76, 77, 78, 117, 97, 96, 70,
-	71, 61, 79, 118, 98, 166, 119, 120, 121, 171,
-	170, 122, 164, 163, 62, 95, 48, 65, 169, 128,
-	60, 33, 129, 36, 34, 35, 45, 84, 38, 39,
-	33, 115, 36, 34, 35, 45, 72, 38, 39, 33,
-	18, 36, 34, 35, 45, 157, 38, 39, 160, 111,
-	40, 159, 110, 70, 71, 138, 137, 134, 135, 40,
-	37, 125, 54, 109, 9, 139, 8, 7, 108, 37,
-	55, 56, 57, 58, 59, 6, 32, 23, 37, 17,
-	5, 4, 3,
+	72, 25, 180, 32, 16, 48, 34, 136, 31, 101,
+	46, 116, 33, 47, 53, 30, 45, 75, 77, 76,
+	60, 95, 96, 95, 96, 51, 50, 102, 174, 118,
+	28, 175, 58, 172, 173, 215, 201, 200, 52, 73,
+	164, 22, 32, 26, 56, 57, 100, 203, 219, 98,
+	207, 71, 202, 99, 103, 140, 56, 57, 15, 55,
+	115, 75, 77, 76, 55, 90, 91, 12, 29, 214,
+	23, 11, 17, 97, 13, 189, 220, 93, 92, 35,
+	14, 127, 18, 67, 125, 37, 161, 40, 38, 39,
+	49, 49, 42, 43, 56, 57, 75, 77, 76, 182,
+	137, 137, 181, 56, 57, 95, 96, 139, 106, 105,
+	2, 193, 79, 80, 44, 183, 32, 144, 32, 32,
+	79, 80, 126, 147, 146, 41, 194, 33, 124, 143,
+	112, 19, 166, 32, 32, 128, 163, 167, 168, 159,
+	165, 59, 129, 130, 162, 28, 170, 176, 113, 171,
+	131, 169, 177, 132, 133, 134, 22, 158, 135, 145,
+	56, 57, 178, 190, 192, 141, 117, 199, 142, 211,
+	210, 191, 188, 187, 160, 195, 114, 195, 123, 82,
+	186, 185, 196, 37, 196, 40, 38, 39, 49, 122,
+	42, 43, 121, 32, 32, 32, 1, 204, 205, 206,
+	153, 184, 150, 209, 212, 83, 84, 85, 86, 87,
+	88, 78, 15, 89, 208, 32, 107, 218, 104, 217,
+	216, 12, 29, 41, 23, 11, 17, 54, 13, 74,
+	109, 110, 108, 94, 14, 111, 18, 81, 21, 37,
+	179, 40, 38, 39, 49, 148, 42, 43, 37, 149,
+	40, 38, 39, 49, 61, 42, 43, 197, 37, 24,
+	40, 38, 39, 49, 213, 42, 43, 198, 44, 10,
+	155, 154, 62, 63, 64, 65, 66, 44, 120, 41,
+	156, 151, 152, 157, 9, 19, 8, 44, 41, 138,
+	68, 7, 37, 119, 40, 38, 39, 49, 41, 42,
+	43, 6, 36, 27, 70, 20, 5, 4, 3, 0,
+	0, 0, 69, 0, 0, 0, 0, 0, 67, 0,
+	0, 44, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 41,
 }
 
 var mtailPact = [...]int{
-	-1000, -1000, 52, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, 37, -1000, -1000, -14, -23, -1000, -39, 215, 136,
-	167, 56, -1000, -1000, 117, -1000, 98, -1000, 28, 34,
-	60, 6, -38, -26, -1000, -1000, -1000, 158, -1000, -1000,
-	158, 110, -1000, -1000, 80, -1000, -1000, 73, -40, -1000,
-	-1000, -1000, -1000, -1000, 175, -1000, -1000, -1000, -1000, -1000,
-	-1000, 44, -23, 171, -1000, -40, -1000, -1000, -1000, -1000,
-	-1000, -1000, -40, -1000, -1000, -1000, -1000, -1000, -1000, -40,
-	-1000, -1000, -40, -40, -40, -1000, -1000, -40, 158, 149,
-	-20, 27, -1000, 117, -1000, -40, -1000, -1000, -40, -1000,
-	-1000, -1000, -1000, 6, -23, 158, -1000, 33, 194, -1000,
-	-1000, -1000, 57, -23, -1000, 36, 158, 158, 167, 158,
-	158, 158, 37, -42, 56, -1000, -41, -1000, 158, 158,
-	-1000, 56, -1000, -1000, -1000, -1000, -1000, 174, 59, 133,
-	20, -1000, -1000, 98, 60, -1000, -1000, 43, 43, 110,
-	-1000, -1000, -1000, 158, -1000, 80, -1000, -34, -1000, -1000,
-	-1000, -1000, -36, -1000, -1000, -1000, 56, 174, 130, -1000,
-	-1000, -1000,
+	-1000, -1000, 208, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, 55, -1000, -1000, -1000, -5, -10, 105, -1000,
+	-57, 267, 275, 152, -10, 39, -1000, -1000, 79, -1000,
+	154, -1000, -2, 14, 56, 26, -24, -18, -1000, -1000,
+	-1000, 261, -1000, -1000, 261, 62, -1000, -1000, 187, -1000,
+	-1000, 115, 40, 157, -66, -1000, -1000, -1000, -1000, -47,
+	-1000, 156, -1000, -1000, -1000, -1000, -1000, -1000, 92, -10,
+	86, 71, -1000, -1000, -66, -1000, -1000, -1000, -1000, -1000,
+	-1000, -66, -66, -1000, -1000, -1000, -1000, -1000, -1000, -66,
+	-1000, -1000, -66, -66, -66, -1000, -1000, -66, 261, 217,
+	-17, -1000, 79, -1000, -66, -1000, -1000, -66, -1000, -1000,
+	-1000, -1000, 26, -1000, -10, 261, -1000, 54, 261, 259,
+	-1000, -1000, -1000, 125, -10, -1000, 149, 46, 261, 261,
+	-33, 152, 261, 261, 261, 55, -41, 39, -1000, -44,
+	-1000, 261, 261, -1000, 39, -1000, -1000, -5, -1000, -1000,
+	-1000, -1000, -1000, -1000, 66, 82, 142, 134, 32, -1000,
+	133, -1000, 154, 56, 261, -1000, -1000, 99, 33, 62,
+	-1000, -1000, -1000, 261, -1000, 227, 187, -1000, 148, -38,
+	-1000, -1000, -1000, -1000, -39, -1000, -1000, -1000, -1000, -1000,
+	-19, -28, 261, 261, 261, 39, -1000, -22, -1000, -10,
+	66, 131, 261, -66, 33, 42, 33, -1000, -1000, -1000,
+	-1000, -1000, -40, 261, 261, 261, -26, 33, 4, -1000,
+	-1000,
 }
 
 var mtailPgo = [...]int{
-	0, 48, 232, 18, 12, 231, 230, 229, 3, 4,
-	15, 13, 2, 227, 10, 11, 1, 14, 226, 7,
-	40, 9, 225, 218, 217, 216, 8, 30, 214, 213,
-	212, 208, 0, 207, 195, 190, 186, 177, 167, 166,
-	165, 154, 152, 138, 120, 112, 102, 73, 17, 97,
+	0, 110, 308, 7, 14, 307, 306, 305, 0, 5,
+	16, 27, 9, 303, 15, 6, 1, 4, 302, 13,
+	79, 8, 301, 293, 291, 286, 10, 43, 284, 278,
+	269, 259, 257, 254, 249, 2, 245, 240, 238, 237,
+	233, 229, 227, 218, 216, 213, 211, 202, 201, 200,
+	196, 60, 38, 178,
 }
 
 var mtailR1 = [...]int{
-	0, 46, 1, 1, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 5, 5, 5, 6, 6, 4,
-	7, 7, 13, 13, 17, 17, 17, 17, 39, 39,
-	16, 16, 38, 38, 38, 14, 14, 36, 36, 36,
-	36, 36, 36, 15, 15, 37, 37, 10, 10, 27,
-	27, 27, 42, 42, 21, 20, 20, 20, 40, 40,
-	9, 9, 41, 41, 41, 41, 12, 12, 11, 11,
-	43, 43, 8, 8, 8, 8, 8, 8, 8, 8,
-	8, 18, 18, 19, 3, 3, 26, 22, 35, 35,
-	23, 23, 23, 23, 29, 29, 30, 30, 30, 30,
-	30, 33, 34, 34, 31, 44, 45, 45, 45, 45,
-	24, 25, 28, 28, 32, 32, 48, 49, 47, 47,
+	0, 50, 1, 1, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 5, 5, 5, 5,
+	5, 6, 6, 4, 7, 7, 13, 13, 13, 13,
+	13, 13, 17, 17, 17, 17, 42, 42, 16, 16,
+	41, 41, 41, 14, 14, 14, 39, 39, 39, 39,
+	39, 39, 15, 15, 40, 40, 10, 10, 27, 27,
+	27, 45, 45, 21, 20, 20, 20, 43, 43, 9,
+	9, 44, 44, 44, 44, 12, 12, 11, 11, 46,
+	46, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 18, 18, 19, 3, 3, 3, 32, 26, 22,
+	38, 38, 23, 23, 23, 23, 23, 23, 23, 29,
+	29, 33, 33, 33, 33, 33, 36, 37, 37, 34,
+	47, 48, 48, 48, 48, 49, 49, 24, 25, 30,
+	31, 28, 28, 35, 35, 52, 53, 51, 51,
 }
 
 var mtailR2 = [...]int{
 	0, 1, 0, 2, 1, 1, 1, 1, 1, 1,
-	1, 3, 1, 1, 4, 2, 2, 1, 2, 3,
-	1, 1, 4, 4, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 4, 1, 1, 1,
-	1, 1, 1, 1, 4, 1, 1, 1, 4, 1,
-	4, 4, 1, 1, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 1, 2, 1, 2,
-	1, 1, 1, 3, 4, 1, 1, 1, 3, 1,
-	1, 1, 4, 1, 1, 3, 5, 3, 0, 1,
-	2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
-	1, 2, 1, 3, 2, 2, 1, 1, 3, 3,
-	4, 3, 4, 2, 1, 1, 0, 0, 0, 1,
+	1, 1, 3, 1, 3, 1, 4, 2, 2, 7,
+	5, 1, 2, 3, 1, 1, 4, 4, 6, 6,
+	6, 8, 1, 1, 4, 4, 1, 1, 1, 4,
+	1, 1, 1, 1, 4, 9, 1, 1, 1, 1,
+	1, 1, 1, 4, 1, 1, 1, 4, 1, 4,
+	4, 1, 1, 1, 1, 4, 4, 1, 1, 1,
+	4, 1, 1, 1, 1, 1, 2, 1, 2, 1,
+	1, 1, 3, 4, 6, 1, 1, 1, 3, 1,
+	1, 1, 4, 1, 1, 3, 3, 1, 5, 3,
+	0, 1, 2, 2, 2, 2, 2, 2, 1, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 3, 2,
+	2, 1, 1, 3, 3, 2, 2, 4, 3, 2,
+	10, 4, 2, 1, 1, 0, 0, 0, 1,
 }
 
 var mtailChk = [...]int{
-	-1000, -46, -1, -2, -5, -6, -22, -24, -25, -28,
-	17, 13, 20, 4, -17, 18, 66, -7, -35, -48,
-	16, -16, -27, -13, -11, 14, -14, -21, -8, -12,
-	-15, -20, -18, 22, 25, 26, 24, 61, 29, 30,
-	51, -10, -26, -19, -9, 27, -19, -4, -39, 59,
-	52, 53, -4, 66, -30, 5, 6, 7, 8, 9,
-	34, 15, 28, -11, -8, -38, 48, 50, 49, -43,
-	32, 33, -36, 42, 43, 44, 45, 46, 47, -42,
-	57, 58, 55, 54, -37, 40, 41, 38, 63, 61,
-	-17, -48, -12, -11, -12, -40, 38, 37, -41, 36,
-	34, 35, 39, -20, 19, -47, 66, -1, -23, -29,
-	27, 24, -49, 27, -4, 10, -47, -47, -47, -47,
-	-47, -47, -47, -3, -16, 62, -3, 62, -47, -47,
-	-4, -16, -27, 60, -33, -31, -44, 12, 11, 21,
-	23, -4, 31, -14, -15, -21, -8, -17, -17, -10,
-	-26, -19, 64, 65, 62, -9, -12, -34, -32, 27,
-	24, 24, -45, 30, 29, 34, -16, 65, 65, -32,
-	30, 29,
+	-1000, -50, -1, -2, -5, -6, -22, -24, -25, -28,
+	-30, 17, 13, 20, 26, 4, -17, 18, 28, 77,
+	-7, -38, -52, 16, -31, -16, -27, -13, -11, 14,
+	-14, -21, -8, -12, -15, -20, -18, 31, 34, 35,
+	33, 71, 38, 39, 60, -10, -26, -19, -9, 36,
+	-19, -26, -52, -4, -42, 69, 61, 62, -4, 36,
+	77, -33, 5, 6, 7, 8, 9, 43, 15, 37,
+	29, -11, -8, -4, -41, 57, 59, 58, -46, 41,
+	42, -39, 25, 51, 52, 53, 54, 55, 56, -45,
+	67, 68, 64, 63, -40, 49, 50, 47, 73, 71,
+	-17, -12, -11, -12, -43, 47, 46, -44, 45, 43,
+	44, 48, -20, 33, 19, -51, 77, -1, 76, -23,
+	-29, 36, 33, -53, 36, -4, 36, 10, -51, -51,
+	-51, -51, -51, -51, -51, -51, -3, -16, 72, -3,
+	72, -51, -51, -4, -16, -27, 70, -17, -36, -34,
+	-47, 22, 23, -49, 12, 11, 21, 24, 32, -4,
+	25, 40, -14, -15, 73, -21, -8, -17, -17, -10,
+	-26, -19, 74, 75, 72, 75, -9, -12, -4, -37,
+	-35, 36, 33, 33, -48, 39, 38, 39, 38, 43,
+	30, -15, 65, 12, 27, -16, -21, -32, 40, 19,
+	75, 75, 71, 75, -17, -17, -17, 72, -4, -35,
+	39, 38, -16, -51, 27, 75, -15, -17, -16, 74,
+	72,
 }
 
 var mtailDef = [...]int{
 	2, -2, -2, 3, 4, 5, 6, 7, 8, 9,
-	10, 0, 12, 13, 0, 0, 17, 0, 0, 0,
-	0, 24, 25, 20, -2, 89, 30, 49, 68, 60,
-	35, 54, 72, 0, 75, 76, 77, 116, 79, 80,
-	0, 43, 55, 81, 47, 83, 116, 15, 118, 2,
-	28, 29, 16, 18, 0, 96, 97, 98, 99, 100,
-	117, 0, 0, 113, 68, 118, 32, 33, 34, 69,
-	70, 71, 118, 37, 38, 39, 40, 41, 42, 118,
-	52, 53, 118, 118, 118, 45, 46, 118, 0, 0,
-	0, 0, 60, 66, 67, 118, 58, 59, 118, 62,
-	63, 64, 65, 11, 0, 116, 119, -2, 87, 93,
-	94, 95, 0, 0, 111, 0, 0, 0, 116, 116,
-	116, 0, 116, 0, 84, 73, 0, 78, 0, 0,
-	14, 26, 27, 19, 90, 91, 92, 0, 0, 0,
-	0, 110, 112, 31, 36, 50, 51, 22, 23, 44,
-	56, 57, 82, 0, 74, 48, 61, 101, 102, 114,
-	115, 104, 105, 106, 107, 86, 85, 0, 0, 103,
-	108, 109,
+	10, 11, 0, 13, 135, 15, 0, 0, 0, 21,
+	0, 0, 0, 0, 0, 32, 33, 24, -2, 101,
+	38, 58, 77, 69, 43, 63, 81, 0, 85, 86,
+	87, 135, 89, 90, 0, 52, 64, 91, 56, 93,
+	135, 0, 0, 17, 137, 2, 36, 37, 18, 0,
+	22, 0, 111, 112, 113, 114, 115, 136, 0, 0,
+	0, 132, 77, 129, 137, 40, 41, 42, 78, 79,
+	80, 137, 137, 46, 47, 48, 49, 50, 51, 137,
+	61, 62, 137, 137, 137, 54, 55, 137, 0, 0,
+	0, 69, 75, 76, 137, 67, 68, 137, 71, 72,
+	73, 74, 12, 14, 0, 135, 138, -2, 135, 99,
+	108, 109, 110, 0, 0, 128, 0, 0, 0, 0,
+	0, 135, 135, 135, 0, 135, 0, 94, 82, 0,
+	88, 0, 0, 16, 34, 35, 23, 0, 102, 103,
+	104, 105, 106, 107, 0, 0, 0, 0, 0, 127,
+	0, 131, 39, 44, 0, 59, 60, 26, 27, 53,
+	65, 66, 92, 135, 83, 135, 57, 70, 20, 116,
+	117, 133, 134, 119, 120, 121, 122, 125, 126, 98,
+	0, 0, 135, 135, 135, 95, 96, 0, 97, 0,
+	0, 0, 0, 137, 28, 29, 30, 84, 19, 118,
+	123, 124, 0, 0, 135, 0, 0, 31, 0, 45,
+	130,
 }
 
 var mtailTok1 = [...]int{
@@ -347,7 +401,8 @@ var mtailTok2 = [...]int{
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
 	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
 	52, 53, 54, 55, 56, 57, 58, 59, 60, 61,
-	62, 63, 64, 65, 66,
+	62, 63, 64, 65, 66, 67, 68, 69, 70, 71,
+	72, 73, 74, 75, 76, 77,
 }
 
 var mtailTok3 = [...]int{
@@ -359,12 +414,12 @@ var mtailErrorMessages = [...]struct {
 	token int
 	msg   string
 }{
-	{112, 4, "unexpected end of file, expecting '/' to end regex"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{14, 63, "unexpected indexing of an expression"},
-	{14, 66, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
+	{123, 4, "unexpected end of file, expecting '/' to end regex"},
+	{21, 1, "unexpected end of file, expecting '}' to end block"},
+	{21, 1, "unexpected end of file, expecting '}' to end block"},
+	{21, 1, "unexpected end of file, expecting '}' to end block"},
+	{16, 73, "unexpected indexing of an expression"},
+	{16, 77, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
 }
 
 //line yaccpar:1
@@ -700,19 +755,19 @@ mtaildefault:
 
 	case 1:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:91
+//line parser.y:93
 		{
 			mtaillex.(*parser).root = mtailDollar[1].n
 		}
 	case 2:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:98
+//line parser.y:100
 		{
 			mtailVAL.n = &ast.StmtList{}
 		}
 	case 3:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:102
+//line parser.y:104
 		{
 			mtailVAL.n = mtailDollar[1].n
 			if mtailDollar[2].n != nil {
@@ -721,711 +776,832 @@ mtaildefault:
 		}
 	case 4:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:112
+//line parser.y:114
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 5:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:114
+//line parser.y:116
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 6:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:116
+//line parser.y:118
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 7:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:118
+//line parser.y:120
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 8:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:120
+//line parser.y:122
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 9:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:122
+//line parser.y:124
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 10:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:124
+//line parser.y:126
 		{
-			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 11:
-		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
 //line parser.y:128
 		{
-			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
+			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
 		}
 	case 12:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
 //line parser.y:132
 		{
-			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
+			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
 		}
 	case 13:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
 //line parser.y:136
 		{
-			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
+			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
 		}
 	case 14:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:143
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:140
 		{
-			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
+			mtailVAL.n = &ast.PreprocessStmt{P: *mtailDollar[2].n.Pos(), Pattern: mtailDollar[2].n.(*ast.PatternLit).Pattern, Replacement: mtailDollar[3].text}
 		}
 	case 15:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:144
+		{
+			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
+		}
+	case 16:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:151
+		{
+			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil, ""}
+		}
+	case 17:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:147
+//line parser.y:155
 		{
 			if mtailDollar[1].n != nil {
-				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
+				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil, ""}
 			} else {
 				mtailVAL.n = mtailDollar[2].n
 			}
 		}
-	case 16:
+	case 18:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:155
+//line parser.y:163
 		{
 			o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
-			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil}
+			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil, ""}
 		}
-	case 17:
+	case 19:
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:168
+		{
+			mtailVAL.n = &ast.CondStmt{mtailDollar[4].n, mtailDollar[5].n, mtailDollar[7].n, nil, mtailDollar[2].text}
+		}
+	case 20:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:172
+		{
+			mtailVAL.n = &ast.CondStmt{mtailDollar[4].n, mtailDollar[5].n, nil, nil, mtailDollar[2].text}
+		}
+	case 21:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:163
+//line parser.y:179
 		{
 			mtailVAL.n = nil
 		}
-	case 18:
+	case 22:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:165
+//line parser.y:181
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 19:
+	case 23:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:170
+//line parser.y:186
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 20:
+	case 24:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:177
+//line parser.y:193
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 21:
+	case 25:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:179
+//line parser.y:195
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 22:
+	case 26:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:184
+//line parser.y:200
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 23:
+	case 27:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:188
+//line parser.y:204
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 24:
+	case 28:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:208
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: &ast.BinaryExpr{Lhs: mtailDollar[4].n, Rhs: mtailDollar[6].n, Op: mtailDollar[5].op}, Op: mtailDollar[2].op}
+		}
+	case 29:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:212
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: &ast.BinaryExpr{Lhs: mtailDollar[4].n, Rhs: mtailDollar[6].n, Op: BY}, Op: mtailDollar[2].op}
+		}
+	case 30:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:216
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: &ast.BinaryExpr{Lhs: mtailDollar[4].n, Rhs: mtailDollar[6].n, Op: EXEMPLAR}, Op: mtailDollar[2].op}
+		}
+	case 31:
+		mtailDollar = mtailS[mtailpt-8 : mtailpt+1]
+//line parser.y:220
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: &ast.BinaryExpr{Lhs: &ast.BinaryExpr{Lhs: mtailDollar[4].n, Rhs: mtailDollar[6].n, Op: BY}, Rhs: mtailDollar[8].n, Op: EXEMPLAR}, Op: mtailDollar[2].op}
+		}
+	case 32:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:195
+//line parser.y:227
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 25:
+	case 33:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:197
+//line parser.y:229
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 26:
+	case 34:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:199
+//line parser.y:231
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 27:
+	case 35:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:203
+//line parser.y:235
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 28:
+	case 36:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:210
+//line parser.y:242
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 29:
+	case 37:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:212
+//line parser.y:244
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 30:
+	case 38:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:217
+//line parser.y:249
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 31:
+	case 39:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:219
+//line parser.y:251
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 32:
+	case 40:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:226
+//line parser.y:258
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 33:
+	case 41:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:228
+//line parser.y:260
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 34:
+	case 42:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:230
+//line parser.y:262
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 35:
+	case 43:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:235
+//line parser.y:267
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 36:
+	case 44:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:237
+//line parser.y:269
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 37:
+	case 45:
+		mtailDollar = mtailS[mtailpt-9 : mtailpt+1]
+//line parser.y:273
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: &ast.BinaryExpr{Lhs: mtailDollar[5].n, Rhs: mtailDollar[8].n, Op: COMMA}, Op: IN}
+		}
+	case 46:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:244
+//line parser.y:280
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 38:
+	case 47:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:246
+//line parser.y:282
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 39:
+	case 48:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:248
+//line parser.y:284
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 40:
+	case 49:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:250
+//line parser.y:286
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 41:
+	case 50:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:252
+//line parser.y:288
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 42:
+	case 51:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:254
+//line parser.y:290
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 43:
+	case 52:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:259
+//line parser.y:295
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 44:
+	case 53:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:261
+//line parser.y:297
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 45:
+	case 54:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:268
+//line parser.y:304
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 46:
+	case 55:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:270
+//line parser.y:306
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 47:
+	case 56:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:275
+//line parser.y:311
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 48:
+	case 57:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:277
+//line parser.y:313
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 49:
+	case 58:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:284
+//line parser.y:320
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 50:
+	case 59:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:286
+//line parser.y:322
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 51:
+	case 60:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:290
+//line parser.y:326
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 52:
+	case 61:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:297
+//line parser.y:333
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 53:
+	case 62:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:299
+//line parser.y:335
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 54:
+	case 63:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:304
+//line parser.y:340
 		{
 			mtailVAL.n = &ast.PatternExpr{Expr: mtailDollar[1].n}
 		}
-	case 55:
+	case 64:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:311
+//line parser.y:347
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 56:
+	case 65:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:313
+//line parser.y:349
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 57:
+	case 66:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:317
+//line parser.y:353
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 58:
+	case 67:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:324
+//line parser.y:360
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 59:
+	case 68:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:326
+//line parser.y:362
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 60:
+	case 69:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:331
+//line parser.y:367
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 61:
+	case 70:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:333
+//line parser.y:369
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 62:
+	case 71:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:340
+//line parser.y:376
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 63:
+	case 72:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:342
+//line parser.y:378
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 64:
+	case 73:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:344
+//line parser.y:380
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 65:
+	case 74:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:346
+//line parser.y:382
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 66:
+	case 75:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:351
+//line parser.y:387
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 67:
+	case 76:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:353
+//line parser.y:389
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
-	case 68:
+	case 77:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:360
+//line parser.y:396
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 69:
+	case 78:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:362
+//line parser.y:398
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[1].n, Op: mtailDollar[2].op}
 		}
-	case 70:
+	case 79:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:369
+//line parser.y:405
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 71:
+	case 80:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:371
+//line parser.y:407
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 72:
+	case 81:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:376
+//line parser.y:412
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 73:
+	case 82:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:378
+//line parser.y:414
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: nil}
 		}
-	case 74:
+	case 83:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:382
+//line parser.y:418
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
 		}
-	case 75:
+	case 84:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:422
+		{
+			mtailDollar[3].n.(*ast.ExprList).Children = append(mtailDollar[3].n.(*ast.ExprList).Children, mtailDollar[5].n)
+			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
+		}
+	case 85:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:386
+//line parser.y:427
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
 		}
-	case 76:
+	case 86:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:390
+//line parser.y:431
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
 		}
-	case 77:
+	case 87:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:394
+//line parser.y:435
 		{
 			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 78:
+	case 88:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:398
+//line parser.y:439
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 79:
+	case 89:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:402
+//line parser.y:443
 		{
 			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
 		}
-	case 80:
+	case 90:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:406
+//line parser.y:447
 		{
 			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
 		}
-	case 81:
+	case 91:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:413
+//line parser.y:454
 		{
 			mtailVAL.n = &ast.IndexedExpr{Lhs: mtailDollar[1].n, Index: &ast.ExprList{}}
 		}
-	case 82:
+	case 92:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:417
+//line parser.y:458
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children = append(
 				mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children,
 				mtailDollar[3].n.(*ast.ExprList).Children...)
 		}
-	case 83:
+	case 93:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:427
+//line parser.y:468
 		{
 			mtailVAL.n = &ast.IdTerm{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
 		}
-	case 84:
+	case 94:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:434
+//line parser.y:475
 		{
 			mtailVAL.n = &ast.ExprList{}
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
 		}
-	case 85:
+	case 95:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:439
+//line parser.y:480
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
 		}
-	case 86:
+	case 96:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:485
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
+		}
+	case 97:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:495
+		{
+			mtailVAL.n = &ast.DurationLit{P: tokenpos(mtaillex), D: mtailDollar[1].duration}
+		}
+	case 98:
 		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
-//line parser.y:447
+//line parser.y:502
 		{
 			mp := markedpos(mtaillex)
 			tp := tokenpos(mtaillex)
 			pos := ast.MergePosition(&mp, &tp)
 			mtailVAL.n = &ast.PatternLit{P: *pos, Pattern: mtailDollar[4].text}
 		}
-	case 87:
+	case 99:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:457
+//line parser.y:512
 		{
 			mtailVAL.n = mtailDollar[3].n
 			d := mtailVAL.n.(*ast.VarDecl)
 			d.Kind = mtailDollar[2].kind
 			d.Hidden = mtailDollar[1].flag
 		}
-	case 88:
+	case 100:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:467
+//line parser.y:522
 		{
 			mtailVAL.flag = false
 		}
-	case 89:
+	case 101:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:471
+//line parser.y:526
 		{
 			mtailVAL.flag = true
 		}
-	case 90:
+	case 102:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:478
+//line parser.y:533
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Keys = mtailDollar[2].texts
 		}
-	case 91:
+	case 103:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:483
+//line parser.y:538
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).ExportedName = mtailDollar[2].text
 		}
-	case 92:
+	case 104:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:488
+//line parser.y:543
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Buckets = mtailDollar[2].floats
 		}
-	case 93:
+	case 105:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:548
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Cumulative = true
+		}
+	case 106:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:553
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Rollup = true
+		}
+	case 107:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:558
+		{
+			mtailVAL.n = mtailDollar[1].n
+			max := mtailDollar[2].floatVal
+			mtailVAL.n.(*ast.VarDecl).Max = &max
+		}
+	case 108:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:493
+//line parser.y:564
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 94:
+	case 109:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:500
+//line parser.y:571
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 95:
+	case 110:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:504
+//line parser.y:575
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 96:
+	case 111:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:511
+//line parser.y:582
 		{
 			mtailVAL.kind = metrics.Counter
 		}
-	case 97:
+	case 112:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:515
+//line parser.y:586
 		{
 			mtailVAL.kind = metrics.Gauge
 		}
-	case 98:
+	case 113:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:519
+//line parser.y:590
 		{
 			mtailVAL.kind = metrics.Timer
 		}
-	case 99:
+	case 114:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:523
+//line parser.y:594
 		{
 			mtailVAL.kind = metrics.Text
 		}
-	case 100:
+	case 115:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:527
+//line parser.y:598
 		{
 			mtailVAL.kind = metrics.Histogram
 		}
-	case 101:
+	case 116:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:534
+//line parser.y:605
 		{
 			mtailVAL.texts = mtailDollar[2].texts
 		}
-	case 102:
+	case 117:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:541
+//line parser.y:612
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 103:
+	case 118:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:546
+//line parser.y:617
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 104:
+	case 119:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:554
+//line parser.y:625
 		{
 			mtailVAL.text = mtailDollar[2].text
 		}
-	case 105:
+	case 120:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:561
+//line parser.y:632
 		{
 			mtailVAL.floats = mtailDollar[2].floats
 		}
-	case 106:
+	case 121:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:567
+//line parser.y:638
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[1].floatVal)
 		}
-	case 107:
+	case 122:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:572
+//line parser.y:643
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[1].intVal))
 		}
-	case 108:
+	case 123:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:577
+//line parser.y:648
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[3].floatVal)
 		}
-	case 109:
+	case 124:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:582
+//line parser.y:653
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[3].intVal))
 		}
-	case 110:
+	case 125:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:660
+		{
+			mtailVAL.floatVal = mtailDollar[2].floatVal
+		}
+	case 126:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:664
+		{
+			mtailVAL.floatVal = float64(mtailDollar[2].intVal)
+		}
+	case 127:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:589
+//line parser.y:671
 		{
 			mtailVAL.n = &ast.DecoDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[4].n}
 		}
-	case 111:
+	case 128:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:596
+//line parser.y:678
 		{
 			mtailVAL.n = &ast.DecoStmt{markedpos(mtaillex), mtailDollar[2].text, mtailDollar[3].n, nil, nil}
 		}
-	case 112:
+	case 129:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:685
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.ForeachStmt).Block = mtailDollar[2].n
+		}
+	case 130:
+		mtailDollar = mtailS[mtailpt-10 : mtailpt+1]
+//line parser.y:695
+		{
+			mtailVAL.n = &ast.ForeachStmt{P: markedpos(mtaillex), Name: mtailDollar[3].text, Str: mtailDollar[7].n, Sep: mtailDollar[9].n}
+		}
+	case 131:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:603
+//line parser.y:702
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n, Expiry: mtailDollar[4].duration}
 		}
-	case 113:
+	case 132:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:607
+//line parser.y:706
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n}
 		}
-	case 114:
+	case 133:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:613
+//line parser.y:712
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 115:
+	case 134:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:617
+//line parser.y:716
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 116:
+	case 135:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:627
+//line parser.y:726
 		{
 			glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
 			mtaillex.(*parser).pos = tokenpos(mtaillex)
 		}
-	case 117:
+	case 136:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:637
+//line parser.y:736
 		{
 			mtaillex.(*parser).inRegex()
 		}
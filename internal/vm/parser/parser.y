@@ -33,20 +33,21 @@ import (
 %type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr
 %type <n> rel_expr shift_expr bitwise_expr logical_expr indexed_expr id_expr concat_expr pattern_expr
 %type <n> declaration decl_attribute_spec decorator_declaration decoration_statement regex_pattern match_expr
-%type <n> delete_statement var_name_spec
+%type <n> delete_statement var_name_spec foreach_statement foreach_spec duration_lit
 %type <kind> type_spec
 %type <text> as_spec id_or_string
 %type <texts> by_spec by_expr_list
 %type <flag> hide_spec
 %type <op> rel_op shift_op bitwise_op logical_op add_op mul_op match_op postfix_op
 %type <floats> buckets_spec buckets_list
+%type <floatVal> max_spec
 // Tokens and types are defined here.
 // Invalid input
 %token <text> INVALID
 // Types
 %token COUNTER GAUGE TIMER TEXT HISTOGRAM
 // Reserved words
-%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS
+%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS CUMULATIVE ROLLUP MAX IN PREPROCESS EXEMPLAR RULE FOREACH SPLIT
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -66,11 +67,12 @@ import (
 %token <op> LT GT LE GE EQ NE
 %token <op> BITAND XOR BITOR NOT AND OR
 %token <op> ADD_ASSIGN ASSIGN
+%token <op> AT
 %token <op> CONCAT
 %token <op> MATCH NOT_MATCH
 // Punctuation
 %token LCURLY RCURLY LPAREN RPAREN LSQUARE RSQUARE
-%token COMMA
+%token COMMA COLON
 %token NL
 
 %start start
@@ -120,6 +122,8 @@ stmt
   { $$ = $1 }
   | delete_statement
   { $$ = $1 }
+  | foreach_statement
+  { $$ = $1 }
   | NEXT
   {
     $$ = &ast.NextStmt{tokenpos(mtaillex)}
@@ -132,6 +136,10 @@ stmt
   {
     $$ = &ast.StopStmt{tokenpos(mtaillex)}
   }
+  | PREPROCESS regex_pattern STRING
+  {
+    $$ = &ast.PreprocessStmt{P: *$2.Pos(), Pattern: $2.(*ast.PatternLit).Pattern, Replacement: $3}
+  }
   | INVALID
   {
     $$ = &ast.Error{tokenpos(mtaillex), $1}
@@ -141,12 +149,12 @@ stmt
 conditional_statement
   : logical_expr compound_statement ELSE compound_statement
   {
-    $$ = &ast.CondStmt{$1, $2, $4, nil}
+    $$ = &ast.CondStmt{$1, $2, $4, nil, ""}
   }
   | logical_expr compound_statement
   {
     if $1 != nil {
-      $$ = &ast.CondStmt{$1, $2, nil, nil}
+      $$ = &ast.CondStmt{$1, $2, nil, nil, ""}
     } else {
       $$ = $2
     }
@@ -154,7 +162,15 @@ conditional_statement
   | OTHERWISE compound_statement
   {
     o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
-    $$ = &ast.CondStmt{o, $2, nil, nil}
+    $$ = &ast.CondStmt{o, $2, nil, nil, ""}
+  }
+  | RULE ID COLON logical_expr compound_statement ELSE compound_statement
+  {
+    $$ = &ast.CondStmt{$4, $5, $7, nil, $2}
+  }
+  | RULE ID COLON logical_expr compound_statement
+  {
+    $$ = &ast.CondStmt{$4, $5, nil, nil, $2}
   }
   ;
 
@@ -188,6 +204,22 @@ assign_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
+  | unary_expr ASSIGN opt_nl logical_expr AT logical_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: &ast.BinaryExpr{Lhs: $4, Rhs: $6, Op: $5}, Op: $2}
+  }
+  | unary_expr ASSIGN opt_nl logical_expr BY logical_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: &ast.BinaryExpr{Lhs: $4, Rhs: $6, Op: BY}, Op: $2}
+  }
+  | unary_expr ASSIGN opt_nl logical_expr EXEMPLAR logical_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: &ast.BinaryExpr{Lhs: $4, Rhs: $6, Op: EXEMPLAR}, Op: $2}
+  }
+  | unary_expr ASSIGN opt_nl logical_expr BY logical_expr EXEMPLAR logical_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: &ast.BinaryExpr{Lhs: &ast.BinaryExpr{Lhs: $4, Rhs: $6, Op: BY}, Rhs: $8, Op: EXEMPLAR}, Op: $2}
+  }
   ;
 
 logical_expr
@@ -237,6 +269,10 @@ rel_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
+  | rel_expr IN opt_nl LSQUARE shift_expr COMMA opt_nl shift_expr RSQUARE
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: &ast.BinaryExpr{Lhs: $5, Rhs: $8, Op: COMMA}, Op: IN}
+  }
   ;
 
 rel_op
@@ -382,6 +418,11 @@ primary_expr
   {
     $$ = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: $1, Args: $3}
   }
+  | BUILTIN LPAREN arg_expr_list COMMA duration_lit RPAREN
+  {
+    $3.(*ast.ExprList).Children = append($3.(*ast.ExprList).Children, $5)
+    $$ = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: $1, Args: $3}
+  }
   | CAPREF
   {
     $$ = &ast.CaprefTerm{tokenpos(mtaillex), $1, false, nil}
@@ -440,6 +481,20 @@ arg_expr_list
     $$ = $1
     $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $3)
   }
+  | arg_expr_list COMMA pattern_expr
+  {
+    $$ = $1
+    $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $3)
+  }
+  ;
+
+// duration_lit is a duration literal, which can only be the last argument of
+// a builtin.
+duration_lit
+  : DURATIONLITERAL
+  {
+    $$ = &ast.DurationLit{P: tokenpos(mtaillex), D: $1}
+  }
   ;
 
 regex_pattern
@@ -489,6 +544,22 @@ decl_attribute_spec
     $$ = $1
     $$.(*ast.VarDecl).Buckets = $2
   }
+  | decl_attribute_spec CUMULATIVE
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Cumulative = true
+  }
+  | decl_attribute_spec ROLLUP
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Rollup = true
+  }
+  | decl_attribute_spec max_spec
+  {
+    $$ = $1
+    max := $2
+    $$.(*ast.VarDecl).Max = &max
+  }
   | var_name_spec
   {
     $$ = $1
@@ -584,6 +655,17 @@ buckets_list
     $$ = append($$, float64($3))
   }
 
+max_spec
+  : MAX FLOATLITERAL
+  {
+    $$ = $2
+  }
+  | MAX INTLITERAL
+  {
+    $$ = float64($2)
+  }
+  ;
+
 decorator_declaration
   : mark_pos DEF ID compound_statement
   {
@@ -598,6 +680,23 @@ decoration_statement
   }
   ;
 
+foreach_statement
+  : foreach_spec compound_statement
+  {
+    $$ = $1
+    $$.(*ast.ForeachStmt).Block = $2
+  }
+  ;
+
+// foreach_spec is reduced before the block, so that the marked position is
+// not overwritten by marks inside the block.
+foreach_spec
+  : mark_pos FOREACH ID IN SPLIT LPAREN bitwise_expr COMMA bitwise_expr RPAREN
+  {
+    $$ = &ast.ForeachStmt{P: markedpos(mtaillex), Name: $3, Str: $7, Sep: $9}
+  }
+  ;
+
 delete_statement
   : DEL postfix_expr AFTER DURATIONLITERAL
   {
@@ -276,6 +276,12 @@ foo = 3.14
 getfilename()
 `},
 
+	{"activeuniq window",
+		`gauge active
+/(\S+)/ {
+  activeuniq(active, $1, 5m)
+}`},
+
 	{"indexed expression arg list", `
 counter foo by a,b
 /(\d) (\d+)/ {
@@ -328,6 +334,151 @@ $foo =~ X {
 // {
   stop
 }`},
+
+	{"preprocess", `
+preprocess /\x1b\[[0-9;]*m/ ""
+/foo/ {
+}`},
+
+	{"in range", `
+/(\d+)/ {
+  $1 in [200, 299] {
+  }
+}`},
+
+	{"exemplar", `
+histogram h buckets 1, 2
+/(\d+) (\d+) (\w+)/ {
+  h = $1 exemplar $3
+  h = $1 by $2 exemplar $3
+}`},
+
+	{"named rules", `
+counter hits by name
+rule errors: /error/ {
+  hits[rulename()]++
+  rule timeouts: /timeout/ {
+    hits[rulename()]++
+  }
+} else {
+  hits[rulename()]++
+}`},
+
+	{"gauge max", `
+gauge queue_length max 1e9
+gauge temperature by room max 100
+`},
+
+	{"contextual keywords as names", `
+counter max
+counter split
+counter log by max, split, log
+/(.*)/ {
+  max++
+  split++
+  log[$1, $1, $1]++
+  log("matched", max)
+}
+`},
+
+	{"at as a name", `
+counter at
+gauge t by at
+/(\d+) (.*)/ {
+  at++
+  t[$2] = $1 at $1
+  t[$2] = at at at
+}
+`},
+
+	{"in as a name", `
+counter bytes by in
+counter in
+/(\d+) (.*)/ {
+  $1 in [200, 299] {
+    bytes[$2]++
+  }
+  in in [1, 2] {
+    in++
+  }
+  foreach in in split($2, " ") {
+    bytes[in]++
+  }
+}
+`},
+
+	{"drop as a name", `
+counter drop
+counter lines by drop
+/(.*)/ {
+  drop++
+  lines[$1]++
+  drop
+}
+/x/ { drop }
+`},
+
+	{"rollup as a name", `
+counter rollup by rollup rollup
+counter requests by path, rollup as "requests_total" rollup
+/(.*)/ {
+  rollup[$1]++
+  requests[$1, $1]++
+}
+`},
+
+	{"cumulative as a name", `
+counter cumulative by cumulative cumulative
+counter total by host rollup cumulative
+/(\S+) (\d+)/ {
+  cumulative[$1] = $2
+  total[$1] = $2
+}
+`},
+
+	{"exemplar as a name", `
+histogram latency by exemplar buckets 1, 2
+counter exemplar
+/(\d+) (\S+)/ {
+  latency[$2] = $1 exemplar $2
+  exemplar++
+}
+`},
+
+	{"foreach as a name", `
+counter foreach by foreach
+/(.*)/ {
+  foreach foreach in split($1, " ") {
+    foreach[foreach]++
+  }
+}
+`},
+
+	{"preprocess as a name", `
+counter preprocess by preprocess
+preprocess /x/ "y"
+/(.*)/ {
+  preprocess[$1]++
+}
+`},
+
+	{"rule as a name", `
+counter rule by rule
+/(.*)/ {
+  rule rule: $1 == "x" {
+    rule[rulename()]++
+  }
+}
+`},
+
+	{"foreach split", `
+counter fields by field
+/(.*)/ {
+  foreach f in split($1, " ") {
+    fields[f]++
+  }
+}
+`},
 }
 
 func TestParserRoundTrip(t *testing.T) {
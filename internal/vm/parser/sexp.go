@@ -114,6 +114,12 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("=")
 		case ADD_ASSIGN:
 			s.emit("+=")
+		case AT:
+			s.emit("at")
+		case BY:
+			s.emit("by")
+		case EXEMPLAR:
+			s.emit("exemplar")
 		case MOD:
 			s.emit("%")
 		case CONCAT:
@@ -122,6 +128,10 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("=~")
 		case NOT_MATCH:
 			s.emit("!~")
+		case IN:
+			s.emit("in")
+		case COMMA:
+			s.emit(",")
 		default:
 			s.emit(fmt.Sprintf("Unexpected op: %s", Kind(v.Op)))
 		}
@@ -179,6 +189,9 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.FloatLit:
 		s.emit(strconv.FormatFloat(v.F, 'g', -1, 64))
 
+	case *ast.DurationLit:
+		s.emit(v.D.String())
+
 	case *ast.NextStmt:
 		s.emit("next")
 	case *ast.OtherwiseStmt:
@@ -198,6 +211,9 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		s.emit("stop")
 
+	case *ast.PreprocessStmt:
+		s.emit(fmt.Sprintf("preprocess %q %q", v.Pattern, v.Replacement))
+
 	case *ast.DecoDecl:
 		s.emit(fmt.Sprintf("%q", v.Name))
 		s.newline()
@@ -210,7 +226,16 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StmtList:
 		s.emitScope(v.Scope)
 
+	case *ast.ForeachStmt:
+		s.emit(fmt.Sprintf("%q", v.Name))
+		s.newline()
+		s.emitScope(v.Scope)
+
 	case *ast.CondStmt:
+		if v.Name != "" {
+			s.emit(fmt.Sprintf("rule %q", v.Name))
+			s.newline()
+		}
 		s.emitScope(v.Scope)
 
 	case *ast.IndexedExpr, *ast.ExprList, *ast.PatternExpr: // normal walk
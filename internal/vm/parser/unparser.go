@@ -68,6 +68,9 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 	case *ast.CondStmt:
+		if v.Name != "" {
+			u.emit("rule " + v.Name + ": ")
+		}
 		if v.Cond != nil {
 			ast.Walk(u, v.Cond)
 		}
@@ -139,6 +142,12 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			u.emit(" = ")
 		case ADD_ASSIGN:
 			u.emit(" += ")
+		case AT:
+			u.emit(" at ")
+		case BY:
+			u.emit(" by ")
+		case EXEMPLAR:
+			u.emit(" exemplar ")
 		case MOD:
 			u.emit(" % ")
 		case CONCAT:
@@ -147,10 +156,17 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			u.emit(" =~ ")
 		case NOT_MATCH:
 			u.emit(" !~ ")
+		case IN:
+			u.emit(" in [")
+		case COMMA:
+			u.emit(", ")
 		default:
 			u.emit(fmt.Sprintf("Unexpected op: %v", v.Op))
 		}
 		ast.Walk(u, v.Rhs)
+		if v.Op == IN {
+			u.emit("]")
+		}
 
 	case *ast.IdTerm:
 		u.emit(v.Name)
@@ -198,6 +214,15 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			}
 			u.emit(buckets.String()[:buckets.Len()-2])
 		}
+		if v.Cumulative {
+			u.emit(" cumulative")
+		}
+		if v.Rollup {
+			u.emit(" rollup")
+		}
+		if v.Max != nil {
+			u.emit(fmt.Sprintf(" max %f", *v.Max))
+		}
 
 	case *ast.UnaryExpr:
 		switch v.Op {
@@ -223,6 +248,9 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.FloatLit:
 		u.emit(strconv.FormatFloat(v.F, 'g', -1, 64))
 
+	case *ast.DurationLit:
+		u.emit(v.D.String())
+
 	case *ast.DecoDecl:
 		u.emit(fmt.Sprintf("def %s {", v.Name))
 		u.newline()
@@ -239,6 +267,18 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.outdent()
 		u.emit("}")
 
+	case *ast.ForeachStmt:
+		u.emit(fmt.Sprintf("foreach %s in split(", v.Name))
+		ast.Walk(u, v.Str)
+		u.emit(", ")
+		ast.Walk(u, v.Sep)
+		u.emit(") {")
+		u.newline()
+		u.indent()
+		ast.Walk(u, v.Block)
+		u.outdent()
+		u.emit("}")
+
 	case *ast.NextStmt:
 		u.emit("next")
 
@@ -267,6 +307,9 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		u.emit("stop")
 
+	case *ast.PreprocessStmt:
+		u.emit("preprocess /" + strings.Replace(v.Pattern, "/", "\\/", -1) + "/ \"" + v.Replacement + "\"")
+
 	default:
 		panic(fmt.Sprintf("unfound undefined type %T", n))
 	}
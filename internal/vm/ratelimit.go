@@ -0,0 +1,61 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"time"
+)
+
+var (
+	// LineRateLimitDrops counts the number of lines dropped by the rate limiter, by log source.
+	LineRateLimitDrops = expvar.NewMap("line_rate_limit_drops_total")
+)
+
+// lineRateLimiter limits the rate of lines delivered to the programs from
+// each log source with a token bucket per source.  A source that exceeds the
+// rate has its excess lines dropped, without affecting other sources.
+type lineRateLimiter struct {
+	rate  float64 // Tokens added to each bucket per second.
+	burst float64 // Maximum number of tokens in a bucket.
+
+	buckets map[string]*tokenBucket // Token buckets by log source.
+
+	now func() time.Time // Returns the current time; replaceable in tests.
+}
+
+type tokenBucket struct {
+	tokens float64   // Number of lines that can be delivered now.
+	last   time.Time // The last time tokens were added.
+}
+
+func newLineRateLimiter(rate float64, burst int) *lineRateLimiter {
+	return &lineRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow returns true if a line from source can be delivered, taking a token
+// from its bucket.
+func (r *lineRateLimiter) allow(source string) bool {
+	now := r.now()
+	b, ok := r.buckets[source]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestLineRateLimiter(t *testing.T) {
+	r := newLineRateLimiter(2, 3)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if r.allow("a") {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("burst: expected 3 lines allowed, got %d", allowed)
+	}
+	// Another source is unaffected by the flood.
+	if !r.allow("b") {
+		t.Error("expected line from b to be allowed")
+	}
+	// Tokens are refilled at the rate.
+	now = now.Add(time.Second)
+	allowed = 0
+	for i := 0; i < 10; i++ {
+		if r.allow("a") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("refill: expected 2 lines allowed, got %d", allowed)
+	}
+}
+
+func TestLoaderLineRateLimit(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, LineRateLimit(0.001, 5))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("count", strings.NewReader("counter lines_total by file\n// {\n  lines_total[getfilename()]++\n}\n")))
+
+	before := make(map[string]int64)
+	for _, f := range []string{"flood.log", "quiet.log"} {
+		if v := LineRateLimitDrops.Get(f); v != nil {
+			before[f] = v.(*expvar.Int).Value()
+		}
+	}
+	for i := 0; i < 20; i++ {
+		lines <- logline.New(context.Background(), "flood.log", "line")
+	}
+	for i := 0; i < 5; i++ {
+		lines <- logline.New(context.Background(), "quiet.log", "line")
+	}
+	close(lines)
+	wg.Wait()
+
+	for f, expected := range map[string]int64{"flood.log": 15, "quiet.log": 0} {
+		var drops int64
+		if v := LineRateLimitDrops.Get(f); v != nil {
+			drops = v.(*expvar.Int).Value() - before[f]
+		}
+		if drops != expected {
+			t.Errorf("%s: expected %d drops, got %d", f, expected, drops)
+		}
+	}
+	m := store.FindMetricOrNil("lines_total", "count")
+	if m == nil {
+		t.Fatal("lines_total not found")
+	}
+	for f, expected := range map[string]string{"flood.log": "5", "quiet.log": "5"} {
+		d, err := m.GetDatum(f)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%s: expected %s lines processed, got %s", f, expected, d.ValueString())
+		}
+	}
+}
@@ -20,6 +20,7 @@ const (
 	CaprefSymbol                    // Capture group references
 	DecoSymbol                      // Decorators
 	PatternSymbol                   // Named pattern constants
+	LoopSymbol                      // Loop variables
 	endSymbol                       // for testing
 )
 
@@ -33,6 +34,8 @@ func (k SymbolKind) String() string {
 		return "decorator"
 	case PatternSymbol:
 		return "named pattern constant"
+	case LoopSymbol:
+		return "loop variable"
 	default:
 		panic("unexpected symbolkind")
 	}
@@ -192,23 +192,69 @@ var (
 	Float   = &Operator{"Float", []Type{}}
 	String  = &Operator{"String", []Type{}}
 	Pattern = &Operator{"Pattern", []Type{}}
+	// Duration is the type of duration literals, which are only accepted as
+	// the window of activeuniq().
+	Duration = &Operator{"Duration", []Type{}}
 	// TODO(jaq): use composite type so we can typecheck the bucket directly, e.g. hist[j] = i
 	Buckets = &Operator{"Buckets", []Type{}}
 )
 
 // Builtins is a mapping of the builtin language functions to their type definitions.
 var Builtins = map[string]Type{
-	"int":         Function(NewVariable(), Int),
-	"bool":        Function(NewVariable(), Bool),
-	"float":       Function(NewVariable(), Float),
-	"string":      Function(NewVariable(), String),
-	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, String, None),
-	"strtol":      Function(String, Int, Int),
-	"tolower":     Function(String, String),
-	"getfilename": Function(String),
+	"int":              Function(NewVariable(), Int),
+	"bool":             Function(NewVariable(), Bool),
+	"float":            Function(NewVariable(), Float),
+	"string":           Function(NewVariable(), String),
+	"timestamp":        Function(Int),
+	"len":              Function(String, Int),
+	"settime":          Function(Int, None),
+	"strptime":         Function(String, String, None),
+	"strtol":           Function(String, Int, Int),
+	"tolower":          Function(String, String),
+	"getfilename":      Function(String),
+	"flush":            Function(None),
+	"urldecode":        Function(String, String),
+	"isnew":            Function(NewVariable(), Bool),
+	"starttimer":       Function(String, None),
+	"hastimer":         Function(String, Bool),
+	"stoptimer":        Function(String, Float),
+	"subst":            Function(String, Pattern, String, String),
+	"geocountry":       Function(String, String),
+	"default":          Function(String, String, String),
+	"jsonpath":         Function(String, String, String),
+	"base64decode":     Function(String, String),
+	"matchcount":       Function(String, Pattern, Int),
+	"sethelp":          Function(NewVariable(), String, None),
+	"hour":             Function(Int, Int),
+	"weekday":          Function(Int, Int),
+	"trim":             Function(String, String),
+	"trimleft":         Function(String, String, String),
+	"trimright":        Function(String, String, String),
+	"journalfield":     Function(String, String),
+	"parseduration":    Function(String, Float),
+	"matches":          Function(String, Pattern, Bool),
+	"uniq":             Function(Int, String, None),
+	"lookup":           Function(String, String, String),
+	"pathsegment":      Function(String, Int, String),
+	"ewma":             Function(Float, Float, Float, None),
+	"round":            Function(Float, Int, Float),
+	"rulename":         Function(String),
+	"meta":             Function(String, String),
+	"div":              Function(Int, Int, Int, Int),
+	"commafy":          Function(Int, String),
+	"hasprefix":        Function(String, String, Bool),
+	"hassuffix":        Function(String, String, Bool),
+	"contains":         Function(String, String, Bool),
+	"percentilerank":   Function(Float, Float, Float),
+	"log":              Function(String, NewVariable(), None),
+	"timediff":         Function(None, None, Float),
+	"sample":           Function(Int, Int, Bool),
+	"normalize":        Function(String, String),
+	"capcount":         Function(Int),
+	"statusclass":      Function(Int, String),
+	"captures":         Function(String),
+	"consistentsample": Function(String, Float, Bool),
+	"activeuniq":       Function(Int, String, Duration, None),
 }
 
 // FreshType returns a new type from the provided type scheme, replacing any
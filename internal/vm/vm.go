@@ -8,9 +8,16 @@ package vm
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"math/rand"
+	"net"
+	"net/url"
 	"regexp"
 	"runtime/debug"
 	"strconv"
@@ -18,9 +25,11 @@ import (
 	"sync"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/golang/groupcache/lru"
+	"github.com/google/mtail/internal/jsonpath"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
@@ -28,6 +37,7 @@ import (
 	"github.com/google/mtail/internal/vm/object"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
@@ -39,15 +49,45 @@ var (
 		Buckets:   prometheus.ExponentialBuckets(0.00002, 2.0, 10),
 	}, []string{"prog"})
 
+	ruleMatchDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mtail",
+		Subsystem: "vm",
+		Name:      "rule_match_duration_seconds",
+		Help:      "VM regular expression match time distribution in seconds, by the named rule executing the match.",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4.0, 10),
+	}, []string{"prog", "rule"})
+
+	// metricValueClamps counts the values set above the maximum of a gauge,
+	// by metric name.
+	metricValueClamps = expvar.NewMap("metric_value_clamps_total")
+
 	runtimeLogError = flag.Bool("vm_logs_runtime_errors", true, "Enables logging of runtime errors to the standard log.  Set to false to only have the errors printed to the HTTP console.")
 )
 
 type thread struct {
-	pc      int              // Program counter.
-	matched bool             // Flag set if any match has been found.
-	matches map[int][]string // Match result variables.
-	time    time.Time        // Time register.
-	stack   []interface{}    // Data stack.
+	pc       int              // Program counter.
+	matched  bool             // Flag set if any match has been found.
+	matches  map[int][]string // Match result variables.
+	subjects map[int]string   // The string each regexp was last matched against, if kept for capcount and captures.
+	time     time.Time        // Time register.
+	stack    []interface{}    // Data stack.
+
+	rollups   map[datum.Datum]datum.Datum     // Rollup datum of each loaded datum of a rollup metric.
+	overflows map[datum.Datum]datum.Datum     // Bucket overflow counter datum of each loaded histogram datum.
+	ceilings  map[datum.Datum]*metrics.Metric // Metric of each loaded datum of a gauge with a maximum.
+	exemplar  string                          // Trace ID to record as an exemplar of the next histogram observation, if not empty.
+	rule      string                          // Name of the innermost named rule being executed, if any.
+	loops     map[int]*fieldLoop              // Fields of each foreach loop being executed, by slot.
+
+	deadline time.Time // Time by which processing of the line must finish, if not zero.
+	timedOut bool      // Set if a match was abandoned at the deadline.
+}
+
+// fieldLoop holds the fields of a string split by a foreach loop, and the
+// index of the current field.
+type fieldLoop struct {
+	fields []string
+	i      int
 }
 
 // VM describes the virtual machine for each program.  It contains virtual
@@ -75,8 +115,125 @@ type VM struct {
 	runtimeErrorMu sync.RWMutex //protects runtimeError
 	runtimeError   string       // records the last runtime error from errorf()
 
+	warnings []string // Compile warnings about the program, which don't stop it running.
+
 	syslogUseCurrentYear bool           // Overwrite zero years with the current year in a strptime.
 	loc                  *time.Location // Override local timezone with provided, if not empty
+
+	flush func() // Called by the flush instruction to request an export, if not nil.
+
+	timers *lru.Cache // Start times of duration timers, by name.
+
+	countries CountryResolver // Looks up the country of IP addresses for geocountry, if not nil.
+	tables    TableResolver   // Looks up values in the tables for lookup, if not nil.
+
+	lineDeadline time.Duration    // If non-zero, processing of a line is abandoned after this long.
+	clock        func() time.Time // Reads the current time for the line deadline.
+
+	ruleTiming bool // If set, the time of each match is recorded in ruleMatchDurations.
+
+	preprocess []object.Replacement // Replacements applied to each input line before the program runs.
+
+	logf   func(format string, args ...interface{}) // Writes the messages of log.
+	logged map[int]time.Time                        // The last time each log instruction, by program counter, wrote a message.
+
+	sampler *rand.Rand // Chooses the lines in the samples taken by sample.
+
+	keepSubjects bool // If set, the program uses capcount or captures, so the strings matched are kept.
+
+	jsonPaths map[int]jsonpath.Path // Compiled constant paths of the jsonpath instructions, by program counter.
+
+	overflows map[*metrics.Metric]*metrics.Metric // Bucket overflow counter of each histogram, if enabled.
+}
+
+// CountryResolver looks up the country code of an IP address.
+type CountryResolver interface {
+	// Country returns the ISO country code of ip, or the empty string if it is not known.
+	Country(ip net.IP) (string, error)
+}
+
+// TableResolver looks up values in named static tables.
+type TableResolver interface {
+	// Lookup returns the value of key in the named table, and whether it was found.
+	Lookup(table, key string) (string, bool)
+}
+
+const (
+	// maxTimers is the number of duration timers that a program can have
+	// started at once; the least recently used are forgotten first.
+	maxTimers = 10000
+	// timerExpiry is how long a duration timer can run before it is forgotten.
+	timerExpiry = 24 * time.Hour
+	// logInterval is the shortest time between the messages written by each
+	// call to log in a program.
+	logInterval = 10 * time.Second
+	// maxLoopFields is the most fields that a foreach loop iterates over;
+	// any further fields of the split string are ignored.
+	maxLoopFields = 1000
+	// ewmaInitialised is the auxiliary state of a datum whose average has
+	// been set by ewma.
+	ewmaInitialised = "ewma"
+	// maxTraceIDRunes is the longest exemplar trace ID, as OpenMetrics
+	// limits the length of an exemplar's labels.
+	maxTraceIDRunes = 128
+)
+
+// clamp returns the maximum of the gauge of datum d and true if value is
+// greater than it, counting the clamped value, or false if the value can be
+// set.
+func (t *thread) clamp(d datum.Datum, value float64) (float64, bool) {
+	m, ok := t.ceilings[d]
+	if !ok || value <= *m.Max {
+		return 0, false
+	}
+	metricValueClamps.Add(m.Name, 1)
+	return *m.Max, true
+}
+
+// countOverflow counts weight observations of value in the bucket overflow
+// counter of the histogram datum d, if it has one and the value is greater
+// than the lower bound of its last, unbounded, bucket.
+func (t *thread) countOverflow(d datum.Datum, value float64, weight int64) {
+	od, ok := t.overflows[d]
+	if !ok {
+		return
+	}
+	b := datum.GetBuckets(d)
+	if len(b.Buckets) > 0 && value > b.Buckets[len(b.Buckets)-1].Range.Min {
+		datum.IncIntBy(od, weight, t.time)
+	}
+}
+
+// addRollup adds delta to the rollup datum of d, if d was loaded from a rollup
+// metric, so that every change to d is also totalled in the rollup.
+func (t *thread) addRollup(d datum.Datum, delta float64) {
+	r, ok := t.rollups[d]
+	if !ok || delta == 0 {
+		return
+	}
+	switch r := r.(type) {
+	case *datum.Int:
+		r.IncBy(int64(delta), t.time)
+	case *datum.Float:
+		r.Set(r.Get()+delta, t.time)
+	}
+}
+
+// recordExemplar records the exemplar register, if set, as an exemplar of the
+// observation of value in the histogram datum d, and clears the register.
+func (t *thread) recordExemplar(d datum.Datum, value float64) {
+	if t.exemplar == "" {
+		return
+	}
+	if b, ok := d.(*datum.Buckets); ok {
+		// Lines without a timestamp are observed now.
+		ts := t.time
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		b.SetExemplar(value, t.exemplar, ts)
+	}
+	t.exemplar = ""
 }
 
 // Push a value onto the stack
@@ -152,6 +309,8 @@ func (t *thread) PopFloat() (float64, error) {
 		return n, nil
 	case int:
 		return float64(n), nil
+	case int64:
+		return float64(n), nil
 	case string:
 		r, err := strconv.ParseFloat(n, 64)
 		if err != nil {
@@ -327,6 +486,67 @@ func (v *VM) ParseTime(layout, value string) (tm time.Time) {
 	return
 }
 
+// matchStart returns the start time of a match when rule timing is enabled,
+// and the zero time otherwise, so that untimed matches don't read the clock.
+func (v *VM) matchStart() time.Time {
+	if !v.ruleTiming {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observeMatch records the time since start of a match in the histogram of
+// the rule being executed, when rule timing is enabled.  Matches outside any
+// named rule are recorded with an empty rule name.
+func (v *VM) observeMatch(t *thread, start time.Time) {
+	if !v.ruleTiming {
+		return
+	}
+	ruleMatchDurations.WithLabelValues(v.name, t.rule).Observe(time.Since(start).Seconds())
+}
+
+// matchWithinDeadline runs the regular expression match f, abandoning it if
+// the deadline of the line passes first, as a pathological pattern can take
+// far longer than the deadline.  It returns false, and marks the thread as
+// timed out, if the match was abandoned; f then finishes in the background
+// and its result is discarded, so f must only write to its own variables.
+func (v *VM) matchWithinDeadline(t *thread, f func()) bool {
+	if t.deadline.IsZero() {
+		f()
+		return true
+	}
+	remaining := t.deadline.Sub(v.clock())
+	if remaining <= 0 {
+		t.timedOut = true
+		return false
+	}
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		t.timedOut = true
+		return false
+	}
+}
+
+// submatchIndex returns the submatch indices of the last match of the regexp
+// at index, or nil if it didn't match.  They are found again from the string
+// it was matched against, as the submatch strings can't tell an empty group
+// from one that didn't participate.
+func (v *VM) submatchIndex(t *thread, index int) []int {
+	if t.matches[index] == nil {
+		return nil
+	}
+	return v.re[index].FindStringSubmatchIndex(t.subjects[index])
+}
+
 // execute performs an instruction cycle in the VM. acting on the instruction
 // i in thread t.
 func (v *VM) execute(t *thread, i code.Instr) {
@@ -354,7 +574,17 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// Store the results in the operandth element of the stack,
 		// where i.opnd == the matched re index
 		index := i.Operand.(int)
-		t.matches[index] = v.re[index].FindStringSubmatch(v.input.Line)
+		line := v.input.Line
+		start := v.matchStart()
+		var m []string
+		if !v.matchWithinDeadline(t, func() { m = v.re[index].FindStringSubmatch(line) }) {
+			return
+		}
+		t.matches[index] = m
+		if v.keepSubjects {
+			t.subjects[index] = line
+		}
+		v.observeMatch(t, start)
 		t.Push(t.matches[index] != nil)
 
 	case code.Smatch:
@@ -365,7 +595,16 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("+%v", err)
 			return
 		}
-		t.matches[index] = v.re[index].FindStringSubmatch(line)
+		start := v.matchStart()
+		var m []string
+		if !v.matchWithinDeadline(t, func() { m = v.re[index].FindStringSubmatch(line) }) {
+			return
+		}
+		t.matches[index] = m
+		if v.keepSubjects {
+			t.subjects[index] = line
+		}
+		v.observeMatch(t, start)
 		t.Push(t.matches[index] != nil)
 
 	case code.Cmp:
@@ -437,6 +676,24 @@ func (v *VM) execute(t *thread, i code.Instr) {
 
 		t.Push(match)
 
+	case code.Inrange:
+		// Compare the value third from top with the inclusive bounds second
+		// from top and at top, and push the result.
+		hi := t.Pop()
+		lo := t.Pop()
+		x := t.Pop()
+		below, err := compare(x, lo, -1)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		above, err := compare(x, hi, 1)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(!below && !above)
+
 	case code.Jnm:
 		val := t.Pop()
 		switch match := val.(type) {
@@ -480,6 +737,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.IncIntBy(n, delta, t.time)
+			t.addRollup(n, float64(delta))
 			t.Push(datum.GetInt(n))
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
@@ -500,6 +758,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.DecIntBy(n, delta, t.time)
+			t.addRollup(n, -float64(delta))
 			t.Push(datum.GetInt(n))
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
@@ -514,7 +773,13 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
+			if max, ok := t.clamp(n, float64(value)); ok {
+				value = int64(max)
+			}
+			old, _ := datum.NumericValue(n)
 			datum.SetInt(n, value, t.time)
+			t.addRollup(n, float64(value)-old)
+			t.recordExemplar(n, float64(value))
 		} else {
 			v.errorf("Unexpected type to iset: %T %q", n, n)
 			return
@@ -528,7 +793,14 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
+			if max, ok := t.clamp(n, value); ok {
+				value = max
+			}
+			old, _ := datum.NumericValue(n)
 			datum.SetFloat(n, value, t.time)
+			t.addRollup(n, value-old)
+			t.countOverflow(n, value, 1)
+			t.recordExemplar(n, value)
 		} else {
 			v.errorf("Unexpected type to fset: %T %q", n, n)
 			return
@@ -569,7 +841,11 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if cached, ok := v.timeMemos.Get(ts); !ok {
 			tm := v.ParseTime(layout, ts)
-			v.timeMemos.Add(ts, tm)
+			// A failed parse is not memoised, so that it is reported again
+			// for every line it fails on.
+			if !tm.IsZero() {
+				v.timeMemos.Add(ts, tm)
+			}
 			t.time = tm
 		} else {
 			t.time = cached.(time.Time)
@@ -584,6 +860,177 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			t.Push(t.time.Unix())
 		}
 
+	case code.Sample:
+		// Pop a period n and the sample size k below it, and push whether
+		// this line is chosen, which k in n lines are at random.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		k, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(v.sampler.Int63n(n) < k)
+
+	case code.Hashsample:
+		// Pop a rate and the key below it, and push whether the key is in
+		// the sample, which is the same for every line with that key.
+		rate, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(inHashSample(key, rate))
+
+	case code.Timereg:
+		t.Push(t.time)
+
+	case code.Timediff:
+		// Pop two time values, and push the seconds from the first to the
+		// second, which are negative if the second is earlier.
+		end, ok := t.Pop().(time.Time)
+		if !ok {
+			v.errorf("timediff: expecting a time value")
+			return
+		}
+		start, ok := t.Pop().(time.Time)
+		if !ok {
+			v.errorf("timediff: expecting a time value")
+			return
+		}
+		if start.IsZero() || end.IsZero() {
+			v.errorf("timediff: time not set")
+			return
+		}
+		t.Push(end.Sub(start).Seconds())
+
+	case code.Hour, code.Weekday:
+		// Pop a timestamp and push its hour of day or day of week, in the
+		// location of the program.
+		ts, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		tm := time.Unix(ts, 0)
+		if v.loc != nil {
+			tm = tm.In(v.loc)
+		}
+		if i.Opcode == code.Hour {
+			t.Push(int64(tm.Hour()))
+		} else {
+			t.Push(int64(tm.Weekday()))
+		}
+
+	case code.Parseduration:
+		// Parse the duration string at TOS, and push its length in seconds.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(d.Seconds())
+
+	case code.Pathsegment:
+		// Push the path segment of the string second from top numbered by
+		// TOS, counting from 1 and skipping empty segments.  The empty
+		// string is pushed if there is no such segment.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(pathSegment(s, n))
+
+	case code.Commafy:
+		// Push the integer at TOS formatted with commas between groups of
+		// three digits.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(commafy(n))
+
+	case code.Statusclass:
+		// Push the class of the HTTP status code at TOS, like 2xx for 200.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(statusClass(n))
+
+	case code.Div:
+		// Push the integer quotient of the values third and second from top,
+		// or the default at TOS if the divisor is zero.
+		def, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		b, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		a, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if b == 0 {
+			t.Push(def)
+		} else {
+			t.Push(a / b)
+		}
+
+	case code.Round:
+		// Push the number second from top rounded half to even to the number
+		// of decimal places at TOS.
+		places, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		f, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		scale := math.Pow10(int(places))
+		switch {
+		case scale == 0:
+			// Fewer places than the digits of any number, so it rounds
+			// to zero.
+			t.Push(0.0)
+		case math.IsInf(scale, 1) || f == 0 || math.IsInf(f*scale, 0):
+			// More places than the number has digits, so it is already
+			// rounded.  Zero is checked too, as zero times an infinite
+			// scale is NaN.
+			t.Push(f)
+		default:
+			t.Push(math.RoundToEven(f*scale) / scale)
+		}
+
 	case code.Settime:
 		// Pop TOS and store in time register
 		val := t.Pop()
@@ -594,6 +1041,28 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.time = time.Unix(ts, 0).UTC()
 
+	case code.Setexemplar:
+		// Pop TOS and store in the exemplar register
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if utf8.RuneCountInString(s) > maxTraceIDRunes {
+			// The observation is still recorded, without an exemplar.
+			glog.V(1).Infof("%s: ignoring exemplar trace ID %q longer than %d characters", v.name, s, maxTraceIDRunes)
+			return
+		}
+		t.exemplar = s
+
+	case code.Setrule:
+		// Store the operand in the rule register
+		t.rule = i.Operand.(string)
+
+	case code.Rulename:
+		// Push the rule register
+		t.Push(t.rule)
+
 	case code.Capref:
 		// Put a capture group reference onto the stack.
 		// First find the match storage index on the stack,
@@ -736,6 +1205,35 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("dload (GetDatum) failed: %s", err)
 			return
 		}
+		if m.Rollup && index > 0 && !allEmpty(keys) {
+			// The rollup datum is the one with every label empty.
+			r, err := m.GetDatum(make([]string, index)...)
+			if err != nil {
+				v.errorf("dload (GetDatum) rollup failed: %s", err)
+				return
+			}
+			if t.rollups == nil {
+				t.rollups = make(map[datum.Datum]datum.Datum)
+			}
+			t.rollups[d] = r
+		}
+		if m.Max != nil {
+			if t.ceilings == nil {
+				t.ceilings = make(map[datum.Datum]*metrics.Metric)
+			}
+			t.ceilings[d] = m
+		}
+		if o, ok := v.overflows[m]; ok {
+			od, err := o.GetDatum(keys...)
+			if err != nil {
+				v.errorf("dload (GetDatum) bucket overflow failed: %s", err)
+				return
+			}
+			if t.overflows == nil {
+				t.overflows = make(map[datum.Datum]datum.Datum)
+			}
+			t.overflows[d] = od
+		}
 		//fmt.Printf("Found %v\n", d)
 		t.Push(d)
 
@@ -772,6 +1270,27 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 
+	case code.Isnew:
+		m := t.Pop().(*metrics.Metric)
+		index := i.Operand.(int)
+		keys := make([]string, index)
+		for j := index - 1; j >= 0; j-- {
+			s, err := t.PopString()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			keys[j] = s
+		}
+		// The datum is looked up and created under one lock, so that only
+		// one line sees the keys as new.
+		_, created, err := m.CreateDatum(keys...)
+		if err != nil {
+			v.errorf("isnew (CreateDatum) failed: %s", err)
+			return
+		}
+		t.Push(created)
+
 	case code.Expire:
 		m := t.Pop().(*metrics.Metric)
 		index := i.Operand.(int)
@@ -799,66 +1318,455 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(strings.ToLower(s))
 
-	case code.Length:
-		// Compute the length of a string from TOS, and push result back.
+	case code.Normalize:
+		// Normalize a string from TOS to NFC, and push the result back.
 		s, err := t.PopString()
 		if err != nil {
 			v.errorf("%+v", err)
 			return
 		}
-		t.Push(len(s))
+		t.Push(norm.NFC.String(s))
 
-	case code.S2i:
-		base := int64(10)
-		var err error
-		if i.Operand != nil {
-			// strtol is emitted with an arglen, int is not
-			base, err = t.PopInt()
-			if err != nil {
-				v.errorf("%s", err)
-				return
-			}
-		}
-		str, err := t.PopString()
+	case code.Subst:
+		// Replace matches of the regular expression in a string, and push
+		// the result.
+		repl, err := t.PopString()
 		if err != nil {
 			v.errorf("%+v", err)
 			return
 		}
-		i, err := strconv.ParseInt(str, int(base), 64)
+		s, err := t.PopString()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(i)
+		t.Push(v.re[i.Operand.(int)].ReplaceAllString(s, repl))
 
-	case code.S2f:
-		str, err := t.PopString()
+	case code.Sethelp:
+		// Set the help text of the metric below TOS to the string at TOS.
+		s, err := t.PopString()
 		if err != nil {
 			v.errorf("%+v", err)
 			return
 		}
-		f, err := strconv.ParseFloat(str, 64)
-		if err != nil {
-			v.errorf("%s", err)
-			return
+		m := t.Pop().(*metrics.Metric)
+		m.SetHelp(s)
+
+	case code.Capcount:
+		// Push the number of capture groups that participated in the last
+		// match of the operand regexp.
+		loc := v.submatchIndex(t, i.Operand.(int))
+		var n int64
+		for g := 1; g < len(loc)/2; g++ {
+			if loc[2*g] >= 0 {
+				n++
+			}
 		}
-		t.Push(f)
+		t.Push(n)
 
-	case code.I2f:
-		i, err := t.PopInt()
+	case code.Captures:
+		// Push the named capture groups that participated in the last match
+		// of the operand regexp, as a JSON object of name to captured string.
+		index := i.Operand.(int)
+		loc := v.submatchIndex(t, index)
+		groups := make(map[string]string)
+		for g, name := range v.re[index].SubexpNames() {
+			if name != "" && 2*g < len(loc) && loc[2*g] >= 0 {
+				groups[name] = t.matches[index][g]
+			}
+		}
+		b, err := json.Marshal(groups)
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(float64(i))
+		t.Push(string(b))
 
-	case code.I2s:
-		i, err := t.PopInt()
+	case code.Matchcount:
+		// Count the non-overlapping matches of the regular expression in
+		// the string at TOS, and push the count.
+		s, err := t.PopString()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(fmt.Sprintf("%d", i))
+		re := v.re[i.Operand.(int)]
+		start := v.matchStart()
+		var n int64
+		if !v.matchWithinDeadline(t, func() { n = int64(len(re.FindAllStringIndex(s, -1))) }) {
+			return
+		}
+		v.observeMatch(t, start)
+		t.Push(n)
+
+	case code.Matches:
+		// Push whether the string at TOS matches the regular expression.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		re := v.re[i.Operand.(int)]
+		start := v.matchStart()
+		var m bool
+		if !v.matchWithinDeadline(t, func() { m = re.MatchString(s) }) {
+			return
+		}
+		v.observeMatch(t, start)
+		t.Push(m)
+
+	case code.Hasprefix:
+		// Push whether the string second from top begins with the string at TOS.
+		sub, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(strings.HasPrefix(s, sub))
+
+	case code.Hassuffix:
+		// Push whether the string second from top ends with the string at TOS.
+		sub, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(strings.HasSuffix(s, sub))
+
+	case code.Contains:
+		// Push whether the string second from top contains the string at TOS.
+		sub, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(strings.Contains(s, sub))
+
+	case code.Uniq:
+		// Add the string at TOS to the sketch of the datum below it, and set
+		// the datum to the estimated number of distinct strings.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to uniq: %T %q", d, d)
+			return
+		}
+		// The sketch is kept on the datum, so it is removed with it and
+		// survives a reload of the program.
+		h, ok := datum.Aux(d).(*hyperLogLog)
+		if !ok {
+			h = newHyperLogLog()
+			datum.SetAux(d, h)
+		}
+		if h.Add(s) {
+			datum.SetInt(d, h.Estimate(), t.time)
+		}
+
+	case code.Activeuniq:
+		// Add the key at TOS to the keys seen within the window in the
+		// operand by the datum below it, and set the datum to their number.
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to activeuniq: %T %q", d, d)
+			return
+		}
+		window, ok := i.Operand.(time.Duration)
+		if !ok {
+			v.errorf("Unexpected window to activeuniq: %T %q", i.Operand, i.Operand)
+			return
+		}
+		// The keys are kept on the datum, so they are removed with it and
+		// carried over when the program is reloaded, unless its window
+		// has changed.
+		a, ok := datum.Aux(d).(*activeSet)
+		if !ok || a.window != window {
+			a = newActiveSet(window)
+			datum.SetAux(d, a)
+		}
+		// The window slides with the timestamps of the log, if it has them.
+		wall := v.clock()
+		now := t.time
+		if now.IsZero() {
+			now = wall
+		}
+		n := a.Add(key, now, wall)
+		datum.SetInt(d, int64(n), now)
+
+	case code.Ewma:
+		// Update the datum third from top to the exponentially weighted moving
+		// average of its old value and the value second from top, with the
+		// smoothing factor at TOS.  The first value sets the average.
+		alpha, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		val, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to ewma: %T %q", d, d)
+			return
+		}
+		if alpha <= 0 || alpha > 1 {
+			v.errorf("ewma smoothing factor %g not in (0, 1]", alpha)
+			return
+		}
+		// The mark is kept on the datum, so it is removed with it and
+		// survives a reload of the program.
+		if datum.Aux(d) == ewmaInitialised {
+			val = alpha*val + (1-alpha)*datum.GetFloat(d)
+		} else {
+			datum.SetAux(d, ewmaInitialised)
+		}
+		datum.SetFloat(d, val, t.time)
+
+	case code.Percentilerank:
+		// Push the estimated fraction of the observations of the histogram
+		// datum second from top that are at or below the value at TOS.
+		val, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(*datum.Buckets)
+		if !ok {
+			v.errorf("Unexpected type to percentilerank: %T %q", d, d)
+			return
+		}
+		t.Push(d.Rank(val))
+
+	case code.Journalfield, code.Meta:
+		// Push the value of the named field of the input line, or the empty
+		// string if the line has no such field.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(logline.Fields(v.input.Context)[name])
+
+	case code.Trim:
+		// Trim whitespace from both ends of the string at TOS, and push the
+		// result.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(strings.TrimSpace(s))
+
+	case code.Trimleft, code.Trimright:
+		// Trim the characters in the cutset at TOS from one end of the
+		// string below it, and push the result.
+		cutset, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if i.Opcode == code.Trimleft {
+			t.Push(strings.TrimLeft(s, cutset))
+		} else {
+			t.Push(strings.TrimRight(s, cutset))
+		}
+
+	case code.Urldecode:
+		// Decode a percent-encoded string from TOS, and push result back.
+		// Malformed input is pushed back unchanged.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if u, err := url.QueryUnescape(s); err == nil {
+			s = u
+		}
+		t.Push(s)
+
+	case code.Default:
+		// Pop the fallback and the value from the stack, and push the value
+		// back, or the fallback if the value is empty.
+		fallback, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if s == "" {
+			s = fallback
+		}
+		t.Push(s)
+
+	case code.Jsonpath:
+		// Pop the path and the JSON document from the stack, and push the
+		// value at that path in the document.
+		path, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		doc, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		p, ok := v.jsonPaths[t.pc-1]
+		if !ok {
+			p, err = jsonpath.Compile(path)
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+		}
+		t.Push(p.Lookup(doc))
+
+	case code.Geocountry:
+		// Look up the country code of the IP address at TOS, and push the
+		// result.  The empty string is pushed if the address is invalid or no
+		// country is known.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		cc := ""
+		if ip := net.ParseIP(s); ip != nil && v.countries != nil {
+			if cc, err = v.countries.Country(ip); err != nil {
+				glog.V(1).Infof("geocountry lookup of %q failed: %s", s, err)
+			}
+		}
+		t.Push(cc)
+
+	case code.Lookup:
+		// Look up the string at TOS in the table named second from top, and
+		// push the value.  The empty string is pushed if the table or key
+		// is not found.
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		table, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		val := ""
+		if v.tables != nil {
+			val, _ = v.tables.Lookup(table, key)
+		}
+		t.Push(val)
+
+	case code.Base64decode:
+		// Decode a base64 encoded string from TOS, and push result back.
+		// The empty string is pushed if the input is not validly encoded.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			b = nil
+		}
+		t.Push(string(b))
+
+	case code.Length:
+		// Compute the length of a string from TOS, and push result back.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(len(s))
+
+	case code.S2i:
+		base := int64(10)
+		var err error
+		if i.Operand != nil {
+			// strtol is emitted with an arglen, int is not
+			base, err = t.PopInt()
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+		}
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		i, err := strconv.ParseInt(str, int(base), 64)
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(i)
+
+	case code.S2f:
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.I2f:
+		i, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(float64(i))
+
+	case code.I2s:
+		i, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(fmt.Sprintf("%d", i))
 
 	case code.F2s:
 		f, err := t.PopFloat()
@@ -891,6 +1799,173 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(a + b)
 
+	case code.Observe:
+		// Observe a value with a weight in a histogram
+		weight, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		if weight < 0 {
+			v.errorf("negative weight %d in histogram observation", weight)
+			return
+		}
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		d := t.Pop()
+		n, ok := d.(*datum.Buckets)
+		if !ok {
+			v.errorf("Unexpected type to observe: %T %q", d, d)
+			return
+		}
+		n.ObserveWeighted(value, uint64(weight), t.time)
+		t.countOverflow(n, value, weight)
+		t.recordExemplar(n, value)
+
+	case code.Cset:
+		// Set a cumulative counter from a raw value, detecting resets
+		var raw float64
+		switch val := t.Pop().(type) {
+		case int64:
+			raw = float64(val)
+		case float64:
+			raw = val
+		default:
+			v.errorf("Unexpected type to cset: %T %q", val, val)
+			return
+		}
+		n := t.Pop()
+		d, ok := n.(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to cset: %T %q", n, n)
+			return
+		}
+		var cur float64
+		switch d := d.(type) {
+		case *datum.Int:
+			cur = float64(d.Get())
+		case *datum.Float:
+			cur = d.Get()
+		default:
+			v.errorf("Unexpected datum type to cset: %T", d)
+			return
+		}
+		next := cur
+		if last, ok := datum.Aux(d).(float64); ok {
+			if raw >= last {
+				next += raw - last
+			} else {
+				// The counter has been reset, so everything it has counted
+				// since is new.
+				next += raw
+			}
+		} else if raw > cur {
+			// No earlier raw value, for example after mtail restarts, so
+			// take this one as the baseline.
+			next = raw
+		}
+		datum.SetAux(d, raw)
+		t.addRollup(d, next-cur)
+		switch d := d.(type) {
+		case *datum.Int:
+			d.Set(int64(next), t.time)
+		case *datum.Float:
+			d.Set(next, t.time)
+		}
+
+	case code.Log:
+		// Pop a value and the message string below it, and write them to the
+		// log, unless this instruction wrote a message within logInterval.
+		val := t.Pop()
+		msg, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		pc := t.pc - 1
+		now := time.Now()
+		if last, ok := v.logged[pc]; ok && now.Sub(last) < logInterval {
+			return
+		}
+		v.logged[pc] = now
+		v.logf("%s:%d: %s %v", v.name, i.SourceLine+1, msg, val)
+
+	case code.Split:
+		// Pop a separator and the string below it, and split the string into
+		// the fields of the loop in the operand slot.
+		sep, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		fields := strings.SplitN(s, sep, maxLoopFields+1)
+		if len(fields) > maxLoopFields {
+			fields = fields[:maxLoopFields]
+		}
+		if t.loops == nil {
+			t.loops = make(map[int]*fieldLoop)
+		}
+		t.loops[i.Operand.(int)] = &fieldLoop{fields: fields, i: -1}
+
+	case code.Nextfield:
+		// Advance the loop in the operand slot, and push whether it has a
+		// current field.
+		l := t.loops[i.Operand.(int)]
+		l.i++
+		t.Push(l.i < len(l.fields))
+
+	case code.Field:
+		l := t.loops[i.Operand.(int)]
+		t.Push(l.fields[l.i])
+
+	case code.Starttimer:
+		// Pop a timer name, and record the current timestamp against it.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		v.timers.Add(name, v.timerNow(t))
+
+	case code.Hastimer:
+		// Pop a timer name, and push whether it has been started.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		_, ok := v.timerStart(name, v.timerNow(t))
+		t.Push(ok)
+
+	case code.Stoptimer:
+		// Pop a timer name, and push the seconds elapsed since it started.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		now := v.timerNow(t)
+		start, ok := v.timerStart(name, now)
+		if !ok {
+			v.errorf("timer %q was not started", name)
+			return
+		}
+		v.timers.Remove(name)
+		t.Push(now.Sub(start).Seconds())
+
+	case code.Flush:
+		if v.flush != nil {
+			v.flush()
+		}
+
 	default:
 		v.errorf("illegal instruction: %d", i.Opcode)
 	}
@@ -903,12 +1978,27 @@ func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
 	defer func() {
 		lineProcessingDurations.WithLabelValues(v.name).Observe(time.Since(start).Seconds())
 	}()
+	if len(v.preprocess) > 0 {
+		// The line is shared with other programs, so is copied rather than
+		// modified.
+		text := line.Line
+		for _, r := range v.preprocess {
+			text = r.Regexp.ReplaceAllString(text, r.Replacement)
+		}
+		line = logline.New(line.Context, line.Filename, text)
+	}
 	t := new(thread)
 	t.matched = false
 	v.t = t
 	v.input = line
 	t.stack = make([]interface{}, 0)
 	t.matches = make(map[int][]string, len(v.re))
+	if v.keepSubjects {
+		t.subjects = make(map[int]string, len(v.re))
+	}
+	if v.lineDeadline > 0 {
+		t.deadline = v.clock().Add(v.lineDeadline)
+	}
 	for {
 		if t.pc >= len(v.prog) {
 			return
@@ -921,21 +2011,173 @@ func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
 			v.terminate = false
 			return
 		}
+		// The deadline is checked between instructions, and regular
+		// expression matches are abandoned when it passes.
+		if t.timedOut || (!t.deadline.IsZero() && v.clock().After(t.deadline)) {
+			progLineTimeouts.Add(v.name, 1)
+			glog.V(1).Infof("%s: abandoned line from %q after %s at instruction %d", v.name, line.Filename, v.lineDeadline, t.pc-1)
+			return
+		}
+	}
+}
+
+// allEmpty returns true if every string in keys is empty.
+func allEmpty(keys []string) bool {
+	for _, k := range keys {
+		if k != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// pathSegment returns the nth segment, counting from 1, of the path in s,
+// which ends at any query or fragment.  Empty segments, such as those before
+// a leading or after a trailing slash, are not counted.  The empty string is
+// returned if there is no nth segment.
+func pathSegment(s string, n int64) string {
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	for _, seg := range strings.Split(s, "/") {
+		if seg == "" {
+			continue
+		}
+		n--
+		if n == 0 {
+			return seg
+		}
+	}
+	return ""
+}
+
+// inHashSample returns whether the key is in a sample of the given fraction
+// of all keys, chosen by the 64-bit FNV-1a hash of the key.
+func inHashSample(key string, rate float64) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV spreads keys that differ only in their last bytes, like user IDs,
+	// poorly over the high bits, so they are mixed before the top 53 bits,
+	// which a float64 holds exactly, are scaled into [0, 1).
+	x := mix64(h.Sum64())
+	return float64(x>>11)/(1<<53) < rate
+}
+
+// statusClass returns the class of the HTTP status code n, from 1xx to 5xx,
+// or "unknown" if n is not between 100 and 599.
+func statusClass(n int64) string {
+	if n < 100 || n > 599 {
+		return "unknown"
+	}
+	return strconv.FormatInt(n/100, 10) + "xx"
+}
+
+// commafy returns the decimal string of n with a comma between each group of
+// three digits, counting from the right, like 1,234,567.
+func commafy(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// timerNow returns the time register of t, unless it's zero in which case
+// the system time, so that timers work in programs that don't set the time.
+func (v *VM) timerNow(t *thread) time.Time {
+	if t.time.IsZero() {
+		return v.clock()
 	}
+	return t.time
+}
+
+// timerStart returns the start time of the named duration timer, if it was
+// started and has not expired at time now.
+func (v *VM) timerStart(name string, now time.Time) (time.Time, bool) {
+	val, ok := v.timers.Get(name)
+	if !ok {
+		return time.Time{}, false
+	}
+	start := val.(time.Time)
+	if now.Sub(start) > timerExpiry {
+		v.timers.Remove(name)
+		return time.Time{}, false
+	}
+	return start, true
 }
 
 // New creates a new virtual machine with the given name, and compiler
 // artifacts for executable and data segments.
 func New(name string, obj *object.Object, syslogUseCurrentYear bool, loc *time.Location) *VM {
+	keepSubjects := false
+	jsonPaths := make(map[int]jsonpath.Path)
+	for pc, i := range obj.Program {
+		switch i.Opcode {
+		case code.Capcount, code.Captures:
+			keepSubjects = true
+		case code.Jsonpath:
+			// Compile the path once if it is a constant, which is pushed
+			// by the instruction immediately before.
+			if pc == 0 || obj.Program[pc-1].Opcode != code.Str {
+				continue
+			}
+			if p, err := jsonpath.Compile(obj.Strings[obj.Program[pc-1].Operand.(int)]); err == nil {
+				jsonPaths[pc] = p
+			}
+		}
+	}
 	return &VM{
 		name:                 name,
 		re:                   obj.Regexps,
 		str:                  obj.Strings,
 		m:                    obj.Metrics,
 		prog:                 obj.Program,
+		preprocess:           obj.Preprocess,
 		timeMemos:            lru.New(64),
+		logf:                 func(format string, args ...interface{}) { glog.V(1).Infof(format, args...) },
+		logged:               make(map[int]time.Time),
+		sampler:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		timers:               lru.New(maxTimers),
+		clock:                time.Now,
 		syslogUseCurrentYear: syslogUseCurrentYear,
 		loc:                  loc,
+		keepSubjects:         keepSubjects,
+		jsonPaths:            jsonPaths,
+	}
+}
+
+// addBucketOverflowCounters creates a counter named after each histogram of
+// the program with a `_bucket_overflow_total' suffix, which counts the
+// observations greater than the histogram's largest bucket boundary.
+func (v *VM) addBucketOverflowCounters() {
+	for _, m := range v.m {
+		if m.Kind != metrics.Histogram || m.Program != v.name {
+			continue
+		}
+		o := metrics.NewMetric(m.Name+"_bucket_overflow_total", m.Program, metrics.Counter, metrics.Int, m.Keys...)
+		o.Hidden = m.Hidden
+		o.SetSource(m.Source)
+		if len(m.Keys) == 0 {
+			// Allocate the storage so the counter is exported before any overflow.
+			if _, err := o.GetDatum(); err != nil {
+				glog.Warning(err)
+				continue
+			}
+		}
+		if v.overflows == nil {
+			v.overflows = make(map[*metrics.Metric]*metrics.Metric)
+		}
+		v.overflows[m] = o
+		v.m = append(v.m, o)
 	}
 }
 
@@ -970,6 +2212,72 @@ func (v *VM) DumpByteCode() string {
 	return b.String()
 }
 
+// bytecode is the form of a compiled program marshalled by MarshalBytecode.
+type bytecode struct {
+	Name    string          `json:"name"`
+	Strings []string        `json:"strings"` // Indexed by the operands of str and others.
+	Regexps []string        `json:"regexps"` // Indexed by the operands of match and others.
+	Program []bytecodeInstr `json:"program"`
+}
+
+// bytecodeInstr is an instruction in the marshalled bytecode.
+type bytecodeInstr struct {
+	Opcode      string      `json:"opcode"`
+	Operand     interface{} `json:"operand"`
+	OperandType string      `json:"operand_type"` // Distinguishes operands that JSON encodes alike, such as ints and floats.
+	Line        int         `json:"line"`         // The line of the source, numbered from 1.
+}
+
+// operandType names the type of an instruction operand in the marshalled
+// bytecode.
+func operandType(operand interface{}) string {
+	switch operand.(type) {
+	case nil:
+		return "none"
+	case bool:
+		return "bool"
+	case int, int64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case time.Duration:
+		return "duration"
+	}
+	return fmt.Sprintf("%T", operand)
+}
+
+// MarshalBytecode returns the compiled program as JSON, for tools that
+// analyse mtail programs.  It has the name of the program, the tables of
+// string and regular expression constants, and each instruction's opcode
+// name, operand, operand type and source line, in order, so that the operands
+// of jumps are indexes into the program.  Operands are JSON numbers, booleans,
+// strings or null, and durations are in nanoseconds; the operand type is one
+// of "int", "float", "bool", "string", "duration" or "none".
+func (v *VM) MarshalBytecode() ([]byte, error) {
+	bc := bytecode{
+		Name:    v.name,
+		Strings: v.str,
+		Regexps: make([]string, 0, len(v.re)),
+		Program: make([]bytecodeInstr, 0, len(v.prog)),
+	}
+	if bc.Strings == nil {
+		bc.Strings = []string{}
+	}
+	for _, re := range v.re {
+		bc.Regexps = append(bc.Regexps, re.String())
+	}
+	for _, i := range v.prog {
+		bc.Program = append(bc.Program, bytecodeInstr{i.Opcode.String(), i.Operand, operandType(i.Operand), i.SourceLine + 1})
+	}
+	b, err := json.Marshal(bc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal bytecode")
+	}
+	return b, nil
+}
+
 // RuntimeErrorString returns the last runtime erro rthat the program enountered.
 func (v *VM) RuntimeErrorString() string {
 	v.runtimeErrorMu.RLock()
@@ -977,6 +2285,12 @@ func (v *VM) RuntimeErrorString() string {
 	return v.runtimeError
 }
 
+// Warnings returns the warnings found when the program was compiled, such as
+// metrics that are declared but never used.
+func (v *VM) Warnings() []string {
+	return v.warnings
+}
+
 // Run starts the VM and processes lines coming in on the input channel.  When
 // the channel is closed, and the VM has finished processing the VM is shut
 // down and the loader signalled via the given waitgroup.
@@ -4,8 +4,17 @@
 package vm
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +24,8 @@ import (
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/object"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var instructions = []struct {
@@ -211,6 +222,538 @@ var instructions = []struct {
 		[]interface{}{"mIxeDCasE"},
 		[]interface{}{"mixedcase"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"subst",
+		code.Instr{code.Subst, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\d+`)},
+		[]string{},
+		[]interface{}{"/user/12345/order/678", ":id"},
+		[]interface{}{"/user/:id/order/:id"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"subst no match",
+		code.Instr{code.Subst, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\d+`)},
+		[]string{},
+		[]interface{}{"/user/me", ":id"},
+		[]interface{}{"/user/me"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"matchcount none",
+		code.Instr{code.Matchcount, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`,`)},
+		[]string{},
+		[]interface{}{"a"},
+		[]interface{}{int64(0)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"matchcount one",
+		code.Instr{code.Matchcount, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`,`)},
+		[]string{},
+		[]interface{}{"a,b"},
+		[]interface{}{int64(1)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"matchcount many",
+		code.Instr{code.Matchcount, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\d+`)},
+		[]string{},
+		[]interface{}{"1 22 x 333"},
+		[]interface{}{int64(3)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"matches true",
+		code.Instr{code.Matches, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\.php$`)},
+		[]string{},
+		[]interface{}{"/index.php"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"matches false",
+		code.Instr{code.Matches, 0, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\.php$`)},
+		[]string{},
+		[]interface{}{"/index.html"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"trim",
+		code.Instr{code.Trim, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{" \tpadded value \n"},
+		[]interface{}{"padded value"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"trimleft",
+		code.Instr{code.Trimleft, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"0042x0", "0"},
+		[]interface{}{"42x0"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"trimleft spaces",
+		code.Instr{code.Trimleft, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"  value  ", " "},
+		[]interface{}{"value  "},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"trimright",
+		code.Instr{code.Trimright, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/path/.//", "./"},
+		[]interface{}{"/path"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseduration milliseconds",
+		code.Instr{code.Parseduration, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"250ms"},
+		[]interface{}{0.25},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseduration minutes",
+		code.Instr{code.Parseduration, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"1m30s"},
+		[]interface{}{90.0},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment first",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1/users", int64(1)},
+		[]interface{}{"api"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment root",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/", int64(1)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment trailing slash",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1/", int64(2)},
+		[]interface{}{"v1"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment past trailing slash",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1/", int64(3)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment zero",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1", int64(0)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment out of range",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1", int64(5)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"pathsegment query",
+		code.Instr{code.Pathsegment, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/search?q=a/b", int64(2)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round up",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{2.36, int64(1)},
+		[]interface{}{2.4},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round down",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{2.34, int64(1)},
+		[]interface{}{2.3},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round half to even",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{0.125, int64(2)},
+		[]interface{}{0.12},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round half to even up",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{3.5, int64(0)},
+		[]interface{}{4.0},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round negative",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{-2.25, int64(1)},
+		[]interface{}{-2.2},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round negative down",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{-7.86, int64(1)},
+		[]interface{}{-7.9},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round more places than digits",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{1.5, int64(400)},
+		[]interface{}{1.5},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round zero to more places than digits",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{0.0, int64(400)},
+		[]interface{}{0.0},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round negative zero to more places than digits",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{math.Copysign(0, -1), int64(400)},
+		[]interface{}{math.Copysign(0, -1)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round large number",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{1e300, int64(10)},
+		[]interface{}{1e300},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round fewer places than digits",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{1250.0, int64(-400)},
+		[]interface{}{0.0},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"round negative places",
+		code.Instr{code.Round, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{1250.0, int64(-2)},
+		[]interface{}{1200.0},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"div",
+		code.Instr{code.Div, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(7), int64(2), int64(0)},
+		[]interface{}{int64(3)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"div negative",
+		code.Instr{code.Div, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(-7), int64(2), int64(0)},
+		[]interface{}{int64(-3)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"div by zero default",
+		code.Instr{code.Div, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(7), int64(0), int64(-1)},
+		[]interface{}{int64(-1)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy zero",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(0)},
+		[]interface{}{"0"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy small",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(999)},
+		[]interface{}{"999"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy thousands",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(1234)},
+		[]interface{}{"1,234"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy millions",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(1234567)},
+		[]interface{}{"1,234,567"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy negative",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(-1234567)},
+		[]interface{}{"-1,234,567"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy negative small",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(-12)},
+		[]interface{}{"-12"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"commafy min int",
+		code.Instr{code.Commafy, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(-9223372036854775808)},
+		[]interface{}{"-9,223,372,036,854,775,808"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"hasprefix",
+		code.Instr{code.Hasprefix, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"GET /index.html", "GET"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"hasprefix no match",
+		code.Instr{code.Hasprefix, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"POST /index.html", "GET"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"hassuffix",
+		code.Instr{code.Hassuffix, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/index.php", ".php"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"hassuffix no match",
+		code.Instr{code.Hassuffix, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/index.html", ".php"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"contains",
+		code.Instr{code.Contains, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1/users", "/v1/"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"contains no match",
+		code.Instr{code.Contains, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v2/users", "/v1/"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"normalize decomposed",
+		code.Instr{code.Normalize, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"Zu\u0308rich"},
+		[]interface{}{"Z\u00fcrich"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"normalize composed",
+		code.Instr{code.Normalize, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"Z\u00fcrich"},
+		[]interface{}{"Z\u00fcrich"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass 1xx",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(101)},
+		[]interface{}{"1xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass 2xx",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(200)},
+		[]interface{}{"2xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass 3xx",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(304)},
+		[]interface{}{"3xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass 4xx",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(404)},
+		[]interface{}{"4xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass 5xx",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(503)},
+		[]interface{}{"5xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass above range",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(600)},
+		[]interface{}{"unknown"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass below range",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(99)},
+		[]interface{}{"unknown"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statusclass negative",
+		code.Instr{code.Statusclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(-200)},
+		[]interface{}{"unknown"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urldecode space",
+		code.Instr{code.Urldecode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/a%20b"},
+		[]interface{}{"/a b"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urldecode plus",
+		code.Instr{code.Urldecode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"q=a+b"},
+		[]interface{}{"q=a b"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urldecode malformed",
+		code.Instr{code.Urldecode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/a%zzb"},
+		[]interface{}{"/a%zzb"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"default empty",
+		code.Instr{code.Default, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"", "unknown"},
+		[]interface{}{"unknown"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"default nonempty",
+		code.Instr{code.Default, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"GET", "unknown"},
+		[]interface{}{"GET"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath nested",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"user": {"id": "alice", "age": 42}}`, "$.user.id"},
+		[]interface{}{"alice"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath number",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"user": {"id": "alice", "age": 42.0}}`, "$.user.age"},
+		[]interface{}{"42.0"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath array index",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"users": [{"id": "alice"}, {"id": "bob"}]}`, "$.users[1].id"},
+		[]interface{}{"bob"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath object",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"user": {"id": "alice"}}`, "$.user"},
+		[]interface{}{`{"id":"alice"}`},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath missing key",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"user": {"id": "alice"}}`, "$.user.name"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath index out of range",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"users": []}`, "$.users[0]"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"jsonpath invalid json",
+		code.Instr{code.Jsonpath, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"user": `, "$.user"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64decode",
+		code.Instr{code.Base64decode, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"aGVsbG8gd29ybGQ="},
+		[]interface{}{"hello world"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64decode single padding",
+		code.Instr{code.Base64decode, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"YWI="},
+		[]interface{}{"ab"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64decode double padding",
+		code.Instr{code.Base64decode, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"YQ=="},
+		[]interface{}{"a"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64decode no padding",
+		code.Instr{code.Base64decode, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"YWJj"},
+		[]interface{}{"abc"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64decode missing padding",
+		code.Instr{code.Base64decode, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"YWI"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64decode invalid characters",
+		code.Instr{code.Base64decode, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"aGVs*G8="},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"length",
 		code.Instr{code.Length, 0, 0},
 		[]*regexp.Regexp{},
@@ -817,3 +1360,1789 @@ func TestTimestampInstr(t *testing.T) {
 		t.Errorf("Expecting timestamp to be %s, was %s", newT, tos)
 	}
 }
+
+func TestSetAtTimestamp(t *testing.T) {
+	prog := `gauge temp by sensor
+/^(?P<sensor>\w+) (?P<temp>\d+) (?P<ts>\d+)$/ {
+  temp[$sensor] = $temp at $ts
+}
+/^(?P<sensor>\w+) (?P<temp>\d+) (?P<date>\S+T\S+)$/ {
+  temp[$sensor] = $temp at strptime($date, "2006-01-02T15:04:05")
+}
+`
+	v, err := Compile("setat", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, tc := range []struct {
+		line     string
+		sensor   string
+		expected string
+		time     time.Time
+	}{
+		{"a 37 1000000000", "a", "37", time.Unix(1000000000, 0).UTC()},
+		{"b 21 2020-02-03T04:05:06", "b", "21", time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		d, err := v.m[0].GetDatum(tc.sensor)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != tc.expected {
+			t.Errorf("%q: unexpected value %q, expected %q", tc.line, d.ValueString(), tc.expected)
+		}
+		if !d.TimeUTC().Equal(tc.time) {
+			t.Errorf("%q: unexpected time %s, expected %s", tc.line, d.TimeUTC(), tc.time)
+		}
+	}
+}
+
+func TestWeightedObserve(t *testing.T) {
+	prog := `histogram latency buckets 0.1, 0.5, 1
+/^(?P<latency>\d+\.\d+) (?P<count>-?\d+)$/ {
+  latency = $latency by $count
+}
+`
+	v, err := Compile("weighted", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"0.3 5", "0.05 2", "0.3 1"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	b := d.(*datum.Buckets)
+	expectedBuckets := map[datum.Range]uint64{
+		{Min: 0, Max: 0.1}:          2,
+		{Min: 0.1, Max: 0.5}:        6,
+		{Min: 0.5, Max: 1}:          0,
+		{Min: 1, Max: math.Inf(+1)}: 0,
+	}
+	testutil.ExpectNoDiff(t, expectedBuckets, b.GetBuckets())
+	if b.GetCount() != 8 {
+		t.Errorf("unexpected count %d, expected 8", b.GetCount())
+	}
+	if math.Abs(b.GetSum()-1.9) > 1e-9 {
+		t.Errorf("unexpected sum %g, expected 1.9", b.GetSum())
+	}
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "0.3 -1"))
+	if v.runtimeError == "" {
+		t.Error("expected a runtime error for a negative weight")
+	}
+	if b.GetCount() != 8 {
+		t.Errorf("count changed after negative weight: %d", b.GetCount())
+	}
+}
+
+func TestDrop(t *testing.T) {
+	prog := `counter seen
+counter kept
+/.*/ {
+  seen++
+}
+/^debug/ {
+  drop
+}
+/.*/ {
+  kept++
+}
+`
+	v, err := Compile("drop", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"debug: noise", "info: useful", "debug: more noise"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for i, expected := range []string{"3", "1"} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%s: unexpected value %q, expected %q", v.m[i].Name, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestCumulativeCounter(t *testing.T) {
+	prog := `counter requests by host cumulative
+/^(?P<host>\w+) (?P<count>\d+)$/ {
+  requests[$host] = $count
+}
+`
+	v, err := Compile("cumulative", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	// Rising, then reset by an upstream restart, then rising again.
+	for _, tc := range []struct {
+		raw      string
+		expected string
+	}{
+		{"10", "10"},
+		{"15", "15"},
+		{"15", "15"},
+		{"20", "20"},
+		{"3", "23"},
+		{"8", "28"},
+		{"0", "28"},
+		{"4", "32"},
+	} {
+		line := "a " + tc.raw
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+		d, err := v.m[0].GetDatum("a")
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != tc.expected {
+			t.Errorf("%q: unexpected value %q, expected %q", line, d.ValueString(), tc.expected)
+		}
+	}
+
+	// The last raw value is kept with the datum, so a reloaded program
+	// counts on from it.
+	r := New("cumulative", &object.Object{Program: v.prog, Strings: v.str, Regexps: v.re, Metrics: v.m}, false, time.UTC)
+	r.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "a 6"))
+	d, err := r.m[0].GetDatum("a")
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "34" {
+		t.Errorf("after reload: unexpected value %q, expected 34", d.ValueString())
+	}
+}
+
+func TestIncByExpression(t *testing.T) {
+	prog := `counter bytes_total
+/^(?P<bytes>\d+) (?P<count>\d+)$/ {
+  bytes_total += $bytes * $count + 1
+}
+`
+	v, err := Compile("incexpr", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"10 3", "7 2"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "46" {
+		t.Errorf("unexpected value %q, expected %q", d.ValueString(), "46")
+	}
+}
+
+func TestIsNew(t *testing.T) {
+	prog := `hidden counter seen by session
+counter sessions_total
+counter requests_total
+/session=(?P<session>\S+)/ {
+  requests_total++
+  isnew(seen[$session]) {
+    sessions_total++
+  }
+}
+`
+	v, err := Compile("isnew", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"session=a", "session=b", "session=a", "session=c", "session=b", "session=a"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for i, expected := range map[int]string{1: "3", 2: "6"} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%s: unexpected value %q, expected %q", v.m[i].Name, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestDurationTimers(t *testing.T) {
+	prog := `histogram job_seconds buckets 1, 10, 100
+gauge last_job_seconds
+counter unmatched_ends_total
+/^(?P<ts>\d+) start (?P<id>\w+)$/ {
+  settime($ts)
+  starttimer($id)
+}
+/^(?P<ts>\d+) end (?P<id>\w+)$/ {
+  settime($ts)
+  hastimer($id) {
+    last_job_seconds = stoptimer($id)
+    job_seconds = last_job_seconds
+  } else {
+    unmatched_ends_total++
+  }
+}
+`
+	v, err := Compile("timers", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, tc := range []struct {
+		line     string
+		expected string // value of last_job_seconds after the line
+	}{
+		{"1000 start a", ""},
+		{"1002 start b", ""},
+		{"1005 end a", "5"},
+		{"1052 end b", "50"},
+		{"1053 end b", "50"}, // b was already stopped
+		{"1060 end c", "50"}, // c was never started
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", tc.line, v.runtimeError)
+		}
+		if tc.expected == "" {
+			continue
+		}
+		d, err := v.m[1].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != tc.expected {
+			t.Errorf("%q: unexpected duration %q, expected %q", tc.line, d.ValueString(), tc.expected)
+		}
+	}
+
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	b := d.(*datum.Buckets)
+	if b.GetCount() != 2 || b.GetSum() != 55 {
+		t.Errorf("unexpected histogram count %d and sum %g, expected 2 and 55", b.GetCount(), b.GetSum())
+	}
+	d, err = v.m[2].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "2" {
+		t.Errorf("unexpected unmatched ends %q, expected 2", d.ValueString())
+	}
+}
+
+func TestDurationTimerExpiry(t *testing.T) {
+	prog := `gauge seconds
+/^(?P<ts>\d+) start$/ {
+  settime($ts)
+  starttimer("t")
+}
+/^(?P<ts>\d+) end$/ {
+  settime($ts)
+  hastimer("t") {
+    seconds = stoptimer("t")
+  }
+}
+`
+	v, err := Compile("timers", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	end := 1000 + int64(timerExpiry/time.Second) + 1
+	for _, line := range []string{"1000 start", fmt.Sprintf("%d end", end)} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	if len(v.m[0].LabelValues) != 0 {
+		t.Errorf("expired timer was recorded: %v", v.m[0].LabelValues)
+	}
+}
+
+func TestDurationTimersWithoutSettime(t *testing.T) {
+	prog := `gauge seconds
+/^start$/ {
+  starttimer("t")
+}
+/^end$/ {
+  seconds = stoptimer("t")
+}
+`
+	v, err := Compile("timers", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	now := time.Unix(1000, 0)
+	v.clock = func() time.Time { return now }
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "start"))
+	now = now.Add(7 * time.Second)
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "end"))
+	if v.runtimeError != "" {
+		t.Fatalf("unexpected runtime error %q", v.runtimeError)
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "7" {
+		t.Errorf("unexpected duration %q, expected 7", d.ValueString())
+	}
+}
+
+func TestSubst(t *testing.T) {
+	prog := `counter requests_total by path
+/^GET (?P<path>\S+) (\d+)$/ {
+  requests_total[subst($path, /(\d+)/, ":id")] += $2
+}
+`
+	v, err := Compile("subst", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"GET /user/12345/order/6 1", "GET /user/99/order/1000 2", "GET /about 4"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for path, expected := range map[string]string{"/user/:id/order/:id": "3", "/about": "4"} {
+		d, err := v.m[0].GetDatum(path)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%s: unexpected value %q, expected %q", path, d.ValueString(), expected)
+		}
+	}
+	if len(v.m[0].LabelValues) != 2 {
+		t.Errorf("unexpected label values: %v", v.m[0].LabelValues)
+	}
+}
+
+func TestMatchcount(t *testing.T) {
+	prog := `counter fields_total
+/^(?P<csv>.*)$/ {
+  fields_total += matchcount($csv, /[^,]+/)
+}
+`
+	v, err := Compile("matchcount", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"", "a", "a,b,c"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "4" {
+		t.Errorf("unexpected value %q, expected 4", d.ValueString())
+	}
+}
+
+func TestInRange(t *testing.T) {
+	prog := `counter ok
+counter slow
+/^(?P<status>\d+) (?P<latency>\S+)$/ {
+  $status in [200, 299] {
+    ok++
+  }
+  $latency in [0.5, 1] {
+    slow++
+  }
+}
+`
+	v, err := Compile("in range", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"199 0.1", "200 0.5", "250 0.75", "299 1", "300 1.01", "404 0.49"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for i, expected := range []string{"3", "3"} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%s: unexpected value %q, expected %s", v.m[i].Name, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestParsedurationInvalid(t *testing.T) {
+	prog := `histogram latency buckets 0.1, 1
+/^latency=(?P<d>\S+)$/ {
+  latency = parseduration($d)
+}
+`
+	v, err := Compile("parseduration", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "latency=1m30s"))
+	if v.runtimeError != "" {
+		t.Fatalf("unexpected runtime error %q", v.runtimeError)
+	}
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "latency=soon"))
+	if !strings.Contains(v.runtimeError, "invalid duration") {
+		t.Errorf("expected invalid duration runtime error, got %q", v.runtimeError)
+	}
+}
+
+func TestBucketOverflowCounters(t *testing.T) {
+	prog := `histogram latency by server buckets 0.1, 1, 10
+/^(?P<server>\S+) (?P<latency>\d+(\.\d+)?)$/ {
+  latency[$server] = $latency
+}
+`
+	v, err := Compile("overflow", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	v.addBucketOverflowCounters()
+	if len(v.m) != 2 || v.m[1].Name != "latency_bucket_overflow_total" {
+		t.Fatalf("expected a bucket overflow counter, got metrics %v", v.m)
+	}
+
+	for _, line := range []string{"a 0.5", "a 10", "a 11", "a 300", "b 2"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for _, tc := range []struct {
+		server   string
+		expected int64
+	}{{"a", 2}, {"b", 0}} {
+		d, err := v.m[1].GetDatum(tc.server)
+		testutil.FatalIfErr(t, err)
+		if datum.GetInt(d) != tc.expected {
+			t.Errorf("server %s: unexpected overflow count %d, expected %d", tc.server, datum.GetInt(d), tc.expected)
+		}
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	prog := `counter errors by component
+preprocess /\x1b\[[0-9;]*m/ ""
+/^ERROR (?P<component>\w+): / {
+  errors[$component]++
+}
+/^WARN / {
+}
+`
+	v, err := Compile("preprocess", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	line := logline.New(context.Background(), "test", "\x1b[1;31mERROR\x1b[0m \x1b[36mdisk\x1b[0m: full")
+	v.ProcessLogLine(context.Background(), line)
+	if v.runtimeError != "" {
+		t.Fatalf("unexpected runtime error %q", v.runtimeError)
+	}
+	d, err := v.m[0].GetDatum("disk")
+	testutil.FatalIfErr(t, err)
+	if datum.GetInt(d) != 1 {
+		t.Errorf("unexpected value %d, expected 1", datum.GetInt(d))
+	}
+	// The line is shared with other programs, so must not be modified.
+	if line.Line != "\x1b[1;31mERROR\x1b[0m \x1b[36mdisk\x1b[0m: full" {
+		t.Errorf("input line was modified: %q", line.Line)
+	}
+}
+
+func TestUniq(t *testing.T) {
+	prog := `gauge clients
+/^(?P<ip>\S+)$/ {
+  uniq(clients, $ip)
+}
+`
+	v, err := Compile("uniq", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	const distinct = 10000
+	for i := 0; i < 3*distinct; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", (i%distinct)>>16, (i%distinct)>>8&0xff, i%distinct&0xff)
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", ip))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); math.Abs(float64(got-distinct)) > 0.05*distinct {
+		t.Errorf("estimate %d not within 5%% of %d", got, distinct)
+	}
+
+	// The sketch survives a reload of the program, so the values already
+	// seen aren't counted again.
+	v = New("uniq", &object.Object{Program: v.prog, Strings: v.str, Regexps: v.re, Metrics: v.m}, false, time.UTC)
+	for i := 0; i < 2*distinct; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff)
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", ip))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+	}
+	if got := datum.GetInt(d); math.Abs(float64(got-2*distinct)) > 0.05*2*distinct {
+		t.Errorf("estimate %d after reload not within 5%% of %d", got, 2*distinct)
+	}
+}
+
+func TestEwma(t *testing.T) {
+	prog := `gauge latency
+/^(?P<ms>\d+)$/ {
+  ewma(latency, $ms, 0.25)
+}
+`
+	v, err := Compile("ewma", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	var expected float64
+	for i, x := range []float64{100, 20, 60, 300, 0, 40, 80} {
+		if i == 6 {
+			// The average carries on after a reload of the program.
+			v = New("ewma", &object.Object{Program: v.prog, Strings: v.str, Regexps: v.re, Metrics: v.m}, false, time.UTC)
+		}
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", fmt.Sprintf("%g", x)))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+		if i == 0 {
+			expected = x
+		} else {
+			expected = 0.25*x + 0.75*expected
+		}
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("after %g: got %g, expected %g", x, got, expected)
+		}
+	}
+}
+
+func TestPercentilerank(t *testing.T) {
+	prog := `histogram latency buckets 0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100
+gauge rank
+/^observe (?P<ms>\d+)$/ {
+  latency = $ms
+}
+/^rank (?P<ms>\d+)$/ {
+  rank = percentilerank(latency, $ms)
+}
+`
+	v, err := Compile("percentilerank", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	// A uniform distribution of 1..100.
+	for i := 1; i <= 100; i++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", fmt.Sprintf("observe %d", i)))
+	}
+	for _, tc := range []struct {
+		ms       int
+		expected float64
+	}{
+		{0, 0},
+		{5, 0.05},
+		{25, 0.25},
+		{90, 0.9},
+		{100, 1},
+		{200, 1},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", fmt.Sprintf("rank %d", tc.ms)))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+		d, err := v.m[1].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); math.Abs(got-tc.expected) > 0.01 {
+			t.Errorf("rank of %d: got %g, expected %g", tc.ms, got, tc.expected)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	prog := `/^slow (\d+)$/ {
+  log("slow request", $1)
+}
+/^error (\S+)$/ {
+  log("error", $1)
+}
+`
+	v, err := Compile("log", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	var messages []string
+	v.logf = func(format string, args ...interface{}) {
+		messages = append(messages, fmt.Sprintf(format, args...))
+	}
+	process := func(line string) {
+		t.Helper()
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+	}
+
+	// Each call writes at most one message per interval.
+	process("slow 1200")
+	process("slow 1500")
+	process("error timeout")
+	process("error refused")
+	expected := []string{"log:2: slow request 1200", "log:5: error timeout"}
+	testutil.ExpectNoDiff(t, expected, messages)
+
+	// Once the interval has passed, the call writes again.
+	for pc, last := range v.logged {
+		v.logged[pc] = last.Add(-logInterval)
+	}
+	process("slow 1800")
+	expected = append(expected, "log:2: slow request 1800")
+	testutil.ExpectNoDiff(t, expected, messages)
+}
+
+func TestForeachSplit(t *testing.T) {
+	prog := `counter bytes by key
+counter fields
+/^kv (.*)$/ {
+  foreach field in split($1, " ") {
+    fields++
+    field =~ /^(\w+)=(\d+)$/ {
+      bytes[$1] += $2
+    }
+  }
+}
+`
+	v, err := Compile("foreach", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	long := "kv" + strings.Repeat(" x", maxLoopFields+500)
+	for _, line := range []string{"kv rx=100 tx=20 rx=5 junk", long} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for key, expected := range map[string]int64{"rx": 105, "tx": 20} {
+		d, err := v.m[0].GetDatum(key)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("bytes %s: got %d, expected %d", key, got, expected)
+		}
+	}
+	// The body ran once per field, up to the cap on the long line.
+	d, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got, expected := datum.GetInt(d), int64(4+maxLoopFields); got != expected {
+		t.Errorf("fields: got %d, expected %d", got, expected)
+	}
+}
+
+func TestTimediff(t *testing.T) {
+	prog := `gauge duration
+/^(\S+) (\S+)$/ {
+  duration = timediff(strptime($1, "2006-01-02T15:04:05.000Z07:00"), strptime($2, "2006-01-02T15:04:05.000Z07:00"))
+}
+`
+	v, err := Compile("timediff", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, tc := range []struct {
+		line     string
+		expected float64
+	}{
+		{"2020-06-01T10:00:00.000Z 2020-06-01T10:01:30.500Z", 90.5},
+		{"2020-06-01T12:00:00.000+02:00 2020-06-01T10:00:02.000Z", 2},
+		// An end before the start is a negative difference.
+		{"2020-06-01T10:01:30.500Z 2020-06-01T10:00:00.000Z", -90.5},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", tc.line, v.runtimeError)
+		}
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); got != tc.expected {
+			t.Errorf("%q: got %g, expected %g", tc.line, got, tc.expected)
+		}
+	}
+
+	// A time that fails to parse is an error every time, and leaves the
+	// difference unchanged.
+	for i := 0; i < 2; i++ {
+		v.runtimeError = ""
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "bad 2020-06-01T10:00:00.000Z"))
+		if v.runtimeError == "" {
+			t.Errorf("%d: expected a runtime error", i)
+		}
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); got != -90.5 {
+			t.Errorf("%d: got %g, expected -90.5", i, got)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	prog := `counter requests
+counter bytes
+gauge backlog
+/^(\d+)$/ {
+  sample(1, 50) {
+    requests++
+    bytes += $1
+    backlog--
+  }
+}
+`
+	v, err := Compile("sample", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	const seed, lines = 1, 1000
+	v.sampler = rand.New(rand.NewSource(seed))
+
+	for i := 0; i < lines; i++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "10"))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+	}
+	// Replay the sampler to find how many lines were chosen.
+	r := rand.New(rand.NewSource(seed))
+	var sampled int64
+	for i := 0; i < lines; i++ {
+		if r.Int63n(50) < 1 {
+			sampled++
+		}
+	}
+	if sampled == 0 || sampled == lines {
+		t.Fatalf("sampled %d of %d lines, expecting some but not all", sampled, lines)
+	}
+	for i, expected := range []int64{sampled * 50, sampled * 50 * 10, -sampled * 50} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("%s: got %d, expected %d", v.m[i].Name, got, expected)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	prog := `counter visits by city
+/city=(\S+)/ {
+  visits[normalize($1)]++
+}
+`
+	v, err := Compile("normalize", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	// The same city, composed and decomposed.
+	for _, line := range []string{"city=Z\u00fcrich", "city=Zu\u0308rich"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	if len(v.m[0].LabelValues) != 1 {
+		t.Fatalf("expected one label value, got %v", v.m[0].LabelValues)
+	}
+	d, err := v.m[0].GetDatum("Z\u00fcrich")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 2 {
+		t.Errorf("visits: got %d, expected 2", got)
+	}
+}
+
+func TestMarshalBytecode(t *testing.T) {
+	prog := `counter lines_total by host
+/^(\S+) / {
+  lines_total[default($1, "-")]++
+}
+`
+	v, err := Compile("bytecode", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	b, err := v.MarshalBytecode()
+	testutil.FatalIfErr(t, err)
+	var got bytes.Buffer
+	testutil.FatalIfErr(t, json.Indent(&got, b, "", "  "))
+	expected := `{
+  "name": "bytecode",
+  "strings": [
+    "-"
+  ],
+  "regexps": [
+    "^(\\S+) "
+  ],
+  "program": [
+    {
+      "opcode": "match",
+      "operand": 0,
+      "operand_type": "int",
+      "line": 2
+    },
+    {
+      "opcode": "jnm",
+      "operand": 11,
+      "operand_type": "int",
+      "line": 2
+    },
+    {
+      "opcode": "setmatched",
+      "operand": false,
+      "operand_type": "bool",
+      "line": 2
+    },
+    {
+      "opcode": "push",
+      "operand": 0,
+      "operand_type": "int",
+      "line": 3
+    },
+    {
+      "opcode": "capref",
+      "operand": 1,
+      "operand_type": "int",
+      "line": 3
+    },
+    {
+      "opcode": "str",
+      "operand": 0,
+      "operand_type": "int",
+      "line": 3
+    },
+    {
+      "opcode": "default",
+      "operand": 2,
+      "operand_type": "int",
+      "line": 3
+    },
+    {
+      "opcode": "mload",
+      "operand": 0,
+      "operand_type": "int",
+      "line": 3
+    },
+    {
+      "opcode": "dload",
+      "operand": 1,
+      "operand_type": "int",
+      "line": 3
+    },
+    {
+      "opcode": "inc",
+      "operand": null,
+      "operand_type": "none",
+      "line": 3
+    },
+    {
+      "opcode": "setmatched",
+      "operand": true,
+      "operand_type": "bool",
+      "line": 2
+    }
+  ]
+}`
+	testutil.ExpectNoDiff(t, expected, got.String())
+}
+
+func TestOperandType(t *testing.T) {
+	for _, tc := range []struct {
+		operand  interface{}
+		expected string
+	}{
+		{nil, "none"},
+		{true, "bool"},
+		{1, "int"},
+		{int64(1), "int"},
+		{1.0, "float"},
+		{"x", "string"},
+		{time.Second, "duration"},
+	} {
+		if got := operandType(tc.operand); got != tc.expected {
+			t.Errorf("operandType(%#v): got %q, expected %q", tc.operand, got, tc.expected)
+		}
+	}
+}
+
+func TestCompileCommentsOnly(t *testing.T) {
+	// A program commented out in full, or left with only its declarations,
+	// still loads and does nothing.
+	for _, tc := range []struct {
+		name    string
+		prog    string
+		metrics int
+	}{
+		{"empty", "", 0},
+		{"comments", "# /foo/ {\n#   foo++\n# }\n", 0},
+		{"no final newline", "# /foo/ {\n#   foo++\n# }", 0},
+		{"declarations", "counter foo\n# /foo/ {\n#   foo++\n# }\n", 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := Compile(tc.name, strings.NewReader(tc.prog), false, false, false, time.UTC)
+			testutil.FatalIfErr(t, err)
+			if len(v.prog) != 0 {
+				t.Errorf("expected empty bytecode, got %v", v.prog)
+			}
+			if len(v.m) != tc.metrics {
+				t.Errorf("expected %d metrics, got %v", tc.metrics, v.m)
+			}
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "foo"))
+			if v.runtimeError != "" {
+				t.Errorf("unexpected runtime error %q", v.runtimeError)
+			}
+			for _, m := range v.m {
+				d, err := m.GetDatum()
+				testutil.FatalIfErr(t, err)
+				if got := datum.GetInt(d); got != 0 {
+					t.Errorf("%s: expected 0, got %d", m.Name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusclass(t *testing.T) {
+	prog := `counter requests by class
+/ (\d+)$/ {
+  requests[statusclass($1)]++
+}
+`
+	v, err := Compile("statusclass", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"GET / 200", "GET / 204", "GET /old 301", "GET /x 404", "GET / 503", "GET / 999"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for class, expected := range map[string]int64{"2xx": 2, "3xx": 1, "4xx": 1, "5xx": 1, "unknown": 1} {
+		d, err := v.m[0].GetDatum(class)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("requests[%q]: got %d, expected %d", class, got, expected)
+		}
+	}
+}
+
+func TestActiveuniq(t *testing.T) {
+	prog := `gauge active_users
+/^(\d+) (\S+)$/ {
+  settime($1)
+  activeuniq(active_users, $2, 5m)
+}
+`
+	v, err := Compile("activeuniq", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	// The line timestamps are the clock that slides the window.
+	for _, tc := range []struct {
+		line     string
+		expected int64
+	}{
+		{"0 alice", 1},
+		{"60 bob", 2},
+		{"120 alice", 2},
+		{"300 carol", 3},
+		// bob was last seen more than five minutes ago.
+		{"400 carol", 2},
+		// So was alice, and bob returns.
+		{"421 bob", 2},
+		{"1000 dave", 1},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", tc.line, v.runtimeError)
+		}
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("%q: got %d active users, expected %d", tc.line, got, tc.expected)
+		}
+	}
+
+	// The keys carry on when the program is reloaded.
+	v = New("activeuniq", &object.Object{Program: v.prog, Strings: v.str, Regexps: v.re, Metrics: v.m}, false, time.UTC)
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "1010 erin"))
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 2 {
+		t.Errorf("after reload: got %d active users, expected 2", got)
+	}
+}
+
+func TestActiveuniqGc(t *testing.T) {
+	prog := `gauge active_users
+/^(\S+)$/ {
+  activeuniq(active_users, $1, 5m)
+}
+`
+	v, err := Compile("activeuniq gc", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	store := metrics.NewStore()
+	testutil.FatalIfErr(t, store.Add(v.m[0]))
+
+	// The lines were read six and four minutes ago.
+	start := time.Now()
+	for _, tc := range []struct {
+		line string
+		ago  time.Duration
+	}{
+		{"alice", 6 * time.Minute},
+		{"bob", 4 * time.Minute},
+	} {
+		v.clock = func() time.Time { return start.Add(-tc.ago) }
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 2 {
+		t.Fatalf("got %d active users, expected 2", got)
+	}
+	// Without any more lines, garbage collection forgets alice.
+	testutil.FatalIfErr(t, store.Gc())
+	if got := datum.GetInt(d); got != 1 {
+		t.Errorf("after gc: got %d active users, expected 1", got)
+	}
+}
+
+func TestActiveSetOutOfOrder(t *testing.T) {
+	a := newActiveSet(time.Minute)
+	at := func(s int64) time.Time { return time.Unix(s, 0) }
+	a.Add("a", at(100), at(100))
+	a.Add("b", at(50), at(100))
+	// An older sighting of a doesn't make it more recent than b.
+	a.Add("a", at(40), at(100))
+	var got []string
+	for e := a.order.Front(); e != nil; e = e.Next() {
+		got = append(got, e.Value.(*activeKey).key)
+	}
+	testutil.ExpectNoDiff(t, []string{"a", "b"}, got)
+	// b was seen more than a minute before c, but a wasn't.
+	if n := a.Add("c", at(155), at(155)); n != 2 {
+		t.Errorf("got %d keys, expected 2", n)
+	}
+	if _, ok := a.keys["b"]; ok {
+		t.Error("expected b to be forgotten")
+	}
+}
+
+func TestActiveSetBound(t *testing.T) {
+	a := newActiveSet(time.Hour)
+	now := time.Unix(0, 0)
+	for i := 0; i <= maxActiveKeys; i++ {
+		a.Add(strconv.Itoa(i), now, now)
+	}
+	if a.Len() != maxActiveKeys {
+		t.Errorf("got %d keys, expected %d", a.Len(), maxActiveKeys)
+	}
+	// The first key seen is forgotten first.
+	if _, ok := a.keys["0"]; ok {
+		t.Error("expected the least recently seen key to be forgotten")
+	}
+}
+
+func TestConsistentsample(t *testing.T) {
+	prog := `counter sampled by user
+/user=(\S+)/ {
+  consistentsample($1, 0.5) {
+    sampled[$1]++
+  }
+}
+`
+	v, err := Compile("consistentsample", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	var users []string
+	for i := 0; i < 20; i++ {
+		users = append(users, fmt.Sprintf("u%d", i))
+	}
+	// Each user is seen three times, and is either always or never sampled.
+	for i := 0; i < 3; i++ {
+		for _, u := range users {
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "GET / user="+u))
+			if v.runtimeError != "" {
+				t.Fatalf("%q: unexpected runtime error %q", u, v.runtimeError)
+			}
+		}
+	}
+	sampled := 0
+	for _, u := range users {
+		var got int64
+		if d := v.m[0].FindLabelValueOrNil([]string{u}); d != nil {
+			got = datum.GetInt(d.Value)
+		}
+		switch got {
+		case 0:
+		case 3:
+			sampled++
+		default:
+			t.Errorf("sampled[%q]: got %d, expected 0 or 3", u, got)
+		}
+		if (got == 3) != inHashSample(u, 0.5) {
+			t.Errorf("sampled[%q]: got %d, but inHashSample is %v", u, got, inHashSample(u, 0.5))
+		}
+	}
+	if sampled == 0 || sampled == len(users) {
+		t.Errorf("expected some but not all users to be sampled, got %d of %d", sampled, len(users))
+	}
+}
+
+func TestCapcount(t *testing.T) {
+	prog := `counter lines by groups
+/^(\w+)=(\d*)$|^(\w+)$/ {
+  lines[capcount()]++
+}
+`
+	v, err := Compile("capcount", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	// An empty value still participates in the match, but the branch
+	// without a value has only one group.
+	for _, line := range []string{"retries=3", "retries=", "retries"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for groups, expected := range map[string]int64{"2": 2, "1": 1} {
+		d, err := v.m[0].GetDatum(groups)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("lines[%q]: got %d, expected %d", groups, got, expected)
+		}
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	prog := `text last
+/^(?P<method>[A-Z]+) (?P<path>\S+)(?: (?P<status>\d+))?( .*)?$/ {
+  last = captures()
+}
+`
+	v, err := Compile("captures", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"GET /index.html 200", `{"method":"GET","path":"/index.html","status":"200"}`},
+		// The optional group that didn't match is left out, and the
+		// unnamed group is never included.
+		{"POST /login", `{"method":"POST","path":"/login"}`},
+		{"PUT /x 201 extra", `{"method":"PUT","path":"/x","status":"201"}`},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", tc.line, v.runtimeError)
+		}
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, datum.GetString(d))
+	}
+}
+
+func TestRulename(t *testing.T) {
+	prog := `counter hits by name
+rule errors: /error/ {
+  hits[rulename()]++
+  rule timeouts: /timeout/ {
+    hits[rulename()]++
+  }
+}
+/./ {
+  hits[rulename()]++
+}
+`
+	v, err := Compile("rulename", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"error", "error timeout", "ok"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	// Lines outside a named rule have an empty rule name.
+	for name, expected := range map[string]int64{"errors": 2, "timeouts": 1, "": 3} {
+		d, err := v.m[0].GetDatum(name)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("hits[%q]: got %d, expected %d", name, got, expected)
+		}
+	}
+}
+
+func TestRuleTiming(t *testing.T) {
+	prog := `counter hits
+rule slow: /(x+x+)+y/ {
+  hits++
+}
+rule fast: /^z/ {
+  hits++
+}
+`
+	v, err := Compile("ruletiming", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	v.ruleTiming = true
+	ruleMatchDurations.DeleteLabelValues("ruletiming", "slow")
+	ruleMatchDurations.DeleteLabelValues("ruletiming", "fast")
+
+	// The slow pattern has to scan the whole line to fail.
+	line := strings.Repeat("x", 10000)
+	for i := 0; i < 3; i++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	var slow, fast dto.Metric
+	testutil.FatalIfErr(t, ruleMatchDurations.WithLabelValues("ruletiming", "slow").(prometheus.Histogram).Write(&slow))
+	testutil.FatalIfErr(t, ruleMatchDurations.WithLabelValues("ruletiming", "fast").(prometheus.Histogram).Write(&fast))
+	if got := slow.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("slow rule: expected 3 matches timed, got %d", got)
+	}
+	if got := slow.GetHistogram().GetSampleSum(); got <= 0 {
+		t.Errorf("slow rule: expected positive match time, got %v", got)
+	}
+	if got := fast.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("fast rule: expected 3 matches timed, got %d", got)
+	}
+	if slow.GetHistogram().GetSampleSum() <= fast.GetHistogram().GetSampleSum() {
+		t.Errorf("expected slow rule time %v to exceed fast rule time %v", slow.GetHistogram().GetSampleSum(), fast.GetHistogram().GetSampleSum())
+	}
+}
+
+func TestRuleTimingBuiltins(t *testing.T) {
+	prog := `counter hits
+rule builtins: /^(.*)$/ {
+  hits += matchcount($1, /x/)
+  matches($1, /y/) {
+    hits++
+  }
+}
+`
+	v, err := Compile("ruletimingbuiltins", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	v.ruleTiming = true
+	ruleMatchDurations.DeleteLabelValues("ruletimingbuiltins", "builtins")
+
+	for i := 0; i < 2; i++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "xxy"))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+	}
+	// The rule's pattern, matchcount() and matches() are each timed.
+	var m dto.Metric
+	testutil.FatalIfErr(t, ruleMatchDurations.WithLabelValues("ruletimingbuiltins", "builtins").(prometheus.Histogram).Write(&m))
+	if got := m.GetHistogram().GetSampleCount(); got != 6 {
+		t.Errorf("expected 6 matches timed, got %d", got)
+	}
+}
+
+func TestExemplar(t *testing.T) {
+	prog := `histogram latency buckets 0.1, 1, 10
+/^(?P<t>\d+\.\d+) (?P<trace>\w+)$/ {
+  latency = $t exemplar $trace
+}
+`
+	v, err := Compile("exemplar", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"0.5 abc", "0.7 def", "5.0 ghi"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	got := datum.GetBucketsExemplarsByMax(d)
+	// Only the most recent exemplar of each bucket is kept.
+	if len(got) != 2 || got[1].TraceID != "def" || got[1].Value != 0.7 || got[10].TraceID != "ghi" {
+		t.Errorf("unexpected exemplars %v", got)
+	}
+	// The lines have no timestamp, so the exemplars are timestamped now.
+	if got[1].Time.IsZero() {
+		t.Errorf("unexpected zero exemplar time")
+	}
+	if datum.GetBucketsCount(d) != 3 {
+		t.Errorf("unexpected count %d, expected 3", datum.GetBucketsCount(d))
+	}
+
+	// A trace ID that is too long is ignored, but the value is observed.
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "0.5 "+strings.Repeat("x", maxTraceIDRunes+1)))
+	if v.runtimeError != "" {
+		t.Fatalf("unexpected runtime error %q", v.runtimeError)
+	}
+	if datum.GetBucketsCount(d) != 4 {
+		t.Errorf("unexpected count %d, expected 4", datum.GetBucketsCount(d))
+	}
+	if got := datum.GetBucketsExemplarsByMax(d); got[1].TraceID != "def" {
+		t.Errorf("unexpected exemplar %v", got[1])
+	}
+}
+
+func TestSethelp(t *testing.T) {
+	prog := `counter requests_total by upstream
+/^(?P<upstream>\S+)$/ {
+  requests_total[$upstream]++
+  sethelp(requests_total, "requests to upstream " + $upstream)
+}
+`
+	v, err := Compile("sethelp", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "backend"))
+	if v.runtimeError != "" {
+		t.Fatalf("unexpected runtime error %q", v.runtimeError)
+	}
+	if v.m[0].Help != "requests to upstream backend" {
+		t.Errorf("unexpected help %q", v.m[0].Help)
+	}
+}
+
+func TestGaugeMax(t *testing.T) {
+	prog := `gauge queue_length max 1000
+gauge temperature by room max 50.5
+/^queue (\d+)$/ {
+  queue_length = $1
+}
+/^temp (\S+) (\S+)$/ {
+  temperature[$1] = float($2)
+}
+`
+	v, err := Compile("gaugemax", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	clamps := func(name string) int64 {
+		if c, ok := metricValueClamps.Get(name).(*expvar.Int); ok {
+			return c.Value()
+		}
+		return 0
+	}
+	queueClamps, temperatureClamps := clamps("queue_length"), clamps("temperature")
+
+	for _, line := range []string{"queue 10", "queue 999999999", "temp kitchen 21.5", "temp attic 80", "temp cellar 50.5"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 1000 {
+		t.Errorf("queue_length: got %d, expected the maximum 1000", got)
+	}
+	for room, expected := range map[string]float64{"kitchen": 21.5, "attic": 50.5, "cellar": 50.5} {
+		d, err := v.m[1].GetDatum(room)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); got != expected {
+			t.Errorf("temperature %s: got %g, expected %g", room, got, expected)
+		}
+	}
+	if got := clamps("queue_length") - queueClamps; got != 1 {
+		t.Errorf("queue_length clamps: got %d, expected 1", got)
+	}
+	if got := clamps("temperature") - temperatureClamps; got != 1 {
+		t.Errorf("temperature clamps: got %d, expected 1", got)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	prog := `counter requests_total by path rollup
+/^(?P<path>\S+) (?P<n>\d+)$/ {
+  requests_total[$path] += $n
+}
+/^(?P<path>\S+)$/ {
+  requests_total[$path]++
+}
+/^(?P<path>\S+) = (?P<n>\d+)$/ {
+  requests_total[$path] = $n
+}
+`
+	v, err := Compile("rollup", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"/a", "/b 3", "/a", "/c 5", "/d = 4", "/d = 6"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for path, expected := range map[string]string{"/a": "2", "/b": "3", "/c": "5", "/d": "6", "": "16"} {
+		d, err := v.m[0].GetDatum(path)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", path, d.ValueString(), expected)
+		}
+	}
+	if len(v.m[0].LabelValues) != 5 {
+		t.Errorf("unexpected label values: %v", v.m[0].LabelValues)
+	}
+}
+
+func TestRollupFloat(t *testing.T) {
+	prog := `counter bytes_total by path rollup
+/^(?P<path>\S+) (?P<n>\S+)$/ {
+  bytes_total[$path] += float($n)
+}
+`
+	v, err := Compile("rollupfloat", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"/a 1.5", "/b 2.25", "/a 0.5"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for path, expected := range map[string]string{"/a": "2", "/b": "2.25", "": "4.25"} {
+		d, err := v.m[0].GetDatum(path)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", path, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestHourWeekday(t *testing.T) {
+	prog := `counter requests_total by hour_of_day, day_of_week
+gauge hour_and_weekday
+/^(?P<date>\S+ \S+) / {
+  strptime($date, "2006-01-02 15:04:05")
+  requests_total[hour(timestamp()), weekday(timestamp())]++
+  hour_and_weekday = hour(timestamp()) + weekday(timestamp())
+}
+`
+	// The hour and weekday are in the program's location, not UTC.
+	v, err := Compile("hourweekday", strings.NewReader(prog), false, false, false, time.FixedZone("UTC-5", -5*60*60))
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"2020-03-04 13:05:00 GET", "2020-03-07 23:59:59 GET", "2020-03-04 13:30:00 GET"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for keys, expected := range map[[2]string]string{{"13", "3"}: "2", {"23", "6"}: "1"} {
+		d, err := v.m[0].GetDatum(keys[0], keys[1])
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%v: unexpected value %q, expected %q", keys, d.ValueString(), expected)
+		}
+	}
+	if len(v.m[0].LabelValues) != 2 {
+		t.Errorf("unexpected label values: %v", v.m[0].LabelValues)
+	}
+	// The results are integers that can be used in arithmetic.
+	d, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "16" {
+		t.Errorf("unexpected hour and weekday %q, expected 16", d.ValueString())
+	}
+}
+
+func TestLineDeadline(t *testing.T) {
+	prog := `counter matched_total
+counter lines_total
+/^(\w+\s?)*$/ {
+  matched_total++
+}
+// {
+  lines_total++
+}
+`
+	v, err := Compile("deadline", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	v.lineDeadline = time.Minute
+	// Each read of the clock advances it by step.
+	var now time.Time
+	var step time.Duration
+	v.clock = func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+
+	timeoutsCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "prog_line_timeouts_total", "deadline", 1)
+
+	// The first line passes the deadline before its match, so the line is
+	// abandoned without matching; the next line is processed in full.
+	for _, tc := range []struct {
+		line string
+		step time.Duration
+	}{
+		{"ab ab", 2 * time.Minute},
+		{"ok", 0},
+	} {
+		step = tc.step
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		if v.runtimeError != "" {
+			t.Fatalf("unexpected runtime error %q", v.runtimeError)
+		}
+	}
+	timeoutsCheck()
+	for i, expected := range []string{"1", "1"} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%s: unexpected value %q, expected %q", v.m[i].Name, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestTextLastValue(t *testing.T) {
+	prog := `text last_error
+/^ERROR (.*)$/ {
+  last_error = $1
+}
+`
+	v, err := Compile("text", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"ERROR disk full", "INFO ok", "ERROR connection refused"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "connection refused" {
+		t.Errorf("unexpected value %q", d.ValueString())
+	}
+}
+
+func TestJournalfield(t *testing.T) {
+	prog := `counter messages_total by unit
+// {
+  messages_total[journalfield("_SYSTEMD_UNIT")]++
+}
+`
+	v, err := Compile("journalfield", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	ctx := context.Background()
+	for _, line := range []*logline.LogLine{
+		logline.New(logline.WithFields(ctx, map[string]string{"_SYSTEMD_UNIT": "nginx.service"}), "journald", "started"),
+		logline.New(logline.WithFields(ctx, map[string]string{"_SYSTEMD_UNIT": "nginx.service"}), "journald", "stopped"),
+		// Lines from other sources have no fields.
+		logline.New(ctx, "test", "plain"),
+	} {
+		v.ProcessLogLine(ctx, line)
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line.Line, v.runtimeError)
+		}
+	}
+	for unit, expected := range map[string]string{"nginx.service": "2", "": "1"} {
+		d, err := v.m[0].GetDatum(unit)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", unit, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	prog := `counter lines_total by severity, filename
+// {
+  lines_total[meta("severity")][meta("filename")]++
+}
+`
+	v, err := Compile("meta", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	ctx := context.Background()
+	for _, line := range []*logline.LogLine{
+		logline.New(logline.WithFields(ctx, map[string]string{"severity": "err"}), "journald", "failed"),
+		logline.New(logline.WithFields(ctx, map[string]string{"severity": "err"}), "journald", "failed again"),
+		logline.New(logline.WithFields(ctx, map[string]string{"filename": "/var/log/app.log"}), "/var/log/app.log", "ok"),
+		// Missing fields are empty.
+		logline.New(ctx, "test", "plain"),
+	} {
+		v.ProcessLogLine(ctx, line)
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line.Line, v.runtimeError)
+		}
+	}
+	for _, tc := range []struct {
+		severity, filename string
+		expected           string
+	}{
+		{"err", "", "2"},
+		{"", "/var/log/app.log", "1"},
+		{"", "", "1"},
+	} {
+		d, err := v.m[0].GetDatum(tc.severity, tc.filename)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != tc.expected {
+			t.Errorf("%q %q: unexpected value %q, expected %q", tc.severity, tc.filename, d.ValueString(), tc.expected)
+		}
+	}
+}
+
+// stubCountries resolves addresses from a fixed table.
+type stubCountries map[string]string
+
+func (s stubCountries) Country(ip net.IP) (string, error) {
+	return s[ip.String()], nil
+}
+
+func TestGeocountry(t *testing.T) {
+	prog := `counter requests_total by country
+/^(?P<client>\S+) GET/ {
+  requests_total[geocountry($client)]++
+}
+`
+	v, err := Compile("geocountry", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	v.countries = stubCountries{"192.0.2.1": "AU", "2001:db8::1": "JP"}
+
+	for _, line := range []string{"192.0.2.1 GET /", "2001:db8::1 GET /", "192.0.2.1 GET /a", "198.51.100.1 GET /", "notanip GET /"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for country, expected := range map[string]string{"AU": "2", "JP": "1", "": "2"} {
+		d, err := v.m[0].GetDatum(country)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", country, d.ValueString(), expected)
+		}
+	}
+}
+
+// stubTables looks up values in fixed tables.
+type stubTables map[string]map[string]string
+
+func (s stubTables) Lookup(table, key string) (string, bool) {
+	v, ok := s[table][key]
+	return v, ok
+}
+
+func TestLookup(t *testing.T) {
+	prog := `counter responses_total by class
+/^(?P<code>\S+)$/ {
+  responses_total[default(lookup("codes", $code), "other")]++
+}
+`
+	v, err := Compile("lookup", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	v.tables = stubTables{"codes": {"404": "client_error", "503": "server_error"}}
+
+	for _, line := range []string{"404", "503", "404", "200"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for class, expected := range map[string]string{"client_error": "2", "server_error": "1", "other": "1"} {
+		d, err := v.m[0].GetDatum(class)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", class, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestDefaultEmptyCapture(t *testing.T) {
+	prog := `counter requests_total by method
+/^(\S+) (GET)?/ {
+  requests_total[default($2, "unknown")]++
+}
+`
+	v, err := Compile("default", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{"a GET", "b POST", "c "} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for method, expected := range map[string]string{"GET": "1", "unknown": "2"} {
+		d, err := v.m[0].GetDatum(method)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", method, d.ValueString(), expected)
+		}
+	}
+	if len(v.m[0].LabelValues) != 2 {
+		t.Errorf("unexpected label values: %v", v.m[0].LabelValues)
+	}
+}
+
+func TestJsonpath(t *testing.T) {
+	prog := `counter requests_total by user
+/^(?P<json>\{.*\})$/ {
+  requests_total[jsonpath($json, "$.request.user.id")]++
+}
+`
+	v, err := Compile("jsonpath", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	for _, line := range []string{
+		`{"request": {"user": {"id": "alice"}}}`,
+		`{"request": {"user": {"id": "bob"}, "path": "/"}}`,
+		`{"request": {"user": {"id": "alice"}}}`,
+		`{"request": {"path": "/"}}`,
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		if v.runtimeError != "" {
+			t.Fatalf("%q: unexpected runtime error %q", line, v.runtimeError)
+		}
+	}
+	for user, expected := range map[string]string{"alice": "2", "bob": "1", "": "1"} {
+		d, err := v.m[0].GetDatum(user)
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != expected {
+			t.Errorf("%q: unexpected value %q, expected %q", user, d.ValueString(), expected)
+		}
+	}
+}
+
+func TestContextualKeywordNames(t *testing.T) {
+	prog := `counter max
+counter log by max, split
+gauge limit max 10
+counter at
+counter in
+counter rule
+counter drop
+counter rollup
+counter cumulative
+counter exemplar
+counter foreach
+counter preprocess
+/^(\S+) (\S+)$/ {
+  max++
+  at++
+  in in [0, 1] {
+    in++
+  }
+  rule matched: $1 == "a" {
+    rule++
+  }
+  drop++
+  rollup++
+  cumulative++
+  exemplar++
+  foreach++
+  preprocess++
+  log[$1, $2]++
+  foreach f in split($2, ",") {
+    limit = len(f)
+  }
+}
+`
+	v, err := Compile("contextual", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "a b,cd"))
+	if v.runtimeError != "" {
+		t.Fatalf("unexpected runtime error %q", v.runtimeError)
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "1" {
+		t.Errorf("max: unexpected value %q", d.ValueString())
+	}
+	d, err = v.m[1].GetDatum("a", "b,cd")
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "1" {
+		t.Errorf("log: unexpected value %q", d.ValueString())
+	}
+	d, err = v.m[2].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "2" {
+		t.Errorf("limit: unexpected value %q", d.ValueString())
+	}
+	for _, m := range v.m[3:] {
+		d, err = m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.ValueString() != "1" {
+			t.Errorf("%s: unexpected value %q", m.Name, d.ValueString())
+		}
+	}
+}